@@ -0,0 +1,203 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/logging"
+	"github.com/google/uuid"
+)
+
+func commandAddAlias(session *sessionState) {
+	// command syntax:
+	// ADDALIAS(User-ID, Workspace-ID="", Alias-ID="")
+
+	if !session.Message.HasField("User-ID") {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	uid := session.Message.Data["User-ID"]
+	if uid == "" || strings.ContainsAny(uid, "/\" \t") {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad User-ID")
+		return
+	}
+
+	target, ok := getAliasOwner(session)
+	if !ok {
+		return
+	}
+
+	// Aliases may only point to workspaces which can actually receive something
+	wtype, err := session.Store.Workspaces.GetWorkspaceType(target)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandAddAlias: error getting workspace type: %s", err.Error())
+		return
+	}
+	switch wtype {
+	case "":
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	case "alias":
+		session.SendStringResponse(400, "BAD REQUEST", "Aliases can't point to other aliases")
+		return
+	}
+
+	aliasWid := uuid.New().String()
+	if session.Message.HasField("Alias-ID") {
+		aliasWid = session.Message.Data["Alias-ID"]
+		if !dbhandler.ValidateUUID(aliasWid) {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Alias-ID")
+			return
+		}
+	}
+
+	success, _ := session.Store.Workspaces.CheckWorkspace(aliasWid)
+	if success {
+		response := NewServerResponse(408, "RESOURCE EXISTS")
+		response.Data["Field"] = "Alias-ID"
+		session.SendResponse(*response)
+		return
+	}
+
+	domain := getSessionDomain(session)
+	success, _ = session.Store.Workspaces.CheckUserID(uid, domain)
+	if success {
+		response := NewServerResponse(408, "RESOURCE EXISTS")
+		response.Data["Field"] = "User-ID"
+		session.SendResponse(*response)
+		return
+	}
+
+	err = session.Store.Aliases.AddAlias(aliasWid, uid, domain, target)
+	if err == dbhandler.ErrUserIDExists {
+		response := NewServerResponse(408, "RESOURCE EXISTS")
+		response.Data["Field"] = "User-ID"
+		session.SendResponse(*response)
+		return
+	}
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandAddAlias: error adding alias: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Alias-ID"] = aliasWid
+	session.SendResponse(*response)
+}
+
+func commandListAliases(session *sessionState) {
+	// command syntax:
+	// LISTALIASES(Workspace-ID="")
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	target, ok := getAliasOwner(session)
+	if !ok {
+		return
+	}
+
+	aliases, err := session.Store.Aliases.GetAliases(target)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandListAliases: error getting aliases: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Aliases"] = aliases.Join(",")
+	session.SendResponse(*response)
+}
+
+func commandRemoveAlias(session *sessionState) {
+	// command syntax:
+	// REMOVEALIAS(User-ID)
+
+	if !session.Message.HasField("User-ID") {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	uid := session.Message.Data["User-ID"]
+	if uid == "" || strings.ContainsAny(uid, "/\" \t") {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad User-ID")
+		return
+	}
+
+	// The built-in abuse and support aliases are listed in the organization's keycard
+	if uid == "abuse" || uid == "support" {
+		session.SendStringResponse(403, "FORBIDDEN", "Can't remove built-in aliases")
+		return
+	}
+
+	aliasWid, err := session.Store.Workspaces.LookupAddress(uid + "/" + getSessionDomain(session))
+	if err == dbhandler.ErrWorkspaceNotFound || (err == nil && aliasWid == "") {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRemoveAlias: error looking up alias: %s", err.Error())
+		return
+	}
+
+	target, err := session.Store.Aliases.GetAliasTarget(aliasWid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRemoveAlias: error getting alias target: %s", err.Error())
+		return
+	}
+	if target == "" {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	if target != session.WID && !checkRole(session, roleSupport) {
+		return
+	}
+
+	err = session.Store.Aliases.RemoveAlias(aliasWid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRemoveAlias: error removing alias: %s", err.Error())
+		return
+	}
+	session.SendStringResponse(200, "OK", "")
+}
+
+// getAliasOwner returns the workspace whose aliases are being managed by the current request.
+// Users manage the aliases for their own workspace and the administrator and support staff may
+// manage those of any workspace by using the Workspace-ID field. If the request is not allowed,
+// the appropriate response is sent to the client and false is returned.
+func getAliasOwner(session *sessionState) (string, bool) {
+	if !session.Message.HasField("Workspace-ID") ||
+		session.Message.Data["Workspace-ID"] == session.WID {
+		return session.WID, true
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Workspace-ID")
+		return "", false
+	}
+
+	if !checkRole(session, roleSupport) || !checkSameDomain(session, wid) {
+		return "", false
+	}
+	return wid, true
+}
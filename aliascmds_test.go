@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+)
+
+func TestCommandAliases(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	domain := config.HostedDomains()[0]
+	wid := "11111111-1111-1111-1111-111111111111"
+	err := store.Workspaces.AddWorkspace(wid, "csimons", domain, "-", "active", "individual")
+	if err != nil {
+		t.Fatalf("TestCommandAliases: Couldn't add workspace: %s", err.Error())
+	}
+
+	var user sessionState
+	user.WID = wid
+	user.Domain = domain
+	user.LoginState = loginClientSession
+
+	// Subtest #1: Users can add aliases for their own workspace
+
+	response, _ := runCommand(t, store, user, "ADDALIAS", map[string]string{
+		"User-ID": "corbinsimons",
+	})
+	if response.Code != 200 || response.Data["Alias-ID"] == "" {
+		t.Fatalf("TestCommandAliases: #1: failed to add alias: %d %s", response.Code,
+			response.Info)
+	}
+	aliasWid := response.Data["Alias-ID"]
+
+	resolved, err := store.Workspaces.ResolveAddress("corbinsimons/" + domain)
+	if err != nil || resolved != wid {
+		t.Fatalf("TestCommandAliases: #1: alias doesn't resolve to its target: %s", resolved)
+	}
+
+	// Subtest #2: User IDs which are taken can't be used for an alias
+
+	response, _ = runCommand(t, store, user, "ADDALIAS", map[string]string{
+		"User-ID": "corbinsimons",
+	})
+	if response.Code != 408 || response.Data["Field"] != "User-ID" {
+		t.Fatalf("TestCommandAliases: #2: duplicate alias added: %d", response.Code)
+	}
+
+	// Subtest #3: Listing aliases
+
+	response, _ = runCommand(t, store, user, "LISTALIASES", map[string]string{})
+	if response.Code != 200 || response.Data["Aliases"] != "corbinsimons/"+domain {
+		t.Fatalf("TestCommandAliases: #3: wrong alias list: %d %s", response.Code,
+			response.Data["Aliases"])
+	}
+
+	// Subtest #4: Removed aliases are no longer listed or resolved
+
+	response, _ = runCommand(t, store, user, "REMOVEALIAS", map[string]string{
+		"User-ID": "corbinsimons",
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandAliases: #4: failed to remove alias: %d %s", response.Code,
+			response.Info)
+	}
+
+	response, _ = runCommand(t, store, user, "LISTALIASES", map[string]string{})
+	if response.Code != 200 || response.Data["Aliases"] != "" {
+		t.Fatalf("TestCommandAliases: #4: removed alias still listed: %s",
+			response.Data["Aliases"])
+	}
+	_, err = store.Workspaces.ResolveAddress(aliasWid + "/" + domain)
+	if err == nil {
+		t.Fatal("TestCommandAliases: #4: removed alias still resolves")
+	}
+
+	response, _ = runCommand(t, store, user, "REMOVEALIAS", map[string]string{
+		"User-ID": "corbinsimons",
+	})
+	if response.Code != 404 {
+		t.Fatalf("TestCommandAliases: #4: removed alias removed again: %d", response.Code)
+	}
+}
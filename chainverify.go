@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/darkwyrm/mensagod/logging"
+)
+
+// The chain verifier walks the keycards stored for a hosted domain and checks everything which
+// ADDENTRY and ORGROTATE check when an entry is added: data compliance, hashes, signatures, index
+// continuity, and the links between entries. Each user chain, as well as each chain restarted by
+// a revocation, must also be linked to the organization entry which was current when its root
+// entry was added. This catches database corruption and tampering which happens after the fact.
+
+// chainProblem describes something wrong with a stored keycard entry
+type chainProblem struct {
+	Owner   string
+	Index   string
+	Message string
+}
+
+func (p chainProblem) String() string {
+	return fmt.Sprintf("%s entry %s: %s", p.Owner, p.Index, p.Message)
+}
+
+// chainReport holds the results of verifying the keycards for a domain
+type chainReport struct {
+	Domain   string
+	Keycards int
+	Problems []chainProblem
+}
+
+func (r *chainReport) addProblem(owner string, index string, message string) {
+	r.Problems = append(r.Problems, chainProblem{owner, index, message})
+}
+
+// verifyDomainChains checks the organization keycard for a domain and all of the user keycards
+// which belong to it. An error is returned only if the keycards could not be read.
+func verifyDomainChains(store *dbhandler.Store, domain string) (chainReport, error) {
+	report := chainReport{Domain: domain, Problems: make([]chainProblem, 0)}
+
+	orgEntries, err := verifyOrgChain(store, &report)
+	if err != nil {
+		return report, err
+	}
+
+	owners, err := store.Keycards.GetKeycardOwners(domain)
+	if err != nil {
+		return report, err
+	}
+	for _, wid := range owners {
+		err = verifyUserChain(store, &report, wid, orgEntries)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// verifyOrgChain checks the organization keycard for the report's domain and returns its entries
+// so that user keycards can be checked against it
+func verifyOrgChain(store *dbhandler.Store, report *chainReport) ([]*keycard.Entry, error) {
+	entryList, err := store.Keycards.GetOrgEntries(report.Domain, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	report.Keycards++
+	if len(entryList) == 0 {
+		report.addProblem("organization", "1", "organization keycard missing")
+		return nil, nil
+	}
+
+	entries := parseChain(report, "organization", entryList)
+	checkOrgEntries(report, entries)
+	return entries, nil
+}
+
+// checkOrgEntries checks the entries of an organization keycard, which must start with its root
+// entry
+func checkOrgEntries(report *chainReport, entries []*keycard.Entry) {
+	for i, entry := range entries {
+		checkEntry(report, "organization", entry)
+
+		// Organization entries are signed with their own primary verification key
+		var pvk cryptostring.CryptoString
+		if pvk.Set(entry.Fields["Primary-Verification-Key"]) != nil {
+			report.addProblem("organization", entry.Fields["Index"],
+				"bad Primary-Verification-Key")
+		} else {
+			checkSignature(report, "organization", entry, pvk, "Organization")
+		}
+
+		if i == 0 {
+			checkIndex(report, "organization", entry, nil)
+		} else {
+			checkLink(report, "organization", entry, entries[i-1])
+		}
+	}
+}
+
+// verifyUserChain checks the keycard for a workspace against the organization keycard for its
+// domain
+func verifyUserChain(store *dbhandler.Store, report *chainReport, wid string,
+	orgEntries []*keycard.Entry) error {
+	entryList, err := store.Keycards.GetUserEntries(wid, 1, 0)
+	if err != nil {
+		return err
+	}
+	revokedList, err := store.Keycards.GetRevokedIndices(wid)
+	if err != nil {
+		return err
+	}
+	revoked := make(map[int]bool)
+	for _, index := range revokedList {
+		revoked[index] = true
+	}
+	report.Keycards++
+
+	checkUserEntries(report, wid, parseChain(report, wid, entryList), revoked, orgEntries)
+	return nil
+}
+
+// checkUserEntries checks the entries of a user keycard, which must start with its root entry.
+// revoked contains the indices of the keycard's revocations. Each user entry is checked against
+// the organization entry which was current when it was added.
+func checkUserEntries(report *chainReport, wid string, entries []*keycard.Entry,
+	revoked map[int]bool, orgEntries []*keycard.Entry) {
+	for i, entry := range entries {
+		checkEntry(report, wid, entry)
+
+		if entry.Fields["Workspace-ID"] != wid {
+			report.addProblem(wid, entry.Fields["Index"], "entry belongs to another workspace")
+		}
+
+		var crvk cryptostring.CryptoString
+		if crvk.Set(entry.Fields["Contact-Request-Verification-Key"]) != nil {
+			report.addProblem(wid, entry.Fields["Index"],
+				"bad Contact-Request-Verification-Key")
+		} else {
+			checkSignature(report, wid, entry, crvk, "User")
+		}
+
+		// The organization signs user entries with the primary signing key current at the time
+		candidates := orgEntriesAt(orgEntries, entry.Fields["Timestamp"])
+		orgSigned := false
+		for _, orgEntry := range candidates {
+			var pvk cryptostring.CryptoString
+			if pvk.Set(orgEntry.Fields["Primary-Verification-Key"]) != nil {
+				continue
+			}
+			if ok, _ := entry.VerifySignature(pvk, "Organization"); ok {
+				orgSigned = true
+				break
+			}
+		}
+		if !orgSigned {
+			report.addProblem(wid, entry.Fields["Index"], "Organization signature failed to verify")
+		}
+
+		var prevEntry *keycard.Entry
+		if i > 0 {
+			prevEntry = entries[i-1]
+		}
+		index, _ := strconv.Atoi(entry.Fields["Index"])
+		if index != 1 && !revoked[index-1] {
+			checkLink(report, wid, entry, prevEntry)
+			continue
+		}
+
+		// Root entries and the first entry after a revocation are linked to the organization's
+		// keycard instead of the entry before them
+		checkIndex(report, wid, entry, prevEntry)
+		linked := false
+		for _, orgEntry := range candidates {
+			if entry.PrevHash == orgEntry.Hash {
+				linked = true
+				break
+			}
+		}
+		if !linked {
+			report.addProblem(wid, entry.Fields["Index"],
+				"root entry not linked to the organization entry current at the time")
+		}
+	}
+}
+
+// parseChain converts the entries stored for a keycard into Entry objects. Because later entries
+// can't be checked without the ones before them, parsing stops at the first bad entry.
+func parseChain(report *chainReport, owner string, entryList []string) []*keycard.Entry {
+	entries := make([]*keycard.Entry, 0, len(entryList))
+	for i, data := range entryList {
+		entry, err := keycard.NewEntryFromData(data)
+		if err != nil {
+			report.addProblem(owner, strconv.Itoa(i+1), "unreadable entry data: "+err.Error())
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// checkEntry performs the checks which don't depend on any other entry
+func checkEntry(report *chainReport, owner string, entry *keycard.Entry) {
+	index := entry.Fields["Index"]
+	if err := entry.ValidateData(); err != nil {
+		report.addProblem(owner, index, "noncompliant data: "+err.Error())
+	}
+	if !entry.IsCompliant() {
+		report.addProblem(owner, index, "required signature or hash missing")
+	}
+	if ok, err := entry.VerifyHash(); !ok {
+		if err != nil {
+			report.addProblem(owner, index, "bad hash: "+err.Error())
+		} else {
+			report.addProblem(owner, index, "hash doesn't match entry data")
+		}
+	}
+}
+
+func checkSignature(report *chainReport, owner string, entry *keycard.Entry,
+	key cryptostring.CryptoString, sigtype string) {
+	ok, err := entry.VerifySignature(key, sigtype)
+	if err != nil {
+		report.addProblem(owner, entry.Fields["Index"],
+			fmt.Sprintf("%s signature error: %s", sigtype, err.Error()))
+	} else if !ok {
+		report.addProblem(owner, entry.Fields["Index"], sigtype+" signature failed to verify")
+	}
+}
+
+// checkIndex makes sure that an entry's index follows the one before it. If there is no previous
+// entry, the index must be 1.
+func checkIndex(report *chainReport, owner string, entry *keycard.Entry, previous *keycard.Entry) {
+	expected := 1
+	if previous != nil {
+		prevIndex, _ := strconv.Atoi(previous.Fields["Index"])
+		expected = prevIndex + 1
+	}
+	if entry.Fields["Index"] != strconv.Itoa(expected) {
+		report.addProblem(owner, entry.Fields["Index"],
+			fmt.Sprintf("non-sequential index, expected %d", expected))
+	}
+}
+
+// checkLink verifies the chain of custody between an entry and the one before it
+func checkLink(report *chainReport, owner string, entry *keycard.Entry, previous *keycard.Entry) {
+	if previous == nil {
+		report.addProblem(owner, entry.Fields["Index"], "chain does not start with a root entry")
+		return
+	}
+	checkIndex(report, owner, entry, previous)
+
+	if entry.PrevHash != previous.Hash {
+		report.addProblem(owner, entry.Fields["Index"],
+			"Previous-Hash doesn't match previous entry")
+	}
+	ok, err := entry.VerifyChain(previous)
+	if err != nil {
+		report.addProblem(owner, entry.Fields["Index"], "custody check failed: "+err.Error())
+	} else if !ok {
+		report.addProblem(owner, entry.Fields["Index"], "Custody signature failed to verify")
+	}
+}
+
+// orgEntriesAt returns the organization entries which could have been current at the specified
+// time. Timestamps only have a resolution of one second, so more than one entry is returned if the
+// organization keycard was rotated during that second.
+func orgEntriesAt(orgEntries []*keycard.Entry, timestamp string) []*keycard.Entry {
+	out := make([]*keycard.Entry, 0, 2)
+	for i, orgEntry := range orgEntries {
+		if orgEntry.Fields["Timestamp"] > timestamp {
+			break
+		}
+		if i+1 == len(orgEntries) || orgEntries[i+1].Fields["Timestamp"] >= timestamp {
+			out = append(out, orgEntry)
+		}
+	}
+	return out
+}
+
+func commandVerifyChains(session *sessionState) {
+	// command syntax:
+	// VERIFYCHAINS(Workspace-ID="")
+
+	if !checkRole(session, roleAuditor) {
+		return
+	}
+
+	report := chainReport{Domain: getSessionDomain(session), Problems: make([]chainProblem, 0)}
+	var err error
+	if session.Message.HasField("Workspace-ID") {
+		wid := session.Message.Data["Workspace-ID"]
+		if !dbhandler.ValidateUUID(wid) {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Workspace-ID")
+			return
+		}
+
+		if !checkSameDomain(session, wid) {
+			return
+		}
+
+		var orgEntries []*keycard.Entry
+		orgEntries, err = verifyOrgChain(session.Store, &report)
+		if err == nil {
+			err = verifyUserChain(session.Store, &report, wid, orgEntries)
+		}
+	} else {
+		report, err = verifyDomainChains(session.Store, report.Domain)
+	}
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandVerifyChains: error reading keycards: %s", err.Error())
+		return
+	}
+
+	problems := make([]string, len(report.Problems))
+	for i, problem := range report.Problems {
+		problems[i] = problem.String()
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Keycard-Count"] = fmt.Sprintf("%d", report.Keycards)
+	response.Data["Problem-Count"] = fmt.Sprintf("%d", len(report.Problems))
+	response.Data["Problems"] = strings.Join(problems, "\r\n")
+	session.SendResponse(*response)
+}
+
+// checkKeycardChains verifies the keycards for all hosted domains and logs any problems found. It
+// is run when the server starts.
+func checkKeycardChains(store *dbhandler.Store) {
+	for _, domain := range config.HostedDomains() {
+		report, err := verifyDomainChains(store, domain)
+		if err != nil {
+			logging.Writef("checkKeycardChains: error reading keycards for %s: %s", domain,
+				err.Error())
+			continue
+		}
+
+		for _, problem := range report.Problems {
+			logging.Writef("checkKeycardChains: %s: %s", domain, problem.String())
+		}
+		if len(report.Problems) > 0 {
+			fmt.Printf("Keycard verification found %d problem(s) for %s. See the log for "+
+				"details.\n", len(report.Problems), domain)
+		}
+	}
+}
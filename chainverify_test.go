@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+)
+
+func TestCommandVerifyChains(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	domain := config.HostedDomains()[0]
+	adminWid := "ae406c5e-2673-4d3e-af20-91325d9623ca"
+	wid := "11111111-1111-1111-1111-111111111111"
+	for _, ws := range [][]string{{adminWid, "admin"}, {wid, "csimons"}} {
+		err := store.Workspaces.AddWorkspace(ws[0], ws[1], domain, "-", "active", "individual")
+		if err != nil {
+			t.Fatalf("TestCommandVerifyChains: Couldn't add workspace: %s", err.Error())
+		}
+	}
+	err := addExpiringEntry(store, wid, domain, "1", 90)
+	if err != nil {
+		t.Fatalf("TestCommandVerifyChains: Couldn't add entry: %s", err.Error())
+	}
+
+	var admin sessionState
+	admin.WID = adminWid
+	admin.Domain = domain
+	admin.LoginState = loginClientSession
+
+	// Subtest #1: The keycards checked are the ones in the session's store
+
+	response, _ := runCommand(t, store, admin, "VERIFYCHAINS", map[string]string{})
+	if response.Code != 200 || response.Data["Keycard-Count"] != "2" {
+		t.Fatalf("TestCommandVerifyChains: #1: wrong response: %d %v", response.Code,
+			response.Data)
+	}
+	if !strings.Contains(response.Data["Problems"], "organization keycard missing") {
+		t.Fatalf("TestCommandVerifyChains: #1: missing org keycard not reported: %s",
+			response.Data["Problems"])
+	}
+
+	// Subtest #2: A single workspace
+
+	response, _ = runCommand(t, store, admin, "VERIFYCHAINS", map[string]string{
+		"Workspace-ID": wid,
+	})
+	if response.Code != 200 || response.Data["Keycard-Count"] != "2" {
+		t.Fatalf("TestCommandVerifyChains: #2: wrong response: %d %v", response.Code,
+			response.Data)
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+// kctool is an offline utility for working with keycard files. It is used to create the root
+// entries for organization and user keycards, chain new entries onto them, and verify them.
+// Keycard files are in the format used by keycard.Keycard.Save(). Generated keys are saved to a
+// separate file containing one key per line in the format Key-Name.public:ALGORITHM:data or
+// Key-Name.private:ALGORITHM:data.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	cs "github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/darkwyrm/mensagod/logging"
+	"github.com/google/uuid"
+)
+
+const hashAlgorithm = "BLAKE2B-256"
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	// The keycard package logs internal errors. None of them are worth keeping for this tool.
+	logging.Init(os.DevNull, false)
+
+	var err error
+	switch os.Args[1] {
+	case "genorg":
+		err = commandGenOrg(os.Args[2:])
+	case "genuser":
+		err = commandGenUser(os.Args[2:])
+	case "chain":
+		err = commandChain(os.Args[2:])
+	case "verify":
+		err = commandVerify(os.Args[2:])
+	case "help", "-h", "--help":
+		printUsage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", os.Args[1])
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func printUsage() {
+	fmt.Println(`Usage: kctool <command> [options]
+
+Commands:
+  genorg   Create the root entry for an organization keycard
+  genuser  Create the root entry for a user keycard
+  chain    Add a new entry with new keys to the end of a keycard
+  verify   Check a keycard file and report any problems found
+
+Use kctool <command> -h for the options for each command.`)
+}
+
+func commandGenOrg(args []string) error {
+	flags := flag.NewFlagSet("genorg", flag.ExitOnError)
+	name := flags.String("name", "", "organization name (required)")
+	admin := flags.String("admin", "", "address of the admin workspace (required)")
+	support := flags.String("support", "", "address of the support workspace")
+	abuse := flags.String("abuse", "", "address of the abuse workspace")
+	language := flags.String("language", "", "preferred language(s) of the organization")
+	outPath := flags.String("out", "", "path of the keycard file to create (required)")
+	keyPath := flags.String("keys", "", "path of the key file to create. Default: <out>.keys")
+	force := flags.Bool("force", false, "overwrite existing files")
+	flags.Parse(args)
+
+	if *name == "" || *admin == "" || *outPath == "" {
+		flags.Usage()
+		return errors.New("missing required option")
+	}
+	if *keyPath == "" {
+		*keyPath = *outPath + ".keys"
+	}
+
+	keys, err := keycard.GenerateOrgKeys(true)
+	if err != nil {
+		return err
+	}
+
+	entry := keycard.NewOrgEntry()
+	entry.SetFields(map[string]string{
+		"Name":                       *name,
+		"Contact-Admin":              *admin,
+		"Primary-Verification-Key":   keyString(keys, "Primary-Verification-Key.public"),
+		"Secondary-Verification-Key": keyString(keys, "Secondary-Verification-Key.public"),
+		"Encryption-Key":             keyString(keys, "Encryption-Key.public"),
+	})
+	optionalFields := map[string]string{
+		"Contact-Support": *support,
+		"Contact-Abuse":   *abuse,
+		"Language":        *language,
+	}
+	for fieldName, value := range optionalFields {
+		if value != "" {
+			entry.Fields[fieldName] = value
+		}
+	}
+
+	err = finishOrgEntry(entry, keys["Primary-Verification-Key.private"])
+	if err != nil {
+		return err
+	}
+
+	card := keycard.Keycard{Type: entry.Type, Entries: []keycard.Entry{*entry}}
+	err = saveCardAndKeys(card, *outPath, keys, *keyPath, *force)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created organization keycard %s with hash %s\n", *outPath, entry.Hash)
+	fmt.Printf("Keys saved to %s. Keep this file safe.\n", *keyPath)
+	return nil
+}
+
+func commandGenUser(args []string) error {
+	flags := flag.NewFlagSet("genuser", flag.ExitOnError)
+	wid := flags.String("wid", "", "workspace ID. A new one is generated if not given")
+	uid := flags.String("uid", "", "user ID")
+	domain := flags.String("domain", "", "domain of the workspace (required)")
+	name := flags.String("name", "", "name of the user")
+	orgKeyPath := flags.String("orgkeys", "", "key file of the organization (required)")
+	orgCardPath := flags.String("orgcard", "",
+		"organization keycard. The root entry is linked to its current entry if given.")
+	outPath := flags.String("out", "", "path of the keycard file to create (required)")
+	keyPath := flags.String("keys", "", "path of the key file to create. Default: <out>.keys")
+	force := flags.Bool("force", false, "overwrite existing files")
+	flags.Parse(args)
+
+	if *domain == "" || *orgKeyPath == "" || *outPath == "" {
+		flags.Usage()
+		return errors.New("missing required option")
+	}
+	if *keyPath == "" {
+		*keyPath = *outPath + ".keys"
+	}
+	if *wid == "" {
+		*wid = uuid.New().String()
+	}
+
+	orgKeys, err := loadKeys(*orgKeyPath)
+	if err != nil {
+		return err
+	}
+	orgSigningKey, ok := orgKeys["Primary-Verification-Key.private"]
+	if !ok {
+		return errors.New("organization signing key missing from " + *orgKeyPath)
+	}
+
+	keys, err := keycard.GenerateUserKeys(true)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]string{
+		"Workspace-ID": *wid,
+		"Domain":       *domain,
+	}
+	for _, name := range []string{"Contact-Request-Verification-Key",
+		"Contact-Request-Encryption-Key", "Public-Encryption-Key", "Alternate-Encryption-Key"} {
+		fields[name] = keyString(keys, name+".public")
+	}
+
+	entry := keycard.NewUserEntry()
+	entry.SetFields(fields)
+	if *uid != "" {
+		entry.Fields["User-ID"] = *uid
+	}
+	if *name != "" {
+		entry.Fields["Name"] = *name
+	}
+
+	if *orgCardPath != "" {
+		var orgCard keycard.Keycard
+		err = orgCard.Load(*orgCardPath, false)
+		if err != nil {
+			return fmt.Errorf("couldn't load %s: %s", *orgCardPath, err.Error())
+		}
+		entry.PrevHash = orgCard.Entries[len(orgCard.Entries)-1].Hash
+	}
+
+	err = finishUserEntry(entry, orgSigningKey, keys["Contact-Request-Verification-Key.private"])
+	if err != nil {
+		return err
+	}
+
+	card := keycard.Keycard{Type: entry.Type, Entries: []keycard.Entry{*entry}}
+	err = saveCardAndKeys(card, *outPath, keys, *keyPath, *force)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created user keycard %s for workspace %s with hash %s\n", *outPath, *wid,
+		entry.Hash)
+	fmt.Printf("Keys saved to %s. Keep this file safe.\n", *keyPath)
+	return nil
+}
+
+func commandChain(args []string) error {
+	flags := flag.NewFlagSet("chain", flag.ExitOnError)
+	cardPath := flags.String("card", "", "keycard file to add the new entry to (required)")
+	keyPath := flags.String("keys", "", "key file for the keycard's current entry (required)")
+	newKeyPath := flags.String("newkeys", "", "path of the key file to create (required)")
+	orgKeyPath := flags.String("orgkeys", "",
+		"key file of the organization. Required for user keycards.")
+	rotateOptional := flags.Bool("rotate-optional", false, "also replace the optional keys")
+	force := flags.Bool("force", false, "overwrite an existing new key file")
+	flags.Parse(args)
+
+	if *cardPath == "" || *keyPath == "" || *newKeyPath == "" {
+		flags.Usage()
+		return errors.New("missing required option")
+	}
+
+	var card keycard.Keycard
+	err := card.Load(*cardPath, false)
+	if err != nil {
+		return fmt.Errorf("couldn't load %s: %s", *cardPath, err.Error())
+	}
+	current := &card.Entries[len(card.Entries)-1]
+
+	keys, err := loadKeys(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	var custodyKeyName string
+	if card.Type == "Organization" {
+		custodyKeyName = "Primary-Verification-Key.private"
+	} else {
+		custodyKeyName = "Contact-Request-Verification-Key.private"
+	}
+	custodyKey, ok := keys[custodyKeyName]
+	if !ok {
+		return fmt.Errorf("%s missing from %s", custodyKeyName, *keyPath)
+	}
+
+	newEntry, newKeys, err := current.Chain(custodyKey, *rotateOptional)
+	if err != nil {
+		return fmt.Errorf("couldn't chain entry: %s", err.Error())
+	}
+	newEntry.PrevHash = current.Hash
+
+	if card.Type == "Organization" {
+		err = finishOrgEntry(newEntry, newKeys["Primary-Verification-Key.private"])
+	} else {
+		if *orgKeyPath == "" {
+			return errors.New("the organization's key file is required for user keycards")
+		}
+		var orgKeys map[string]cs.CryptoString
+		orgKeys, err = loadKeys(*orgKeyPath)
+		if err != nil {
+			return err
+		}
+		orgSigningKey, ok := orgKeys["Primary-Verification-Key.private"]
+		if !ok {
+			return errors.New("organization signing key missing from " + *orgKeyPath)
+		}
+		err = finishUserEntry(newEntry, orgSigningKey,
+			newKeys["Contact-Request-Verification-Key.private"])
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keys which weren't rotated are still needed, so the new key file gets the old ones, too
+	for keyName, key := range newKeys {
+		if key.IsValid() {
+			keys[keyName] = key
+		}
+	}
+	err = saveKeys(keys, *newKeyPath, *force)
+	if err != nil {
+		return err
+	}
+
+	card.Entries = append(card.Entries, *newEntry)
+	err = card.Save(*cardPath, true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added entry %s to %s with hash %s\n", newEntry.Fields["Index"], *cardPath,
+		newEntry.Hash)
+	fmt.Printf("Keys saved to %s. Keep this file safe.\n", *newKeyPath)
+	return nil
+}
+
+func commandVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	orgCardPath := flags.String("orgcard", "",
+		"organization keycard used to check the Organization signatures of user entries")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: kctool verify [options] <keycard file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("missing keycard file")
+	}
+	cardPath := flags.Arg(0)
+
+	var card keycard.Keycard
+	err := card.Load(cardPath, false)
+	if err != nil {
+		return fmt.Errorf("couldn't load %s: %s", cardPath, err.Error())
+	}
+
+	var orgCard keycard.Keycard
+	if *orgCardPath != "" {
+		err = orgCard.Load(*orgCardPath, false)
+		if err != nil {
+			return fmt.Errorf("couldn't load %s: %s", *orgCardPath, err.Error())
+		}
+		if orgCard.Type != "Organization" {
+			return fmt.Errorf("%s is not an organization keycard", *orgCardPath)
+		}
+	}
+
+	problemCount := 0
+	for i := range card.Entries {
+		var previous *keycard.Entry
+		if i > 0 {
+			previous = &card.Entries[i-1]
+		}
+
+		problems := verifyEntry(&card.Entries[i], previous, &orgCard)
+		label := fmt.Sprintf("Entry %d (index %s)", i+1, card.Entries[i].Fields["Index"])
+		if len(problems) == 0 {
+			fmt.Printf("%s: OK\n", label)
+			continue
+		}
+
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", label, problem)
+		}
+		problemCount += len(problems)
+	}
+
+	if problemCount > 0 {
+		return fmt.Errorf("%d problem(s) found in %s", problemCount, cardPath)
+	}
+	fmt.Printf("%s: %d entries verified\n", cardPath, len(card.Entries))
+	return nil
+}
+
+// verifyEntry checks an entry and returns a list of the problems found with it. The previous entry
+// is nil for the first entry in a keycard. The organization keycard may be empty, in which case
+// the Organization signatures of user entries are not checked.
+func verifyEntry(entry *keycard.Entry, previous *keycard.Entry,
+	orgCard *keycard.Keycard) []string {
+	problems := make([]string, 0)
+
+	err := entry.ValidateData()
+	if err != nil {
+		problems = append(problems, "bad field data: "+err.Error())
+	}
+
+	expired, err := entry.IsExpired()
+	if err == nil && expired {
+		problems = append(problems, "entry expired on "+entry.Fields["Expires"])
+	}
+
+	if entry.Hash == "" {
+		problems = append(problems, "hash missing")
+	} else {
+		ok, err := entry.VerifyHash()
+		if err != nil {
+			problems = append(problems, "couldn't check hash: "+err.Error())
+		} else if !ok {
+			problems = append(problems, "hash doesn't match entry data")
+		}
+	}
+
+	// Organization entries are signed with their own primary key. User entries carry both an
+	// Organization signature and a User signature from the contact request key.
+	var orgKey, userKey string
+	if entry.Type == "Organization" {
+		orgKey = entry.Fields["Primary-Verification-Key"]
+	} else {
+		userKey = entry.Fields["Contact-Request-Verification-Key"]
+		if len(orgCard.Entries) > 0 {
+			orgKey = findOrgKey(entry, orgCard)
+			if orgKey == "" {
+				problems = append(problems, "no organization entry matches Previous-Hash")
+			}
+		}
+	}
+	if orgKey != "" {
+		problems = append(problems, checkSignature(entry, "Organization", orgKey)...)
+	}
+	if userKey != "" {
+		problems = append(problems, checkSignature(entry, "User", userKey)...)
+	}
+
+	if previous != nil {
+		if entry.PrevHash != previous.Hash {
+			problems = append(problems, "Previous-Hash doesn't match hash of previous entry")
+		}
+		ok, err := entry.VerifyChain(previous)
+		if err != nil {
+			problems = append(problems, "chain of custody broken: "+err.Error())
+		} else if !ok {
+			problems = append(problems, "Custody signature failed to verify")
+		}
+	}
+
+	return problems
+}
+
+// findOrgKey returns the organization verification key to use for a user entry. The root entry
+// of a user keycard is linked to the organization entry current when it was created, so its
+// key is used. Later entries are checked against the organization's current key.
+func findOrgKey(entry *keycard.Entry, orgCard *keycard.Keycard) string {
+	if entry.Fields["Index"] == "1" {
+		for _, orgEntry := range orgCard.Entries {
+			if orgEntry.Hash == entry.PrevHash {
+				return orgEntry.Fields["Primary-Verification-Key"]
+			}
+		}
+		return ""
+	}
+	return orgCard.Entries[len(orgCard.Entries)-1].Fields["Primary-Verification-Key"]
+}
+
+func checkSignature(entry *keycard.Entry, sigtype string, keyString string) []string {
+	if entry.Signatures[sigtype] == "" {
+		return []string{sigtype + " signature missing"}
+	}
+
+	var key cs.CryptoString
+	err := key.Set(keyString)
+	if err != nil {
+		return []string{fmt.Sprintf("bad verification key for %s signature", sigtype)}
+	}
+
+	ok, err := entry.VerifySignature(key, sigtype)
+	if err != nil {
+		return []string{fmt.Sprintf("couldn't check %s signature: %s", sigtype, err.Error())}
+	}
+	if !ok {
+		return []string{sigtype + " signature failed to verify"}
+	}
+	return nil
+}
+
+// finishOrgEntry adds the hash and Organization signature to an organization entry
+func finishOrgEntry(entry *keycard.Entry, signingKey cs.CryptoString) error {
+	err := entry.ValidateData()
+	if err != nil {
+		return fmt.Errorf("bad entry data: %s", err.Error())
+	}
+
+	err = entry.GenerateHash(hashAlgorithm)
+	if err != nil {
+		return fmt.Errorf("couldn't hash entry: %s", err.Error())
+	}
+
+	err = entry.Sign(signingKey, "Organization")
+	if err != nil {
+		return fmt.Errorf("couldn't sign entry: %s", err.Error())
+	}
+
+	if !entry.IsCompliant() {
+		return errors.New("new entry isn't compliant")
+	}
+	return nil
+}
+
+// finishUserEntry adds the Organization signature, hash, and User signature to a user entry
+func finishUserEntry(entry *keycard.Entry, orgSigningKey cs.CryptoString,
+	userSigningKey cs.CryptoString) error {
+	err := entry.ValidateData()
+	if err != nil {
+		return fmt.Errorf("bad entry data: %s", err.Error())
+	}
+
+	err = entry.Sign(orgSigningKey, "Organization")
+	if err != nil {
+		return fmt.Errorf("couldn't org sign entry: %s", err.Error())
+	}
+
+	err = entry.GenerateHash(hashAlgorithm)
+	if err != nil {
+		return fmt.Errorf("couldn't hash entry: %s", err.Error())
+	}
+
+	err = entry.Sign(userSigningKey, "User")
+	if err != nil {
+		return fmt.Errorf("couldn't user sign entry: %s", err.Error())
+	}
+
+	if !entry.IsCompliant() {
+		return errors.New("new entry isn't compliant")
+	}
+	return nil
+}
+
+func saveCardAndKeys(card keycard.Keycard, cardPath string, keys map[string]cs.CryptoString,
+	keyPath string, clobber bool) error {
+	// The keys are saved first so that a card is never created without them
+	err := saveKeys(keys, keyPath, clobber)
+	if err != nil {
+		return err
+	}
+	return card.Save(cardPath, clobber)
+}
+
+// keyString returns a key from a key map as a string
+func keyString(keys map[string]cs.CryptoString, name string) string {
+	key := keys[name]
+	return key.AsString()
+}
+
+// loadKeys reads a key file created by this tool
+func loadKeys(path string) (map[string]cs.CryptoString, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]cs.CryptoString)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		var key cs.CryptoString
+		if len(parts) != 2 || key.Set(parts[1]) != nil {
+			return nil, fmt.Errorf("bad key data in %s line %d", path, i+1)
+		}
+		keys[parts[0]] = key
+	}
+	return keys, nil
+}
+
+// saveKeys writes a key file. Only the owner is given access to the file.
+func saveKeys(keys map[string]cs.CryptoString, path string, clobber bool) error {
+	_, err := os.Stat(path)
+	if !os.IsNotExist(err) && !clobber {
+		return fmt.Errorf("%s exists", path)
+	}
+
+	names := make([]string, 0, len(keys))
+	for name, key := range keys {
+		if key.IsValid() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name := range names {
+		key := keys[name]
+		builder.WriteString(name + ":" + key.AsString() + "\n")
+	}
+	return ioutil.WriteFile(path, []byte(builder.String()), 0600)
+}
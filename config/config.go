@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"runtime"
 
+	"github.com/darkwyrm/mensagod/ezcrypt"
 	"github.com/darkwyrm/mensagod/logging"
 	"github.com/everlastingbeta/diceware"
 	"github.com/everlastingbeta/diceware/wordlist"
@@ -48,6 +49,10 @@ func SetupConfig() diceware.Wordlist {
 	viper.SetDefault("database.name", "mensago")
 	viper.SetDefault("database.user", "mensago")
 	viper.SetDefault("database.password", "")
+	viper.SetDefault("database.max_open_connections", 25)
+	viper.SetDefault("database.max_idle_connections", 5)
+	viper.SetDefault("database.connection_lifetime", 30)
+	viper.SetDefault("database.query_timeout", 30)
 
 	// Location of workspace data, server log
 	switch runtime.GOOS {
@@ -62,11 +67,13 @@ func SetupConfig() diceware.Wordlist {
 
 		viper.SetDefault("global.workspace_dir", filepath.Join(programData, "mensago"))
 		viper.Set("global.log_dir", filepath.Join(programData, "mensagod"))
+		viper.SetDefault("database.file", filepath.Join(programData, "mensagod", "mensagod.db"))
 		viper.SetConfigName("serverconfig")
 		viper.AddConfigPath(filepath.Join(programData, "mensagod"))
 	default:
 		viper.SetDefault("global.workspace_dir", "/var/mensago/")
 		viper.Set("global.log_dir", "/var/log/mensagod/")
+		viper.SetDefault("database.file", "/var/lib/mensagod/mensagod.db")
 		viper.SetConfigName("serverconfig")
 		viper.AddConfigPath("/etc/mensagod/")
 	}
@@ -93,6 +100,13 @@ func SetupConfig() diceware.Wordlist {
 	// Max message size in MiB. max_file_size takes precedence over this value
 	viper.SetDefault("global.max_message_size", 50)
 
+	// Number of days before an unregistration request can be approved on servers which use
+	// private or moderated registration
+	viper.SetDefault("global.unregister_grace_days", 7)
+
+	// Number of days a user has to export their data once an unregistration request is approved
+	viper.SetDefault("global.unregister_export_days", 14)
+
 	// Diceware settings for registration code and password reset code generation
 	viper.SetDefault("security.diceware_wordlist", "eff_short_prefix")
 	viper.SetDefault("security.diceware_wordcount", 6)
@@ -116,6 +130,22 @@ func SetupConfig() diceware.Wordlist {
 	// Resource usage for password hashing
 	viper.SetDefault("security.password_security", "normal")
 
+	// Verify all stored keycards when the server starts
+	viper.SetDefault("security.verify_keycards", true)
+
+	// Number of days before a keycard expires that its owner is notified
+	viper.SetDefault("security.keycard_notice_days", 14)
+
+	// Hash algorithm used for new keycard entries
+	viper.SetDefault("security.keycard_hash", "BLAKE2B-256")
+
+	// Number of transparency log requests a client can make each minute
+	viper.SetDefault("security.log_requests_per_min", 60)
+
+	// Encryption of the organization's private keys in the database
+	viper.SetDefault("security.org_key_protection", "none")
+	viper.SetDefault("security.org_key_file", "")
+
 	// Read the config file
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -156,12 +186,45 @@ func SetupConfig() diceware.Wordlist {
 		}
 	}
 
-	if viper.GetString("database.password") == "" {
-		logging.Write("Database password not set in config file. Exiting.")
+	switch viper.GetString("database.engine") {
+	case "postgresql":
+		if viper.GetString("database.password") == "" {
+			logging.Write("Database password not set in config file. Exiting.")
+			logging.Shutdown()
+			os.Exit(1)
+		}
+	case "sqlite":
+		if viper.GetString("database.file") == "" {
+			logging.Write("Database file not set in config file. Exiting.")
+			logging.Shutdown()
+			os.Exit(1)
+		}
+	default:
+		logging.Write("Invalid database engine in config file. Exiting.")
 		logging.Shutdown()
 		os.Exit(1)
 	}
 
+	if viper.GetInt("database.max_open_connections") < 0 {
+		viper.Set("database.max_open_connections", 0)
+		logging.Write("Negative maximum database connections in config file. Assuming no limit.")
+	}
+
+	if viper.GetInt("database.max_idle_connections") < 0 {
+		viper.Set("database.max_idle_connections", 0)
+		logging.Write("Negative idle database connections in config file. Assuming zero.")
+	}
+
+	if viper.GetInt("database.connection_lifetime") < 0 {
+		viper.Set("database.connection_lifetime", 0)
+		logging.Write("Negative database connection lifetime in config file. Assuming no limit.")
+	}
+
+	if viper.GetInt("database.query_timeout") < 1 {
+		viper.Set("database.query_timeout", 30)
+		logging.Write("Database query timeout out of bounds in config file. Assuming 30.")
+	}
+
 	pattern := regexp.MustCompile("([a-zA-Z0-9]+\x2E)+[a-zA-Z0-9]+")
 	if viper.GetString("global.domain") == "" ||
 		!pattern.MatchString(viper.GetString("global.domain")) {
@@ -205,6 +268,22 @@ func SetupConfig() diceware.Wordlist {
 		logging.Write("Negative quota value in config file. Assuming zero.")
 	}
 
+	if !loadDomains() {
+		logging.Write("Invalid hosted domain configuration. Exiting.")
+		logging.Shutdown()
+		os.Exit(1)
+	}
+
+	if viper.GetInt("global.unregister_grace_days") < 0 {
+		viper.Set("global.unregister_grace_days", 0)
+		logging.Write("Negative unregistration grace period. Setting to zero.")
+	}
+
+	if viper.GetInt("global.unregister_export_days") < 0 {
+		viper.Set("global.unregister_export_days", 0)
+		logging.Write("Negative unregistration export window. Setting to zero.")
+	}
+
 	if viper.GetInt("security.failure_delay_sec") > 60 {
 		viper.Set("security.failure_delay_sec", 60)
 		logging.Write("Limiting maximum failure delay to 60.")
@@ -234,6 +313,37 @@ func SetupConfig() diceware.Wordlist {
 		logging.Write("Invalid password reset time. Setting to 60.")
 	}
 
+	if viper.GetInt("security.keycard_notice_days") < 1 ||
+		viper.GetInt("security.keycard_notice_days") > 365 {
+		viper.Set("security.keycard_notice_days", 14)
+		logging.Write("Invalid keycard expiration notice period. Setting to 14.")
+	}
+
+	if !ezcrypt.IsSupported(viper.GetString("security.keycard_hash"), ezcrypt.CapHash) {
+		viper.Set("security.keycard_hash", "BLAKE2B-256")
+		logging.Write("Unsupported keycard hash algorithm. Setting to BLAKE2B-256.")
+	}
+
+	if viper.GetInt("security.log_requests_per_min") < 1 {
+		viper.Set("security.log_requests_per_min", 60)
+		logging.Write("Invalid transparency log request limit. Setting to 60.")
+	}
+
+	switch viper.GetString("security.org_key_protection") {
+	case "none", "passphrase":
+		// Do nothing. Legitimate values.
+	case "keyfile":
+		if viper.GetString("security.org_key_file") == "" {
+			logging.Write("org_key_file must be set when org_key_protection is keyfile. Exiting.")
+			logging.Shutdown()
+			os.Exit(1)
+		}
+	default:
+		logging.Write("Invalid organization key protection mode in config file. Exiting.")
+		logging.Shutdown()
+		os.Exit(1)
+	}
+
 	gSetupInit = true
 
 	return outList
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/darkwyrm/mensagod/logging"
+	"github.com/spf13/viper"
+)
+
+// DomainConfig holds the settings which may differ between the domains hosted by the server
+type DomainConfig struct {
+	Name         string
+	Registration string
+	// Default user workspace quota in MiB. 0 = no quota
+	DefaultQuota int64
+}
+
+// domainEntry is used to read a domain's settings from the config file. Pointers are used so
+// that unset values can fall back to those in the global section.
+type domainEntry struct {
+	Name         string `mapstructure:"name"`
+	Registration string `mapstructure:"registration"`
+	DefaultQuota *int64 `mapstructure:"default_quota"`
+}
+
+var gDomains map[string]DomainConfig
+
+// loadDomains reads the list of domains hosted by the server. The domain in the global section is
+// the primary domain and uses the global registration and quota settings. Additional domains are
+// listed in the config file as an array of tables named domains.
+func loadDomains() bool {
+	gDomains = make(map[string]DomainConfig)
+
+	primary := strings.ToLower(viper.GetString("global.domain"))
+	gDomains[primary] = DomainConfig{
+		Name:         primary,
+		Registration: strings.ToLower(viper.GetString("global.registration")),
+		DefaultQuota: viper.GetInt64("global.default_quota"),
+	}
+
+	var entries []domainEntry
+	err := viper.UnmarshalKey("domains", &entries)
+	if err != nil {
+		logging.Writef("Unable to read hosted domain list: %s", err)
+		return false
+	}
+
+	pattern := regexp.MustCompile("([a-zA-Z0-9]+\x2E)+[a-zA-Z0-9]+")
+	for _, entry := range entries {
+		name := strings.ToLower(entry.Name)
+		if name == "" || !pattern.MatchString(name) {
+			logging.Writef("Invalid hosted domain '%s' in config file.", entry.Name)
+			return false
+		}
+		if _, exists := gDomains[name]; exists {
+			logging.Writef("Duplicate hosted domain %s in config file.", name)
+			return false
+		}
+
+		dc := DomainConfig{
+			Name:         name,
+			Registration: strings.ToLower(entry.Registration),
+			DefaultQuota: viper.GetInt64("global.default_quota"),
+		}
+
+		switch dc.Registration {
+		case "":
+			dc.Registration = strings.ToLower(viper.GetString("global.registration"))
+		case "private", "public", "network", "moderated":
+			// Do nothing. Legitimate values.
+		default:
+			logging.Writef("Invalid registration mode for domain %s in config file.", name)
+			return false
+		}
+
+		if entry.DefaultQuota != nil {
+			dc.DefaultQuota = *entry.DefaultQuota
+			if dc.DefaultQuota < 0 {
+				dc.DefaultQuota = 0
+				logging.Writef("Negative quota value for domain %s. Assuming zero.", name)
+			}
+		}
+		gDomains[name] = dc
+	}
+	return true
+}
+
+// PrimaryDomain returns the server's primary domain, which is used when a request doesn't specify
+// one
+func PrimaryDomain() string {
+	return strings.ToLower(viper.GetString("global.domain"))
+}
+
+// GetDomain returns the settings for a hosted domain. If the server does not host the domain,
+// false is returned.
+func GetDomain(domain string) (DomainConfig, bool) {
+	dc, ok := gDomains[strings.ToLower(domain)]
+	return dc, ok
+}
+
+// IsHostedDomain returns true if the specified domain is hosted by the server
+func IsHostedDomain(domain string) bool {
+	_, ok := gDomains[strings.ToLower(domain)]
+	return ok
+}
+
+// HostedDomains returns a sorted list of all domains hosted by the server
+func HostedDomains() []string {
+	out := make([]string, 0, len(gDomains))
+	for name := range gDomains {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
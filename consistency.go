@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/fshandler"
+)
+
+// The consistency checker looks for the pieces of accounts which were left behind when an account
+// operation failed partway through or the database and workspace folder were restored from
+// backups made at different times: workspaces without a directory, directories without a
+// workspace, directories of removed workspaces which were never deleted, and devices without a
+// workspace. It only reports what it finds, because which side
+// is right depends on what went wrong.
+
+// accountReport holds the orphans found by checkAccounts
+type accountReport struct {
+	Workspaces  []string
+	Directories []string
+	Removed     []string
+	Devices     []dbhandler.OrphanedDevice
+}
+
+// Count returns the number of problems in the report
+func (r accountReport) Count() int {
+	return len(r.Workspaces) + len(r.Directories) + len(r.Removed) + len(r.Devices)
+}
+
+// checkAccounts compares the workspaces and devices in the database with each other and with the
+// workspace directories in the filesystem
+func checkAccounts(store *dbhandler.Store) (accountReport, error) {
+	var report accountReport
+
+	widList, err := store.Accounts.GetWorkspaceIDs()
+	if err != nil {
+		return report, err
+	}
+	dirList, err := fshandler.ListWorkspaces()
+	if err != nil {
+		return report, err
+	}
+
+	dirs := make(map[string]bool, len(dirList))
+	for _, dir := range dirList {
+		dirs[dir] = true
+	}
+	workspaces := make(map[string]bool, len(widList))
+	for _, wid := range widList {
+		workspaces[wid] = true
+		if !dirs[wid] {
+			report.Workspaces = append(report.Workspaces, wid)
+		}
+	}
+	for _, dir := range dirList {
+		if !workspaces[dir] {
+			report.Directories = append(report.Directories, dir)
+		}
+	}
+
+	// A WorkspaceRemoval sets the directory aside before deleting it, so a removal which failed
+	// to finish leaves the directory behind under another name
+	report.Removed, err = fshandler.ListRemovedWorkspaces()
+	if err != nil {
+		return report, err
+	}
+
+	report.Devices, err = store.Accounts.GetOrphanedDevices()
+	return report, err
+}
+
+// commandCheck implements 'mensagod check', which runs the consistency checker and prints what
+// it finds
+func commandCheck() error {
+	report, err := checkAccounts(gStore)
+	if err != nil {
+		return err
+	}
+
+	for _, wid := range report.Workspaces {
+		fmt.Printf("Workspace without a directory: %s\n", wid)
+	}
+	for _, dir := range report.Directories {
+		fmt.Printf("Directory without a workspace: %s\n", dir)
+	}
+	for _, wid := range report.Removed {
+		fmt.Printf("Directory of a removed workspace: .%s.removed\n", wid)
+	}
+	for _, device := range report.Devices {
+		fmt.Printf("Device without a workspace: %s on %s\n", device.DevID, device.WID)
+	}
+
+	if report.Count() == 0 {
+		fmt.Println("No problems found.")
+	} else {
+		fmt.Printf("%d problem(s) found.\n", report.Count())
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package dbhandler
+
+import (
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/logging"
+)
+
+// Registering and unregistering a workspace each take several database changes as well as a change
+// to the filesystem. The database changes are made in a single transaction and the filesystem
+// change is made just before it is committed. If the filesystem change fails, the transaction is
+// rolled back, and if the commit fails, the filesystem change is reverted, so that a failure at
+// any step leaves no half-created or half-deleted account behind.
+
+// FSChange is a filesystem change made as part of an account operation
+type FSChange interface {
+	// Apply makes the change. It is called after the database changes have been made but before
+	// they are committed.
+	Apply() error
+
+	// Revert undoes the change if the database changes could not be committed
+	Revert() error
+
+	// Finish completes the change once the database changes have been committed. Anything which
+	// can't be undone belongs here.
+	Finish() error
+}
+
+// Registration holds the information needed to add a workspace and its first device. Shared
+// workspaces have no devices, so DeviceID is empty for them and Admin is the workspace ID of the
+// member who becomes the workspace's first administrator.
+type Registration struct {
+	WID       string
+	UID       string
+	Domain    string
+	Password  string
+	Status    string
+	Type      string
+	DeviceID  string
+	DeviceKey cryptostring.CryptoString
+	Admin     string
+
+	// RegCode is the registration code used if the workspace was preregistered. PreregID is the
+	// workspace ID or user ID it was given with, and PreregIsWID tells which one it is.
+	RegCode     string
+	PreregID    string
+	PreregIsWID bool
+}
+
+// OrphanedDevice is a device which belongs to a workspace which doesn't exist or has been deleted
+type OrphanedDevice struct {
+	WID   string
+	DevID string
+}
+
+// RegisterWorkspace adds a workspace and its first device or, for a shared workspace, its first
+// administrator. If the workspace was preregistered, its registration code is also deleted.
+// change is usually the creation of the workspace's directory and may be nil.
+func RegisterWorkspace(reg Registration, change FSChange) error {
+	return registerWorkspace(dbConn, reg, change)
+}
+
+func registerWorkspace(db *database, reg Registration, change FSChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = addWorkspace(tx, reg.WID, reg.UID, reg.Domain, reg.Password, reg.Status, reg.Type)
+	if err != nil {
+		return err
+	}
+	if reg.DeviceID != "" {
+		err = addDevice(tx, reg.WID, reg.DeviceID, reg.DeviceKey, "active")
+		if err != nil {
+			return err
+		}
+	}
+	if reg.Admin != "" {
+		err = setMember(tx, reg.WID, reg.Admin, "admin")
+		if err != nil {
+			return err
+		}
+	}
+	if reg.RegCode != "" {
+		err = deleteRegCode(tx, reg.PreregID, reg.Domain, reg.PreregIsWID, reg.RegCode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return commitWithChange(tx, change)
+}
+
+// UnregisterWorkspace removes a workspace in the same way as RemoveWorkspace. change is usually
+// the removal of the workspace's files and may be nil.
+func UnregisterWorkspace(wid string, change FSChange) error {
+	return unregisterWorkspace(dbConn, wid, change)
+}
+
+func unregisterWorkspace(db *database, wid string, change FSChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = removeWorkspace(tx, wid)
+	if err != nil {
+		return err
+	}
+
+	return commitWithChange(tx, change)
+}
+
+// commitWithChange applies a filesystem change and commits a transaction, reverting the change if
+// the commit fails. It succeeds once the commit does.
+func commitWithChange(tx *transaction, change FSChange) error {
+	if change == nil {
+		return tx.Commit()
+	}
+
+	err := change.Apply()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		revertErr := change.Revert()
+		if revertErr != nil {
+			logging.Writef("dbhandler.commitWithChange: failed to revert filesystem change: %s",
+				revertErr.Error())
+		}
+		return err
+	}
+
+	finishChange(change)
+	return nil
+}
+
+// finishChange finishes a filesystem change whose account operation has been committed. The
+// operation is done at that point and anything Finish leaves behind is only clutter, so a failure
+// is logged instead of being returned.
+func finishChange(change FSChange) {
+	err := change.Finish()
+	if err != nil {
+		logging.Writef("dbhandler.finishChange: failed to finish filesystem change: %s",
+			err.Error())
+	}
+}
+
+// GetWorkspaceIDs returns the IDs of all workspaces which are expected to have a directory: those
+// which are neither aliases nor deleted, as well as those which have been preregistered.
+func GetWorkspaceIDs() ([]string, error) {
+	return getWorkspaceIDs(dbConn)
+}
+
+func getWorkspaceIDs(db queryer) ([]string, error) {
+	out := make([]string, 0)
+	rows, err := db.Query(`SELECT wid FROM workspaces WHERE status!='deleted' AND ` +
+		`wtype!='alias' UNION SELECT wid FROM prereg ORDER BY wid`)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var wid string
+		err = rows.Scan(&wid)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, wid)
+	}
+	return out, rows.Err()
+}
+
+// GetOrphanedDevices returns the devices which belong to workspaces which don't exist or have
+// been deleted
+func GetOrphanedDevices() ([]OrphanedDevice, error) {
+	return getOrphanedDevices(dbConn)
+}
+
+func getOrphanedDevices(db queryer) ([]OrphanedDevice, error) {
+	out := make([]OrphanedDevice, 0)
+	rows, err := db.Query(`SELECT wid,devid FROM iwkspc_devices WHERE wid NOT IN ` +
+		`(SELECT wid FROM workspaces WHERE status!='deleted') ORDER BY wid,devid`)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var device OrphanedDevice
+		err = rows.Scan(&device.WID, &device.DevID)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, device)
+	}
+	return out, rows.Err()
+}
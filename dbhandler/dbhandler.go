@@ -5,6 +5,8 @@ package dbhandler
 // eliminate cluttering up the otherwise-clean Go code with the ugly SQL queries.
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"log"
@@ -12,51 +14,59 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"database/sql"
 
+	"github.com/darkwyrm/b85"
 	"github.com/darkwyrm/gostringlist"
+	"github.com/darkwyrm/mensagod/config"
 	"github.com/darkwyrm/mensagod/cryptostring"
 	"github.com/darkwyrm/mensagod/ezcrypt"
 	"github.com/darkwyrm/mensagod/fshandler"
 	"github.com/darkwyrm/mensagod/keycard"
 	"github.com/darkwyrm/mensagod/logging"
+	"github.com/darkwyrm/mensagod/translog"
 	"github.com/everlastingbeta/diceware"
-	"github.com/lib/pq"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/blake2b"
 )
 
 var (
 	connected bool
 	serverLog *log.Logger
-	dbConn    *sql.DB
+	dbConn    *database
 )
 
 // Connect utilizes the viper config system and connects to the specified database. Because
 // problems in the connection are almost always fatal to the successful continuation of the server
 // daemon, if there are problems, it logs the problem and exits the main process.
 func Connect() {
-	if viper.GetString("database.engine") != "postgresql" {
-		logging.Write("Database password not set in config file. Exiting.")
+	engine, err := getEngine(viper.GetString("database.engine"))
+	if err != nil {
+		logging.Writef("Bad database engine in config file. Exiting. Error: %s", err.Error())
 		logging.Shutdown()
 		os.Exit(1)
 	}
 
-	connString := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		viper.GetString("database.ip"), viper.GetString("database.port"),
-		viper.GetString("database.user"), viper.GetString("database.password"),
-		viper.GetString("database.name"))
-
-	var err error
-	dbConn, err = sql.Open("postgres", connString)
+	conn, err := engine.Open()
 	if err != nil {
 		logging.Writef("Failed to open database connection. Exiting. Error: %s", err.Error())
 		logging.Shutdown()
 		os.Exit(1)
 	}
+	conn.SetMaxOpenConns(viper.GetInt("database.max_open_connections"))
+	conn.SetMaxIdleConns(viper.GetInt("database.max_idle_connections"))
+	conn.SetConnMaxLifetime(time.Duration(viper.GetInt("database.connection_lifetime")) *
+		time.Minute)
+	queryTimeout = time.Duration(viper.GetInt("database.query_timeout")) * time.Second
+	dbConn = &database{conn, engine, context.Background()}
+
 	// Calling Ping() is required because Open() just validates the settings passed
-	err = dbConn.Ping()
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	err = dbConn.PingContext(ctx)
 	if err != nil {
 		logging.Writef("Failed to open database connection. Exiting. Error: %s", err.Error())
 		logging.Shutdown()
@@ -77,6 +87,22 @@ func IsConnected() bool {
 	return connected
 }
 
+// IsAvailable returns false if the last query to reach the database failed because the connection
+// to it failed, or timed out and the database then didn't answer a ping
+func IsAvailable() bool {
+	return atomic.LoadInt32(&unavailable) == 0
+}
+
+// IsUnavailableError returns true if an error returned by this package means that the database
+// couldn't be reached. A query which timed out only counts if the database has since been found
+// to be unavailable, because a timeout may only mean that the query was slow.
+func IsUnavailableError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return !IsAvailable()
+	}
+	return isUnavailableError(err)
+}
+
 // LogFailure adds an entry to the database of a failure which needs tracked. This
 // includes a type (workspace, password, recipient), the source (IP address, WID),
 // and the timestamp of the failure.
@@ -84,6 +110,10 @@ func IsConnected() bool {
 // exceeded the threshold for that type of failure, then a lockout timestamp will
 // be set.
 func LogFailure(failType string, wid string, sourceip string) error {
+	return logFailure(dbConn, failType, wid, sourceip)
+}
+
+func logFailure(db queryer, failType string, wid string, sourceip string) error {
 	if failType == "" {
 		logging.Write("LogFailure(): empty fail type")
 		return errors.New("empty fail type")
@@ -101,7 +131,7 @@ func LogFailure(failType string, wid string, sourceip string) error {
 	timeString := time.Now().UTC().Format(time.RFC3339)
 
 	// Now that the error-checking is out of the way, we can actually update the db. :)
-	row := dbConn.QueryRow(`SELECT count FROM failure_log WHERE type=$1 AND source=$2`,
+	row := db.QueryRow(`SELECT count FROM failure_log WHERE type=$1 AND source=$2`,
 		failType, sourceip)
 	var failCount int
 	err := row.Scan(&failCount)
@@ -111,7 +141,7 @@ func LogFailure(failType string, wid string, sourceip string) error {
 		if err == sql.ErrNoRows {
 			sqlStatement := `INSERT INTO failure_log(type, source, id, count, last_failure)
 			VALUES($1, $2, $3, $4, $5)`
-			_, err = dbConn.Exec(sqlStatement, failType, sourceip, wid, failCount, timeString)
+			_, err = db.Exec(sqlStatement, failType, sourceip, wid, failCount, timeString)
 			if err != nil {
 				logging.Write("dbhandler.LogFailure: failed to update failure log")
 			}
@@ -131,7 +161,7 @@ func LogFailure(failType string, wid string, sourceip string) error {
 			UPDATE failure_log 
 			SET count=$1, last_failure=$2, lockout_until=$3
 			WHERE type=$4 AND source=$5 AND id=$6`
-		_, err = dbConn.Exec(sqlStatement, failCount, timeString, lockout.Format(time.RFC3339),
+		_, err = db.Exec(sqlStatement, failCount, timeString, lockout.Format(time.RFC3339),
 			failType, sourceip, wid)
 		if err != nil {
 			logging.Write("dbhandler.LogFailure: failed to update failure log")
@@ -143,7 +173,7 @@ func LogFailure(failType string, wid string, sourceip string) error {
 			UPDATE failure_log 
 			SET count=$1, last_failure=$2 
 			WHERE type=$3 AND source=$4 and wid=$5`
-		_, err = dbConn.Exec(sqlStatement, failCount, timeString, failType, sourceip, wid)
+		_, err = db.Exec(sqlStatement, failCount, timeString, failType, sourceip, wid)
 		if err != nil {
 			logging.Write("dbhandler.LogFailure: failed to update failure log")
 			return err
@@ -180,8 +210,39 @@ func GetMensagoAddressType(addr string) int {
 	return 2
 }
 
-// ResolveAddress returns the WID corresponding to an Mensago address.
+// ResolveAddress returns the WID corresponding to an Mensago address. If the address belongs to an
+// alias, the WID of the alias' target is returned.
 func ResolveAddress(addr string) (string, error) {
+	return resolveAddress(dbConn, addr)
+}
+
+func resolveAddress(db queryer, addr string) (string, error) {
+	wid, err := lookupAddress(db, addr)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := getAliasTarget(db, wid)
+	if err != nil {
+		return "", err
+	}
+	if target != "" {
+		return target, nil
+	}
+	return wid, nil
+}
+
+// ErrWorkspaceNotFound is returned by LookupAddress and ResolveAddress when no workspace has the
+// address
+var ErrWorkspaceNotFound = errors.New("workspace not found")
+
+// LookupAddress returns the WID of the workspace named by a Mensago address. Unlike
+// ResolveAddress, aliases are not followed, so the WID of the alias itself is returned.
+func LookupAddress(addr string) (string, error) {
+	return lookupAddress(dbConn, addr)
+}
+
+func lookupAddress(db queryer, addr string) (string, error) {
 	parts := strings.Split(addr, "/")
 	if len(parts) != 2 {
 		return "", errors.New("invalid address")
@@ -201,42 +262,25 @@ func ResolveAddress(addr string) (string, error) {
 		return "", errors.New("invalid user id")
 	}
 
+	var row *dbRow
 	if isWid {
 		// If the address is a workspace address, then all we have to do is confirm that the
-		// workspace exists -- workspace IDs are unique across an organization, not just a domain
-		row := dbConn.QueryRow(`SELECT wtype FROM workspaces WHERE wid=$1`, parts[0])
-		var wtype string
-		err := row.Scan(&wtype)
-
-		if err != nil {
-			if err == sql.ErrNoRows {
-				// No entry in the table
-				return "", errors.New("workspace not found")
-			}
-			return "", err
-		}
-
-		if wtype == "alias" {
-			row := dbConn.QueryRow(`SELECT wid FROM aliases WHERE wid=$1`, parts[0])
-			var targetAddr string
-			err := row.Scan(&targetAddr)
-			if err != nil {
-				return "", err
-			}
-
-			return targetAddr, nil
-		}
-		return addr, nil
+		// workspace exists -- workspace IDs are unique across an organization, not just a domain.
+		// Deleted workspaces keep their IDs so that they aren't reused, but they no longer have
+		// an address.
+		row = db.QueryRow(`SELECT wid FROM workspaces WHERE wid=$1 AND status!='deleted'`,
+			parts[0])
+	} else {
+		row = db.QueryRow(`SELECT wid FROM workspaces WHERE uid=$1 AND domain=$2 `+
+			`AND status!='deleted'`, parts[0], strings.ToLower(parts[1]))
 	}
 
-	row := dbConn.QueryRow(`SELECT wid,domain FROM workspaces WHERE uid=$1`, parts[0])
-	var wid, domain string
-
-	err := row.Scan(&wid, &domain)
+	var wid string
+	err := row.Scan(&wid)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// No entry in the table
-			return "", errors.New("workspace not found")
+			return "", ErrWorkspaceNotFound
 		}
 		return "", err
 	}
@@ -251,7 +295,11 @@ func ResolveAddress(addr string) (string, error) {
 // For example, for logins, it is the workspace ID. For preregistration codes, it is the IP
 // address of the remote host.
 func CheckLockout(failType string, id string, source string) (string, error) {
-	row := dbConn.QueryRow(`SELECT lockout_until FROM failure_log 
+	return checkLockout(dbConn, failType, id, source)
+}
+
+func checkLockout(db queryer, failType string, id string, source string) (string, error) {
+	row := db.QueryRow(`SELECT lockout_until FROM failure_log 
 		WHERE id=$1 and source=$2`, id, source)
 
 	var locktime string
@@ -281,7 +329,7 @@ func CheckLockout(failType string, id string, source string) (string, error) {
 	if lockstamp.Before(time.Now().UTC()) {
 		sqlStatement := `DELETE FROM failure_log
 		WHERE failtype=$1 AND source=$2 AND lockout_until=$3 `
-		_, err = dbConn.Exec(sqlStatement, failType, source, locktime)
+		_, err = db.Exec(sqlStatement, failType, source, locktime)
 		if err != nil {
 			logging.Write("dbhandler.CheckLockout: couldn't remove lockout from db")
 			return "", err
@@ -295,8 +343,12 @@ func CheckLockout(failType string, id string, source string) (string, error) {
 // CheckPasscode checks the validity of a workspace/passcode combination. This function will return
 // an error of "expired" if the combination is valid but expired.
 func CheckPasscode(wid string, passcode string) (bool, error) {
+	return checkPasscode(dbConn, wid, passcode)
+}
+
+func checkPasscode(db queryer, wid string, passcode string) (bool, error) {
 	var expires string
-	row := dbConn.QueryRow(`SELECT expires FROM passcodes WHERE wid = $1 AND passcode = $2 `,
+	row := db.QueryRow(`SELECT expires FROM passcodes WHERE wid = $1 AND passcode = $2 `,
 		wid, passcode)
 	err := row.Scan(&expires)
 	if err != nil {
@@ -307,9 +359,16 @@ func CheckPasscode(wid string, passcode string) (bool, error) {
 		return false, err
 	}
 
-	// We made it this far, so the combination is valid. Is it expired?
-	var codestamp time.Time
-	codestamp, err = time.Parse(time.RFC3339, expires)
+	return checkPasscodeExpiration(expires)
+}
+
+// checkPasscodeExpiration returns an error of "expired" if the expiration time of a valid passcode
+// has passed
+func checkPasscodeExpiration(expires string) (bool, error) {
+	codestamp, err := time.Parse(time.RFC3339, expires)
+	if err != nil {
+		codestamp, err = time.Parse("20060102T150405Z", expires)
+	}
 	if err != nil {
 		logging.Write("dbhandler.CheckPasscode: bad timestamp in database")
 		return false, err
@@ -324,7 +383,11 @@ func CheckPasscode(wid string, passcode string) (bool, error) {
 
 // DeletePasscode deletes a workspace/passcode combination
 func DeletePasscode(wid string, passcode string) error {
-	_, err := dbConn.Exec(`DELETE FROM passcodes WHERE wid = $1 AND passcode = $2`,
+	return deletePasscode(dbConn, wid, passcode)
+}
+
+func deletePasscode(db queryer, wid string, passcode string) error {
+	_, err := db.Exec(`DELETE FROM passcodes WHERE wid = $1 AND passcode = $2`,
 		wid, passcode)
 
 	return err
@@ -332,34 +395,52 @@ func DeletePasscode(wid string, passcode string) error {
 
 // RemoveExpiredPasscodes removes any workspace/passcode combination entries which are expired
 func RemoveExpiredPasscodes() error {
-	_, err := dbConn.Exec(`DELETE FROM passcodes WHERE expires < CURRENT_TIMESTAMP`)
+	_, err := dbConn.Exec(`DELETE FROM passcodes WHERE expires < $1`,
+		time.Now().UTC().Format(time.RFC3339))
 
 	return err
 }
 
 // ResetPassword adds a reset code combination to the database for later authentication by the
-// user. All parameters are expected to be populated.
+// user, replacing any which the workspace already has. All parameters are expected to be
+// populated.
 func ResetPassword(wid string, passcode string, expires string) error {
-	_, err := dbConn.Exec(`DELETE FROM passcodes WHERE wid = $1`, wid)
+	return resetPassword(dbConn, wid, passcode, expires)
+}
+
+func resetPassword(db *database, wid string, passcode string, expires string) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = dbConn.Exec(`INSERT INTO passcodes(wid, passcode, expires) VALUES($1, $2, $3)`,
-		wid, passcode, expires)
+	_, err = tx.Exec(`DELETE FROM passcodes WHERE wid = $1`, wid)
+	if err != nil {
+		return err
+	}
 
-	return err
+	_, err = tx.Exec(`INSERT INTO passcodes(wid, passcode, expires) VALUES($1, $2, $3)`,
+		wid, passcode, expires)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // SetPassword does just that: sets the password for a workspace. It returns a boolean state,
 // indicating a match (or lack thereof) and an error state. It will take any input string of up to
 // 64 characters and store it in the database.
 func SetPassword(wid string, password string) error {
+	return setPassword(dbConn, wid, password)
+}
+
+func setPassword(db queryer, wid string, password string) error {
 	if len(password) > 128 {
 		return errors.New("Password string has a maximum 128 characters")
 	}
 	passHash := ezcrypt.HashPassword(password)
-	_, err := dbConn.Exec(`UPDATE workspaces SET password=$1 WHERE wid=$2`, passHash, wid)
+	_, err := db.Exec(`UPDATE workspaces SET password=$1 WHERE wid=$2`, passHash, wid)
 	return err
 }
 
@@ -367,7 +448,11 @@ func SetPassword(wid string, password string) error {
 // if the two hashes match. It does not perform any validity checking of the input--this should be
 // done when the input is received from the user.
 func CheckPassword(wid string, password string) (bool, error) {
-	row := dbConn.QueryRow(`SELECT password FROM workspaces WHERE wid=$1`, wid)
+	return checkPassword(dbConn, wid, password)
+}
+
+func checkPassword(db queryer, wid string, password string) (bool, error) {
+	row := db.QueryRow(`SELECT password FROM workspaces WHERE wid=$1`, wid)
 
 	var dbhash string
 	err := row.Scan(&dbhash)
@@ -378,10 +463,84 @@ func CheckPassword(wid string, password string) (bool, error) {
 	return ezcrypt.VerifyPasswordHash(password, dbhash)
 }
 
+// RehashPassword replaces the stored hash of a workspace's password if it was made with settings
+// other than the ones currently used for new hashes. The password must already have been checked
+// with CheckPassword. It returns true if the hash was replaced, which doesn't happen if the
+// password was changed after it was checked.
+func RehashPassword(wid string, password string) (bool, error) {
+	return rehashPassword(dbConn, wid, password)
+}
+
+func rehashPassword(db queryer, wid string, password string) (bool, error) {
+	row := db.QueryRow(`SELECT password FROM workspaces WHERE wid=$1`, wid)
+
+	var dbhash string
+	err := row.Scan(&dbhash)
+	if err != nil {
+		return false, err
+	}
+
+	rehash, err := ezcrypt.PasswordNeedsRehash(dbhash)
+	if err != nil || !rehash {
+		return false, err
+	}
+
+	// The hash is only replaced if it hasn't changed since it was read so that a new password set
+	// by another session in the meantime isn't overwritten with the old one
+	result, err := db.Exec(`UPDATE workspaces SET password=$1 WHERE wid=$2 AND password=$3`,
+		ezcrypt.HashPassword(password), wid, dbhash)
+	if err != nil {
+		return false, err
+	}
+	rowcount, err := result.RowsAffected()
+	return rowcount > 0, err
+}
+
+// CountLegacyPasswords returns the number of workspaces in a domain which have a password, how
+// many of those passwords are stored with hash settings other than the current ones, and how many
+// hashes can't be read at all. Unreadable hashes are not counted as legacy ones because logging in
+// won't replace them. Shared workspaces and aliases don't have passwords of their own and are not
+// counted.
+func CountLegacyPasswords(domain string) (int, int, int, error) {
+	return countLegacyPasswords(dbConn, domain)
+}
+
+func countLegacyPasswords(db queryer, domain string) (int, int, int, error) {
+	rows, err := db.Query(`SELECT password FROM workspaces WHERE domain=$1 AND password!='-'`,
+		domain)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer rows.Close()
+
+	total, legacy, unreadable := 0, 0, 0
+	for rows.Next() {
+		var dbhash string
+		err = rows.Scan(&dbhash)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		total++
+		rehash, err := ezcrypt.PasswordNeedsRehash(dbhash)
+		if err != nil {
+			unreadable++
+		} else if rehash {
+			legacy++
+		}
+	}
+
+	return total, legacy, unreadable, rows.Err()
+}
+
 // SetWorkspaceStatus sets the status of a workspace. Valid values are "disabled", "active", and
 // "approved". Although a workspace can also have a status of "awaiting", this state is internal
 // to the dbhandler API and cannot be set directly.
 func SetWorkspaceStatus(wid string, status string) error {
+	return setWorkspaceStatus(dbConn, wid, status)
+}
+
+func setWorkspaceStatus(db queryer, wid string, status string) error {
 	realStatus := strings.ToLower(status)
 
 	if realStatus == "awaiting" {
@@ -394,7 +553,7 @@ func SetWorkspaceStatus(wid string, status string) error {
 		return fmt.Errorf("%s is not a valid workspace ID", wid)
 	}
 	var err error
-	_, err = dbConn.Exec(`UPDATE workspaces SET status=$1 WHERE wid=$2`, status, wid)
+	_, err = db.Exec(`UPDATE workspaces SET status=$1 WHERE wid=$2`, status, wid)
 	return err
 }
 
@@ -402,23 +561,28 @@ func SetWorkspaceStatus(wid string, status string) error {
 // device, adds it to the device table, sets the device status, and returns the session string for
 // the new device.
 func AddDevice(wid string, devid string, devkey cryptostring.CryptoString, status string) error {
-	var err error
+	return addDevice(dbConn, wid, devid, devkey, status)
+}
+
+func addDevice(db queryer, wid string, devid string, devkey cryptostring.CryptoString,
+	status string) error {
 	sqlStatement := `INSERT INTO iwkspc_devices(wid, devid, devkey, status) ` +
 		`VALUES($1, $2, $3, $4)`
-	_, err = dbConn.Exec(sqlStatement, wid, devid, devkey.AsString(), status)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := db.Exec(sqlStatement, wid, devid, devkey.AsString(), status)
+	return err
 }
 
 // RemoveDevice removes a session string for a workspace. It returns true if successful and false
 // if not.
 func RemoveDevice(wid string, devid string) (bool, error) {
+	return removeDevice(dbConn, wid, devid)
+}
+
+func removeDevice(db queryer, wid string, devid string) (bool, error) {
 	if len(devid) != 40 {
 		return false, errors.New("invalid session string")
 	}
-	_, err := dbConn.Exec(`DELETE FROM iwkspc_devices WHERE wid=$1 AND devid=$2`, wid, devid)
+	_, err := db.Exec(`DELETE FROM iwkspc_devices WHERE wid=$1 AND devid=$2`, wid, devid)
 	if err != nil {
 		return false, nil
 	}
@@ -427,7 +591,11 @@ func RemoveDevice(wid string, devid string) (bool, error) {
 
 // CheckDevice checks a session string on a workspace and returns true or false if there is a match.
 func CheckDevice(wid string, devid string, devkey string) (bool, error) {
-	row := dbConn.QueryRow(`SELECT status FROM iwkspc_devices WHERE wid=$1 AND 
+	return checkDevice(dbConn, wid, devid, devkey)
+}
+
+func checkDevice(db queryer, wid string, devid string, devkey string) (bool, error) {
+	row := db.QueryRow(`SELECT status FROM iwkspc_devices WHERE wid=$1 AND 
 		devid=$2 AND devkey=$3`, wid, devid, devkey)
 
 	var widStatus string
@@ -445,7 +613,11 @@ func CheckDevice(wid string, devid string, devkey string) (bool, error) {
 
 // UpdateDevice replaces a device's old key with a new one
 func UpdateDevice(wid string, devid string, oldkey string, newkey string) error {
-	_, err := dbConn.Exec(`UPDATE iwkspc_devices SET devkey=$1 WHERE wid=$2 AND 
+	return updateDevice(dbConn, wid, devid, oldkey, newkey)
+}
+
+func updateDevice(db queryer, wid string, devid string, oldkey string, newkey string) error {
+	_, err := db.Exec(`UPDATE iwkspc_devices SET devkey=$1 WHERE wid=$2 AND 
 		devid=$3 AND devkey=$4`, newkey, wid, devid, oldkey)
 
 	return err
@@ -453,16 +625,35 @@ func UpdateDevice(wid string, devid string, oldkey string, newkey string) error
 
 // AddWorkspace is used for adding a workspace to a server. Upon failure, it returns the error
 // state for the failure. It makes the necessary database modifications and creates the folder for
-// the workspace in the filesystem. Note that this function is strictly for adding workspaces for
-// individuals. Shared workspaces are not yet supported/implemented. Status may be 'active',
-// 'pending', or 'disabled'.
+// the workspace in the filesystem. Shared workspaces have no password of their own and are
+// accessed through the sessions of their members, so the password is ignored for them. Status may
+// be 'active', 'pending', or 'disabled'. Server setup adds rows without a password for the
+// preregistered abuse and support workspaces, and such a row is filled in instead of adding
+// another.
 func AddWorkspace(wid string, uid string, domain string, password string, status string,
 	wtype string) error {
-	passString := ezcrypt.HashPassword(password)
+	return addWorkspace(dbConn, wid, uid, domain, password, status, wtype)
+}
+
+func addWorkspace(db queryer, wid string, uid string, domain string, password string,
+	status string, wtype string) error {
+	passString := "-"
+	if wtype != "shared" {
+		passString = ezcrypt.HashPassword(password)
+	}
+
+	result, err := db.Exec(`UPDATE workspaces SET uid=$1, domain=$2, password=$3, status=$4, `+
+		`wtype=$5 WHERE wid=$6 AND password IS NULL`, uid, domain, passString, status, wtype, wid)
+	if err != nil {
+		return err
+	}
+	rowcount, err := result.RowsAffected()
+	if err != nil || rowcount > 0 {
+		return err
+	}
 
 	// wid, uid, domain, wtype, status, password
-	var err error
-	_, err = dbConn.Exec(`INSERT INTO workspaces(wid, uid, domain, password, status, wtype) `+
+	_, err = db.Exec(`INSERT INTO workspaces(wid, uid, domain, password, status, wtype) `+
 		`VALUES($1, $2, $3, $4, $5, $6)`,
 		wid, uid, domain, passString, status, wtype)
 	return err
@@ -471,14 +662,26 @@ func AddWorkspace(wid string, uid string, domain string, password string, status
 // RemoveWorkspace deletes a workspace. It returns an error if unsuccessful. Note that this does
 // not remove all information about the workspace. WIDs and UIDs may not be reused for security
 // purposes, so the uid and wid attached to the workspace will remain in the database for this
-// reason
+// reason. The workspace's devices, any aliases pointing to it, and any unregistration request for
+// it are also removed.
 func RemoveWorkspace(wid string) error {
+	return removeWorkspace(dbConn, wid)
+}
+
+func removeWorkspace(db queryer, wid string) error {
 	var sqlCommands = []string{
 		`UPDATE workspaces SET password='-',status='deleted' WHERE wid=$1`,
+		`DELETE FROM iwkspc_devices WHERE wid=$1`,
 		`DELETE FROM iwkspc_folders WHERE wid=$1`,
+		`DELETE FROM swkspc_members WHERE wid=$1 OR member=$1`,
+		`DELETE FROM roles WHERE wid=$1`,
+		`UPDATE workspaces SET status='deleted' WHERE wid IN ` +
+			`(SELECT wid FROM aliases WHERE alias LIKE CAST($1 AS TEXT) || '/%')`,
+		`DELETE FROM aliases WHERE alias LIKE CAST($1 AS TEXT) || '/%'`,
+		`DELETE FROM unregrequests WHERE wid=$1`,
 	}
 	for _, sqlCmd := range sqlCommands {
-		_, err := dbConn.Exec(sqlCmd, wid)
+		_, err := db.Exec(sqlCmd, wid)
 		if err != nil {
 			return err
 		}
@@ -486,144 +689,500 @@ func RemoveWorkspace(wid string) error {
 	return nil
 }
 
-// CheckWorkspace checks to see if a workspace exists. If the workspace does exist,
-// True is returned along with a string containing the workspace's status. If the
-// workspace does not exist, it returns false and an empty string. The workspace
-// status can be 'active', 'pending', or 'disabled'. Preregistered workspaces have the status
-// 'approved'. Note that this function does not check the validity of the WID string passed to it.
-// This should be done when the input is received from the user.
-func CheckWorkspace(wid string) (bool, string) {
-	row := dbConn.QueryRow(`SELECT status FROM workspaces WHERE wid=$1`, wid)
+// GetWorkspaceDomain returns the domain a workspace belongs to. An empty string is returned if the
+// workspace does not exist.
+func GetWorkspaceDomain(wid string) (string, error) {
+	return getWorkspaceDomain(dbConn, wid)
+}
 
-	var widStatus string
-	err := row.Scan(&widStatus)
+func getWorkspaceDomain(db queryer, wid string) (string, error) {
+	row := db.QueryRow(`SELECT domain FROM workspaces WHERE wid=$1`, wid)
 
-	switch err {
-	case sql.ErrNoRows:
-		break
-	case nil:
-		return true, widStatus
-	case err.(*pq.Error):
-		logging.Writef("dbhandler.CheckWorkspace: PostgreSQL error reading workspaces: %s",
-			err.Error())
-		return false, ""
-	default:
-		logging.Writef("dbhandler.CheckWorkspace: unexpected error reading workspaces: %s",
-			err.Error())
-		return false, ""
+	var domain string
+	err := row.Scan(&domain)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
 	}
+	return domain, nil
+}
 
-	row = dbConn.QueryRow(`SELECT wid FROM prereg WHERE wid=$1`, wid)
-	err = row.Scan(&widStatus)
+// GetWorkspaceType returns the type of a workspace, which can be 'individual', 'shared', or
+// 'alias'. An empty string is returned if the workspace does not exist.
+func GetWorkspaceType(wid string) (string, error) {
+	return getWorkspaceType(dbConn, wid)
+}
 
-	switch err {
-	case sql.ErrNoRows:
-		return false, ""
-	case nil:
-		return true, "approved"
-	case err.(*pq.Error):
-		logging.Writef("dbhandler.CheckWorkspace: PostgreSQL error reading prereg: %s",
-			err.Error())
-		return false, ""
-	default:
-		logging.Writef("dbhandler.CheckWorkspace: unexpected error reading prereg: %s",
-			err.Error())
-		return false, ""
+func getWorkspaceType(db queryer, wid string) (string, error) {
+	row := db.QueryRow(`SELECT wtype FROM workspaces WHERE wid=$1`, wid)
+
+	var wtype string
+	err := row.Scan(&wtype)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
 	}
+	return wtype, nil
 }
 
-// CheckUserID works the same as CheckWorkspace except that it checks for user IDs
-func CheckUserID(uid string) (bool, string) {
-	row := dbConn.QueryRow(`SELECT status FROM workspaces WHERE uid=$1`, uid)
-
-	var widStatus string
-	err := row.Scan(&widStatus)
+// AddMember adds a member to a shared workspace or changes the role of an existing one. Role can
+// be 'read', 'write', or 'admin'.
+func AddMember(wid string, member string, role string) error {
+	return addMember(dbConn, wid, member, role)
+}
 
-	switch err {
-	case sql.ErrNoRows:
-		break
-	case nil:
-		return true, widStatus
-	case err.(*pq.Error):
-		logging.Writef("dbhandler.CheckUserID: PostgreSQL error reading workspaces: %s",
-			err.Error())
-		return false, ""
-	default:
-		logging.Writef("dbhandler.CheckUserID: unexpected error reading workspaces: %s",
-			err.Error())
-		return false, ""
+func addMember(db *database, wid string, member string, role string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	row = dbConn.QueryRow(`SELECT uid FROM prereg WHERE uid=$1`, uid)
-	err = row.Scan(&widStatus)
+	err = setMember(tx, wid, member, role)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	switch err {
-	case sql.ErrNoRows:
-		return false, ""
-	case nil:
-		return true, "approved"
-	case err.(*pq.Error):
-		logging.Writef("dbhandler.CheckUserID: PostgreSQL error reading prereg: %s",
-			err.Error())
-		return false, ""
-	default:
-		logging.Writef("dbhandler.CheckUserID: unexpected error reading prereg: %s",
-			err.Error())
-		return false, ""
+// setMember does the work of AddMember. The caller is responsible for running it in a
+// transaction.
+func setMember(db queryer, wid string, member string, role string) error {
+	_, err := db.Exec(`DELETE FROM swkspc_members WHERE wid=$1 AND member=$2`, wid, member)
+	if err != nil {
+		return err
 	}
+
+	_, err = db.Exec(`INSERT INTO swkspc_members(wid, member, role) VALUES($1, $2, $3)`,
+		wid, member, role)
+	return err
 }
 
-// PreregWorkspace preregisters a workspace, adding a specified wid to the database and returns
-// a randomly-generated registration code needed to authenticate the first login. Registration
-// codes are stored in the clear, but that's merely because if an attacker already has access to
-// the server to see the codes, the attacker can easily create new workspaces.
-func PreregWorkspace(wid string, uid string, domain string, wordList *diceware.Wordlist,
-	wordcount int) (string, error) {
+// RemoveMember removes a member from a shared workspace
+func RemoveMember(wid string, member string) error {
+	return removeMember(dbConn, wid, member)
+}
 
-	if len(wid) > 36 || len(uid) > 128 {
-		return "", errors.New("Bad parameter length")
-	}
+func removeMember(db queryer, wid string, member string) error {
+	_, err := db.Exec(`DELETE FROM swkspc_members WHERE wid=$1 AND member=$2`, wid, member)
+	return err
+}
 
-	if len(uid) > 0 {
-		row := dbConn.QueryRow(`SELECT uid FROM prereg WHERE uid=$1`, uid)
-		var hasuid string
-		err := row.Scan(&hasuid)
+// GetMemberRole returns the role of a member of a shared workspace. An empty string is returned if
+// the workspace ID passed is not a member of the workspace.
+func GetMemberRole(wid string, member string) (string, error) {
+	return getMemberRole(dbConn, wid, member)
+}
 
-		if hasuid != "" {
-			return "", errors.New("uid exists")
-		}
+func getMemberRole(db queryer, wid string, member string) (string, error) {
+	row := db.QueryRow(`SELECT role FROM swkspc_members WHERE wid=$1 AND member=$2`,
+		wid, member)
 
-		switch err {
-		case sql.ErrNoRows:
-			break
-		case err.(*pq.Error):
-			logging.Writef("dbhandler.PreregWorkspace: PostgreSQL error reading prereg: %s",
-				err.Error())
-			return "", err
-		default:
-			logging.Writef("dbhandler.PreregWorkspace: unexpected error reading prereg: %s",
-				err.Error())
-			return "", err
+	var role string
+	err := row.Scan(&role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
 		}
+		return "", err
 	}
+	return role, nil
+}
 
-	regcode, err := diceware.RollWords(wordcount, "-", *wordList)
+// GetMembers returns a map of the workspace IDs of the members of a shared workspace to their roles
+func GetMembers(wid string) (map[string]string, error) {
+	return getMembers(dbConn, wid)
+}
 
-	_, err = dbConn.Exec(`INSERT INTO prereg(wid, uid, domain, regcode) VALUES($1, $2, $3, $4)`,
-		wid, uid, domain, regcode)
+func getMembers(db queryer, wid string) (map[string]string, error) {
+	out := make(map[string]string)
+	rows, err := db.Query(`SELECT member,role FROM swkspc_members WHERE wid=$1`, wid)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
 
-	return regcode, err
+	for rows.Next() {
+		var member, role string
+		err := rows.Scan(&member, &role)
+		if err != nil {
+			return out, err
+		}
+		out[member] = role
+	}
+	return out, nil
 }
 
-// CheckRegCode handles authenticating a host using a user/workspace ID and registration
+// AddRole grants an administrative role to a workspace. Granting a role which the workspace
+// already has is not an error.
+func AddRole(wid string, role string) error {
+	return addRole(dbConn, wid, role)
+}
+
+func addRole(db *database, wid string, role string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM roles WHERE wid=$1 AND role=$2`, wid, role)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO roles(wid, role) VALUES($1, $2)`, wid, role)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveRole revokes an administrative role from a workspace
+func RemoveRole(wid string, role string) error {
+	return removeRole(dbConn, wid, role)
+}
+
+func removeRole(db queryer, wid string, role string) error {
+	_, err := db.Exec(`DELETE FROM roles WHERE wid=$1 AND role=$2`, wid, role)
+	return err
+}
+
+// GetRoles returns a StringList containing the administrative roles granted to a workspace
+func GetRoles(wid string) (gostringlist.StringList, error) {
+	return getRoles(dbConn, wid)
+}
+
+func getRoles(db queryer, wid string) (gostringlist.StringList, error) {
+	var out gostringlist.StringList
+	rows, err := db.Query(`SELECT role FROM roles WHERE wid=$1`, wid)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return out, err
+		}
+		out.Append(role)
+	}
+	out.Sort()
+	return out, nil
+}
+
+// HasRole returns true if a workspace has been granted the specified administrative role
+func HasRole(wid string, role string) (bool, error) {
+	return hasRole(dbConn, wid, role)
+}
+
+func hasRole(db queryer, wid string, role string) (bool, error) {
+	row := db.QueryRow(`SELECT role FROM roles WHERE wid=$1 AND role=$2`, wid, role)
+
+	var result string
+	err := row.Scan(&result)
+	switch err {
+	case sql.ErrNoRows:
+		return false, nil
+	case nil:
+		return true, nil
+	}
+	return false, err
+}
+
+// UnregRequest is a request from a user to remove their workspace
+type UnregRequest struct {
+	WID         string
+	Status      string
+	GraceUntil  string
+	ExportUntil string
+}
+
+// AddUnregRequest queues a request from a user to remove their workspace. It is used when the
+// server's registration mode requires administrator involvement. The request can't be approved
+// until graceUntil has passed, and the user may cancel it until it is approved. Any existing
+// request for the workspace is replaced.
+func AddUnregRequest(wid string, graceUntil string) error {
+	return addUnregRequest(dbConn, wid, graceUntil)
+}
+
+func addUnregRequest(db queryer, wid string, graceUntil string) error {
+	_, err := db.Exec(`DELETE FROM unregrequests WHERE wid=$1`, wid)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO unregrequests(wid, requested, grace_until, status) `+
+		`VALUES($1, $2, $3, 'pending')`, wid, time.Now().UTC().Format(time.RFC3339), graceUntil)
+	return err
+}
+
+// GetUnregRequest returns the status, the end of the grace period, and the end of the data export
+// window for a workspace's unregistration request. The export window is empty until the request
+// has been approved. If no request exists, the status returned is empty and no error is returned.
+func GetUnregRequest(wid string) (string, string, string, error) {
+	return getUnregRequest(dbConn, wid)
+}
+
+func getUnregRequest(db queryer, wid string) (string, string, string, error) {
+	row := db.QueryRow(`SELECT status,grace_until,export_until FROM unregrequests `+
+		`WHERE wid=$1`, wid)
+
+	var status, graceUntil string
+	var exportUntil sql.NullString
+	err := row.Scan(&status, &graceUntil, &exportUntil)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", "", nil
+		}
+		return "", "", "", err
+	}
+
+	return status, graceUntil, exportUntil.String, nil
+}
+
+// GetUnregRequests returns all unregistration requests for workspaces in a hosted domain, ordered
+// by the end of their grace periods
+func GetUnregRequests(domain string) ([]UnregRequest, error) {
+	return getUnregRequests(dbConn, domain)
+}
+
+func getUnregRequests(db queryer, domain string) ([]UnregRequest, error) {
+	out := make([]UnregRequest, 0)
+	rows, err := db.Query(`SELECT u.wid,u.status,u.grace_until,u.export_until `+
+		`FROM unregrequests u JOIN workspaces w ON u.wid=w.wid WHERE w.domain=$1 `+
+		`ORDER BY u.grace_until,u.wid`, domain)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var request UnregRequest
+		var exportUntil sql.NullString
+		err = rows.Scan(&request.WID, &request.Status, &request.GraceUntil, &exportUntil)
+		if err != nil {
+			return out, err
+		}
+		request.ExportUntil = exportUntil.String
+		out = append(out, request)
+	}
+	return out, rows.Err()
+}
+
+// ApproveUnregRequest marks a workspace's unregistration request as approved. The workspace will
+// be removed by the server once exportUntil has passed, giving the user time to export their data.
+func ApproveUnregRequest(wid string, exportUntil string) error {
+	return approveUnregRequest(dbConn, wid, exportUntil)
+}
+
+func approveUnregRequest(db queryer, wid string, exportUntil string) error {
+	_, err := db.Exec(`UPDATE unregrequests SET status='approved',export_until=$1 `+
+		`WHERE wid=$2`, exportUntil, wid)
+	return err
+}
+
+// DeleteUnregRequest removes a workspace's unregistration request, either because it was
+// canceled or rejected or because the workspace has been removed.
+func DeleteUnregRequest(wid string) error {
+	return deleteUnregRequest(dbConn, wid)
+}
+
+func deleteUnregRequest(db queryer, wid string) error {
+	_, err := db.Exec(`DELETE FROM unregrequests WHERE wid=$1`, wid)
+	return err
+}
+
+// GetExpiredUnregRequests returns the workspace IDs of all approved unregistration requests whose
+// data export window has closed.
+func GetExpiredUnregRequests() ([]string, error) {
+	return getExpiredUnregRequests(dbConn)
+}
+
+func getExpiredUnregRequests(db queryer) ([]string, error) {
+	out := make([]string, 0, 10)
+	rows, err := db.Query(`SELECT wid FROM unregrequests WHERE status='approved' `+
+		`AND export_until < $1`, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var wid string
+		err := rows.Scan(&wid)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, wid)
+	}
+	return out, nil
+}
+
+// CheckWorkspace checks to see if a workspace exists. If the workspace does exist,
+// True is returned along with a string containing the workspace's status. If the
+// workspace does not exist, it returns false and an empty string. The workspace
+// status can be 'active', 'pending', or 'disabled'. Preregistered workspaces have the status
+// 'approved'. Note that this function does not check the validity of the WID string passed to it.
+// This should be done when the input is received from the user.
+func CheckWorkspace(wid string) (bool, string) {
+	return checkWorkspace(dbConn, wid)
+}
+
+func checkWorkspace(db queryer, wid string) (bool, string) {
+	row := db.QueryRow(`SELECT status FROM workspaces WHERE wid=$1`, wid)
+
+	var widStatus string
+	err := row.Scan(&widStatus)
+
+	switch {
+	case err == sql.ErrNoRows:
+		break
+	case err == nil:
+		return true, widStatus
+	case isDBError(err):
+		logging.Writef("dbhandler.CheckWorkspace: database error reading workspaces: %s",
+			err.Error())
+		return false, ""
+	default:
+		logging.Writef("dbhandler.CheckWorkspace: unexpected error reading workspaces: %s",
+			err.Error())
+		return false, ""
+	}
+
+	row = db.QueryRow(`SELECT wid FROM prereg WHERE wid=$1`, wid)
+	err = row.Scan(&widStatus)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return false, ""
+	case err == nil:
+		return true, "approved"
+	case isDBError(err):
+		logging.Writef("dbhandler.CheckWorkspace: database error reading prereg: %s",
+			err.Error())
+		return false, ""
+	default:
+		logging.Writef("dbhandler.CheckWorkspace: unexpected error reading prereg: %s",
+			err.Error())
+		return false, ""
+	}
+}
+
+// CheckUserID works the same as CheckWorkspace except that it checks for user IDs. Because each
+// hosted domain has its own set of user IDs, the domain must also be specified.
+func CheckUserID(uid string, domain string) (bool, string) {
+	return checkUserID(dbConn, uid, domain)
+}
+
+func checkUserID(db queryer, uid string, domain string) (bool, string) {
+	row := db.QueryRow(`SELECT status FROM workspaces WHERE uid=$1 AND domain=$2`, uid,
+		domain)
+
+	var widStatus string
+	err := row.Scan(&widStatus)
+
+	switch {
+	case err == sql.ErrNoRows:
+		break
+	case err == nil:
+		return true, widStatus
+	case isDBError(err):
+		logging.Writef("dbhandler.CheckUserID: database error reading workspaces: %s",
+			err.Error())
+		return false, ""
+	default:
+		logging.Writef("dbhandler.CheckUserID: unexpected error reading workspaces: %s",
+			err.Error())
+		return false, ""
+	}
+
+	row = db.QueryRow(`SELECT uid FROM prereg WHERE uid=$1 AND domain=$2`, uid, domain)
+	err = row.Scan(&widStatus)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return false, ""
+	case err == nil:
+		return true, "approved"
+	case isDBError(err):
+		logging.Writef("dbhandler.CheckUserID: database error reading prereg: %s",
+			err.Error())
+		return false, ""
+	default:
+		logging.Writef("dbhandler.CheckUserID: unexpected error reading prereg: %s",
+			err.Error())
+		return false, ""
+	}
+}
+
+// PreregWorkspace preregisters a workspace, adding a specified wid to the database and returns
+// a randomly-generated registration code needed to authenticate the first login. Registration
+// codes are stored in the clear, but that's merely because if an attacker already has access to
+// the server to see the codes, the attacker can easily create new workspaces.
+func PreregWorkspace(wid string, uid string, domain string, wordList *diceware.Wordlist,
+	wordcount int) (string, error) {
+	return preregWorkspace(dbConn, wid, uid, domain, wordList, wordcount)
+}
+
+func preregWorkspace(db queryer, wid string, uid string, domain string,
+	wordList *diceware.Wordlist, wordcount int) (string, error) {
+
+	if len(wid) > 36 || len(uid) > 128 {
+		return "", errors.New("Bad parameter length")
+	}
+
+	if len(uid) > 0 {
+		row := db.QueryRow(`SELECT uid FROM prereg WHERE uid=$1`, uid)
+		var hasuid string
+		err := row.Scan(&hasuid)
+
+		if hasuid != "" {
+			return "", errors.New("uid exists")
+		}
+
+		switch {
+		case err == sql.ErrNoRows:
+			break
+		case isDBError(err):
+			logging.Writef("dbhandler.PreregWorkspace: database error reading prereg: %s",
+				err.Error())
+			return "", err
+		default:
+			logging.Writef("dbhandler.PreregWorkspace: unexpected error reading prereg: %s",
+				err.Error())
+			return "", err
+		}
+	}
+
+	regcode, err := diceware.RollWords(wordcount, "-", *wordList)
+
+	_, err = db.Exec(`INSERT INTO prereg(wid, uid, domain, regcode) VALUES($1, $2, $3, $4)`,
+		wid, uid, domain, regcode)
+
+	return regcode, err
+}
+
+// CheckRegCode handles authenticating a host using a user/workspace ID and registration
 // code provided by PreregWorkspace. Based on authentication it either returns the workspace ID
 // (success) or an empty string (failure). An error is returned only if authentication was not
 // successful. The caller is still responsible for performing the necessary steps to add the
 // workspace to the database.
 func CheckRegCode(id string, domain string, iswid bool, regcode string) (string, string, error) {
+	return checkRegCode(dbConn, id, domain, iswid, regcode)
+}
+
+func checkRegCode(db queryer, id string, domain string, iswid bool,
+	regcode string) (string, string, error) {
 	var wid, uid string
 	if iswid {
-		row := dbConn.QueryRow(`SELECT wid,uid FROM prereg WHERE regcode = $1 AND domain = $2`,
+		row := db.QueryRow(`SELECT wid,uid FROM prereg WHERE regcode = $1 AND domain = $2`,
 			regcode, domain)
 		err := row.Scan(&wid, &uid)
 		if err != nil {
@@ -640,243 +1199,1007 @@ func CheckRegCode(id string, domain string, iswid bool, regcode string) (string,
 		return "", "", errors.New("wid mismatch")
 	}
 
-	row := dbConn.QueryRow(`SELECT wid,uid FROM prereg WHERE regcode = $1 AND uid = $2 `+
-		`AND domain = $3`, regcode, id, domain)
-	err := row.Scan(&wid, &uid)
+	row := db.QueryRow(`SELECT wid,uid FROM prereg WHERE regcode = $1 AND uid = $2 `+
+		`AND domain = $3`, regcode, id, domain)
+	err := row.Scan(&wid, &uid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// No entry in the table
+			return "", "", errors.New("regcode not found")
+		}
+		return "", "", err
+	}
+
+	return wid, uid, nil
+}
+
+// DeleteRegCode removes preregistration data from the database.
+func DeleteRegCode(id string, domain string, iswid bool, regcode string) error {
+	return deleteRegCode(dbConn, id, domain, iswid, regcode)
+}
+
+func deleteRegCode(db queryer, id string, domain string, iswid bool, regcode string) error {
+	var err error
+	if iswid {
+		_, err = db.Exec(`DELETE FROM prereg WHERE wid = $1 AND regcode = $2 AND domain = $3`,
+			id, regcode, domain)
+	} else {
+		_, err = db.Exec(`DELETE FROM prereg WHERE uid = $1 AND regcode = $2 AND domain = $3`,
+			id, regcode, domain)
+	}
+
+	return err
+}
+
+// GetOrgEntries pulls one or more entries for the organization keycard of a hosted domain from
+// the database. If an end index is not desired, set it to 0. Passing a starting index of 0 will
+// return the current entry for the organization.
+func GetOrgEntries(domain string, startIndex int, endIndex int) ([]string, error) {
+	return getOrgEntries(dbConn, domain, startIndex, endIndex)
+}
+
+func getOrgEntries(db queryer, domain string, startIndex int, endIndex int) ([]string, error) {
+	out := make([]string, 0, 10)
+
+	if startIndex < 1 {
+		// If given a 0 or negative number, we return just the current entry.
+		row := db.QueryRow(`SELECT entry FROM keycards WHERE owner = 'organization' `+
+			`AND domain = $1 ORDER BY "index" DESC LIMIT 1`, domain)
+
+		var entry string
+		err := row.Scan(&entry)
+		if err == nil {
+			out = append(out, entry)
+		}
+		return out, err
+
+	} else if endIndex >= 1 {
+		// Given both a start and end index
+		if endIndex < startIndex {
+			return out, nil
+		}
+		rows, err := db.Query(`SELECT entry FROM keycards WHERE owner = 'organization' `+
+			`AND domain = $1 AND "index" >= $2 AND "index" <= $3 ORDER BY "index"`, domain,
+			startIndex, endIndex)
+		if err != nil {
+			return out, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry string
+			err := rows.Scan(&entry)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, entry)
+		}
+
+	} else {
+		// Given just a start index
+		rows, err := db.Query(`SELECT entry FROM keycards WHERE owner = 'organization' `+
+			`AND domain = $1 AND "index" >= $2 ORDER BY "index"`, domain, startIndex)
+		if err != nil {
+			return out, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry string
+			err := rows.Scan(&entry)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, entry)
+		}
+
+	}
+	return out, nil
+}
+
+// GetUserEntries pulls one or more entries from the database. If an end index is not desired, set
+// it to 0. Passing a starting index of 0 will return the current entry for the workspace specified.
+func GetUserEntries(wid string, startIndex int, endIndex int) ([]string, error) {
+	return getUserEntries(dbConn, wid, startIndex, endIndex)
+}
+
+func getUserEntries(db queryer, wid string, startIndex int, endIndex int) ([]string, error) {
+	out := make([]string, 0, 10)
+
+	if startIndex < 1 {
+		// If given a 0 or negative number, we return just the current entry.
+		row := db.QueryRow(`SELECT entry FROM keycards WHERE owner = $1 `+
+			`ORDER BY "index" DESC LIMIT 1`, wid)
+
+		var entry string
+		err := row.Scan(&entry)
+		if err == nil {
+			out = append(out, entry)
+		}
+		return out, err
+
+	} else if endIndex >= 1 {
+		// Given both a start and end index
+		if endIndex < startIndex {
+			return out, nil
+		}
+		rows, err := db.Query(`SELECT entry FROM keycards WHERE owner = $1 `+
+			`AND "index" >= $2 AND "index" <= $3 ORDER BY "index"`, wid, startIndex, endIndex)
+		if err != nil {
+			return out, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry string
+			err := rows.Scan(&entry)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, entry)
+		}
+
+	} else {
+		// Given just a start index
+		rows, err := db.Query(`SELECT entry FROM keycards WHERE owner = $1 `+
+			`AND "index" >= $2 ORDER BY "index"`, wid, startIndex)
+		if err != nil {
+			return out, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry string
+			err := rows.Scan(&entry)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, entry)
+		}
+
+	}
+	return out, nil
+}
+
+// AddRevocation records the revocation of a workspace's keycard. All entries with an index at or
+// below the one given are considered revoked. The caller is responsible for creating and signing
+// the revocation record.
+func AddRevocation(wid string, index int, revoked string, record string) error {
+	return addRevocation(dbConn, wid, index, revoked, record)
+}
+
+func addRevocation(db queryer, wid string, index int, revoked string, record string) error {
+	_, err := db.Exec(`INSERT INTO revocations(wid, "index", revoked, record) `+
+		`VALUES($1, $2, $3, $4)`, wid, index, revoked, record)
+	return err
+}
+
+// GetRevocation returns the highest revoked entry index for a workspace's keycard and the
+// revocation record for it. If the keycard has never been revoked, 0 and an empty string are
+// returned.
+func GetRevocation(wid string) (int, string, error) {
+	return getRevocation(dbConn, wid)
+}
+
+func getRevocation(db queryer, wid string) (int, string, error) {
+	row := db.QueryRow(`SELECT "index", record FROM revocations WHERE wid=$1 `+
+		`ORDER BY "index" DESC LIMIT 1`, wid)
+
+	var index int
+	var record string
+	err := row.Scan(&index, &record)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, "", nil
+		}
+		return 0, "", err
+	}
+	return index, record, nil
+}
+
+// GetRevokedIndices returns the indices of all revocations of a workspace's keycard in ascending
+// order. The entry following each of these indices starts a new chain of trust.
+func GetRevokedIndices(wid string) ([]int, error) {
+	return getRevokedIndices(dbConn, wid)
+}
+
+func getRevokedIndices(db queryer, wid string) ([]int, error) {
+	out := make([]int, 0)
+	rows, err := db.Query(`SELECT "index" FROM revocations WHERE wid=$1 ORDER BY "index"`, wid)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var index int
+		err = rows.Scan(&index)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, index)
+	}
+	return out, nil
+}
+
+// CheckKeycardNotice returns true if an expiration notice of the specified type has already been
+// sent for a keycard entry. notice is either 'expiring' or 'expired'.
+func CheckKeycardNotice(domain string, owner string, index int, notice string) (bool, error) {
+	return checkKeycardNotice(dbConn, domain, owner, index, notice)
+}
+
+func checkKeycardNotice(db queryer, domain string, owner string, index int,
+	notice string) (bool, error) {
+	row := db.QueryRow(`SELECT rowid FROM keycardnotices WHERE domain=$1 AND owner=$2 `+
+		`AND "index"=$3 AND notice=$4`, strings.ToLower(domain), owner, index, notice)
+
+	var rowid int
+	err := row.Scan(&rowid)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	}
+	return false, err
+}
+
+// AddKeycardNotice records that an expiration notice has been sent for a keycard entry. Notices
+// for earlier entries of the same keycard are no longer needed and are removed.
+func AddKeycardNotice(domain string, owner string, index int, notice string) error {
+	return addKeycardNotice(dbConn, domain, owner, index, notice)
+}
+
+func addKeycardNotice(db queryer, domain string, owner string, index int, notice string) error {
+	domain = strings.ToLower(domain)
+	_, err := db.Exec(`DELETE FROM keycardnotices WHERE domain=$1 AND owner=$2 AND "index"<$3`,
+		domain, owner, index)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO keycardnotices(domain, owner, "index", notice, sent) `+
+		`VALUES($1, $2, $3, $4, $5)`, domain, owner, index, notice,
+		time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetKeycardOwners returns the workspace IDs of all user keycards stored for a hosted domain
+func GetKeycardOwners(domain string) ([]string, error) {
+	return getKeycardOwners(dbConn, domain)
+}
+
+func getKeycardOwners(db queryer, domain string) ([]string, error) {
+	out := make([]string, 0)
+	rows, err := db.Query(`SELECT DISTINCT owner FROM keycards WHERE domain=$1 `+
+		`AND owner != 'organization' ORDER BY owner`, strings.ToLower(domain))
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var owner string
+		err = rows.Scan(&owner)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, owner)
+	}
+	return out, nil
+}
+
+// GetRemoteKeycard looks up a cached keycard from another server. id may be 'organization', a
+// workspace ID, or a user ID. The workspace ID of the keycard's owner and the keycard's latest
+// revocation are returned. If the keycard is not in the cache or has expired, an empty owner is
+// returned.
+func GetRemoteKeycard(domain string, id string) (string, int, string, error) {
+	return getRemoteKeycard(dbConn, domain, id)
+}
+
+func getRemoteKeycard(db queryer, domain string, id string) (string, int, string, error) {
+	row := db.QueryRow(`SELECT owner, revoked_index, revocation FROM remotecards `+
+		`WHERE domain = $1 AND (owner = $2 OR uid = $2) AND expires > $3`,
+		strings.ToLower(domain), id, time.Now().UTC().Format(time.RFC3339))
+
+	var owner string
+	var revokedIndex int
+	var revocation sql.NullString
+	err := row.Scan(&owner, &revokedIndex, &revocation)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", 0, "", nil
+		}
+		return "", 0, "", err
+	}
+	return owner, revokedIndex, revocation.String, nil
+}
+
+// GetRemoteEntries pulls entries for a cached keycard from another server. The indices work the
+// same as for GetUserEntries.
+func GetRemoteEntries(domain string, owner string, startIndex int, endIndex int) ([]string, error) {
+	return getRemoteEntries(dbConn, domain, owner, startIndex, endIndex)
+}
+
+func getRemoteEntries(db queryer, domain string, owner string, startIndex int,
+	endIndex int) ([]string, error) {
+	out := make([]string, 0, 10)
+	domain = strings.ToLower(domain)
+
+	var rows *dbRows
+	var err error
+	if startIndex < 1 {
+		rows, err = db.Query(`SELECT entry FROM remoteentries WHERE domain = $1 `+
+			`AND owner = $2 ORDER BY "index" DESC LIMIT 1`, domain, owner)
+	} else if endIndex >= 1 {
+		if endIndex < startIndex {
+			return out, nil
+		}
+		rows, err = db.Query(`SELECT entry FROM remoteentries WHERE domain = $1 `+
+			`AND owner = $2 AND "index" >= $3 AND "index" <= $4 ORDER BY "index"`, domain, owner,
+			startIndex, endIndex)
+	} else {
+		rows, err = db.Query(`SELECT entry FROM remoteentries WHERE domain = $1 `+
+			`AND owner = $2 AND "index" >= $3 ORDER BY "index"`, domain, owner, startIndex)
+	}
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry string
+		err = rows.Scan(&entry)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, entry)
+	}
+	return out, nil
+}
+
+// SetRemoteKeycard replaces the cached copy of a keycard from another server in one transaction,
+// so readers see either the old copy or the new one. entries must be the entire chain of the
+// keycard in order. The caller is responsible for verifying the keycard before caching it.
+func SetRemoteKeycard(domain string, owner string, uid string, entries []string,
+	revokedIndex int, revocation string, expires string) error {
+	return setRemoteKeycard(dbConn, domain, owner, uid, entries, revokedIndex, revocation, expires)
+}
+
+func setRemoteKeycard(db *database, domain string, owner string, uid string, entries []string,
+	revokedIndex int, revocation string, expires string) error {
+	domain = strings.ToLower(domain)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM remotecards WHERE domain = $1 AND owner = $2`, domain, owner)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM remoteentries WHERE domain = $1 AND owner = $2`, domain, owner)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO remotecards(domain, owner, uid, revoked_index, revocation, `+
+		`expires) VALUES($1, $2, $3, $4, $5, $6)`, domain, owner, uid, revokedIndex, revocation,
+		expires)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		_, err = tx.Exec(`INSERT INTO remoteentries(domain, owner, "index", entry) `+
+			`VALUES($1, $2, $3, $4)`, domain, owner, i+1, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetLastEntry returns the last entry in the database
+func GetLastEntry() (string, error) {
+	row := dbConn.QueryRow(`SELECT entry FROM keycards ORDER BY rowid DESC LIMIT 1`)
+
+	var entry string
+	err := row.Scan(&entry)
+	return entry, err
+}
+
+// AddEntry adds an entry to the database and appends it to its domain's transparency log in the
+// same transaction, so an entry is never stored without being logged. If another entry is logged
+// at the same time, the loser's transaction fails on the log's unique position and nothing is
+// stored. The caller is responsible for validation of *ALL* data passed to this command.
+func AddEntry(entry *keycard.Entry) error {
+	return addEntry(dbConn, entry)
+}
+
+func addEntry(db *database, entry *keycard.Entry) error {
+	var owner string
+	if entry.Fields["Type"] == "Organization" {
+		owner = "organization"
+	} else {
+		owner = entry.Fields["Workspace-ID"]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO keycards(owner, creationtime, "index", entry, fingerprint, `+
+		`domain) VALUES($1, $2, $3, $4, $5, $6)`, owner, entry.Fields["Timestamp"],
+		entry.Fields["Index"], string(entry.MakeByteString(-1)), entry.Hash,
+		strings.ToLower(entry.Fields["Domain"]))
+	if err != nil {
+		return err
+	}
+	err = appendLogEntry(tx, strings.ToLower(entry.Fields["Domain"]), entry)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddOrgEntry adds a new entry to the organization keycard of a hosted domain and stores the keys
+// which belong to it. Keys from previous entries are kept so that older entries can still be
+// verified. The keys are expected to be in the format returned by keycard.Entry.Chain(). The entry,
+// its log record, and its keys are stored in one transaction. As with AddEntry, the caller is
+// responsible for validation of the entry.
+func AddOrgEntry(domain string, entry *keycard.Entry,
+	keys map[string]cryptostring.CryptoString) error {
+	return addOrgEntry(dbConn, domain, entry, keys)
+}
+
+func addOrgEntry(db *database, domain string, entry *keycard.Entry,
+	keys map[string]cryptostring.CryptoString) error {
+	domain = strings.ToLower(domain)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO keycards(owner, creationtime, "index", entry, fingerprint, `+
+		`domain) VALUES('organization', $1, $2, $3, $4, $5)`, entry.Fields["Timestamp"],
+		entry.Fields["Index"], string(entry.MakeByteString(-1)), entry.Hash, domain)
+	if err != nil {
+		return err
+	}
+
+	err = appendLogEntry(tx, domain, entry)
+	if err != nil {
+		return err
+	}
+
+	purposes := map[string]string{
+		"Primary-Verification-Key":   "sign",
+		"Secondary-Verification-Key": "altsign",
+		"Encryption-Key":             "encrypt",
+	}
+	for field, purpose := range purposes {
+		pubkey, ok := keys[field+".public"]
+		if !ok {
+			continue
+		}
+		privkey := keys[field+".private"]
+
+		sum := blake2b.Sum256([]byte(pubkey.Data))
+		fingerprint := "BLAKE2B-256:" + b85.Encode(sum[:])
+		sealed, err := sealOrgKey(privkey.AsString())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, `+
+			`fingerprint, domain) VALUES($1, $2, $3, $4, $5, $6)`, entry.Fields["Timestamp"],
+			pubkey.AsString(), sealed, purpose, fingerprint, domain)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// appendLogEntry adds a keycard entry to the end of the transparency log for a domain
+func appendLogEntry(db queryer, domain string, entry *keycard.Entry) error {
+	leafHash := translog.LeafHash(entry.MakeByteString(-1))
+	_, err := db.Exec(`INSERT INTO translog(domain, seq, fingerprint, leafhash) `+
+		`SELECT $1, COALESCE(MAX(seq) + 1, 0), $2, $3 FROM translog WHERE domain=$1`, domain,
+		entry.Hash, translog.HashAlgorithm+":"+b85.Encode(leafHash))
+	return err
+}
+
+// GetLogSize returns the number of entries in the keycard transparency log for a domain
+func GetLogSize(domain string) (int, error) {
+	return getLogSize(dbConn, domain)
+}
+
+func getLogSize(db queryer, domain string) (int, error) {
+	row := db.QueryRow(`SELECT COUNT(*) FROM translog WHERE domain=$1`, domain)
+
+	var size int
+	err := row.Scan(&size)
+	return size, err
+}
+
+// GetLogLeaves returns the leaf hashes of the first entries in the keycard transparency log for a
+// domain. If the log contains fewer entries than requested, all of them are returned.
+func GetLogLeaves(domain string, size int) ([][]byte, error) {
+	return getLogLeaves(dbConn, domain, size)
+}
+
+func getLogLeaves(db queryer, domain string, size int) ([][]byte, error) {
+	out := make([][]byte, 0, size)
+	rows, err := db.Query(`SELECT leafhash FROM translog WHERE domain=$1 AND seq < $2 `+
+		`ORDER BY seq`, domain, size)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var leafString string
+		err := rows.Scan(&leafString)
+		if err != nil {
+			return out, err
+		}
+
+		var leafHash cryptostring.CryptoString
+		err = leafHash.Set(leafString)
+		if err != nil || leafHash.RawData() == nil {
+			return out, fmt.Errorf("bad leaf hash %s in transparency log", leafString)
+		}
+		out = append(out, leafHash.RawData())
+	}
+	return out, nil
+}
+
+// GetLogIndex returns the position of a keycard entry in the transparency log for a domain given
+// the entry's hash. -1 is returned if the entry is not in the log.
+func GetLogIndex(domain string, fingerprint string) (int, error) {
+	return getLogIndex(dbConn, domain, fingerprint)
+}
+
+func getLogIndex(db queryer, domain string, fingerprint string) (int, error) {
+	row := db.QueryRow(`SELECT seq FROM translog WHERE domain=$1 AND fingerprint=$2`, domain,
+		fingerprint)
+
+	var index int
+	err := row.Scan(&index)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return -1, nil
+		}
+		return -1, err
+	}
+	return index, nil
+}
+
+// GetPrimarySigningKey obtains the primary signing key for a hosted domain's organization as a
+// CryptoString
+func GetPrimarySigningKey(domain string) (string, error) {
+	return getPrimarySigningKey(dbConn, domain)
+}
+
+func getPrimarySigningKey(db queryer, domain string) (string, error) {
+	row := db.QueryRow(`SELECT privkey FROM orgkeys WHERE purpose = 'sign' AND domain = $1 `+
+		`ORDER BY rowid DESC LIMIT 1`, domain)
+
+	var psk string
+	err := row.Scan(&psk)
+	if err == nil {
+		return openOrgKey(psk)
+	}
+	return "", err
+}
+
+// GetEncryptionPair returns the encryption keypair for a hosted domain's organization as an
+// EncryptionPair
+func GetEncryptionPair(domain string) (*ezcrypt.EncryptionPair, error) {
+	return getEncryptionPair(dbConn, domain)
+}
+
+func getEncryptionPair(db queryer, domain string) (*ezcrypt.EncryptionPair, error) {
+	row := db.QueryRow(`SELECT pubkey,privkey FROM orgkeys WHERE purpose = 'encrypt' `+
+		`AND domain = $1 ORDER BY rowid DESC LIMIT 1`, domain)
+
+	var pubkey, privkey string
+	err := row.Scan(&pubkey, &privkey)
+	if err != nil {
+		return nil, err
+	}
+
+	privkey, err = openOrgKey(privkey)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// No entry in the table
-			return "", "", errors.New("regcode not found")
-		}
-		return "", "", err
+		return nil, err
 	}
+	keypair := ezcrypt.NewEncryptionPair(cryptostring.New(pubkey),
+		cryptostring.New(privkey))
+	return keypair, nil
+}
 
-	return wid, uid, nil
+// Organization private keys are stored wrapped with a key-encryption key (KEK) which is kept
+// outside of the database and unlocked when the server starts. Keys which were stored before a
+// KEK was configured remain readable and are wrapped once it is unlocked.
+
+// ErrOrgKeysLocked is returned when a wrapped organization key is needed but no key-encryption
+// key has been unlocked
+var ErrOrgKeysLocked = errors.New("organization keys locked")
+
+// ErrWrongKEK is returned when the key-encryption key given to UnlockOrgKeys is not the one used
+// to wrap the organization keys
+var ErrWrongKEK = errors.New("incorrect key-encryption key")
+
+// orgKEK is the key-encryption key for organization private keys. Its prefix is empty if the keys
+// are stored unencrypted.
+var orgKEK cryptostring.CryptoString
+
+// kekCheckValue is wrapped with the key-encryption key and stored so that using the wrong key can
+// be detected before any organization keys are touched
+var kekCheckValue = cryptostring.New("KEK-CHECK:" + b85.Encode([]byte("mensagod")))
+
+// withQueryTimeout returns the connection with a context which ends after the query timeout. It is
+// for work done outside of a client session, such as unlocking the organization keys when the
+// server starts, so that an unresponsive database can't hang it, including while a transaction is
+// started or committed. The cancel function must be called once the work is done.
+func withQueryTimeout() (*database, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	return dbConn.WithContext(ctx), cancel
 }
 
-// DeleteRegCode removes preregistration data from the database.
-func DeleteRegCode(id string, domain string, iswid bool, regcode string) error {
+// GetKEKSalt returns the salt used to derive the key-encryption key from a passphrase. A random
+// salt is created the first time this is called.
+func GetKEKSalt() ([]byte, error) {
+	db, cancel := withQueryTimeout()
+	defer cancel()
+	return getKEKSalt(db)
+}
 
-	var err error
-	if iswid {
-		_, err = dbConn.Exec(`DELETE FROM prereg WHERE wid = $1 AND regcode = $2 AND domain = $3`,
-			id, regcode, domain)
-	} else {
-		_, err = dbConn.Exec(`DELETE FROM prereg WHERE uid = $1 AND regcode = $2 AND domain = $3`,
-			id, regcode, domain)
+func getKEKSalt(db queryer) ([]byte, error) {
+	row := db.QueryRow(`SELECT salt FROM orgkeywrap LIMIT 1`)
+
+	var salt string
+	err := row.Scan(&salt)
+	if err == nil {
+		return b85.Decode(salt)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
 	}
 
-	return err
+	newSalt := make([]byte, 16)
+	_, err = rand.Read(newSalt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`INSERT INTO orgkeywrap(salt) VALUES($1)`, b85.Encode(newSalt))
+	return newSalt, err
 }
 
-// GetOrgEntries pulls one or more entries from the database. If an end index is not desired, set
-// it to 0. Passing a starting index of 0 will return the current entry for the organization.
-func GetOrgEntries(startIndex int, endIndex int) ([]string, error) {
-	out := make([]string, 0, 10)
+// OrgKeysWrapped returns true if the organization private keys have been wrapped with a
+// key-encryption key, in which case one must be unlocked before they can be used
+func OrgKeysWrapped() (bool, error) {
+	db, cancel := withQueryTimeout()
+	defer cancel()
+	return orgKeysWrapped(db)
+}
 
-	if startIndex < 1 {
-		// If given a 0 or negative number, we return just the current entry.
-		row := dbConn.QueryRow(`SELECT entry FROM keycards WHERE owner = 'organization' ` +
-			`ORDER BY index DESC LIMIT 1`)
+func orgKeysWrapped(db queryer) (bool, error) {
+	row := db.QueryRow(`SELECT verifier FROM orgkeywrap LIMIT 1`)
+	var verifier sql.NullString
+	err := row.Scan(&verifier)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return verifier.Valid, err
+}
 
-		var entry string
-		err := row.Scan(&entry)
-		if err == nil {
-			out = append(out, entry)
-		}
-		return out, err
+// UnlockOrgKeys sets the key-encryption key used for organization private keys. ErrWrongKEK is
+// returned if the keys have already been wrapped with a different key. Any keys which are still
+// stored unencrypted are wrapped with the new key.
+func UnlockOrgKeys(kek cryptostring.CryptoString) error {
+	db, cancel := withQueryTimeout()
+	defer cancel()
+	return unlockOrgKeys(db, kek)
+}
 
-	} else if endIndex >= 1 {
-		// Given both a start and end index
-		if endIndex < startIndex {
-			return out, nil
+func unlockOrgKeys(db *database, kek cryptostring.CryptoString) error {
+	salt, err := getKEKSalt(db)
+	if err != nil {
+		return err
+	}
+
+	row := db.QueryRow(`SELECT verifier FROM orgkeywrap LIMIT 1`)
+	var verifier sql.NullString
+	err = row.Scan(&verifier)
+	if err != nil {
+		return err
+	}
+
+	if verifier.Valid {
+		_, err = ezcrypt.UnwrapKey(kek, cryptostring.New(verifier.String))
+		if err != nil {
+			return ErrWrongKEK
 		}
-		rows, err := dbConn.Query(`SELECT entry FROM keycards WHERE owner = 'organization' `+
-			`AND index >= $1 AND index <= $2 ORDER BY index`, startIndex, endIndex)
+		orgKEK = kek
+	} else {
+		// Keys have never been wrapped, so they are all wrapped now
+		err = rewrapOrgKeys(db, kek, salt)
 		if err != nil {
-			return out, err
+			return err
 		}
-		defer rows.Close()
+	}
 
-		for rows.Next() {
-			var entry string
-			err := rows.Scan(&entry)
-			if err != nil {
-				return out, err
-			}
-			out = append(out, entry)
-		}
+	// Keys added by tools which don't know about the KEK, such as setupconfig, are stored in the
+	// clear and need to be sealed
+	rows, err := db.Query(`SELECT rowid, privkey FROM orgkeys WHERE privkey NOT LIKE $1`,
+		ezcrypt.KeyWrapAlgorithm+":%")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-	} else {
-		// Given just a start index
-		rows, err := dbConn.Query(`SELECT entry FROM keycards WHERE owner = 'organization' `+
-			`AND index >= $1 ORDER BY index`, startIndex)
+	unsealed := make(map[int]string)
+	for rows.Next() {
+		var rowid int
+		var privkey string
+		err = rows.Scan(&rowid, &privkey)
 		if err != nil {
-			return out, err
+			return err
 		}
-		defer rows.Close()
+		unsealed[rowid] = privkey
+	}
 
-		for rows.Next() {
-			var entry string
-			err := rows.Scan(&entry)
-			if err != nil {
-				return out, err
-			}
-			out = append(out, entry)
+	for rowid, privkey := range unsealed {
+		sealed, err := sealOrgKey(privkey)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`UPDATE orgkeys SET privkey=$1 WHERE rowid=$2`, sealed, rowid)
+		if err != nil {
+			return err
 		}
-
 	}
-	return out, nil
+	return nil
 }
 
-// GetUserEntries pulls one or more entries from the database. If an end index is not desired, set
-// it to 0. Passing a starting index of 0 will return the current entry for the workspace specified.
-func GetUserEntries(wid string, startIndex int, endIndex int) ([]string, error) {
-	out := make([]string, 0, 10)
+// RewrapOrgKeys re-encrypts all organization private keys with a new key-encryption key. newSalt
+// is the salt used if the new key was derived from a passphrase. UnlockOrgKeys must have already
+// been called with the current key unless the keys are not yet wrapped. All keys are rewrapped or
+// none are.
+func RewrapOrgKeys(newKEK cryptostring.CryptoString, newSalt []byte) error {
+	db, cancel := withQueryTimeout()
+	defer cancel()
+	return rewrapOrgKeys(db, newKEK, newSalt)
+}
 
-	if startIndex < 1 {
-		// If given a 0 or negative number, we return just the current entry.
-		row := dbConn.QueryRow(`SELECT entry FROM keycards WHERE owner = $1 `+
-			`ORDER BY index DESC LIMIT 1`, wid)
+func rewrapOrgKeys(db *database, newKEK cryptostring.CryptoString, newSalt []byte) error {
+	verifier, err := ezcrypt.WrapKey(newKEK, kekCheckValue)
+	if err != nil {
+		return err
+	}
 
-		var entry string
-		err := row.Scan(&entry)
-		if err == nil {
-			out = append(out, entry)
-		}
-		return out, err
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	} else if endIndex >= 1 {
-		// Given both a start and end index
-		if endIndex < startIndex {
-			return out, nil
-		}
-		rows, err := dbConn.Query(`SELECT entry FROM keycards WHERE owner = $1 `+
-			`AND index >= $2 AND index <= $3 ORDER BY index`, wid, startIndex, endIndex)
+	rows, err := tx.Query(`SELECT rowid, privkey FROM orgkeys`)
+	if err != nil {
+		return err
+	}
+	keys := make(map[int]string)
+	for rows.Next() {
+		var rowid int
+		var privkey string
+		err = rows.Scan(&rowid, &privkey)
 		if err != nil {
-			return out, err
+			rows.Close()
+			return err
 		}
-		defer rows.Close()
+		keys[rowid] = privkey
+	}
+	rows.Close()
 
-		for rows.Next() {
-			var entry string
-			err := rows.Scan(&entry)
-			if err != nil {
-				return out, err
-			}
-			out = append(out, entry)
+	for rowid, privkey := range keys {
+		privkey, err = openOrgKey(privkey)
+		if err != nil {
+			return err
 		}
-
-	} else {
-		// Given just a start index
-		rows, err := dbConn.Query(`SELECT entry FROM keycards WHERE owner = $1 `+
-			`AND index >= $2 ORDER BY index`, wid, startIndex)
+		wrapped, err := ezcrypt.WrapKey(newKEK, cryptostring.New(privkey))
 		if err != nil {
-			return out, err
+			return err
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var entry string
-			err := rows.Scan(&entry)
-			if err != nil {
-				return out, err
-			}
-			out = append(out, entry)
+		_, err = tx.Exec(`UPDATE orgkeys SET privkey=$1 WHERE rowid=$2`, wrapped.AsString(),
+			rowid)
+		if err != nil {
+			return err
 		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM orgkeywrap`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO orgkeywrap(salt, verifier) VALUES($1, $2)`,
+		b85.Encode(newSalt), verifier.AsString())
+	if err != nil {
+		return err
+	}
 
+	err = tx.Commit()
+	if err == nil {
+		orgKEK = newKEK
 	}
-	return out, nil
+	return err
 }
 
-// GetLastEntry returns the last entry in the database
-func GetLastEntry() (string, error) {
-	row := dbConn.QueryRow(`SELECT entry FROM keycards ORDER BY rowid DESC LIMIT 1`)
+// sealOrgKey prepares an organization private key for storage in the database
+func sealOrgKey(key string) (string, error) {
+	if orgKEK.Prefix == "" {
+		return key, nil
+	}
+	wrapped, err := ezcrypt.WrapKey(orgKEK, cryptostring.New(key))
+	if err != nil {
+		return "", err
+	}
+	return wrapped.AsString(), nil
+}
 
-	var entry string
-	err := row.Scan(&entry)
-	return entry, err
+// openOrgKey returns the CryptoString for an organization private key as stored in the database
+func openOrgKey(stored string) (string, error) {
+	if !strings.HasPrefix(stored, ezcrypt.KeyWrapAlgorithm+":") {
+		return stored, nil
+	}
+	if orgKEK.Prefix == "" {
+		return "", ErrOrgKeysLocked
+	}
+	key, err := ezcrypt.UnwrapKey(orgKEK, cryptostring.New(stored))
+	if err != nil {
+		return "", err
+	}
+	return key.AsString(), nil
 }
 
-// AddEntry adds an entry to the database. The caller is responsible for validation of *ALL* data
-// passed to this command.
-func AddEntry(entry *keycard.Entry) error {
-	var owner string
-	if entry.Fields["Type"] == "Organization" {
-		owner = "organization"
-	} else {
-		owner = entry.Fields["Workspace-ID"]
+// ErrUserIDExists is returned by AddAlias when the alias' user ID or workspace ID is already in use
+var ErrUserIDExists = errors.New("user ID exists")
+
+// AddAlias creates an alias workspace which forwards to the specified target workspace. Like any
+// other workspace, the alias has its own WID and user ID. ErrUserIDExists is returned if either
+// is already taken.
+func AddAlias(aliasWid string, uid string, domain string, target string) error {
+	return addAlias(dbConn, aliasWid, uid, domain, target)
+}
+
+func addAlias(db *database, aliasWid string, uid string, domain string, target string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	var err error
-	_, err = dbConn.Exec(`INSERT INTO keycards(owner, creationtime, index, entry, fingerprint) `+
-		`VALUES($1, $2, $3, $4, $5)`, owner, entry.Fields["Timestamp"], entry.Fields["Index"],
-		string(entry.MakeByteString(-1)), entry.Hash)
-	return err
+	// The caller checks for these, too, but another request may have taken the IDs since then.
+	// The unique index on user IDs catches anything which slips through on PostgreSQL.
+	exists, _ := checkWorkspace(tx, aliasWid)
+	if !exists {
+		exists, _ = checkUserID(tx, uid, domain)
+	}
+	if exists {
+		return ErrUserIDExists
+	}
+
+	_, err = tx.Exec(`INSERT INTO workspaces(wid, uid, domain, password, status, wtype) `+
+		`VALUES($1, $2, $3, '-', 'active', 'alias')`, aliasWid, uid, domain)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO aliases(wid, alias) VALUES($1, $2)`, aliasWid,
+		target+"/"+domain)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// GetPrimarySigningKey obtains the organization's primary signing key as an CryptoString
-func GetPrimarySigningKey() (string, error) {
-	row := dbConn.QueryRow(`SELECT privkey FROM orgkeys WHERE purpose = 'sign' ` +
-		`ORDER BY rowid DESC LIMIT 1`)
+// RemoveAlias deletes an alias. As with RemoveWorkspace, the alias' WID and user ID remain in the
+// database so that they are not reused.
+func RemoveAlias(aliasWid string) error {
+	return removeAlias(dbConn, aliasWid)
+}
 
-	var psk string
-	err := row.Scan(&psk)
-	if err == nil {
-		return psk, nil
+func removeAlias(db *database, aliasWid string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
-	return "", err
+	defer tx.Rollback()
+
+	var sqlCommands = []string{
+		`UPDATE workspaces SET status='deleted' WHERE wid=$1 AND wtype='alias'`,
+		`DELETE FROM aliases WHERE wid=$1`,
+	}
+	for _, sqlCmd := range sqlCommands {
+		_, err := tx.Exec(sqlCmd, aliasWid)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-// GetEncryptionPair returns the organization's encryption keypair as an EncryptionPair
-func GetEncryptionPair() (*ezcrypt.EncryptionPair, error) {
-	row := dbConn.QueryRow(`SELECT pubkey,privkey FROM orgkeys WHERE purpose = 'encrypt' ` +
-		`ORDER BY rowid DESC LIMIT 1`)
+// GetAliasTarget returns the WID of the workspace which an alias points to. An empty string is
+// returned if the workspace is not an alias.
+func GetAliasTarget(aliasWid string) (string, error) {
+	return getAliasTarget(dbConn, aliasWid)
+}
 
-	var pubkey, privkey string
-	err := row.Scan(&pubkey, &privkey)
-	if err == nil {
-		keypair := ezcrypt.NewEncryptionPair(cryptostring.New(pubkey),
-			cryptostring.New(privkey))
-		return keypair, nil
+func getAliasTarget(db queryer, aliasWid string) (string, error) {
+	row := db.QueryRow(`SELECT alias FROM aliases WHERE wid=$1`, aliasWid)
+
+	var target string
+	err := row.Scan(&target)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
 	}
-	return nil, err
+
+	return strings.Split(strings.TrimSpace(target), "/")[0], nil
 }
 
-// GetAliases returns a StringList containing the aliases pointing to the specified WID
+// GetAliases returns a StringList containing the addresses of the aliases pointing to the
+// specified WID
 func GetAliases(wid string) (gostringlist.StringList, error) {
+	return getAliases(dbConn, wid)
+}
+
+func getAliases(db queryer, wid string) (gostringlist.StringList, error) {
 	var out gostringlist.StringList
-	rows, err := dbConn.Query(`SELECT alias FROM alias WHERE wid=$1`, wid)
+	rows, err := db.Query(`SELECT workspaces.uid,workspaces.domain FROM aliases `+
+		`JOIN workspaces ON aliases.wid=workspaces.wid `+
+		`WHERE aliases.alias LIKE $1 AND workspaces.status!='deleted'`, wid+"/%")
 	if err != nil {
 		return out, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var entry string
-		err := rows.Scan(&entry)
+		var uid, domain string
+		err := rows.Scan(&uid, &domain)
 		if err != nil {
 			return out, err
 		}
-		out.Append(entry)
+		out.Append(uid + "/" + domain)
 	}
 	return out, nil
 }
 
 // IsAlias returns a bool if the specified workspace is an alias or a real account
 func IsAlias(wid string) (bool, error) {
-	row := dbConn.QueryRow(`SELECT alias FROM aliases WHERE wid=$1`, wid)
+	return isAlias(dbConn, wid)
+}
+
+func isAlias(db queryer, wid string) (bool, error) {
+	row := db.QueryRow(`SELECT alias FROM aliases WHERE wid=$1`, wid)
 
 	var alias string
 	err := row.Scan(&alias)
 
-	switch err {
-	case sql.ErrNoRows:
+	switch {
+	case err == sql.ErrNoRows:
 		break
-	case nil:
+	case err == nil:
 		return true, nil
-	case err.(*pq.Error):
-		logging.Writef("dbhandler.IsAlias: PostgreSQL error: %s", err.Error())
+	case isDBError(err):
+		logging.Writef("dbhandler.IsAlias: database error: %s", err.Error())
 		return false, err
 	default:
 		return false, err
@@ -886,25 +2209,29 @@ func IsAlias(wid string) (bool, error) {
 
 // GetQuotaInfo returns the disk usage and quota size of a workspace in bytes
 func GetQuotaInfo(wid string) (uint64, uint64, error) {
-	row := dbConn.QueryRow(`SELECT usage,quota FROM quotas WHERE wid=$1`, wid)
+	return getQuotaInfo(dbConn, wid)
+}
+
+func getQuotaInfo(db queryer, wid string) (uint64, uint64, error) {
+	row := db.QueryRow(`SELECT usage,quota FROM quotas WHERE wid=$1`, wid)
 
 	var dbUsage, dbQuota int64
 	var outUsage, outQuota uint64
 	err := row.Scan(&dbUsage, &dbQuota)
 
-	switch err {
-	case sql.ErrNoRows:
+	switch {
+	case err == sql.ErrNoRows:
 		outUsage, err = fshandler.GetFSProvider().GetDiskUsage(wid)
 		if err != nil {
 			return 0, 0, err
 		}
-		return outUsage, outQuota, SetQuotaUsage(wid, outUsage)
-	case nil:
+		return outUsage, outQuota, setQuotaUsage(db, wid, outUsage)
+	case err == nil:
 		if dbUsage >= 0 {
 			return uint64(dbUsage), uint64(dbQuota), nil
 		}
-	case err.(*pq.Error):
-		logging.Writef("dbhandler.GetQuotaUsage: PostgreSQL error: %s", err.Error())
+	case isDBError(err):
+		logging.Writef("dbhandler.GetQuotaUsage: database error: %s", err.Error())
 		return 0, 0, err
 	default:
 		logging.Writef("dbhandler.GetQuotaUsage: unexpected error: %s", err.Error())
@@ -917,43 +2244,47 @@ func GetQuotaInfo(wid string) (uint64, uint64, error) {
 	}
 
 	sqlStatement := `INSERT INTO quotas(wid, usage, quota)	VALUES($1, $2, $3)`
-	_, err = dbConn.Exec(sqlStatement, wid, outUsage,
-		viper.GetInt64("global.default_quota")*1_048_576)
+	_, err = db.Exec(sqlStatement, wid, outUsage,
+		getDefaultQuota(db, wid))
 	if err != nil {
 		logging.Writef("dbhandler.GetQuotaUsage: failed to add quota entry to table: %s",
 			err.Error())
 	}
 
-	return outUsage, outQuota, SetQuotaUsage(wid, outUsage)
+	return outUsage, outQuota, setQuotaUsage(db, wid, outUsage)
 }
 
 // ModifyQuotaUsage modifies the disk usage by a relative amount, specified in bytes. Note that if
 func ModifyQuotaUsage(wid string, amount int64) (uint64, error) {
-	row := dbConn.QueryRow(`SELECT usage FROM quotas WHERE wid=$1`, wid)
+	return modifyQuotaUsage(dbConn, wid, amount)
+}
+
+func modifyQuotaUsage(db queryer, wid string, amount int64) (uint64, error) {
+	row := db.QueryRow(`SELECT usage FROM quotas WHERE wid=$1`, wid)
 
 	var dbUsage int64
 	var out uint64
 	err := row.Scan(&dbUsage)
 
-	switch err {
-	case sql.ErrNoRows:
+	switch {
+	case err == sql.ErrNoRows:
 		out, err = fshandler.GetFSProvider().GetDiskUsage(wid)
 		if err != nil {
 			return 0, err
 		}
 
 		sqlStatement := `INSERT INTO quotas(wid, usage, quota)	VALUES($1, $2, $3)`
-		_, err = dbConn.Exec(sqlStatement, wid, out,
-			viper.GetInt64("global.default_quota")*1_048_576)
+		_, err = db.Exec(sqlStatement, wid, out,
+			getDefaultQuota(db, wid))
 		if err != nil {
 			logging.Writef("dbhandler.ModifyQuotaUsage: failed to add quota entry to table: %s",
 				err.Error())
 		}
-		return out, SetQuotaUsage(wid, out)
-	case nil:
+		return out, setQuotaUsage(db, wid, out)
+	case err == nil:
 		// Keep going
-	case err.(*pq.Error):
-		logging.Writef("dbhandler.ModifyQuotaUsage: PostgreSQL error: %s", err.Error())
+	case isDBError(err):
+		logging.Writef("dbhandler.ModifyQuotaUsage: database error: %s", err.Error())
 		return 0, err
 	default:
 		logging.Writef("dbhandler.ModifyQuotaUsage: unexpected error: %s", err.Error())
@@ -968,20 +2299,41 @@ func ModifyQuotaUsage(wid string, amount int64) (uint64, error) {
 		if err != nil {
 			return 0, err
 		}
-		return out, SetQuotaUsage(wid, out)
+		return out, setQuotaUsage(db, wid, out)
 	}
 
 	newTotal := dbUsage + amount
 	if newTotal < 0 {
 		newTotal = 0
 	}
-	return uint64(newTotal), SetQuotaUsage(wid, uint64(newTotal))
+	return uint64(newTotal), setQuotaUsage(db, wid, uint64(newTotal))
+}
+
+// getDefaultQuota returns the default quota, in bytes, for the domain a workspace belongs to
+func getDefaultQuota(db queryer, wid string) int64 {
+	domain, err := getWorkspaceDomain(db, wid)
+	if err != nil {
+		domain = ""
+	}
+	return defaultDomainQuota(domain)
+}
+
+// defaultDomainQuota returns the default quota, in bytes, for workspaces in a domain
+func defaultDomainQuota(domain string) int64 {
+	if dc, ok := config.GetDomain(domain); ok {
+		return dc.DefaultQuota * 1_048_576
+	}
+	return viper.GetInt64("global.default_quota") * 1_048_576
 }
 
 // ResetQuotaUsage resets the disk quota usage count in the database for all workspaces
 func ResetQuotaUsage() error {
+	return resetQuotaUsage(dbConn)
+}
+
+func resetQuotaUsage(db queryer) error {
 	sqlStatement := `UPDATE quotas SET usage=-1`
-	_, err := dbConn.Exec(sqlStatement)
+	_, err := db.Exec(sqlStatement)
 	if err != nil {
 		logging.Write("dbhandler.ResetQuotaUsage: failed to update reset disk quotas")
 		return err
@@ -991,8 +2343,12 @@ func ResetQuotaUsage() error {
 
 // SetQuota sets the disk quota for a workspace to the specified number of bytes
 func SetQuota(wid string, quota uint64) error {
+	return setQuota(dbConn, wid, quota)
+}
+
+func setQuota(db queryer, wid string, quota uint64) error {
 	sqlStatement := `UPDATE quotas SET quota=$1 WHERE wid=$2`
-	result, err := dbConn.Exec(sqlStatement, quota, wid)
+	result, err := db.Exec(sqlStatement, quota, wid)
 	if err != nil {
 		logging.Writef("dbhandler.SetQuota: failed to update quota for %s: %s", wid, err.Error())
 		return err
@@ -1005,7 +2361,7 @@ func SetQuota(wid string, quota uint64) error {
 			return err
 		}
 		sqlStatement := `INSERT INTO quotas(wid, usage, quota)	VALUES($1, $2, $3)`
-		_, err = dbConn.Exec(sqlStatement, wid, usage, quota)
+		_, err = db.Exec(sqlStatement, wid, usage, quota)
 		if err != nil {
 			logging.Writef("dbhandler.SetQuota: failed to add quota entry to table: %s",
 				err.Error())
@@ -1019,8 +2375,12 @@ func SetQuota(wid string, quota uint64) error {
 // usage has not been updated since boot, the total is ignored and the actual value from disk
 // is used.
 func SetQuotaUsage(wid string, total uint64) error {
+	return setQuotaUsage(dbConn, wid, total)
+}
+
+func setQuotaUsage(db queryer, wid string, total uint64) error {
 	sqlStatement := `UPDATE quotas SET usage=$1 WHERE wid=$2`
-	result, err := dbConn.Exec(sqlStatement, total, wid)
+	result, err := db.Exec(sqlStatement, total, wid)
 	if err != nil {
 		logging.Writef("dbhandler.SetQuotaUsage: failed to update quota for %s: %s", wid,
 			err.Error())
@@ -1035,8 +2395,8 @@ func SetQuotaUsage(wid string, total uint64) error {
 		}
 
 		sqlStatement := `INSERT INTO quotas(wid, usage, quota)	VALUES($1, $2, $3)`
-		_, err = dbConn.Exec(sqlStatement, wid, usage,
-			viper.GetInt64("global.default_quota")*1_048_576)
+		_, err = db.Exec(sqlStatement, wid, usage,
+			getDefaultQuota(db, wid))
 		if err != nil {
 			logging.Writef("dbhandler.SetQuotaUsage: failed to add quota entry to table: %s",
 				err.Error())
@@ -1,18 +1,25 @@
 package dbhandler
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/ezcrypt"
 	"github.com/darkwyrm/mensagod/fshandler"
+	"github.com/darkwyrm/mensagod/keycard"
 	"github.com/google/uuid"
+	"github.com/spf13/viper"
 )
 
 // setupTest initializes the global config and resets the database
@@ -31,19 +38,56 @@ func setupTest() error {
 	return nil
 }
 
-// resetDatabase empties out the workspace directory to make sure it's ready for a filesystem
-// test. Because the workspace directory may have special permissions set on it, we can't just
-// delete the directory and recreate it--we have to actually empty the directory.
+// resetDatabase drops all tables in the database and creates them again with the migrations for
+// the configured engine, so the tests use the same schema as a server
 func resetDatabase() error {
-	data, err := ioutil.ReadFile("psql_schema.sql")
+	err := dropTables()
 	if err != nil {
 		return err
 	}
 
-	_, err = dbConn.Exec(string(data))
+	_, err = Migrate()
 	return err
 }
 
+// dropTables drops all tables in the database
+func dropTables() error {
+	if viper.GetString("database.engine") != "sqlite" {
+		_, err := dbConn.Exec(`DO $$ DECLARE
+			r RECORD;
+		BEGIN
+			FOR r IN (SELECT tablename FROM pg_tables WHERE schemaname = current_schema()) LOOP
+				EXECUTE 'DROP TABLE IF EXISTS ' || quote_ident(r.tablename) || ' CASCADE';
+			END LOOP;
+		END $$;`)
+		return err
+	}
+
+	rows, err := dbConn.Query(`SELECT name FROM sqlite_master WHERE type='table'`)
+	if err != nil {
+		return err
+	}
+	tables := make([]string, 0)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		_, err = dbConn.Exec(`DROP TABLE ` + table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // resetWorkspaceDir empties out the workspace directory to make sure it's ready for a filesystem
 // test. Because the workspace directory may have special permissions set on it, we can't just
 // delete the directory and recreate it--we have to actually empty the directory.
@@ -287,6 +331,57 @@ func TestDBHandler_GetQuotaInfo(t *testing.T) {
 	}
 }
 
+func TestDBHandler_HasRole(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_HasRole: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+
+	// Subtest #1: No roles granted
+
+	granted, err := HasRole(wid, "registrar")
+	if err != nil {
+		t.Fatalf("TestDBHandler_HasRole: #1: failed to check role: %s", err)
+	}
+	if granted {
+		t.Fatal("TestDBHandler_HasRole: #1: reported an ungranted role")
+	}
+
+	// Subtest #2: Granted roles, including a duplicate grant
+
+	for _, role := range []string{"registrar", "auditor", "registrar"} {
+		err = AddRole(wid, role)
+		if err != nil {
+			t.Fatalf("TestDBHandler_HasRole: #2: failed to add role %s: %s", role, err)
+		}
+	}
+
+	granted, err = HasRole(wid, "registrar")
+	if err != nil || !granted {
+		t.Fatal("TestDBHandler_HasRole: #2: failed to report a granted role")
+	}
+
+	roles, err := GetRoles(wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_HasRole: #2: failed to get roles: %s", err)
+	}
+	if roles.Join(",") != "auditor,registrar" {
+		t.Fatalf("TestDBHandler_HasRole: #2: bad role list %s", roles.Join(","))
+	}
+
+	// Subtest #3: Revoked role
+
+	err = RemoveRole(wid, "registrar")
+	if err != nil {
+		t.Fatalf("TestDBHandler_HasRole: #3: failed to remove role: %s", err)
+	}
+	granted, err = HasRole(wid, "registrar")
+	if err != nil || granted {
+		t.Fatal("TestDBHandler_HasRole: #3: reported a revoked role")
+	}
+}
+
 func TestDBHandler_ModifyQuotaUsage(t *testing.T) {
 	if err := setupTest(); err != nil {
 		t.Fatalf("TestDBHandler_ModifyQuotaUsage: Couldn't reset database: %s", err.Error())
@@ -518,19 +613,942 @@ func TestDBHandler_SetQuotaUsage(t *testing.T) {
 	}
 }
 
+func TestDBHandler_ResolveAddress(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_ResolveAddress: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	aliasWid := "22222222-2222-2222-2222-222222222222"
+	err := AddWorkspace(wid, "csimons", "example.com", "password", "active", "individual")
+	if err != nil {
+		t.Fatalf("TestDBHandler_ResolveAddress: Pre-execution error: %s", err)
+	}
+	err = AddAlias(aliasWid, "corbinsimons", "example.com", wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_ResolveAddress: Failed to add alias: %s", err)
+	}
+
+	// Subtest #1: Workspace and user addresses
+
+	for _, addr := range []string{wid + "/example.com", "csimons/example.com"} {
+		resolved, err := ResolveAddress(addr)
+		if err != nil {
+			t.Fatalf("TestDBHandler_ResolveAddress: #1: failed to resolve %s: %s", addr, err)
+		}
+		if resolved != wid {
+			t.Fatalf("TestDBHandler_ResolveAddress: #1: %s resolved to %s", addr, resolved)
+		}
+	}
+
+	// Subtest #2: Aliases resolve to their targets, but can be looked up directly
+
+	for _, addr := range []string{aliasWid + "/example.com", "corbinsimons/example.com"} {
+		resolved, err := ResolveAddress(addr)
+		if err != nil {
+			t.Fatalf("TestDBHandler_ResolveAddress: #2: failed to resolve %s: %s", addr, err)
+		}
+		if resolved != wid {
+			t.Fatalf("TestDBHandler_ResolveAddress: #2: %s resolved to %s", addr, resolved)
+		}
+	}
+
+	resolved, err := LookupAddress("corbinsimons/example.com")
+	if err != nil || resolved != aliasWid {
+		t.Fatalf("TestDBHandler_ResolveAddress: #2: LookupAddress followed an alias")
+	}
+
+	aliases, err := GetAliases(wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_ResolveAddress: #2: failed to get aliases: %s", err)
+	}
+	if aliases.Join(",") != "corbinsimons/example.com" {
+		t.Fatalf("TestDBHandler_ResolveAddress: #2: bad alias list %s", aliases.Join(","))
+	}
+
+	// Subtest #3: Removed aliases
+
+	err = RemoveAlias(aliasWid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_ResolveAddress: #3: failed to remove alias: %s", err)
+	}
+	for _, addr := range []string{aliasWid + "/example.com", "corbinsimons/example.com"} {
+		_, err = ResolveAddress(addr)
+		if err == nil {
+			t.Fatalf("TestDBHandler_ResolveAddress: #3: removed alias %s still resolved", addr)
+		}
+	}
+	aliases, err = GetAliases(wid)
+	if err != nil || !aliases.IsEmpty() {
+		t.Fatalf("TestDBHandler_ResolveAddress: #3: removed alias still listed")
+	}
+
+	// The user ID of a removed alias isn't given out again
+	err = AddAlias("33333333-3333-3333-3333-333333333333", "corbinsimons", "example.com", wid)
+	if err != ErrUserIDExists {
+		t.Fatalf("TestDBHandler_ResolveAddress: #3: removed alias' user ID reused: %v", err)
+	}
+
+	// Subtest #4: Nonexistent workspace
+
+	_, err = ResolveAddress("44444444-4444-4444-4444-444444444444/example.com")
+	if err == nil {
+		t.Fatal("TestDBHandler_ResolveAddress: #4: resolved a nonexistent workspace")
+	}
+}
+
+func TestDBHandler_CheckUserID(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_CheckUserID: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	err := AddWorkspace(wid, "csimons", "example.com", "password", "active", "individual")
+	if err != nil {
+		t.Fatalf("TestDBHandler_CheckUserID: Pre-execution error: %s", err)
+	}
+
+	// Subtest #1: User IDs are unique within a domain
+
+	exists, status := CheckUserID("csimons", "example.com")
+	if !exists || status != "active" {
+		t.Fatal("TestDBHandler_CheckUserID: #1: existing user ID not found")
+	}
+
+	// The database refuses duplicates which get past the check
+	err = AddWorkspace("22222222-2222-2222-2222-222222222222", "csimons", "example.com", "password",
+		"active", "individual")
+	if err == nil {
+		t.Fatal("TestDBHandler_CheckUserID: #1: duplicate user ID added")
+	}
+
+	// Subtest #2: The same user ID may be used in another domain
+
+	exists, _ = CheckUserID("csimons", "example.org")
+	if exists {
+		t.Fatal("TestDBHandler_CheckUserID: #2: user ID found in the wrong domain")
+	}
+
+	_, err = LookupAddress("csimons/example.org")
+	if err != ErrWorkspaceNotFound {
+		t.Fatalf("TestDBHandler_CheckUserID: #2: address resolved in the wrong domain: %v", err)
+	}
+
+	// Subtest #3: Workspace domain lookup
+
+	domain, err := GetWorkspaceDomain(wid)
+	if err != nil || domain != "example.com" {
+		t.Fatalf("TestDBHandler_CheckUserID: #3: bad workspace domain '%s'", domain)
+	}
+}
+
+func TestDBHandler_GetRevocation(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_GetRevocation: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+
+	// Subtest #1: Keycard never revoked
+
+	index, record, err := GetRevocation(wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetRevocation: #1: error getting revocation: %s", err)
+	}
+	if index != 0 || record != "" {
+		t.Fatal("TestDBHandler_GetRevocation: #1: revocation found for unrevoked keycard")
+	}
+
+	// Subtest #2: The latest revocation is returned
+
+	err = AddRevocation(wid, 1, "20210101T000000Z", "record1")
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetRevocation: #2: failed to add revocation: %s", err)
+	}
+	err = AddRevocation(wid, 3, "20210201T000000Z", "record2")
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetRevocation: #2: failed to add revocation: %s", err)
+	}
+
+	index, record, err = GetRevocation(wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetRevocation: #2: error getting revocation: %s", err)
+	}
+	if index != 3 || record != "record2" {
+		t.Fatalf("TestDBHandler_GetRevocation: #2: wrong revocation %d, %s", index, record)
+	}
+}
+
+func TestDBHandler_GetRevokedIndices(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_GetRevokedIndices: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	for _, index := range []int{3, 1} {
+		err := AddRevocation(wid, index, "20210101T000000Z", "record")
+		if err != nil {
+			t.Fatalf("TestDBHandler_GetRevokedIndices: failed to add revocation: %s", err)
+		}
+	}
+
+	indices, err := GetRevokedIndices(wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetRevokedIndices: error getting revocations: %s", err)
+	}
+	if len(indices) != 2 || indices[0] != 1 || indices[1] != 3 {
+		t.Fatalf("TestDBHandler_GetRevokedIndices: wrong indices %v", indices)
+	}
+}
+
+func TestDBHandler_RemoteKeycard(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_RemoteKeycard: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	future := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	err := SetRemoteKeycard("example.org", wid, "csimons", []string{"entry1", "entry2"}, 0, "",
+		future)
+	if err != nil {
+		t.Fatalf("TestDBHandler_RemoteKeycard: #1: failed to cache keycard: %s", err)
+	}
+
+	// Subtest #1: Lookup by user ID
+
+	owner, _, _, err := GetRemoteKeycard("example.org", "csimons")
+	if err != nil || owner != wid {
+		t.Fatalf("TestDBHandler_RemoteKeycard: #1: lookup failed: %s, %v", owner, err)
+	}
+
+	entries, err := GetRemoteEntries("example.org", wid, 0, 0)
+	if err != nil || len(entries) != 1 || entries[0] != "entry2" {
+		t.Fatalf("TestDBHandler_RemoteKeycard: #1: wrong current entry: %v, %v", entries, err)
+	}
+
+	// Subtest #2: Expired keycards are not returned
+
+	past := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	err = SetRemoteKeycard("example.org", wid, "csimons", []string{"entry1"}, 0, "", past)
+	if err != nil {
+		t.Fatalf("TestDBHandler_RemoteKeycard: #2: failed to cache keycard: %s", err)
+	}
+	owner, _, _, err = GetRemoteKeycard("example.org", wid)
+	if err != nil || owner != "" {
+		t.Fatalf("TestDBHandler_RemoteKeycard: #2: expired keycard returned: %s, %v", owner, err)
+	}
+}
+
+func TestDBHandler_OrgKeyWrap(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: Couldn't reset database: %s", err.Error())
+	}
+	defer func() { orgKEK = cryptostring.CryptoString{} }()
+
+	signkey := "ED25519:{^A@`5N*T%5ybCU%be892x6%*Rb2rnYd=SGeO4jF"
+	_, err := dbConn.Exec(`INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, `+
+		`fingerprint, domain) VALUES($1, $2, $3, 'sign', $4, 'example.com')`,
+		time.Now().UTC().Format(time.RFC3339), "ED25519:PnY~pK2|;AYO#1Z;B%T$2}E$^kIpL=>>VzfMKsDx",
+		signkey, "BLAKE2B-256:test")
+	if err != nil {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: failed to add org key: %s", err)
+	}
+
+	// Subtest #1: Unlocking seals keys which are stored in the clear
+
+	wrapped, err := OrgKeysWrapped()
+	if err != nil || wrapped {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #1: keys reported wrapped before unlock: %v", err)
+	}
+
+	kek, _ := ezcrypt.GenerateKEK()
+	if err = UnlockOrgKeys(kek); err != nil {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #1: unlock failed: %s", err)
+	}
+	wrapped, err = OrgKeysWrapped()
+	if err != nil || !wrapped {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #1: keys not reported wrapped: %v", err)
+	}
+
+	var stored string
+	dbConn.QueryRow(`SELECT privkey FROM orgkeys`).Scan(&stored)
+	if !strings.HasPrefix(stored, ezcrypt.KeyWrapAlgorithm+":") {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #1: key not sealed: %s", stored)
+	}
+
+	psk, err := GetPrimarySigningKey("example.com")
+	if err != nil || psk != signkey {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #1: wrong signing key: %s, %v", psk, err)
+	}
+
+	// Subtest #2: Wrong key and locked keys
+
+	otherKEK, _ := ezcrypt.GenerateKEK()
+	if err = UnlockOrgKeys(otherKEK); err != ErrWrongKEK {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #2: wrong key not detected: %v", err)
+	}
+
+	orgKEK = cryptostring.CryptoString{}
+	if _, err = GetPrimarySigningKey("example.com"); err != ErrOrgKeysLocked {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #2: locked key returned: %v", err)
+	}
+
+	// Subtest #3: Rewrapping
+
+	if err = UnlockOrgKeys(kek); err != nil {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #3: unlock failed: %s", err)
+	}
+	if err = RewrapOrgKeys(otherKEK, []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #3: rewrap failed: %s", err)
+	}
+	if err = UnlockOrgKeys(kek); err != ErrWrongKEK {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #3: old key still accepted: %v", err)
+	}
+	if err = UnlockOrgKeys(otherKEK); err != nil {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #3: new key rejected: %s", err)
+	}
+	psk, err = GetPrimarySigningKey("example.com")
+	if err != nil || psk != signkey {
+		t.Fatalf("TestDBHandler_OrgKeyWrap: #3: wrong signing key: %s, %v", psk, err)
+	}
+}
+
+func TestDBHandler_KeycardNotice(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_KeycardNotice: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	sent, err := CheckKeycardNotice("example.com", wid, 1, "expiring")
+	if err != nil || sent {
+		t.Fatalf("TestDBHandler_KeycardNotice: #1: notice reported before sending: %v", err)
+	}
+
+	// Subtest #1: Notices are tracked per entry and type
+
+	if err = AddKeycardNotice("example.com", wid, 1, "expiring"); err != nil {
+		t.Fatalf("TestDBHandler_KeycardNotice: #1: failed to add notice: %s", err)
+	}
+	sent, err = CheckKeycardNotice("example.com", wid, 1, "expiring")
+	if err != nil || !sent {
+		t.Fatalf("TestDBHandler_KeycardNotice: #1: notice not recorded: %v", err)
+	}
+	sent, err = CheckKeycardNotice("example.com", wid, 1, "expired")
+	if err != nil || sent {
+		t.Fatalf("TestDBHandler_KeycardNotice: #1: wrong notice type matched: %v", err)
+	}
+
+	// Subtest #2: Notices for earlier entries are removed
+
+	if err = AddKeycardNotice("example.com", wid, 2, "expiring"); err != nil {
+		t.Fatalf("TestDBHandler_KeycardNotice: #2: failed to add notice: %s", err)
+	}
+	sent, err = CheckKeycardNotice("example.com", wid, 1, "expiring")
+	if err != nil || sent {
+		t.Fatalf("TestDBHandler_KeycardNotice: #2: old notice not removed: %v", err)
+	}
+}
+
+func TestDBHandler_AddEntry(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_AddEntry: Couldn't reset database: %s", err.Error())
+	}
+
+	// Subtest #1: Each entry is logged at the next position in its domain's log
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	for _, index := range []string{"1", "2"} {
+		entry := keycard.NewUserEntry()
+		entry.SetFields(map[string]string{
+			"Index":        index,
+			"Workspace-ID": wid,
+			"Domain":       "example.com",
+		})
+		if err := AddEntry(entry); err != nil {
+			t.Fatalf("TestDBHandler_AddEntry: #1: failed to add entry %s: %s", index, err)
+		}
+	}
+	size, err := GetLogSize("example.com")
+	if err != nil || size != 2 {
+		t.Fatalf("TestDBHandler_AddEntry: #1: wrong log size %d: %v", size, err)
+	}
+
+	// Subtest #2: A log position can't be taken twice
+
+	_, err = dbConn.Exec(`INSERT INTO translog(domain, seq, fingerprint, leafhash) ` +
+		`VALUES('example.com', 1, 'fingerprint', 'leafhash')`)
+	if err == nil {
+		t.Fatal("TestDBHandler_AddEntry: #2: duplicate log position accepted")
+	}
+}
+
+func TestDBHandler_AddOrgEntry(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_AddOrgEntry: Couldn't reset database: %s", err.Error())
+	}
+
+	keys, err := keycard.GenerateOrgKeys(false)
+	if err != nil {
+		t.Fatalf("TestDBHandler_AddOrgEntry: Couldn't generate keys: %s", err)
+	}
+	entry := keycard.NewOrgEntry()
+	entry.SetFields(map[string]string{
+		"Index":  "1",
+		"Domain": "example.com",
+	})
+
+	// Subtest #1: The entry, its log record, and its keys are all stored
+
+	if err = AddOrgEntry("example.com", entry, keys); err != nil {
+		t.Fatalf("TestDBHandler_AddOrgEntry: #1: failed to add entry: %s", err)
+	}
+	size, err := GetLogSize("example.com")
+	if err != nil || size != 1 {
+		t.Fatalf("TestDBHandler_AddOrgEntry: #1: wrong log size %d: %v", size, err)
+	}
+	psk, err := GetPrimarySigningKey("example.com")
+	pskWant := keys["Primary-Verification-Key.private"]
+	if err != nil || psk != pskWant.AsString() {
+		t.Fatalf("TestDBHandler_AddOrgEntry: #1: wrong signing key: %s, %v", psk, err)
+	}
+}
+
+func TestDBHandler_PasswordRehash(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_PasswordRehash: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	err := AddWorkspace(wid, "csimons", "example.com", "password", "active", "individual")
+	if err != nil {
+		t.Fatalf("TestDBHandler_PasswordRehash: Couldn't add workspace: %s", err.Error())
+	}
+
+	// Subtest #1: Hashes made with the current settings are left alone
+
+	rehashed, err := RehashPassword(wid, "password")
+	if err != nil || rehashed {
+		t.Fatalf("TestDBHandler_PasswordRehash: #1: current hash was replaced: %v", err)
+	}
+	total, legacy, unreadable, err := CountLegacyPasswords("example.com")
+	if err != nil || total != 1 || legacy != 0 || unreadable != 0 {
+		t.Fatalf("TestDBHandler_PasswordRehash: #1: wrong counts %d/%d: %v", legacy, total, err)
+	}
+
+	// Subtest #2: Hashes made with other settings are counted and replaced
+
+	oldHash := "$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCqdcCYkJLok65" +
+		"qussSyhN5TTZP+OTgzEI"
+	_, err = dbConn.Exec(`UPDATE workspaces SET password=$1 WHERE wid=$2`, oldHash, wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_PasswordRehash: #2: Couldn't set old hash: %s", err.Error())
+	}
+	_, legacy, _, err = CountLegacyPasswords("example.com")
+	if err != nil || legacy != 1 {
+		t.Fatalf("TestDBHandler_PasswordRehash: #2: legacy hash not counted: %v", err)
+	}
+
+	rehashed, err = RehashPassword(wid, "password")
+	if err != nil || !rehashed {
+		t.Fatalf("TestDBHandler_PasswordRehash: #2: legacy hash not replaced: %v", err)
+	}
+	match, err := CheckPassword(wid, "password")
+	if err != nil || !match {
+		t.Fatalf("TestDBHandler_PasswordRehash: #2: rehashed password didn't match: %v", err)
+	}
+	_, legacy, _, err = CountLegacyPasswords("example.com")
+	if err != nil || legacy != 0 {
+		t.Fatalf("TestDBHandler_PasswordRehash: #2: rehashed password still counted: %v", err)
+	}
+
+	// Subtest #3: Hashes which can't be read are counted on their own
+
+	_, err = dbConn.Exec(`UPDATE workspaces SET password='$argon2id$bad' WHERE wid=$1`, wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_PasswordRehash: #3: Couldn't set bad hash: %s", err.Error())
+	}
+	total, legacy, unreadable, err = CountLegacyPasswords("example.com")
+	if err != nil || total != 1 || legacy != 0 || unreadable != 1 {
+		t.Fatalf("TestDBHandler_PasswordRehash: #3: wrong counts %d/%d/%d: %v", legacy,
+			unreadable, total, err)
+	}
+}
+
+func TestDBHandler_Migrate(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_Migrate: Couldn't reset database: %s", err.Error())
+	}
+
+	latest, err := LatestSchemaVersion()
+	if err != nil || latest < 1 {
+		t.Fatalf("TestDBHandler_Migrate: Couldn't load migrations: %v", err)
+	}
+
+	// Subtest #1: A freshly-reset database is current
+
+	version, err := SchemaVersion()
+	if err != nil || version != latest {
+		t.Fatalf("TestDBHandler_Migrate: #1: wrong schema version %d: %v", version, err)
+	}
+	pending, err := PendingMigrations()
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("TestDBHandler_Migrate: #1: unexpected pending migrations: %v", err)
+	}
+
+	// Subtest #2: Migrations are applied to a database set up before migrations were added
+	// without disturbing its data, and its keycards are given the server's domain
+
+	migrations, err := loadMigrations(dbConn.engine.Name())
+	if err != nil {
+		t.Fatalf("TestDBHandler_Migrate: #2: Couldn't load migrations: %s", err.Error())
+	}
+	err = dropTables()
+	if err != nil {
+		t.Fatalf("TestDBHandler_Migrate: #2: Couldn't drop tables: %s", err.Error())
+	}
+	_, err = dbConn.Exec(migrations[0].script)
+	if err != nil {
+		t.Fatalf("TestDBHandler_Migrate: #2: Couldn't create original schema: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	err = AddWorkspace(wid, "csimons", "example.com", "password", "active", "individual")
+	if err != nil {
+		t.Fatalf("TestDBHandler_Migrate: #2: Couldn't add workspace: %s", err.Error())
+	}
+	_, err = dbConn.Exec(`INSERT INTO keycards(owner, creationtime, "index", entry, fingerprint) `+
+		`VALUES($1, $2, 1, 'entry', 'fingerprint')`, wid, "2021-03-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("TestDBHandler_Migrate: #2: Couldn't add keycard entry: %s", err.Error())
+	}
+
+	// Registering a support workspace preregistered by older versions of server setup left two
+	// rows for it, which would keep the user ID index from being created
+	supportWid := "22222222-2222-2222-2222-222222222222"
+	_, err = dbConn.Exec(`INSERT INTO workspaces(wid, uid, domain, wtype, status) `+
+		`VALUES($1, 'support', 'example.com', 'individual', 'active')`, supportWid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_Migrate: #2: Couldn't add setup row: %s", err.Error())
+	}
+	_, err = dbConn.Exec(`INSERT INTO workspaces(wid, uid, domain, wtype, status, password) `+
+		`VALUES($1, 'support', 'example.com', 'individual', 'active', $2)`, supportWid,
+		ezcrypt.HashPassword("password"))
+	if err != nil {
+		t.Fatalf("TestDBHandler_Migrate: #2: Couldn't add registered row: %s", err.Error())
+	}
+
+	applied, err := Migrate()
+	if err != nil || len(applied) != latest {
+		t.Fatalf("TestDBHandler_Migrate: #2: migrations not applied: %v", err)
+	}
+	var rowcount int
+	err = dbConn.QueryRow(`SELECT COUNT(*) FROM workspaces WHERE wid=$1`, supportWid).
+		Scan(&rowcount)
+	if err != nil || rowcount != 1 {
+		t.Fatalf("TestDBHandler_Migrate: #2: duplicate rows not merged: %d %v", rowcount, err)
+	}
+	match, err := CheckPassword(supportWid, "password")
+	if err != nil || !match {
+		t.Fatalf("TestDBHandler_Migrate: #2: registered row not kept: %v", err)
+	}
+	version, err = SchemaVersion()
+	if err != nil || version != latest {
+		t.Fatalf("TestDBHandler_Migrate: #2: wrong schema version %d: %v", version, err)
+	}
+	match, err = CheckPassword(wid, "password")
+	if err != nil || !match {
+		t.Fatalf("TestDBHandler_Migrate: #2: workspace lost in migration: %v", err)
+	}
+	owners, err := GetKeycardOwners(viper.GetString("global.domain"))
+	if err != nil || len(owners) != 1 || owners[0] != wid {
+		t.Fatalf("TestDBHandler_Migrate: #2: keycard not given the server's domain: %v", err)
+	}
+
+	// Subtest #3: Databases with a newer schema are refused
+
+	_, err = dbConn.Exec(`INSERT INTO schema_version(version, name, applied) VALUES($1, $2, $3)`,
+		latest+1, "future", time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("TestDBHandler_Migrate: #3: Couldn't add schema version: %s", err.Error())
+	}
+	_, err = Migrate()
+	if err != ErrSchemaTooNew {
+		t.Fatalf("TestDBHandler_Migrate: #3: newer schema not refused: %v", err)
+	}
+}
+
+// failingChange is an FSChange which can't be applied
+type failingChange struct{}
+
+func (c *failingChange) Apply() error {
+	return errors.New("apply failed")
+}
+
+func (c *failingChange) Revert() error {
+	return nil
+}
+
+func (c *failingChange) Finish() error {
+	return nil
+}
+
+func TestDBHandler_RegisterWorkspace(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: Couldn't reset database: %s", err.Error())
+	}
+	if err := resetWorkspaceDir(); err != nil {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: Couldn't reset workspace dir: %s",
+			err.Error())
+	}
+
+	devkey := cryptostring.New("CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z")
+	reg := Registration{
+		WID:       "11111111-1111-1111-1111-111111111111",
+		UID:       "csimons",
+		Domain:    "example.com",
+		Password:  "password",
+		Status:    "active",
+		Type:      "individual",
+		DeviceID:  "14e5a5ad-1e9c-4a9f-9efc-3c0e4e5a7a39",
+		DeviceKey: devkey,
+		RegCode:   "valid-regcode",
+		PreregID:  "11111111-1111-1111-1111-111111111111",
+	}
+	reg.PreregIsWID = true
+	_, err := dbConn.Exec(`INSERT INTO prereg(wid, uid, domain, regcode) VALUES($1, $2, $3, $4)`,
+		reg.WID, reg.UID, reg.Domain, reg.RegCode)
+	if err != nil {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: Couldn't preregister: %s", err.Error())
+	}
+
+	var anpath fshandler.LocalAnPath
+	err = anpath.Set("/ " + reg.WID)
+	if err != nil {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: Couldn't get workspace path: %s", err.Error())
+	}
+
+	// Subtest #1: A failed filesystem change leaves nothing in the database
+
+	err = RegisterWorkspace(reg, &failingChange{})
+	if err == nil {
+		t.Fatal("TestDBHandler_RegisterWorkspace: #1: failed change not reported")
+	}
+	if ok, status := CheckWorkspace(reg.WID); status != "approved" {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #1: registration not rolled back: %v %s",
+			ok, status)
+	}
+
+	// Subtest #2: Success. The workspace, device, and directory exist and the registration code
+	// is gone.
+
+	err = RegisterWorkspace(reg, &fshandler.WorkspaceCreation{WID: reg.WID})
+	if err != nil {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #2: registration failed: %s", err.Error())
+	}
+	if ok, status := CheckWorkspace(reg.WID); !ok || status != "active" {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #2: workspace not added: %s", status)
+	}
+	if ok, _ := CheckDevice(reg.WID, reg.DeviceID, devkey.AsString()); !ok {
+		t.Fatal("TestDBHandler_RegisterWorkspace: #2: device not added")
+	}
+	if _, err = os.Stat(anpath.ProviderPath()); err != nil {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #2: directory not created: %s", err.Error())
+	}
+	if wid, _, _ := CheckRegCode(reg.WID, reg.Domain, true, reg.RegCode); wid != "" {
+		t.Fatal("TestDBHandler_RegisterWorkspace: #2: registration code not deleted")
+	}
+
+	// Subtest #3: Unregistering removes the workspace's devices, files, and unregistration request
+
+	err = AddUnregRequest(reg.WID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #3: Couldn't add request: %s", err.Error())
+	}
+	err = UnregisterWorkspace(reg.WID, &fshandler.WorkspaceRemoval{WID: reg.WID})
+	if err != nil {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #3: unregistration failed: %s", err.Error())
+	}
+	if _, status := CheckWorkspace(reg.WID); status != "deleted" {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #3: workspace not removed: %s", status)
+	}
+	if ok, _ := CheckDevice(reg.WID, reg.DeviceID, devkey.AsString()); ok {
+		t.Fatal("TestDBHandler_RegisterWorkspace: #3: device not removed")
+	}
+	if status, _, _, _ := GetUnregRequest(reg.WID); status != "" {
+		t.Fatal("TestDBHandler_RegisterWorkspace: #3: unregistration request not removed")
+	}
+	if _, err = os.Stat(anpath.ProviderPath()); !os.IsNotExist(err) {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #3: directory not removed: %v", err)
+	}
+	widList, err := GetWorkspaceIDs()
+	if err != nil || len(widList) != 0 {
+		t.Fatalf("TestDBHandler_RegisterWorkspace: #3: removed workspace still listed: %v",
+			widList)
+	}
+}
+
+func TestDBHandler_RegisterPreregistered(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_RegisterPreregistered: Couldn't reset database: %s", err.Error())
+	}
+
+	// Server setup preregisters the abuse and support workspaces and adds a row for each of them
+	// without a password
+	wid := "11111111-1111-1111-1111-111111111111"
+	_, err := dbConn.Exec(`INSERT INTO prereg(wid, uid, domain, regcode) `+
+		`VALUES($1, 'support', 'example.com', 'valid-regcode')`, wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_RegisterPreregistered: Couldn't preregister: %s", err.Error())
+	}
+	_, err = dbConn.Exec(`INSERT INTO workspaces(wid, uid, domain, wtype, status) `+
+		`VALUES($1, 'support', 'example.com', 'individual', 'active')`, wid)
+	if err != nil {
+		t.Fatalf("TestDBHandler_RegisterPreregistered: Couldn't add setup row: %s", err.Error())
+	}
+
+	// Subtest #1: Redeeming the registration code fills in the existing row
+
+	reg := Registration{
+		WID:      wid,
+		UID:      "support",
+		Domain:   "example.com",
+		Password: "password",
+		Status:   "active",
+		Type:     "individual",
+		RegCode:  "valid-regcode",
+		PreregID: "support",
+	}
+	err = RegisterWorkspace(reg, nil)
+	if err != nil {
+		t.Fatalf("TestDBHandler_RegisterPreregistered: #1: registration failed: %s", err.Error())
+	}
+	var rowcount int
+	err = dbConn.QueryRow(`SELECT COUNT(*) FROM workspaces WHERE wid=$1`, wid).Scan(&rowcount)
+	if err != nil || rowcount != 1 {
+		t.Fatalf("TestDBHandler_RegisterPreregistered: #1: wrong row count %d: %v", rowcount, err)
+	}
+	match, err := CheckPassword(wid, "password")
+	if err != nil || !match {
+		t.Fatalf("TestDBHandler_RegisterPreregistered: #1: password not set: %v", err)
+	}
+}
+
+func TestDBHandler_GetOrphanedDevices(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_GetOrphanedDevices: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	devkey := cryptostring.New("CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z")
+	err := AddWorkspace(wid, "csimons", "example.com", "password", "active", "individual")
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetOrphanedDevices: Couldn't add workspace: %s", err.Error())
+	}
+	err = AddDevice(wid, "14e5a5ad-1e9c-4a9f-9efc-3c0e4e5a7a39", devkey, "active")
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetOrphanedDevices: Couldn't add device: %s", err.Error())
+	}
+
+	orphanWID := "22222222-2222-2222-2222-222222222222"
+	err = AddDevice(orphanWID, "3f3e3fa4-5f1a-4f1e-8a43-92a3c3d9b1b4", devkey, "active")
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetOrphanedDevices: Couldn't add device: %s", err.Error())
+	}
+
+	devices, err := GetOrphanedDevices()
+	if err != nil {
+		t.Fatalf("TestDBHandler_GetOrphanedDevices: error getting devices: %s", err.Error())
+	}
+	if len(devices) != 1 || devices[0].WID != orphanWID {
+		t.Fatalf("TestDBHandler_GetOrphanedDevices: wrong orphans returned: %v", devices)
+	}
+}
+
+func TestDBHandler_QueryTimeout(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_QueryTimeout: Couldn't reset database: %s", err.Error())
+	}
+
+	oldTimeout := queryTimeout
+	defer func() { queryTimeout = oldTimeout }()
+	slowQuery := `WITH RECURSIVE counter(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM counter ` +
+		`WHERE x < 100000000) SELECT COUNT(*) FROM counter`
+
+	// Subtest #1: A query which runs too long is canceled, but the database still answers, so it
+	// isn't marked unavailable
+
+	queryTimeout = 50 * time.Millisecond
+	var count int
+	err := dbConn.QueryRow(slowQuery).Scan(&count)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("TestDBHandler_QueryTimeout: #1: slow query not canceled: %v", err)
+	}
+	if !IsAvailable() || IsUnavailableError(err) {
+		t.Fatal("TestDBHandler_QueryTimeout: #1: slow query marked database unavailable")
+	}
+
+	// Subtest #2: A failed connection marks the database unavailable
+
+	queryTimeout = oldTimeout
+	checkAvailability(sql.ErrConnDone)
+	if IsAvailable() || !IsUnavailableError(sql.ErrConnDone) {
+		t.Fatal("TestDBHandler_QueryTimeout: #2: database not marked unavailable")
+	}
+
+	// Subtest #3: Canceling a session's queries doesn't affect availability
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store := NewSQLStore(ctx)
+	_, err = store.Workspaces.GetWorkspaceType("11111111-1111-1111-1111-111111111111")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestDBHandler_QueryTimeout: #3: canceled query not stopped: %v", err)
+	}
+	if IsAvailable() {
+		t.Fatal("TestDBHandler_QueryTimeout: #3: cancellation changed availability")
+	}
+
+	// Subtest #4: A successful query marks the database available again
+
+	_, err = GetWorkspaceType("11111111-1111-1111-1111-111111111111")
+	if err != nil {
+		t.Fatalf("TestDBHandler_QueryTimeout: #4: query failed: %s", err.Error())
+	}
+	if !IsAvailable() {
+		t.Fatal("TestDBHandler_QueryTimeout: #4: database still marked unavailable")
+	}
+
+	// Subtest #5: Work on the organization keys outside of a session, including starting its
+	// transaction, is limited to the query timeout
+
+	queryTimeout = time.Nanosecond
+	_, err = OrgKeysWrapped()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("TestDBHandler_QueryTimeout: #5: OrgKeysWrapped not timed out: %v", err)
+	}
+	kek, _ := ezcrypt.GenerateKEK()
+	err = RewrapOrgKeys(kek, []byte("0123456789abcdef"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("TestDBHandler_QueryTimeout: #5: RewrapOrgKeys not timed out: %v", err)
+	}
+	queryTimeout = oldTimeout
+	wrapped, err := OrgKeysWrapped()
+	if err != nil || wrapped {
+		t.Fatalf("TestDBHandler_QueryTimeout: #5: timed out rewrap changed keys: %v", err)
+	}
+}
+
+func TestDBHandler_UnregRequests(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_UnregRequests: Couldn't reset database: %s", err.Error())
+	}
+
+	wids := []string{
+		"11111111-1111-1111-1111-111111111111",
+		"22222222-2222-2222-2222-222222222222",
+		"33333333-3333-3333-3333-333333333333",
+	}
+	domains := []string{"example.com", "example.com", "example.net"}
+	for i, wid := range wids {
+		err := AddWorkspace(wid, "", domains[i], "-", "active", "individual")
+		if err != nil {
+			t.Fatalf("TestDBHandler_UnregRequests: Couldn't add workspace: %s", err.Error())
+		}
+		err = AddUnregRequest(wid, fmt.Sprintf("2021-03-0%dT00:00:00Z", 3-i))
+		if err != nil {
+			t.Fatalf("TestDBHandler_UnregRequests: Couldn't add request: %s", err.Error())
+		}
+	}
+	err := ApproveUnregRequest(wids[0], "2021-04-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("TestDBHandler_UnregRequests: Couldn't approve request: %s", err.Error())
+	}
+
+	// Only the requests for the domain are returned, ordered by the ends of their grace periods
+
+	requests, err := GetUnregRequests("example.com")
+	if err != nil {
+		t.Fatalf("TestDBHandler_UnregRequests: Couldn't get requests: %s", err.Error())
+	}
+	expected := []UnregRequest{
+		{wids[1], "pending", "2021-03-02T00:00:00Z", ""},
+		{wids[0], "approved", "2021-03-03T00:00:00Z", "2021-04-01T00:00:00Z"},
+	}
+	if len(requests) != len(expected) || requests[0] != expected[0] ||
+		requests[1] != expected[1] {
+		t.Fatalf("TestDBHandler_UnregRequests: wrong requests returned: %v", requests)
+	}
+}
+
+func TestDBHandler_SessionQueries(t *testing.T) {
+	if err := setupTest(); err != nil {
+		t.Fatalf("TestDBHandler_SessionQueries: Couldn't reset database: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+
+	// Subtest #1: Reset codes work through a session's Store
+
+	store := NewSQLStore(context.Background())
+	err := store.Passcodes.ResetPassword(wid, "barely-enough-words", "29991231T235959Z")
+	if err != nil {
+		t.Fatalf("TestDBHandler_SessionQueries: #1: couldn't add reset code: %s", err.Error())
+	}
+	verified, err := store.Passcodes.CheckPasscode(wid, "barely-enough-words")
+	if err != nil || !verified {
+		t.Fatalf("TestDBHandler_SessionQueries: #1: reset code not accepted: %v", err)
+	}
+	err = store.Passcodes.DeletePasscode(wid, "barely-enough-words")
+	if err != nil {
+		t.Fatalf("TestDBHandler_SessionQueries: #1: couldn't delete reset code: %s", err.Error())
+	}
+	verified, err = store.Passcodes.CheckPasscode(wid, "barely-enough-words")
+	if err != nil || verified {
+		t.Fatal("TestDBHandler_SessionQueries: #1: deleted reset code accepted")
+	}
+
+	// Subtest #2: Queries for passcodes, organization keys, and the transparency log are canceled
+	// along with the session
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store = NewSQLStore(ctx)
+
+	_, err = store.Passcodes.CheckPasscode(wid, "barely-enough-words")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestDBHandler_SessionQueries: #2: CheckPasscode not canceled: %v", err)
+	}
+	_, err = store.Workspaces.LookupAddress("csimons/example.com")
+	if !errors.Is(err, context.Canceled) || err == ErrWorkspaceNotFound {
+		t.Fatalf("TestDBHandler_SessionQueries: #2: LookupAddress not canceled: %v", err)
+	}
+	err = store.Passcodes.ResetPassword(wid, "barely-enough-words", "29991231T235959Z")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestDBHandler_SessionQueries: #2: ResetPassword not canceled: %v", err)
+	}
+	_, err = store.Keycards.GetEncryptionPair("example.com")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestDBHandler_SessionQueries: #2: GetEncryptionPair not canceled: %v", err)
+	}
+	_, err = store.TransLog.GetLogSize("example.com")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestDBHandler_SessionQueries: #2: GetLogSize not canceled: %v", err)
+	}
+	_, err = store.TransLog.GetLogLeaves("example.com", 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestDBHandler_SessionQueries: #2: GetLogLeaves not canceled: %v", err)
+	}
+}
+
 // TODO: Tests to write:
 
 // AddDevice
-// AddEntry
 // AddWorkspace
 // CheckDevice
 // CheckLockout
-// CheckPasscode
 // CheckPassword
 // CheckRegCode
-// CheckUserID
 // CheckWorkspace
-// DeletePasscode
 // DeleteRegCode
 // GetAliases
 // GetMensagoAddressType
@@ -545,8 +1563,6 @@ func TestDBHandler_SetQuotaUsage(t *testing.T) {
 // RemoveDevice
 // RemoveExpiredPasscodes
 // RemoveWorkspace
-// ResetPassword
-// ResolveAddress
 // SetPassword
 // SetWorkspaceStatus
 // UpdateDevice
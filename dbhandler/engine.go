@@ -0,0 +1,267 @@
+package dbhandler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+)
+
+// The server can store its data in more than one kind of database. Queries in this package are
+// written for PostgreSQL using its numbered placeholders ($1, $2, etc.) and standard SQL which
+// every supported engine understands. Anything which differs between engines -- how a connection
+// is opened, placeholder syntax, and the driver's error types -- is handled by a dbEngine.
+
+// dbEngine hides the differences between the database engines supported by the server
+type dbEngine interface {
+	// Name returns the engine's name as used in the server config
+	Name() string
+
+	// Open returns a connection to the database described by the server's configuration
+	Open() (*sql.DB, error)
+
+	// Rebind converts a query written with PostgreSQL placeholders to the engine's syntax
+	Rebind(query string) string
+
+	// IsDBError returns true if an error was returned by the engine's driver
+	IsDBError(err error) bool
+
+	// IsUnavailable returns true if an error from the engine's driver means that the connection to
+	// the database failed
+	IsUnavailable(err error) bool
+}
+
+// getEngine returns the dbEngine for an engine name used in the server config
+func getEngine(name string) (dbEngine, error) {
+	switch name {
+	case "postgresql":
+		return postgresEngine{}, nil
+	case "sqlite":
+		return sqliteEngine{}, nil
+	}
+	return nil, fmt.Errorf("unsupported database engine %s", name)
+}
+
+// queryTimeout is the longest a single query may run before it is canceled. It is set from the
+// server config by Connect.
+var queryTimeout = 30 * time.Second
+
+// pingTimeout is how long the database has to answer a ping after a query times out
+const pingTimeout = 5 * time.Second
+
+// unavailable is set to 1 when a query fails because the database couldn't be reached and back to
+// 0 when one reaches it again
+var unavailable int32
+
+// database is a connection to the server's database which converts queries to the dialect of
+// the engine in use. Queries are canceled when its context is done or they take longer than the
+// query timeout.
+type database struct {
+	*sql.DB
+	engine dbEngine
+	ctx    context.Context
+}
+
+// WithContext returns a copy of the connection whose queries are canceled when ctx is done
+func (db *database) WithContext(ctx context.Context) *database {
+	return &database{db.DB, db.engine, ctx}
+}
+
+// Exec executes a query which doesn't return rows
+func (db *database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(db.ctx, queryTimeout)
+	defer cancel()
+	result, err := db.DB.ExecContext(ctx, db.engine.Rebind(query), args...)
+	checkAvailability(err)
+	return result, err
+}
+
+// Query executes a query which returns rows
+func (db *database) Query(query string, args ...interface{}) (*dbRows, error) {
+	ctx, cancel := context.WithTimeout(db.ctx, queryTimeout)
+	rows, err := db.DB.QueryContext(ctx, db.engine.Rebind(query), args...)
+	checkAvailability(err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &dbRows{rows, cancel}, nil
+}
+
+// QueryRow executes a query which is expected to return at most one row
+func (db *database) QueryRow(query string, args ...interface{}) *dbRow {
+	ctx, cancel := context.WithTimeout(db.ctx, queryTimeout)
+	return &dbRow{db.DB.QueryRowContext(ctx, db.engine.Rebind(query), args...), cancel}
+}
+
+// Begin starts a transaction. The transaction is rolled back if the connection's context is done
+// before it is committed.
+func (db *database) Begin() (*transaction, error) {
+	tx, err := db.DB.BeginTx(db.ctx, nil)
+	checkAvailability(err)
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{tx, db.engine, db.ctx}, nil
+}
+
+// transaction is a database transaction which converts and times out queries like database does
+type transaction struct {
+	*sql.Tx
+	engine dbEngine
+	ctx    context.Context
+}
+
+// Exec executes a query which doesn't return rows
+func (tx *transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(tx.ctx, queryTimeout)
+	defer cancel()
+	result, err := tx.Tx.ExecContext(ctx, tx.engine.Rebind(query), args...)
+	checkAvailability(err)
+	return result, err
+}
+
+// Query executes a query which returns rows
+func (tx *transaction) Query(query string, args ...interface{}) (*dbRows, error) {
+	ctx, cancel := context.WithTimeout(tx.ctx, queryTimeout)
+	rows, err := tx.Tx.QueryContext(ctx, tx.engine.Rebind(query), args...)
+	checkAvailability(err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &dbRows{rows, cancel}, nil
+}
+
+// QueryRow executes a query which is expected to return at most one row
+func (tx *transaction) QueryRow(query string, args ...interface{}) *dbRow {
+	ctx, cancel := context.WithTimeout(tx.ctx, queryTimeout)
+	return &dbRow{tx.Tx.QueryRowContext(ctx, tx.engine.Rebind(query), args...), cancel}
+}
+
+// queryer runs queries. Both database and transaction implement it, so functions which take one
+// can be used inside or outside of a transaction.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*dbRows, error)
+	QueryRow(query string, args ...interface{}) *dbRow
+}
+
+// dbRows is the result of a query. Its timeout is released when it is closed.
+type dbRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+// Close closes the rows and releases the query's timeout
+func (r *dbRows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
+
+// dbRow is the result of a query for a single row. Its timeout is released when it is scanned.
+type dbRow struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+// Scan copies the row's columns into dest and releases the query's timeout
+func (r *dbRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	r.cancel()
+	checkAvailability(err)
+	return err
+}
+
+// checkAvailability updates whether the database can be reached based on the result of a query
+func checkAvailability(err error) {
+	switch {
+	case err == nil, err == sql.ErrNoRows:
+		atomic.StoreInt32(&unavailable, 0)
+	case errors.Is(err, context.Canceled):
+		// The caller gave up, which says nothing about the database
+	case errors.Is(err, context.DeadlineExceeded):
+		// A query which times out may only be slow, so the database is asked directly
+		checkPing()
+	case isUnavailableError(err):
+		atomic.StoreInt32(&unavailable, 1)
+	case isDBError(err):
+		atomic.StoreInt32(&unavailable, 0)
+	}
+}
+
+// checkPing updates whether the database can be reached by pinging it
+func checkPing() {
+	if dbConn == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if dbConn.DB.PingContext(ctx) != nil {
+		atomic.StoreInt32(&unavailable, 1)
+	} else {
+		atomic.StoreInt32(&unavailable, 0)
+	}
+}
+
+// isUnavailableError returns true if an error means the connection to the database failed
+func isUnavailableError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return dbConn != nil && dbConn.engine.IsUnavailable(err)
+}
+
+// isDBError returns true if an error came from the database engine's driver
+func isDBError(err error) bool {
+	return dbConn != nil && dbConn.engine.IsDBError(err)
+}
+
+// postgresEngine connects to a PostgreSQL server
+type postgresEngine struct{}
+
+func (e postgresEngine) Name() string {
+	return "postgresql"
+}
+
+func (e postgresEngine) Open() (*sql.DB, error) {
+	connString := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		viper.GetString("database.ip"), viper.GetString("database.port"),
+		viper.GetString("database.user"), viper.GetString("database.password"),
+		viper.GetString("database.name"))
+
+	return sql.Open("postgres", connString)
+}
+
+func (e postgresEngine) Rebind(query string) string {
+	return query
+}
+
+func (e postgresEngine) IsDBError(err error) bool {
+	_, ok := err.(*pq.Error)
+	return ok
+}
+
+func (e postgresEngine) IsUnavailable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	// Class 08 is connection exceptions. The others are the server shutting down or starting up.
+	return pqErr.Code.Class() == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" ||
+		pqErr.Code == "57P03"
+}
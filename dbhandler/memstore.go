@@ -0,0 +1,1229 @@
+package dbhandler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkwyrm/gostringlist"
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/ezcrypt"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/darkwyrm/mensagod/translog"
+	"github.com/everlastingbeta/diceware"
+	"github.com/spf13/viper"
+)
+
+// memWorkspace is a row of the workspaces table
+type memWorkspace struct {
+	uid      string
+	domain   string
+	wtype    string
+	status   string
+	password string
+}
+
+// memPasscode is a row of the passcodes table
+type memPasscode struct {
+	passcode string
+	expires  string
+}
+
+// memDevice is a row of the iwkspc_devices table
+type memDevice struct {
+	key    string
+	status string
+}
+
+// memEntry is a row of the keycards table
+type memEntry struct {
+	owner  string
+	domain string
+	index  int
+	entry  string
+}
+
+// memOrgKeys holds the newest keys of each purpose from the orgkeys table for a domain
+type memOrgKeys struct {
+	signing    string
+	encryption *ezcrypt.EncryptionPair
+}
+
+// memLogEntry is a row of the translog table
+type memLogEntry struct {
+	domain      string
+	fingerprint string
+	leafHash    []byte
+}
+
+// memRevocation is a row of the revocations table
+type memRevocation struct {
+	wid    string
+	index  int
+	record string
+}
+
+// memNotice is a row of the keycardnotices table
+type memNotice struct {
+	domain string
+	owner  string
+	index  int
+	notice string
+}
+
+// memRemoteCard is a row of the remotecards table along with the keycard's entries from the
+// remoteentries table
+type memRemoteCard struct {
+	uid          string
+	revokedIndex int
+	revocation   string
+	expires      string
+	entries      []string
+}
+
+// memUnreg is a row of the unregrequests table
+type memUnreg struct {
+	status      string
+	graceUntil  string
+	exportUntil string
+}
+
+// memQuota is a row of the quotas table
+type memQuota struct {
+	usage uint64
+	quota uint64
+}
+
+// memFailure is a row of the failure_log table
+type memFailure struct {
+	count        int
+	lockoutUntil time.Time
+}
+
+// memPrereg is a row of the prereg table
+type memPrereg struct {
+	uid     string
+	domain  string
+	regcode string
+}
+
+// memoryStore implements all of the Store interfaces without a database. Workspaces have no
+// files, so disk usage starts at 0 and changes only through the QuotaStore methods.
+type memoryStore struct {
+	mutex       sync.Mutex
+	workspaces  map[string]*memWorkspace
+	passcodes   map[string]*memPasscode
+	aliases     map[string]string
+	devices     map[string]map[string]*memDevice
+	members     map[string]map[string]string
+	roles       map[string]map[string]bool
+	entries     []memEntry
+	orgkeys     map[string]*memOrgKeys
+	translog    []memLogEntry
+	revocations []memRevocation
+	notices     []memNotice
+	remotecards map[string]*memRemoteCard
+	quotas      map[string]*memQuota
+	failures    map[string]*memFailure
+	prereg      map[string]*memPrereg
+	unregs      map[string]*memUnreg
+}
+
+// NewMemoryStore returns an empty Store which keeps its data in memory. It is meant for tests and
+// is safe for use by multiple goroutines.
+func NewMemoryStore() *Store {
+	s := &memoryStore{
+		workspaces:  make(map[string]*memWorkspace),
+		passcodes:   make(map[string]*memPasscode),
+		aliases:     make(map[string]string),
+		devices:     make(map[string]map[string]*memDevice),
+		members:     make(map[string]map[string]string),
+		roles:       make(map[string]map[string]bool),
+		entries:     make([]memEntry, 0),
+		orgkeys:     make(map[string]*memOrgKeys),
+		translog:    make([]memLogEntry, 0),
+		revocations: make([]memRevocation, 0),
+		notices:     make([]memNotice, 0),
+		remotecards: make(map[string]*memRemoteCard),
+		quotas:      make(map[string]*memQuota),
+		failures:    make(map[string]*memFailure),
+		prereg:      make(map[string]*memPrereg),
+		unregs:      make(map[string]*memUnreg),
+	}
+	return &Store{s, s, s, s, s, s, s, s, s, s, s, s, s, s}
+}
+
+func (s *memoryStore) AddWorkspace(wid string, uid string, domain string, password string,
+	status string, wtype string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.workspaces[wid]; exists {
+		return errors.New("workspace exists")
+	}
+
+	passString := "-"
+	if wtype != "shared" {
+		passString = ezcrypt.HashPassword(password)
+	}
+	s.workspaces[wid] = &memWorkspace{uid, domain, wtype, status, passString}
+	return nil
+}
+
+func (s *memoryStore) RemoveWorkspace(wid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.removeWorkspace(wid)
+	return nil
+}
+
+// removeWorkspace does the work of RemoveWorkspace. The caller must hold the mutex.
+func (s *memoryStore) removeWorkspace(wid string) {
+	// As with the database, the workspace is kept so that its IDs aren't reused
+	if ws, exists := s.workspaces[wid]; exists {
+		ws.password = "-"
+		ws.status = "deleted"
+	}
+	delete(s.devices, wid)
+	for aliasWid, target := range s.aliases {
+		if target == wid {
+			s.workspaces[aliasWid].status = "deleted"
+			delete(s.aliases, aliasWid)
+		}
+	}
+	delete(s.unregs, wid)
+}
+
+func (s *memoryStore) CheckWorkspace(wid string) (bool, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ws, exists := s.workspaces[wid]; exists {
+		return true, ws.status
+	}
+	if _, exists := s.prereg[wid]; exists {
+		return true, "approved"
+	}
+	return false, ""
+}
+
+func (s *memoryStore) CheckUserID(uid string, domain string) (bool, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, ws := range s.workspaces {
+		if ws.uid == uid && ws.domain == domain {
+			return true, ws.status
+		}
+	}
+	for _, pr := range s.prereg {
+		if pr.uid == uid && pr.domain == domain {
+			return true, "approved"
+		}
+	}
+	return false, ""
+}
+
+func (s *memoryStore) SetWorkspaceStatus(wid string, status string) error {
+	realStatus := strings.ToLower(status)
+
+	if realStatus == "awaiting" {
+		return fmt.Errorf("awaiting is an internal-only workspace status")
+	}
+	if realStatus != "active" && realStatus != "disabled" && realStatus != "approved" {
+		return fmt.Errorf("%s is not a valid status", realStatus)
+	}
+	if !ValidateUUID(wid) {
+		return fmt.Errorf("%s is not a valid workspace ID", wid)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ws, exists := s.workspaces[wid]; exists {
+		ws.status = status
+	}
+	return nil
+}
+
+func (s *memoryStore) GetWorkspaceDomain(wid string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ws, exists := s.workspaces[wid]; exists {
+		return ws.domain, nil
+	}
+	return "", nil
+}
+
+func (s *memoryStore) GetWorkspaceType(wid string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ws, exists := s.workspaces[wid]; exists {
+		return ws.wtype, nil
+	}
+	return "", nil
+}
+
+func (s *memoryStore) SetPassword(wid string, password string) error {
+	if len(password) > 128 {
+		return errors.New("Password string has a maximum 128 characters")
+	}
+	passHash := ezcrypt.HashPassword(password)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ws, exists := s.workspaces[wid]; exists {
+		ws.password = passHash
+	}
+	return nil
+}
+
+// getPasswordHash returns the stored password hash for a workspace
+func (s *memoryStore) getPasswordHash(wid string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ws, exists := s.workspaces[wid]
+	if !exists {
+		return "", errors.New("workspace not found")
+	}
+	return ws.password, nil
+}
+
+func (s *memoryStore) CheckPassword(wid string, password string) (bool, error) {
+	dbhash, err := s.getPasswordHash(wid)
+	if err != nil {
+		return false, err
+	}
+	return ezcrypt.VerifyPasswordHash(password, dbhash)
+}
+
+func (s *memoryStore) RehashPassword(wid string, password string) (bool, error) {
+	dbhash, err := s.getPasswordHash(wid)
+	if err != nil {
+		return false, err
+	}
+
+	rehash, err := ezcrypt.PasswordNeedsRehash(dbhash)
+	if err != nil || !rehash {
+		return false, err
+	}
+	passHash := ezcrypt.HashPassword(password)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ws, exists := s.workspaces[wid]
+	if !exists || ws.password != dbhash {
+		return false, nil
+	}
+	ws.password = passHash
+	return true, nil
+}
+
+func (s *memoryStore) CountLegacyPasswords(domain string) (int, int, int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	total, legacy, unreadable := 0, 0, 0
+	for _, ws := range s.workspaces {
+		if ws.domain != domain || ws.password == "-" {
+			continue
+		}
+
+		total++
+		rehash, err := ezcrypt.PasswordNeedsRehash(ws.password)
+		if err != nil {
+			unreadable++
+		} else if rehash {
+			legacy++
+		}
+	}
+	return total, legacy, unreadable, nil
+}
+
+func (s *memoryStore) ResetPassword(wid string, passcode string, expires string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.passcodes[wid] = &memPasscode{passcode, expires}
+	return nil
+}
+
+func (s *memoryStore) CheckPasscode(wid string, passcode string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	code, exists := s.passcodes[wid]
+	if !exists || code.passcode != passcode {
+		return false, nil
+	}
+	return checkPasscodeExpiration(code.expires)
+}
+
+func (s *memoryStore) DeletePasscode(wid string, passcode string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if code, exists := s.passcodes[wid]; exists && code.passcode == passcode {
+		delete(s.passcodes, wid)
+	}
+	return nil
+}
+
+func (s *memoryStore) ResolveAddress(addr string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wid, err := s.lookupAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	if target, exists := s.aliases[wid]; exists {
+		return target, nil
+	}
+	return wid, nil
+}
+
+func (s *memoryStore) LookupAddress(addr string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lookupAddress(addr)
+}
+
+// lookupAddress does the work of LookupAddress. The caller must hold the mutex.
+func (s *memoryStore) lookupAddress(addr string) (string, error) {
+	parts := strings.Split(addr, "/")
+	if len(parts) != 2 {
+		return "", errors.New("invalid address")
+	}
+	domain := strings.ToLower(parts[1])
+
+	if ws, exists := s.workspaces[parts[0]]; exists && ws.status != "deleted" {
+		return parts[0], nil
+	}
+	for wid, ws := range s.workspaces {
+		if ws.uid == parts[0] && ws.domain == domain && ws.status != "deleted" {
+			return wid, nil
+		}
+	}
+	return "", ErrWorkspaceNotFound
+}
+
+func (s *memoryStore) AddAlias(aliasWid string, uid string, domain string, target string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.workspaces[aliasWid]; exists {
+		return ErrUserIDExists
+	}
+	for _, ws := range s.workspaces {
+		if ws.uid == uid && ws.domain == domain {
+			return ErrUserIDExists
+		}
+	}
+	s.workspaces[aliasWid] = &memWorkspace{uid, domain, "alias", "active", "-"}
+	s.aliases[aliasWid] = target
+	return nil
+}
+
+func (s *memoryStore) RemoveAlias(aliasWid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ws, exists := s.workspaces[aliasWid]; exists && ws.wtype == "alias" {
+		ws.status = "deleted"
+	}
+	delete(s.aliases, aliasWid)
+	return nil
+}
+
+func (s *memoryStore) GetAliasTarget(aliasWid string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.aliases[aliasWid], nil
+}
+
+func (s *memoryStore) GetAliases(wid string) (gostringlist.StringList, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var out gostringlist.StringList
+	for aliasWid, target := range s.aliases {
+		ws := s.workspaces[aliasWid]
+		if target == wid && ws.status != "deleted" {
+			out.Append(ws.uid + "/" + ws.domain)
+		}
+	}
+	out.Sort()
+	return out, nil
+}
+
+func (s *memoryStore) IsAlias(wid string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, exists := s.aliases[wid]
+	return exists, nil
+}
+
+func (s *memoryStore) AddDevice(wid string, devid string, devkey cryptostring.CryptoString,
+	status string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.devices[wid]; !exists {
+		s.devices[wid] = make(map[string]*memDevice)
+	}
+	s.devices[wid][devid] = &memDevice{devkey.AsString(), status}
+	return nil
+}
+
+func (s *memoryStore) RemoveDevice(wid string, devid string) (bool, error) {
+	if len(devid) != 40 {
+		return false, errors.New("invalid session string")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.devices[wid], devid)
+	return true, nil
+}
+
+func (s *memoryStore) CheckDevice(wid string, devid string, devkey string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dev, exists := s.devices[wid][devid]
+	return exists && dev.key == devkey, nil
+}
+
+func (s *memoryStore) UpdateDevice(wid string, devid string, oldkey string, newkey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if dev, exists := s.devices[wid][devid]; exists && dev.key == oldkey {
+		dev.key = newkey
+	}
+	return nil
+}
+
+func (s *memoryStore) AddMember(wid string, member string, role string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.members[wid]; !exists {
+		s.members[wid] = make(map[string]string)
+	}
+	s.members[wid][member] = role
+	return nil
+}
+
+func (s *memoryStore) RemoveMember(wid string, member string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.members[wid], member)
+	return nil
+}
+
+func (s *memoryStore) GetMemberRole(wid string, member string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.members[wid][member], nil
+}
+
+func (s *memoryStore) GetMembers(wid string) (map[string]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make(map[string]string)
+	for member, role := range s.members[wid] {
+		out[member] = role
+	}
+	return out, nil
+}
+
+func (s *memoryStore) AddRole(wid string, role string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.roles[wid]; !exists {
+		s.roles[wid] = make(map[string]bool)
+	}
+	s.roles[wid][role] = true
+	return nil
+}
+
+func (s *memoryStore) RemoveRole(wid string, role string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.roles[wid], role)
+	return nil
+}
+
+func (s *memoryStore) GetRoles(wid string) (gostringlist.StringList, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var out gostringlist.StringList
+	for role := range s.roles[wid] {
+		out.Append(role)
+	}
+	out.Sort()
+	return out, nil
+}
+
+func (s *memoryStore) HasRole(wid string, role string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.roles[wid][role], nil
+}
+
+// getEntries returns the entries of a keycard in the same way as GetOrgEntries and GetUserEntries.
+// The match function selects the keycard's entries.
+func (s *memoryStore) getEntries(match func(memEntry) bool, startIndex int,
+	endIndex int) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	card := make([]memEntry, 0, 10)
+	for _, entry := range s.entries {
+		if match(entry) {
+			card = append(card, entry)
+		}
+	}
+	sort.Slice(card, func(i, j int) bool { return card[i].index < card[j].index })
+
+	out := make([]string, 0, 10)
+	if startIndex < 1 {
+		if len(card) == 0 {
+			return out, sql.ErrNoRows
+		}
+		return append(out, card[len(card)-1].entry), nil
+	}
+
+	for _, entry := range card {
+		if entry.index >= startIndex && (endIndex < 1 || entry.index <= endIndex) {
+			out = append(out, entry.entry)
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) GetOrgEntries(domain string, startIndex int, endIndex int) ([]string, error) {
+	return s.getEntries(func(e memEntry) bool {
+		return e.owner == "organization" && e.domain == domain
+	}, startIndex, endIndex)
+}
+
+func (s *memoryStore) GetUserEntries(wid string, startIndex int, endIndex int) ([]string, error) {
+	return s.getEntries(func(e memEntry) bool {
+		return e.owner == wid
+	}, startIndex, endIndex)
+}
+
+func (s *memoryStore) AddEntry(entry *keycard.Entry) error {
+	owner := entry.Fields["Workspace-ID"]
+	if entry.Fields["Type"] == "Organization" {
+		owner = "organization"
+	}
+	index, err := strconv.Atoi(entry.Fields["Index"])
+	if err != nil {
+		return err
+	}
+
+	domain := strings.ToLower(entry.Fields["Domain"])
+	entryString := entry.MakeByteString(-1)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = append(s.entries, memEntry{owner, domain, index, string(entryString)})
+	s.translog = append(s.translog, memLogEntry{domain, entry.Hash,
+		translog.LeafHash(entryString)})
+	return nil
+}
+
+// AddOrgEntry adds an entry to an organization's keycard. Only the newest private primary signing
+// key and encryption keypair are kept, and they are stored unwrapped.
+func (s *memoryStore) AddOrgEntry(domain string, entry *keycard.Entry,
+	keys map[string]cryptostring.CryptoString) error {
+	err := s.AddEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	domain = strings.ToLower(domain)
+	orgkeys, exists := s.orgkeys[domain]
+	if !exists {
+		orgkeys = &memOrgKeys{}
+		s.orgkeys[domain] = orgkeys
+	}
+	if psk, ok := keys["Primary-Verification-Key.private"]; ok {
+		orgkeys.signing = psk.AsString()
+	}
+	if epriv, ok := keys["Encryption-Key.private"]; ok {
+		orgkeys.encryption = ezcrypt.NewEncryptionPair(keys["Encryption-Key.public"], epriv)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetPrimarySigningKey(domain string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	orgkeys, exists := s.orgkeys[domain]
+	if !exists || orgkeys.signing == "" {
+		return "", sql.ErrNoRows
+	}
+	return orgkeys.signing, nil
+}
+
+func (s *memoryStore) GetEncryptionPair(domain string) (*ezcrypt.EncryptionPair, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	orgkeys, exists := s.orgkeys[domain]
+	if !exists || orgkeys.encryption == nil {
+		return nil, sql.ErrNoRows
+	}
+	return orgkeys.encryption, nil
+}
+
+// getLog returns the transparency log entries for a domain in the order they were added
+func (s *memoryStore) getLog(domain string) []memLogEntry {
+	out := make([]memLogEntry, 0)
+	for _, entry := range s.translog {
+		if entry.domain == domain {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+func (s *memoryStore) GetLogSize(domain string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.getLog(domain)), nil
+}
+
+func (s *memoryStore) GetLogLeaves(domain string, size int) ([][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([][]byte, 0, size)
+	for _, entry := range s.getLog(domain) {
+		if len(out) == size {
+			break
+		}
+		out = append(out, entry.leafHash)
+	}
+	return out, nil
+}
+
+func (s *memoryStore) GetLogIndex(domain string, fingerprint string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, entry := range s.getLog(domain) {
+		if entry.fingerprint == fingerprint {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+func (s *memoryStore) AddRevocation(wid string, index int, revoked string, record string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.revocations = append(s.revocations, memRevocation{wid, index, record})
+	return nil
+}
+
+func (s *memoryStore) GetRevocation(wid string) (int, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var latest memRevocation
+	for _, item := range s.revocations {
+		if item.wid == wid && item.index > latest.index {
+			latest = item
+		}
+	}
+	return latest.index, latest.record, nil
+}
+
+func (s *memoryStore) GetRevokedIndices(wid string) ([]int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]int, 0)
+	for _, item := range s.revocations {
+		if item.wid == wid {
+			out = append(out, item.index)
+		}
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+func (s *memoryStore) GetKeycardOwners(domain string) ([]string, error) {
+	domain = strings.ToLower(domain)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	owners := make(map[string]bool)
+	out := make([]string, 0)
+	for _, entry := range s.entries {
+		if entry.domain == domain && entry.owner != "organization" && !owners[entry.owner] {
+			owners[entry.owner] = true
+			out = append(out, entry.owner)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (s *memoryStore) CheckKeycardNotice(domain string, owner string, index int,
+	notice string) (bool, error) {
+	sent := memNotice{strings.ToLower(domain), owner, index, notice}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, item := range s.notices {
+		if item == sent {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) AddKeycardNotice(domain string, owner string, index int,
+	notice string) error {
+	domain = strings.ToLower(domain)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	notices := make([]memNotice, 0, len(s.notices)+1)
+	for _, item := range s.notices {
+		if item.domain != domain || item.owner != owner || item.index >= index {
+			notices = append(notices, item)
+		}
+	}
+	s.notices = append(notices, memNotice{domain, owner, index, notice})
+	return nil
+}
+
+func (s *memoryStore) GetRemoteKeycard(domain string, id string) (string, int, string, error) {
+	domain = strings.ToLower(domain)
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, card := range s.remotecards {
+		parts := strings.SplitN(key, "/", 2)
+		if parts[0] == domain && (parts[1] == id || card.uid == id) && card.expires > now {
+			return parts[1], card.revokedIndex, card.revocation, nil
+		}
+	}
+	return "", 0, "", nil
+}
+
+// GetRemoteEntries returns cached entries whether or not the keycard has expired, as does the
+// database version
+func (s *memoryStore) GetRemoteEntries(domain string, owner string, startIndex int,
+	endIndex int) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]string, 0, 10)
+	card, exists := s.remotecards[strings.ToLower(domain)+"/"+owner]
+	if !exists || len(card.entries) == 0 {
+		return out, nil
+	}
+	if startIndex < 1 {
+		return append(out, card.entries[len(card.entries)-1]), nil
+	}
+	for i, entry := range card.entries {
+		if i+1 >= startIndex && (endIndex < 1 || i+1 <= endIndex) {
+			out = append(out, entry)
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) SetRemoteKeycard(domain string, owner string, uid string, entries []string,
+	revokedIndex int, revocation string, expires string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remotecards[strings.ToLower(domain)+"/"+owner] = &memRemoteCard{uid, revokedIndex,
+		revocation, expires, append([]string{}, entries...)}
+	return nil
+}
+
+// getQuota returns the quota record for a workspace, creating it if needed. The caller must hold
+// the store's mutex.
+func (s *memoryStore) getQuota(wid string) *memQuota {
+	quota, exists := s.quotas[wid]
+	if !exists {
+		domain := ""
+		if ws, ok := s.workspaces[wid]; ok {
+			domain = ws.domain
+		}
+		quota = &memQuota{0, uint64(defaultDomainQuota(domain))}
+		s.quotas[wid] = quota
+	}
+	return quota
+}
+
+func (s *memoryStore) GetQuotaInfo(wid string) (uint64, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	quota := s.getQuota(wid)
+	return quota.usage, quota.quota, nil
+}
+
+func (s *memoryStore) ModifyQuotaUsage(wid string, amount int64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	quota := s.getQuota(wid)
+	newTotal := int64(quota.usage) + amount
+	if newTotal < 0 {
+		newTotal = 0
+	}
+	quota.usage = uint64(newTotal)
+	return quota.usage, nil
+}
+
+func (s *memoryStore) ResetQuotaUsage() error {
+	// The database version marks usage to be recounted from disk. There is no disk here, so the
+	// usage is always current.
+	return nil
+}
+
+func (s *memoryStore) SetQuota(wid string, quota uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.getQuota(wid).quota = quota
+	return nil
+}
+
+func (s *memoryStore) SetQuotaUsage(wid string, total uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.getQuota(wid).usage = total
+	return nil
+}
+
+func (s *memoryStore) LogFailure(failType string, wid string, sourceip string) error {
+	if failType == "" {
+		return errors.New("empty fail type")
+	}
+	if sourceip == "" {
+		return errors.New("empty source ip")
+	} else if net.ParseIP(sourceip) == nil {
+		return errors.New("bad source ip")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := failType + "/" + sourceip
+	failure, exists := s.failures[key]
+	if !exists {
+		failure = &memFailure{}
+		s.failures[key] = failure
+	}
+	failure.count++
+	if failure.count >= viper.GetInt("security.max_failures") {
+		delay := time.Duration(viper.GetInt64("security.lockout_delay_min")) * time.Minute
+		failure.lockoutUntil = time.Now().UTC().Add(delay)
+	}
+	return nil
+}
+
+func (s *memoryStore) CheckLockout(failType string, id string, source string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := failType + "/" + source
+	failure, exists := s.failures[key]
+	if !exists || failure.lockoutUntil.IsZero() {
+		return "", nil
+	}
+
+	// As with the database, an expired lockout is removed along with its failure count
+	if failure.lockoutUntil.Before(time.Now().UTC()) {
+		delete(s.failures, key)
+		return "", nil
+	}
+	return failure.lockoutUntil.Format(time.RFC3339), nil
+}
+
+func (s *memoryStore) PreregWorkspace(wid string, uid string, domain string,
+	wordList *diceware.Wordlist, wordcount int) (string, error) {
+	if len(wid) > 36 || len(uid) > 128 {
+		return "", errors.New("Bad parameter length")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(uid) > 0 {
+		for _, pr := range s.prereg {
+			if pr.uid == uid {
+				return "", errors.New("uid exists")
+			}
+		}
+	}
+	if _, exists := s.prereg[wid]; exists {
+		return "", errors.New("wid exists")
+	}
+
+	regcode, err := diceware.RollWords(wordcount, "-", *wordList)
+	if err != nil {
+		return "", err
+	}
+	s.prereg[wid] = &memPrereg{uid, domain, regcode}
+	return regcode, nil
+}
+
+func (s *memoryStore) CheckRegCode(id string, domain string, iswid bool,
+	regcode string) (string, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for wid, pr := range s.prereg {
+		if pr.regcode != regcode || pr.domain != domain {
+			continue
+		}
+		if iswid {
+			if wid == id {
+				return wid, pr.uid, nil
+			}
+			return "", "", errors.New("wid mismatch")
+		}
+		if pr.uid == id {
+			return wid, pr.uid, nil
+		}
+	}
+	return "", "", errors.New("regcode not found")
+}
+
+func (s *memoryStore) DeleteRegCode(id string, domain string, iswid bool, regcode string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for wid, pr := range s.prereg {
+		if pr.regcode != regcode || pr.domain != domain {
+			continue
+		}
+		if (iswid && wid == id) || (!iswid && pr.uid == id) {
+			delete(s.prereg, wid)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AddUnregRequest(wid string, graceUntil string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.unregs[wid] = &memUnreg{"pending", graceUntil, ""}
+	return nil
+}
+
+func (s *memoryStore) GetUnregRequest(wid string) (string, string, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	request, exists := s.unregs[wid]
+	if !exists {
+		return "", "", "", nil
+	}
+	return request.status, request.graceUntil, request.exportUntil, nil
+}
+
+func (s *memoryStore) GetUnregRequests(domain string) ([]UnregRequest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]UnregRequest, 0)
+	for wid, request := range s.unregs {
+		if ws, exists := s.workspaces[wid]; exists && ws.domain == domain {
+			out = append(out, UnregRequest{wid, request.status, request.graceUntil,
+				request.exportUntil})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].GraceUntil != out[j].GraceUntil {
+			return out[i].GraceUntil < out[j].GraceUntil
+		}
+		return out[i].WID < out[j].WID
+	})
+	return out, nil
+}
+
+func (s *memoryStore) ApproveUnregRequest(wid string, exportUntil string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if request, exists := s.unregs[wid]; exists {
+		request.status = "approved"
+		request.exportUntil = exportUntil
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteUnregRequest(wid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.unregs, wid)
+	return nil
+}
+
+func (s *memoryStore) GetExpiredUnregRequests() ([]string, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]string, 0)
+	for wid, request := range s.unregs {
+		if request.status == "approved" && request.exportUntil < now {
+			out = append(out, wid)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (s *memoryStore) RegisterWorkspace(reg Registration, change FSChange) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Nothing can fail once the checks are done, so the change is applied before anything is
+	// modified and never needs to be reverted
+	if _, exists := s.workspaces[reg.WID]; exists {
+		return errors.New("workspace exists")
+	}
+	if change != nil {
+		if err := change.Apply(); err != nil {
+			return err
+		}
+	}
+
+	passString := "-"
+	if reg.Type != "shared" {
+		passString = ezcrypt.HashPassword(reg.Password)
+	}
+	s.workspaces[reg.WID] = &memWorkspace{reg.UID, reg.Domain, reg.Type, reg.Status, passString}
+	if reg.DeviceID != "" {
+		s.devices[reg.WID] = map[string]*memDevice{
+			reg.DeviceID: {reg.DeviceKey.AsString(), "active"},
+		}
+	}
+	if reg.Admin != "" {
+		s.members[reg.WID] = map[string]string{reg.Admin: "admin"}
+	}
+
+	if reg.RegCode != "" {
+		for wid, pr := range s.prereg {
+			if pr.regcode != reg.RegCode || pr.domain != reg.Domain {
+				continue
+			}
+			if (reg.PreregIsWID && wid == reg.PreregID) ||
+				(!reg.PreregIsWID && pr.uid == reg.PreregID) {
+				delete(s.prereg, wid)
+			}
+		}
+	}
+
+	if change != nil {
+		finishChange(change)
+	}
+	return nil
+}
+
+func (s *memoryStore) UnregisterWorkspace(wid string, change FSChange) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if change != nil {
+		if err := change.Apply(); err != nil {
+			return err
+		}
+	}
+	s.removeWorkspace(wid)
+	if change != nil {
+		finishChange(change)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetWorkspaceIDs() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]string, 0)
+	for wid, ws := range s.workspaces {
+		if ws.status != "deleted" && ws.wtype != "alias" {
+			out = append(out, wid)
+		}
+	}
+	for wid := range s.prereg {
+		if _, exists := s.workspaces[wid]; !exists {
+			out = append(out, wid)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (s *memoryStore) GetOrphanedDevices() ([]OrphanedDevice, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]OrphanedDevice, 0)
+	for wid, devices := range s.devices {
+		if ws, exists := s.workspaces[wid]; exists && ws.status != "deleted" {
+			continue
+		}
+		for devid := range devices {
+			out = append(out, OrphanedDevice{wid, devid})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].WID != out[j].WID {
+			return out[i].WID < out[j].WID
+		}
+		return out[i].DevID < out[j].DevID
+	})
+	return out, nil
+}
@@ -0,0 +1,171 @@
+package dbhandler
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The database schema is changed only by migrations, which are SQL scripts kept in
+// migrations/<engine>. Each one is named with its version number and a short description, e.g.
+// 0002_add_widgets.sql, and the versions for each engine must start at 1 and have no gaps. The
+// versions which have been applied are recorded in the schema_version table. A migration must
+// never be changed once it has been released -- changes to the schema go in a new one, and each
+// engine needs its own version of it.
+
+//go:embed migrations
+var migrationFS embed.FS
+
+var migrationNamePattern = regexp.MustCompile(`^([0-9]{4})_([a-z0-9_]+)\.sql$`)
+
+// migrationSteps holds the work for migrations which need more than SQL, such as values from the
+// server's config. Each step runs after its migration's script, in the same transaction.
+var migrationSteps = map[int]func(tx *transaction) error{
+	2: setDefaultDomain,
+}
+
+// ErrSchemaTooNew is returned when the database has been migrated by a newer version of the
+// server than this one
+var ErrSchemaTooNew = errors.New("database schema is newer than this server supports")
+
+// Migration is a change to the database schema
+type Migration struct {
+	Version int
+	Name    string
+	script  string
+}
+
+// loadMigrations returns all migrations for an engine, sorted by version
+func loadMigrations(engine string) ([]Migration, error) {
+	dir := "migrations/" + engine
+	entries, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		parts := migrationNamePattern.FindStringSubmatch(entry.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("bad migration name %s", entry.Name())
+		}
+
+		// ReadDir sorts entries by name, so the versions are in order
+		version, _ := strconv.Atoi(parts[1])
+		if version != len(out)+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence", entry.Name())
+		}
+
+		script, err := fs.ReadFile(migrationFS, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Migration{version, parts[2], string(script)})
+	}
+	return out, nil
+}
+
+// LatestSchemaVersion returns the version of the newest schema known to the server
+func LatestSchemaVersion() (int, error) {
+	migrations, err := loadMigrations(dbConn.engine.Name())
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
+
+// SchemaVersion returns the version of the database's schema. Databases which have never been
+// migrated are at version 0.
+func SchemaVersion() (int, error) {
+	_, err := dbConn.Exec(`CREATE TABLE IF NOT EXISTS schema_version(version INTEGER PRIMARY KEY,
+		name VARCHAR(128) NOT NULL, applied VARCHAR(32) NOT NULL)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = dbConn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// PendingMigrations returns the migrations which have not yet been applied to the database. It
+// returns ErrSchemaTooNew if the database has been migrated past the latest known version.
+func PendingMigrations() ([]Migration, error) {
+	migrations, err := loadMigrations(dbConn.engine.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, ErrSchemaTooNew
+	}
+	return migrations[version:], nil
+}
+
+// Migrate applies all pending migrations to the database in order and returns the ones which were
+// applied. Each migration is applied in its own transaction along with its schema_version record,
+// so a failed migration leaves the database at the previous version. If two servers try to apply
+// the same migration at once, the second one fails when it tries to record it.
+func Migrate() ([]Migration, error) {
+	pending, err := PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0, len(pending))
+	for _, migration := range pending {
+		tx, err := dbConn.Begin()
+		if err != nil {
+			return applied, err
+		}
+
+		_, err = tx.Exec(migration.script)
+		if step, exists := migrationSteps[migration.Version]; exists && err == nil {
+			err = step(tx)
+		}
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_version(version, name, applied) `+
+				`VALUES($1, $2, $3)`, migration.Version, migration.Name, time.Now().UTC().Format(time.RFC3339))
+		}
+		if err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %04d_%s failed: %s", migration.Version,
+				migration.Name, err.Error())
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// setDefaultDomain fills in the domain of the keycard entries and organization keys which were
+// stored before migration 2 added it. Servers only hosted one domain then, so they all belong to
+// the one in the config file.
+func setDefaultDomain(tx *transaction) error {
+	domain := strings.ToLower(viper.GetString("global.domain"))
+	if domain == "" {
+		return errors.New("global.domain is not set")
+	}
+
+	_, err := tx.Exec(`UPDATE keycards SET domain=$1 WHERE domain=''`, domain)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE orgkeys SET domain=$1 WHERE domain=''`, domain)
+	return err
+}
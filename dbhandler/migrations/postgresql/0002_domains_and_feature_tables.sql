@@ -0,0 +1,56 @@
+-- Support for hosting more than one domain, and the tables for the features added along with it.
+-- Keycards and organization keys gain the domain they belong to. Before this, a server hosted only
+-- the domain in its config file, so the domain of existing rows is filled in from global.domain
+-- when the migration is applied.
+ALTER TABLE keycards ADD COLUMN domain VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE orgkeys ADD COLUMN domain VARCHAR(255) NOT NULL DEFAULT '';
+
+-- Members of shared workspaces. role can be 'read', 'write', or 'admin'
+CREATE TABLE swkspc_members(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL,
+	member CHAR(36) NOT NULL, role VARCHAR(16) NOT NULL);
+
+-- Self-service unregistration requests for servers using private or moderated registration.
+-- status can be 'pending' or 'approved'
+CREATE TABLE unregrequests(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL UNIQUE,
+	requested TIMESTAMP NOT NULL, grace_until TIMESTAMP NOT NULL, export_until TIMESTAMP,
+	status VARCHAR(16) NOT NULL);
+
+-- Administrative roles delegated to workspaces. role can be 'quota-manager', 'registrar',
+-- 'support', or 'auditor'. The admin workspace implicitly holds all roles.
+CREATE TABLE roles(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL,
+	role VARCHAR(32) NOT NULL);
+
+-- Revocations of user keycards. All entries with an index at or below index are revoked. record is
+-- the organization-signed revocation record which is given to clients.
+CREATE TABLE revocations(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL,
+	index INTEGER NOT NULL, revoked TIMESTAMP NOT NULL, record VARCHAR(2048) NOT NULL);
+
+-- Keycard transparency log. Every keycard entry added to the database is appended to the log for
+-- its domain. seq is the entry's position in the log and leafhash is its Merkle tree leaf hash.
+-- A position can only be taken once, so two entries added at the same time can't share one.
+CREATE TABLE translog(rowid SERIAL PRIMARY KEY, domain VARCHAR(255) NOT NULL,
+	seq BIGINT NOT NULL, fingerprint VARCHAR(96) NOT NULL, leafhash VARCHAR(96) NOT NULL,
+	UNIQUE(domain, seq));
+
+-- Keycards fetched from other Mensago servers. owner is 'organization' for an organization's
+-- keycard and the workspace ID for user keycards. uid is the User-ID field of a user's current
+-- entry, if it has one. Cached keycards are discarded after the expires time, which is set from
+-- the Time-To-Live field of the current entry.
+CREATE TABLE remotecards(rowid SERIAL PRIMARY KEY, domain VARCHAR(255) NOT NULL,
+	owner VARCHAR(64) NOT NULL, uid VARCHAR(64), revoked_index INTEGER NOT NULL,
+	revocation VARCHAR(2048), expires TIMESTAMP NOT NULL);
+
+CREATE TABLE remoteentries(rowid SERIAL PRIMARY KEY, domain VARCHAR(255) NOT NULL,
+	owner VARCHAR(64) NOT NULL, index INTEGER NOT NULL, entry VARCHAR(8192) NOT NULL);
+
+-- Protection for the organization's private keys when they are encrypted at rest. salt is used to
+-- derive the key-encryption key from a passphrase. verifier is a known value wrapped with the
+-- key-encryption key so that the server can tell when it has been given the wrong key.
+CREATE TABLE orgkeywrap(rowid SERIAL PRIMARY KEY, salt VARCHAR(64) NOT NULL,
+	verifier VARCHAR(256));
+
+-- Keycard expiration notices which have been sent to workspace owners. notice is 'expiring' when
+-- the entry is about to expire and 'expired' once it has.
+CREATE TABLE keycardnotices(rowid SERIAL PRIMARY KEY, domain VARCHAR(255) NOT NULL,
+	owner VARCHAR(64) NOT NULL, index INTEGER NOT NULL, notice VARCHAR(16) NOT NULL,
+	sent TIMESTAMP NOT NULL);
@@ -0,0 +1,44 @@
+-- The server's original schema for the SQLite engine. It matches the PostgreSQL one, with these
+-- differences: rowid columns are INTEGER PRIMARY KEY so that SQLite assigns them, the index column
+-- is quoted because it is a keyword in SQLite, and timestamps are TEXT in RFC 3339 format, which
+-- sorts correctly as long as all of them are in UTC.
+
+-- Lookup table for all workspaces. When any workspace is created, its wid is added here. userid is
+-- optional. wtype can be 'individual', 'shared', or 'alias'
+CREATE TABLE IF NOT EXISTS workspaces(rowid INTEGER PRIMARY KEY, wid CHAR(36) NOT NULL,
+	uid VARCHAR(64), domain VARCHAR(255) NOT NULL, wtype VARCHAR(32) NOT NULL,
+	status VARCHAR(16) NOT NULL, password VARCHAR(128));
+
+CREATE TABLE IF NOT EXISTS aliases(rowid INTEGER PRIMARY KEY, wid CHAR(36) NOT NULL,
+	alias CHAR(292) NOT NULL);
+
+CREATE TABLE IF NOT EXISTS passcodes(rowid INTEGER PRIMARY KEY, wid VARCHAR(36) NOT NULL UNIQUE,
+	passcode VARCHAR(128) NOT NULL, expires TEXT NOT NULL);
+
+CREATE TABLE IF NOT EXISTS failure_log(rowid INTEGER PRIMARY KEY, type VARCHAR(16) NOT NULL,
+	id VARCHAR(36), source VARCHAR(36) NOT NULL, count INTEGER,
+	last_failure TEXT NOT NULL, lockout_until TEXT);
+
+CREATE TABLE IF NOT EXISTS prereg(rowid INTEGER PRIMARY KEY, wid VARCHAR(36) NOT NULL UNIQUE,
+	uid VARCHAR(128) NOT NULL, domain VARCHAR(255) NOT NULL, regcode VARCHAR(128));
+
+-- Keycard entries. owner is 'organization' for entries in the organization's keycard and the
+-- workspace ID for user entries.
+CREATE TABLE IF NOT EXISTS keycards(rowid INTEGER PRIMARY KEY, owner VARCHAR(292) NOT NULL,
+	creationtime TEXT NOT NULL, "index" INTEGER NOT NULL,
+	entry VARCHAR(8192) NOT NULL, fingerprint VARCHAR(96) NOT NULL);
+
+CREATE TABLE IF NOT EXISTS orgkeys(rowid INTEGER PRIMARY KEY, creationtime TEXT NOT NULL,
+	pubkey VARCHAR(7000), privkey VARCHAR(7000) NOT NULL,
+	purpose VARCHAR(8) NOT NULL, fingerprint VARCHAR(96) NOT NULL);
+
+CREATE TABLE IF NOT EXISTS quotas(rowid INTEGER PRIMARY KEY, wid CHAR(36) NOT NULL,
+	usage BIGINT, quota BIGINT);
+
+-- Information about individual workspaces
+
+CREATE TABLE IF NOT EXISTS iwkspc_folders(rowid INTEGER PRIMARY KEY, wid char(36) NOT NULL,
+	enc_key VARCHAR(64) NOT NULL);
+
+CREATE TABLE IF NOT EXISTS iwkspc_devices(rowid INTEGER PRIMARY KEY, wid CHAR(36) NOT NULL,
+	devid CHAR(36) NOT NULL, devkey VARCHAR(1000) NOT NULL, status VARCHAR(16) NOT NULL);
@@ -0,0 +1,13 @@
+-- User IDs are unique within a domain. Workspaces without a user ID store an empty one, so they are
+-- left out of the index. Deleted workspaces keep their user IDs so that they aren't reused.
+--
+-- Server setup used to add a row without a password for the preregistered abuse and support
+-- workspaces, and registering them added a second row. Only the newest row of each workspace is
+-- kept. Any other workspaces which share a user ID lose it, except for the oldest one.
+DELETE FROM workspaces WHERE EXISTS (SELECT 1 FROM workspaces w2 WHERE w2.wid=workspaces.wid
+	AND w2.uid=workspaces.uid AND w2.domain=workspaces.domain AND w2.rowid > workspaces.rowid);
+
+UPDATE workspaces SET uid='' WHERE uid <> '' AND EXISTS (SELECT 1 FROM workspaces w2
+	WHERE w2.uid=workspaces.uid AND w2.domain=workspaces.domain AND w2.rowid < workspaces.rowid);
+
+CREATE UNIQUE INDEX workspaces_uid ON workspaces(uid, domain) WHERE uid <> '';
@@ -0,0 +1,59 @@
+package dbhandler
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
+)
+
+// SQLite's numbered placeholders are ?1, ?2, etc. Unlike its $-prefixed named placeholders, they
+// are bound by number, so a query can use them in any order and more than once.
+var placeholderPattern = regexp.MustCompile(`\$([0-9]+)`)
+
+// sqliteEngine stores the server's data in a single file with SQLite, which needs no database
+// server. The file is given by database.file in the server config and is created if it doesn't
+// exist. Its tables are created by the engine's migrations.
+type sqliteEngine struct{}
+
+func (e sqliteEngine) Name() string {
+	return "sqlite"
+}
+
+func (e sqliteEngine) Open() (*sql.DB, error) {
+	path := viper.GetString("database.file")
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server handles each client on its own goroutine, so connections wait on each other's
+	// locks instead of failing right away. Write-ahead logging keeps readers from blocking the
+	// writer, and transactions take the write lock when they start because SQLite can't upgrade
+	// a read lock held by one connection while another is waiting to write.
+	return sql.Open("sqlite3", "file:"+path+
+		"?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate")
+}
+
+func (e sqliteEngine) Rebind(query string) string {
+	return placeholderPattern.ReplaceAllString(query, "?$1")
+}
+
+func (e sqliteEngine) IsDBError(err error) bool {
+	_, ok := err.(sqlite3.Error)
+	return ok
+}
+
+func (e sqliteEngine) IsUnavailable(err error) bool {
+	// The database file can't be opened or read. A lock held past the busy timeout only means
+	// that another connection is slow, like a query which times out.
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrCantOpen || sqliteErr.Code == sqlite3.ErrIoErr
+}
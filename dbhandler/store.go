@@ -0,0 +1,476 @@
+package dbhandler
+
+import (
+	"context"
+
+	"github.com/darkwyrm/gostringlist"
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/ezcrypt"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/everlastingbeta/diceware"
+)
+
+// Command handlers reach the data they need through a Store instead of calling this package's
+// functions directly, so that they can be tested without a database. NewSQLStore returns the Store
+// used by the server, which does the same work as the functions of the same name in this package
+// but with queries tied to a context, such as a client's session. NewMemoryStore returns one
+// which keeps everything in memory for tests.
+
+// WorkspaceStore manages workspaces and their passwords
+type WorkspaceStore interface {
+	AddWorkspace(wid string, uid string, domain string, password string, status string,
+		wtype string) error
+	RemoveWorkspace(wid string) error
+	CheckWorkspace(wid string) (bool, string)
+	CheckUserID(uid string, domain string) (bool, string)
+	SetWorkspaceStatus(wid string, status string) error
+	GetWorkspaceDomain(wid string) (string, error)
+	GetWorkspaceType(wid string) (string, error)
+	SetPassword(wid string, password string) error
+	CheckPassword(wid string, password string) (bool, error)
+	RehashPassword(wid string, password string) (bool, error)
+	CountLegacyPasswords(domain string) (int, int, int, error)
+	ResolveAddress(addr string) (string, error)
+	LookupAddress(addr string) (string, error)
+}
+
+// PasscodeStore manages the codes used to reset the passwords of workspaces
+type PasscodeStore interface {
+	ResetPassword(wid string, passcode string, expires string) error
+	CheckPasscode(wid string, passcode string) (bool, error)
+	DeletePasscode(wid string, passcode string) error
+}
+
+// AliasStore manages alias workspaces, which forward to another workspace
+type AliasStore interface {
+	AddAlias(aliasWid string, uid string, domain string, target string) error
+	RemoveAlias(aliasWid string) error
+	GetAliasTarget(aliasWid string) (string, error)
+	GetAliases(wid string) (gostringlist.StringList, error)
+	IsAlias(wid string) (bool, error)
+}
+
+// DeviceStore manages the devices which are allowed to log into a workspace
+type DeviceStore interface {
+	AddDevice(wid string, devid string, devkey cryptostring.CryptoString, status string) error
+	RemoveDevice(wid string, devid string) (bool, error)
+	CheckDevice(wid string, devid string, devkey string) (bool, error)
+	UpdateDevice(wid string, devid string, oldkey string, newkey string) error
+}
+
+// MemberStore manages the members of shared workspaces and their roles
+type MemberStore interface {
+	AddMember(wid string, member string, role string) error
+	RemoveMember(wid string, member string) error
+	GetMemberRole(wid string, member string) (string, error)
+	GetMembers(wid string) (map[string]string, error)
+}
+
+// RoleStore manages the administrative roles delegated to workspaces
+type RoleStore interface {
+	AddRole(wid string, role string) error
+	RemoveRole(wid string, role string) error
+	GetRoles(wid string) (gostringlist.StringList, error)
+	HasRole(wid string, role string) (bool, error)
+}
+
+// KeycardStore manages the keycards of hosted domains and their workspaces, the organizations'
+// keys, revocations, and the expiration notices sent for them. Asking for the current entry of a
+// keycard which doesn't exist returns sql.ErrNoRows.
+type KeycardStore interface {
+	GetOrgEntries(domain string, startIndex int, endIndex int) ([]string, error)
+	GetUserEntries(wid string, startIndex int, endIndex int) ([]string, error)
+	AddEntry(entry *keycard.Entry) error
+	AddOrgEntry(domain string, entry *keycard.Entry,
+		keys map[string]cryptostring.CryptoString) error
+	GetPrimarySigningKey(domain string) (string, error)
+	GetEncryptionPair(domain string) (*ezcrypt.EncryptionPair, error)
+	AddRevocation(wid string, index int, revoked string, record string) error
+	GetRevocation(wid string) (int, string, error)
+	GetRevokedIndices(wid string) ([]int, error)
+	GetKeycardOwners(domain string) ([]string, error)
+	CheckKeycardNotice(domain string, owner string, index int, notice string) (bool, error)
+	AddKeycardNotice(domain string, owner string, index int, notice string) error
+}
+
+// TransLogStore reads the keycard transparency logs of hosted domains. Entries are appended to a
+// domain's log by KeycardStore when they are added to a keycard.
+type TransLogStore interface {
+	GetLogSize(domain string) (int, error)
+	GetLogLeaves(domain string, size int) ([][]byte, error)
+	GetLogIndex(domain string, fingerprint string) (int, error)
+}
+
+// RemoteCardStore caches the keycards of other organizations and their users
+type RemoteCardStore interface {
+	GetRemoteKeycard(domain string, id string) (string, int, string, error)
+	GetRemoteEntries(domain string, owner string, startIndex int, endIndex int) ([]string, error)
+	SetRemoteKeycard(domain string, owner string, uid string, entries []string, revokedIndex int,
+		revocation string, expires string) error
+}
+
+// QuotaStore manages disk quotas and usage
+type QuotaStore interface {
+	GetQuotaInfo(wid string) (uint64, uint64, error)
+	ModifyQuotaUsage(wid string, amount int64) (uint64, error)
+	ResetQuotaUsage() error
+	SetQuota(wid string, quota uint64) error
+	SetQuotaUsage(wid string, total uint64) error
+}
+
+// FailureStore tracks failed attempts at logins, registration, and so on, and the lockouts which
+// result from them
+type FailureStore interface {
+	LogFailure(failType string, wid string, sourceip string) error
+	CheckLockout(failType string, id string, source string) (string, error)
+}
+
+// PreregStore manages preregistered workspaces and their registration codes
+type PreregStore interface {
+	PreregWorkspace(wid string, uid string, domain string, wordList *diceware.Wordlist,
+		wordcount int) (string, error)
+	CheckRegCode(id string, domain string, iswid bool, regcode string) (string, string, error)
+	DeleteRegCode(id string, domain string, iswid bool, regcode string) error
+}
+
+// UnregStore manages the queue of requests from users to remove their workspaces
+type UnregStore interface {
+	AddUnregRequest(wid string, graceUntil string) error
+	GetUnregRequest(wid string) (string, string, string, error)
+	GetUnregRequests(domain string) ([]UnregRequest, error)
+	ApproveUnregRequest(wid string, exportUntil string) error
+	DeleteUnregRequest(wid string) error
+	GetExpiredUnregRequests() ([]string, error)
+}
+
+// AccountStore performs account operations which span several tables and the filesystem, and
+// finds the inconsistencies left behind when they fail partway through
+type AccountStore interface {
+	RegisterWorkspace(reg Registration, change FSChange) error
+	UnregisterWorkspace(wid string, change FSChange) error
+	GetWorkspaceIDs() ([]string, error)
+	GetOrphanedDevices() ([]OrphanedDevice, error)
+}
+
+// Store is the data access used by command handlers
+type Store struct {
+	Workspaces  WorkspaceStore
+	Passcodes   PasscodeStore
+	Aliases     AliasStore
+	Devices     DeviceStore
+	Members     MemberStore
+	Roles       RoleStore
+	Keycards    KeycardStore
+	TransLog    TransLogStore
+	RemoteCards RemoteCardStore
+	Quotas      QuotaStore
+	Failures    FailureStore
+	Prereg      PreregStore
+	Unregs      UnregStore
+	Accounts    AccountStore
+}
+
+// NewSQLStore returns a Store which uses the server's database. Its queries are canceled when ctx
+// is done, so a session's queries don't outlive it. Connect() must be called before it is used.
+func NewSQLStore(ctx context.Context) *Store {
+	s := sqlStore{dbConn.WithContext(ctx)}
+	return &Store{s, s, s, s, s, s, s, s, s, s, s, s, s, s}
+}
+
+// sqlStore implements all of the Store interfaces with the same functions as this package's
+// exported ones, using its own connection
+type sqlStore struct {
+	db *database
+}
+
+func (s sqlStore) AddWorkspace(wid string, uid string, domain string, password string,
+	status string, wtype string) error {
+	return addWorkspace(s.db, wid, uid, domain, password, status, wtype)
+}
+
+func (s sqlStore) RemoveWorkspace(wid string) error {
+	return removeWorkspace(s.db, wid)
+}
+
+func (s sqlStore) CheckWorkspace(wid string) (bool, string) {
+	return checkWorkspace(s.db, wid)
+}
+
+func (s sqlStore) CheckUserID(uid string, domain string) (bool, string) {
+	return checkUserID(s.db, uid, domain)
+}
+
+func (s sqlStore) SetWorkspaceStatus(wid string, status string) error {
+	return setWorkspaceStatus(s.db, wid, status)
+}
+
+func (s sqlStore) GetWorkspaceDomain(wid string) (string, error) {
+	return getWorkspaceDomain(s.db, wid)
+}
+
+func (s sqlStore) GetWorkspaceType(wid string) (string, error) {
+	return getWorkspaceType(s.db, wid)
+}
+
+func (s sqlStore) SetPassword(wid string, password string) error {
+	return setPassword(s.db, wid, password)
+}
+
+func (s sqlStore) CheckPassword(wid string, password string) (bool, error) {
+	return checkPassword(s.db, wid, password)
+}
+
+func (s sqlStore) RehashPassword(wid string, password string) (bool, error) {
+	return rehashPassword(s.db, wid, password)
+}
+
+func (s sqlStore) CountLegacyPasswords(domain string) (int, int, int, error) {
+	return countLegacyPasswords(s.db, domain)
+}
+
+func (s sqlStore) ResolveAddress(addr string) (string, error) {
+	return resolveAddress(s.db, addr)
+}
+
+func (s sqlStore) LookupAddress(addr string) (string, error) {
+	return lookupAddress(s.db, addr)
+}
+
+func (s sqlStore) ResetPassword(wid string, passcode string, expires string) error {
+	return resetPassword(s.db, wid, passcode, expires)
+}
+
+func (s sqlStore) CheckPasscode(wid string, passcode string) (bool, error) {
+	return checkPasscode(s.db, wid, passcode)
+}
+
+func (s sqlStore) DeletePasscode(wid string, passcode string) error {
+	return deletePasscode(s.db, wid, passcode)
+}
+
+func (s sqlStore) AddAlias(aliasWid string, uid string, domain string, target string) error {
+	return addAlias(s.db, aliasWid, uid, domain, target)
+}
+
+func (s sqlStore) RemoveAlias(aliasWid string) error {
+	return removeAlias(s.db, aliasWid)
+}
+
+func (s sqlStore) GetAliasTarget(aliasWid string) (string, error) {
+	return getAliasTarget(s.db, aliasWid)
+}
+
+func (s sqlStore) GetAliases(wid string) (gostringlist.StringList, error) {
+	return getAliases(s.db, wid)
+}
+
+func (s sqlStore) IsAlias(wid string) (bool, error) {
+	return isAlias(s.db, wid)
+}
+
+func (s sqlStore) AddDevice(wid string, devid string, devkey cryptostring.CryptoString,
+	status string) error {
+	return addDevice(s.db, wid, devid, devkey, status)
+}
+
+func (s sqlStore) RemoveDevice(wid string, devid string) (bool, error) {
+	return removeDevice(s.db, wid, devid)
+}
+
+func (s sqlStore) CheckDevice(wid string, devid string, devkey string) (bool, error) {
+	return checkDevice(s.db, wid, devid, devkey)
+}
+
+func (s sqlStore) UpdateDevice(wid string, devid string, oldkey string, newkey string) error {
+	return updateDevice(s.db, wid, devid, oldkey, newkey)
+}
+
+func (s sqlStore) AddMember(wid string, member string, role string) error {
+	return addMember(s.db, wid, member, role)
+}
+
+func (s sqlStore) RemoveMember(wid string, member string) error {
+	return removeMember(s.db, wid, member)
+}
+
+func (s sqlStore) GetMemberRole(wid string, member string) (string, error) {
+	return getMemberRole(s.db, wid, member)
+}
+
+func (s sqlStore) GetMembers(wid string) (map[string]string, error) {
+	return getMembers(s.db, wid)
+}
+
+func (s sqlStore) AddRole(wid string, role string) error {
+	return addRole(s.db, wid, role)
+}
+
+func (s sqlStore) RemoveRole(wid string, role string) error {
+	return removeRole(s.db, wid, role)
+}
+
+func (s sqlStore) GetRoles(wid string) (gostringlist.StringList, error) {
+	return getRoles(s.db, wid)
+}
+
+func (s sqlStore) HasRole(wid string, role string) (bool, error) {
+	return hasRole(s.db, wid, role)
+}
+
+func (s sqlStore) GetOrgEntries(domain string, startIndex int, endIndex int) ([]string, error) {
+	return getOrgEntries(s.db, domain, startIndex, endIndex)
+}
+
+func (s sqlStore) GetUserEntries(wid string, startIndex int, endIndex int) ([]string, error) {
+	return getUserEntries(s.db, wid, startIndex, endIndex)
+}
+
+func (s sqlStore) AddEntry(entry *keycard.Entry) error {
+	return addEntry(s.db, entry)
+}
+
+func (s sqlStore) AddOrgEntry(domain string, entry *keycard.Entry,
+	keys map[string]cryptostring.CryptoString) error {
+	return addOrgEntry(s.db, domain, entry, keys)
+}
+
+func (s sqlStore) GetPrimarySigningKey(domain string) (string, error) {
+	return getPrimarySigningKey(s.db, domain)
+}
+
+func (s sqlStore) GetEncryptionPair(domain string) (*ezcrypt.EncryptionPair, error) {
+	return getEncryptionPair(s.db, domain)
+}
+
+func (s sqlStore) AddRevocation(wid string, index int, revoked string, record string) error {
+	return addRevocation(s.db, wid, index, revoked, record)
+}
+
+func (s sqlStore) GetRevocation(wid string) (int, string, error) {
+	return getRevocation(s.db, wid)
+}
+
+func (s sqlStore) GetRevokedIndices(wid string) ([]int, error) {
+	return getRevokedIndices(s.db, wid)
+}
+
+func (s sqlStore) GetKeycardOwners(domain string) ([]string, error) {
+	return getKeycardOwners(s.db, domain)
+}
+
+func (s sqlStore) CheckKeycardNotice(domain string, owner string, index int,
+	notice string) (bool, error) {
+	return checkKeycardNotice(s.db, domain, owner, index, notice)
+}
+
+func (s sqlStore) AddKeycardNotice(domain string, owner string, index int, notice string) error {
+	return addKeycardNotice(s.db, domain, owner, index, notice)
+}
+
+func (s sqlStore) GetLogSize(domain string) (int, error) {
+	return getLogSize(s.db, domain)
+}
+
+func (s sqlStore) GetLogLeaves(domain string, size int) ([][]byte, error) {
+	return getLogLeaves(s.db, domain, size)
+}
+
+func (s sqlStore) GetLogIndex(domain string, fingerprint string) (int, error) {
+	return getLogIndex(s.db, domain, fingerprint)
+}
+
+func (s sqlStore) GetRemoteKeycard(domain string, id string) (string, int, string, error) {
+	return getRemoteKeycard(s.db, domain, id)
+}
+
+func (s sqlStore) GetRemoteEntries(domain string, owner string, startIndex int,
+	endIndex int) ([]string, error) {
+	return getRemoteEntries(s.db, domain, owner, startIndex, endIndex)
+}
+
+func (s sqlStore) SetRemoteKeycard(domain string, owner string, uid string, entries []string,
+	revokedIndex int, revocation string, expires string) error {
+	return setRemoteKeycard(s.db, domain, owner, uid, entries, revokedIndex, revocation, expires)
+}
+
+func (s sqlStore) GetQuotaInfo(wid string) (uint64, uint64, error) {
+	return getQuotaInfo(s.db, wid)
+}
+
+func (s sqlStore) ModifyQuotaUsage(wid string, amount int64) (uint64, error) {
+	return modifyQuotaUsage(s.db, wid, amount)
+}
+
+func (s sqlStore) ResetQuotaUsage() error {
+	return resetQuotaUsage(s.db)
+}
+
+func (s sqlStore) SetQuota(wid string, quota uint64) error {
+	return setQuota(s.db, wid, quota)
+}
+
+func (s sqlStore) SetQuotaUsage(wid string, total uint64) error {
+	return setQuotaUsage(s.db, wid, total)
+}
+
+func (s sqlStore) LogFailure(failType string, wid string, sourceip string) error {
+	return logFailure(s.db, failType, wid, sourceip)
+}
+
+func (s sqlStore) CheckLockout(failType string, id string, source string) (string, error) {
+	return checkLockout(s.db, failType, id, source)
+}
+
+func (s sqlStore) PreregWorkspace(wid string, uid string, domain string,
+	wordList *diceware.Wordlist, wordcount int) (string, error) {
+	return preregWorkspace(s.db, wid, uid, domain, wordList, wordcount)
+}
+
+func (s sqlStore) CheckRegCode(id string, domain string, iswid bool,
+	regcode string) (string, string, error) {
+	return checkRegCode(s.db, id, domain, iswid, regcode)
+}
+
+func (s sqlStore) DeleteRegCode(id string, domain string, iswid bool, regcode string) error {
+	return deleteRegCode(s.db, id, domain, iswid, regcode)
+}
+
+func (s sqlStore) AddUnregRequest(wid string, graceUntil string) error {
+	return addUnregRequest(s.db, wid, graceUntil)
+}
+
+func (s sqlStore) GetUnregRequest(wid string) (string, string, string, error) {
+	return getUnregRequest(s.db, wid)
+}
+
+func (s sqlStore) GetUnregRequests(domain string) ([]UnregRequest, error) {
+	return getUnregRequests(s.db, domain)
+}
+
+func (s sqlStore) ApproveUnregRequest(wid string, exportUntil string) error {
+	return approveUnregRequest(s.db, wid, exportUntil)
+}
+
+func (s sqlStore) DeleteUnregRequest(wid string) error {
+	return deleteUnregRequest(s.db, wid)
+}
+
+func (s sqlStore) GetExpiredUnregRequests() ([]string, error) {
+	return getExpiredUnregRequests(s.db)
+}
+
+func (s sqlStore) RegisterWorkspace(reg Registration, change FSChange) error {
+	return registerWorkspace(s.db, reg, change)
+}
+
+func (s sqlStore) UnregisterWorkspace(wid string, change FSChange) error {
+	return unregisterWorkspace(s.db, wid, change)
+}
+
+func (s sqlStore) GetWorkspaceIDs() ([]string, error) {
+	return getWorkspaceIDs(s.db)
+}
+
+func (s sqlStore) GetOrphanedDevices() ([]OrphanedDevice, error) {
+	return getOrphanedDevices(s.db)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/logging"
+)
+
+// getSessionDomain returns the domain a session operates in. This is the domain of the logged-in
+// workspace or the server's primary domain if the client hasn't logged in.
+func getSessionDomain(session *sessionState) string {
+	if session.Domain != "" {
+		return session.Domain
+	}
+	return config.PrimaryDomain()
+}
+
+// getRequestDomain returns the domain used by the current request. This is the request's Domain
+// field, if present, and the session's domain otherwise. If the server does not host the
+// requested domain, a 404 response is sent to the client and false is returned.
+func getRequestDomain(session *sessionState) (string, bool) {
+	if !session.Message.HasField("Domain") || session.Message.Data["Domain"] == "" {
+		return getSessionDomain(session), true
+	}
+
+	domain := strings.ToLower(session.Message.Data["Domain"])
+	if !config.IsHostedDomain(domain) {
+		session.SendStringResponse(404, "NOT FOUND", "Domain not hosted on this server")
+		return "", false
+	}
+	return domain, true
+}
+
+// getDomainConfig returns the settings for a domain used by the current request. If the server
+// does not host the domain, a 404 response is sent to the client and false is returned.
+func getDomainConfig(session *sessionState, domain string) (config.DomainConfig, bool) {
+	dc, ok := config.GetDomain(domain)
+	if !ok {
+		session.SendStringResponse(404, "NOT FOUND", "Domain not hosted on this server")
+		logging.Writef("getDomainConfig: no settings for domain %s", domain)
+	}
+	return dc, ok
+}
+
+// checkSameDomain makes sure that a workspace belongs to the same domain as the session. Privileged
+// users of one hosted domain may not manage the workspaces of another. If the workspace belongs to
+// another domain, the appropriate response is sent to the client and false is returned.
+func checkSameDomain(session *sessionState, wid string) bool {
+	domain, err := session.Store.Workspaces.GetWorkspaceDomain(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("checkSameDomain: error getting workspace domain: %s", err.Error())
+		return false
+	}
+
+	// Nonexistent workspaces are left for the caller to handle
+	if domain != "" && domain != getSessionDomain(session) {
+		session.SendStringResponse(403, "FORBIDDEN", "Workspace belongs to another domain")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/ezcrypt"
+	"github.com/darkwyrm/mensagod/fshandler"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/darkwyrm/mensagod/logging"
+	"github.com/spf13/viper"
+)
+
+// Keycard entries expire, and an expired current entry makes its keycard unusable until the owner
+// adds a new one. The server watches the current entry of each keycard it hosts and leaves a
+// notice in the owner's workspace when it is about to expire and again once it has. Notices for
+// the organization's keycard go to the domain's admin.
+
+// expiringCard describes a keycard whose current entry has expired or will expire soon
+type expiringCard struct {
+	Owner   string
+	Index   int
+	Expires string
+	Expired bool
+}
+
+func (c expiringCard) String() string {
+	return fmt.Sprintf("%s,%d,%s", c.Owner, c.Index, c.Expires)
+}
+
+// expirationNotice is the payload of the notice placed in a workspace. It is encrypted with the
+// recipient's public encryption key.
+type expirationNotice struct {
+	Owner   string
+	Domain  string
+	Index   string
+	Expires string
+	Status  string
+	Message string
+}
+
+// findExpiringCards returns the keycards for a hosted domain whose current entries have expired
+// or will expire within the specified number of days
+func findExpiringCards(store *dbhandler.Store, domain string, days int) ([]expiringCard, error) {
+	out := make([]expiringCard, 0)
+	limit := time.Now().UTC().AddDate(0, 0, days)
+
+	// A domain which is still being set up may not have a keycard yet
+	entryList, err := store.Keycards.GetOrgEntries(domain, 0, 0)
+	if err != nil && err != sql.ErrNoRows {
+		return out, err
+	}
+	if card, ok := checkExpiration("organization", entryList, limit); ok {
+		out = append(out, card)
+	}
+
+	owners, err := store.Keycards.GetKeycardOwners(domain)
+	if err != nil {
+		return out, err
+	}
+	for _, wid := range owners {
+		entryList, err = store.Keycards.GetUserEntries(wid, 0, 0)
+		if err != nil {
+			return out, err
+		}
+		if card, ok := checkExpiration(wid, entryList, limit); ok {
+			out = append(out, card)
+		}
+	}
+	return out, nil
+}
+
+// checkExpiration returns an expiringCard if the current entry in entryList expires before the
+// limit. Entries which can't be read are left to the chain verifier to report.
+func checkExpiration(owner string, entryList []string, limit time.Time) (expiringCard, bool) {
+	if len(entryList) == 0 {
+		return expiringCard{}, false
+	}
+	entry, err := keycard.NewEntryFromData(entryList[0])
+	if err != nil {
+		return expiringCard{}, false
+	}
+	expires, err := time.Parse("20060102", entry.Fields["Expires"])
+	if err != nil || expires.After(limit) {
+		return expiringCard{}, false
+	}
+
+	expired, _ := entry.IsExpired()
+	index, _ := strconv.Atoi(entry.Fields["Index"])
+	return expiringCard{owner, index, entry.Fields["Expires"], expired}, true
+}
+
+// processKeycardExpirations sends expiration notices for the keycards of all hosted domains. Each
+// kind of notice is only sent once per entry.
+func processKeycardExpirations(store *dbhandler.Store) {
+	days := viper.GetInt("security.keycard_notice_days")
+	for _, domain := range config.HostedDomains() {
+		cards, err := findExpiringCards(store, domain, days)
+		if err != nil {
+			logging.Writef("processKeycardExpirations: error reading keycards for %s: %s",
+				domain, err.Error())
+			continue
+		}
+
+		for _, card := range cards {
+			notice := "expiring"
+			if card.Expired {
+				notice = "expired"
+			}
+
+			sent, err := store.Keycards.CheckKeycardNotice(domain, card.Owner, card.Index, notice)
+			if err != nil {
+				logging.Writef("processKeycardExpirations: error checking notices: %s",
+					err.Error())
+				return
+			}
+			if sent {
+				continue
+			}
+
+			err = sendExpirationNotice(store, domain, card, notice)
+			if err != nil {
+				logging.Writef("processKeycardExpirations: couldn't notify owner of %s/%s: %s",
+					card.Owner, domain, err.Error())
+				continue
+			}
+
+			err = store.Keycards.AddKeycardNotice(domain, card.Owner, card.Index, notice)
+			if err != nil {
+				logging.Writef("processKeycardExpirations: error recording notice: %s",
+					err.Error())
+			}
+		}
+	}
+}
+
+// sendExpirationNotice places an expiration notice for a keycard in the workspace of the
+// keycard's owner
+func sendExpirationNotice(store *dbhandler.Store, domain string, card expiringCard,
+	notice string) error {
+	recipient := card.Owner
+	message := fmt.Sprintf("Your keycard expires on %s. Please add a new entry to renew it.",
+		card.Expires)
+	if card.Expired {
+		message = fmt.Sprintf("Your keycard expired on %s. Please add a new entry to renew it.",
+			card.Expires)
+	}
+
+	if card.Owner == "organization" {
+		adminWid, err := store.Workspaces.ResolveAddress("admin/" + domain)
+		if err != nil {
+			return err
+		}
+		recipient = adminWid
+		message = strings.Replace(message, "Your keycard", "The organization's keycard", 1)
+	}
+
+	exists, status := store.Workspaces.CheckWorkspace(recipient)
+	if !exists || status != "active" {
+		return fmt.Errorf("workspace %s not active", recipient)
+	}
+
+	payload, err := json.Marshal(expirationNotice{
+		Owner:   card.Owner,
+		Domain:  domain,
+		Index:   strconv.Itoa(card.Index),
+		Expires: card.Expires,
+		Status:  notice,
+		Message: message,
+	})
+	if err != nil {
+		return err
+	}
+	return queueNotice(store, recipient, domain, "keycardexpiration", payload)
+}
+
+// queueNotice encrypts a system notice with the recipient's current encryption key and saves it
+// in the top level of the recipient's workspace, where the client picks up new items
+func queueNotice(store *dbhandler.Store, wid string, domain string, subtype string,
+	payload []byte) error {
+	entryList, err := store.Keycards.GetUserEntries(wid, 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(entryList) == 0 {
+		return fmt.Errorf("no keycard for %s", wid)
+	}
+	entry, err := keycard.NewEntryFromData(entryList[0])
+	if err != nil {
+		return err
+	}
+
+	var pubkey cryptostring.CryptoString
+	err = pubkey.Set(entry.Fields["Public-Encryption-Key"])
+	if err != nil {
+		return err
+	}
+	encrypted, err := ezcrypt.NewEncryptionKey(pubkey).Encrypt(payload)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"Type":    "sysnotice",
+		"Subtype": subtype,
+		"Version": "1.0",
+		"From":    domain,
+		"To":      wid + "/" + domain,
+		"Date":    time.Now().UTC().Format(time.RFC3339),
+		"Payload": pubkey.Prefix + ":" + encrypted,
+	})
+	if err != nil {
+		return err
+	}
+
+	fsp := fshandler.GetFSProvider()
+	wsPath := "/ " + wid
+	err = fsp.MakeDirectory(wsPath)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+
+	handle, tempName, err := fsp.MakeTempFile(wid)
+	if err != nil {
+		return err
+	}
+	_, err = handle.Write(data)
+	handle.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = fsp.InstallTempFile(wid, tempName, wsPath)
+	return err
+}
+
+func commandExpiringCards(session *sessionState) {
+	// command syntax:
+	// EXPIRINGCARDS(Days="")
+
+	if !checkRole(session, roleAuditor) {
+		return
+	}
+
+	days := viper.GetInt("security.keycard_notice_days")
+	if session.Message.HasField("Days") {
+		var err error
+		days, err = strconv.Atoi(session.Message.Data["Days"])
+		if err != nil || days < 0 || days > 1095 {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Days")
+			return
+		}
+	}
+
+	cards, err := findExpiringCards(session.Store, getSessionDomain(session), days)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandExpiringCards: error reading keycards: %s", err.Error())
+		return
+	}
+
+	expiring := make([]string, 0)
+	expired := make([]string, 0)
+	for _, card := range cards {
+		if card.Expired {
+			expired = append(expired, card.String())
+		} else {
+			expiring = append(expiring, card.String())
+		}
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Expiring-Count"] = fmt.Sprintf("%d", len(expiring))
+	response.Data["Expiring"] = strings.Join(expiring, "\r\n")
+	response.Data["Expired-Count"] = fmt.Sprintf("%d", len(expired))
+	response.Data["Expired"] = strings.Join(expired, "\r\n")
+	session.SendResponse(*response)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/spf13/viper"
+)
+
+// addExpiringEntry adds an entry to a user's keycard which expires after the given number of days
+func addExpiringEntry(store *dbhandler.Store, wid string, domain string, index string,
+	days int) error {
+	entry, err := newExpiringEntry(wid, domain, index, days)
+	if err != nil {
+		return err
+	}
+	return store.Keycards.AddEntry(entry)
+}
+
+// newExpiringEntry returns an unsigned user keycard entry which expires after the given number of
+// days
+func newExpiringEntry(wid string, domain string, index string, days int) (*keycard.Entry, error) {
+	keys, err := keycard.GenerateUserKeys(true)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{
+		"Index":        index,
+		"Workspace-ID": wid,
+		"Domain":       domain,
+		"Expires":      time.Now().UTC().AddDate(0, 0, days).Format("20060102"),
+	}
+	for _, name := range []string{"Contact-Request-Verification-Key",
+		"Contact-Request-Encryption-Key", "Public-Encryption-Key"} {
+		key := keys[name+".public"]
+		fields[name] = key.AsString()
+	}
+
+	entry := keycard.NewUserEntry()
+	entry.SetFields(fields)
+	return entry, nil
+}
+
+// countNotices returns the number of items in the top level of a workspace
+func countNotices(wid string) (int, error) {
+	items, err := ioutil.ReadDir(filepath.Join(viper.GetString("global.workspace_dir"), wid))
+	return len(items), err
+}
+
+func TestProcessKeycardExpirations(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	domain := config.HostedDomains()[0]
+	wid := "11111111-1111-1111-1111-111111111111"
+	err := store.Workspaces.AddWorkspace(wid, "csimons", domain, "-", "active", "individual")
+	if err != nil {
+		t.Fatalf("TestProcessKeycardExpirations: Couldn't add workspace: %s", err.Error())
+	}
+
+	// The workspace's folder already exists, as it does once the workspace has logged in
+	wsPath := filepath.Join(viper.GetString("global.workspace_dir"), wid)
+	err = os.MkdirAll(wsPath, 0700)
+	if err != nil {
+		t.Fatalf("TestProcessKeycardExpirations: Couldn't make workspace folder: %s", err.Error())
+	}
+	defer os.RemoveAll(wsPath)
+	defer os.RemoveAll(filepath.Join(viper.GetString("global.workspace_dir"), "tmp", wid))
+
+	// Subtest #1: An entry which expires soon gets an 'expiring' notice
+
+	err = addExpiringEntry(store, wid, domain, "1", 5)
+	if err != nil {
+		t.Fatalf("TestProcessKeycardExpirations: #1: Couldn't add entry: %s", err.Error())
+	}
+	processKeycardExpirations(store)
+
+	count, err := countNotices(wid)
+	if err != nil || count != 1 {
+		t.Fatalf("TestProcessKeycardExpirations: #1: expected 1 notice, found %d (%v)", count,
+			err)
+	}
+	sent, err := store.Keycards.CheckKeycardNotice(domain, wid, 1, "expiring")
+	if err != nil || !sent {
+		t.Fatal("TestProcessKeycardExpirations: #1: notice wasn't recorded")
+	}
+
+	// Subtest #2: A notice is only sent once
+
+	processKeycardExpirations(store)
+	count, err = countNotices(wid)
+	if err != nil || count != 1 {
+		t.Fatalf("TestProcessKeycardExpirations: #2: expected 1 notice, found %d (%v)", count,
+			err)
+	}
+
+	// Subtest #3: An expired entry gets an 'expired' notice
+
+	err = addExpiringEntry(store, wid, domain, "2", -1)
+	if err != nil {
+		t.Fatalf("TestProcessKeycardExpirations: #3: Couldn't add entry: %s", err.Error())
+	}
+	processKeycardExpirations(store)
+
+	count, err = countNotices(wid)
+	if err != nil || count != 2 {
+		t.Fatalf("TestProcessKeycardExpirations: #3: expected 2 notices, found %d (%v)", count,
+			err)
+	}
+	sent, err = store.Keycards.CheckKeycardNotice(domain, wid, 2, "expired")
+	if err != nil || !sent {
+		t.Fatal("TestProcessKeycardExpirations: #3: notice wasn't recorded")
+	}
+}
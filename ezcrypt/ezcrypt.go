@@ -62,7 +62,11 @@ func (vkey VerificationKey) Verify(data []byte, signature cryptostring.CryptoStr
 		return false, errors.New("invalid signature")
 	}
 
-	if signature.Prefix != "ED25519" {
+	if signature.Prefix != vkey.key.Prefix {
+		return false, errors.New("signature algorithm doesn't match key")
+	}
+	alg, err := GetAlgorithm(signature.Prefix, CapSign)
+	if err != nil {
 		return false, errors.New("signature uses unsupported signing algorithm")
 	}
 	digest := signature.RawData()
@@ -75,14 +79,12 @@ func (vkey VerificationKey) Verify(data []byte, signature cryptostring.CryptoStr
 		return false, errors.New("decoding error in verification key")
 	}
 
-	verifyStatus := ed25519.Verify(verifyKeyDecoded, data, digest)
-
-	return verifyStatus, nil
+	return alg.Verify(verifyKeyDecoded, data, digest), nil
 }
 
 // Set assigns a CryptoString value to the key
 func (vkey *VerificationKey) Set(key cryptostring.CryptoString) error {
-	if key.Prefix != "ED25519" {
+	if !IsSupported(key.Prefix, CapSign) {
 		return errors.New("unsupported signing algorithm")
 	}
 	vkey.key = key
@@ -128,7 +130,7 @@ func (spair SigningPair) GetType() string {
 func (spair *SigningPair) Set(pubkey cryptostring.CryptoString,
 	privkey cryptostring.CryptoString) error {
 
-	if pubkey.Prefix != "ED25519" || privkey.Prefix != "ED25519" {
+	if pubkey.Prefix != privkey.Prefix || !IsSupported(pubkey.Prefix, CapSign) {
 		return errors.New("unsupported signing algorithm")
 	}
 	spair.PublicKey = pubkey
@@ -154,21 +156,7 @@ func (spair SigningPair) Generate() error {
 
 // Sign cryptographically signs a byte slice.
 func (spair SigningPair) Sign(data []byte) (cryptostring.CryptoString, error) {
-	var out cryptostring.CryptoString
-
-	signkeyDecoded := spair.PrivateKey.RawData()
-	if signkeyDecoded == nil {
-		return out, errors.New("bad signing key")
-	}
-
-	// We bypass the nacl/sign module because it requires a 64-bit private key. We, however, pass
-	// around the 32-bit ed25519 seeds used to generate the keys. Thus, we have to skip using
-	// nacl.Sign() and go directly to the equivalent code in the ed25519 module.
-	signKeyPriv := ed25519.NewKeyFromSeed(signkeyDecoded)
-	signature := ed25519.Sign(signKeyPriv, data)
-	out.Set("ED25519:" + b85.Encode(signature))
-
-	return out, nil
+	return Sign(spair.PrivateKey, data)
 }
 
 // Verify uses the internal verification key with the passed data and signature and returns true
@@ -178,7 +166,11 @@ func (spair SigningPair) Verify(data []byte, signature cryptostring.CryptoString
 		return false, errors.New("invalid signature")
 	}
 
-	if signature.Prefix != "ED25519" {
+	if signature.Prefix != spair.PublicKey.Prefix {
+		return false, errors.New("signature algorithm doesn't match key")
+	}
+	alg, err := GetAlgorithm(signature.Prefix, CapSign)
+	if err != nil {
 		return false, errors.New("signature uses unsupported signing algorithm")
 	}
 	digest := signature.RawData()
@@ -191,9 +183,7 @@ func (spair SigningPair) Verify(data []byte, signature cryptostring.CryptoString
 		return false, errors.New("decoding error in verification key")
 	}
 
-	verifyStatus := ed25519.Verify(verifyKeyDecoded, data, digest)
-
-	return verifyStatus, nil
+	return alg.Verify(verifyKeyDecoded, data, digest), nil
 }
 
 // EncryptionPair defines an asymmetric encryption EncryptionPair
@@ -232,7 +222,7 @@ func (kpair EncryptionPair) GetType() string {
 func (kpair *EncryptionPair) Set(pubkey cryptostring.CryptoString,
 	privkey cryptostring.CryptoString) error {
 
-	if pubkey.Prefix != "CURVE25519" || privkey.Prefix != "CURVE25519" {
+	if pubkey.Prefix != privkey.Prefix || !IsSupported(pubkey.Prefix, CapEncrypt) {
 		return errors.New("unsupported encryption algorithm")
 	}
 	kpair.PublicKey = pubkey
@@ -264,17 +254,16 @@ func (kpair EncryptionPair) Encrypt(data []byte) (string, error) {
 		return "", nil
 	}
 
+	alg, err := GetAlgorithm(kpair.PublicKey.Prefix, CapEncrypt)
+	if err != nil {
+		return "", err
+	}
 	pubKeyDecoded := kpair.PublicKey.RawData()
 	if pubKeyDecoded == nil {
 		return "", errors.New("decoding error in public key")
 	}
 
-	// This kind of stupid is why this class is even necessary
-	var tempPtr [32]byte
-	ptrAdapter := tempPtr[0:32]
-	copy(ptrAdapter, pubKeyDecoded)
-
-	encryptedData, err := box.SealAnonymous(nil, data, &tempPtr, rand.Reader)
+	encryptedData, err := alg.Encrypt(pubKeyDecoded, data)
 	if err != nil {
 		return "", err
 	}
@@ -289,35 +278,27 @@ func (kpair EncryptionPair) Decrypt(data string) ([]byte, error) {
 		return nil, nil
 	}
 
+	alg, err := GetAlgorithm(kpair.PublicKey.Prefix, CapEncrypt)
+	if err != nil {
+		return nil, err
+	}
+
 	pubKeyDecoded := kpair.PublicKey.RawData()
 	if pubKeyDecoded == nil {
 		return nil, errors.New("decoding error in public key")
 	}
-	var pubKeyPtr [32]byte
-
-	ptrAdapter := pubKeyPtr[0:32]
-	copy(ptrAdapter, pubKeyDecoded)
 
 	privKeyDecoded := kpair.PrivateKey.RawData()
 	if privKeyDecoded == nil {
 		return nil, errors.New("decoding error in private key")
 	}
-	var privKeyPtr [32]byte
-
-	ptrAdapter = privKeyPtr[0:32]
-	copy(ptrAdapter, privKeyDecoded)
 
 	decodedData, err := b85.Decode(data)
 	if err != nil {
 		return nil, err
 	}
 
-	decryptedData, ok := box.OpenAnonymous(nil, decodedData, &pubKeyPtr, &privKeyPtr)
-
-	if ok {
-		return decryptedData, nil
-	}
-	return nil, errors.New("decryption error")
+	return alg.Decrypt(pubKeyDecoded, privKeyDecoded, decodedData)
 }
 
 // EncryptionKey defines an asymmetric encryption EncryptionPair
@@ -353,7 +334,7 @@ func (ekey EncryptionKey) GetType() string {
 // Set assigns a pair of CryptoString values to the EncryptionKey
 func (ekey *EncryptionKey) Set(pubkey cryptostring.CryptoString) error {
 
-	if pubkey.Prefix != "CURVE25519" {
+	if !IsSupported(pubkey.Prefix, CapEncrypt) {
 		return errors.New("unsupported encryption algorithm")
 	}
 	ekey.PublicKey = pubkey
@@ -371,17 +352,100 @@ func (ekey EncryptionKey) Encrypt(data []byte) (string, error) {
 		return "", nil
 	}
 
+	alg, err := GetAlgorithm(ekey.PublicKey.Prefix, CapEncrypt)
+	if err != nil {
+		return "", err
+	}
 	pubKeyDecoded := ekey.PublicKey.RawData()
 	if pubKeyDecoded == nil {
 		return "", errors.New("decoding error in public key")
 	}
 
-	// This kind of stupid is why this class is even necessary
-	var tempPtr [32]byte
-	ptrAdapter := tempPtr[0:32]
-	copy(ptrAdapter, pubKeyDecoded)
+	encryptedData, err := alg.Encrypt(pubKeyDecoded, data)
+	if err != nil {
+		return "", err
+	}
+
+	return b85.Encode(encryptedData), nil
+}
+
+// SecretKey is a symmetric encryption key. XSALSA20 keys use NaCl's secretbox construction,
+// XSalsa20-Poly1305, and XCHACHA20 keys use the IETF AEAD construction XChaCha20-Poly1305. The
+// full name of the latter is too long for a CryptoString prefix. For both algorithms, encrypted
+// data is the random nonce followed by the ciphertext, which is the format used by PyNaCl's
+// SecretBox and Aead classes.
+type SecretKey struct {
+	Hash           string
+	encryptionType string
+	keyType        string
+	Key            cryptostring.CryptoString
+}
+
+// NewSecretKey creates a new SecretKey object from a CryptoString of the key
+func NewSecretKey(key cryptostring.CryptoString) *SecretKey {
+	var newkey SecretKey
+
+	// All parameter validation is handled in Set
+	if newkey.Set(key) != nil {
+		return nil
+	}
+
+	return &newkey
+}
+
+// GetEncryptionType returns the algorithm used by the key
+func (skey SecretKey) GetEncryptionType() string {
+	return skey.encryptionType
+}
+
+// GetType returns the type of key -- asymmetric or symmetric
+func (skey SecretKey) GetType() string {
+	return skey.keyType
+}
+
+// Set assigns a CryptoString value to the SecretKey
+func (skey *SecretKey) Set(key cryptostring.CryptoString) error {
+	if !IsSupported(key.Prefix, CapSymmetric) {
+		return cryptostring.ErrUnsupportedAlgorithm
+	}
+	if len(key.RawData()) != 32 {
+		return errors.New("bad key length")
+	}
+	skey.Key = key
+	skey.encryptionType = key.Prefix
+	skey.keyType = "symmetric"
+
+	sum := blake2b.Sum256([]byte(key.AsString()))
+	skey.Hash = "BLAKE2B-256:" + b85.Encode(sum[:])
+
+	return nil
+}
+
+// Generate initializes the object to a new random key for the specified symmetric algorithm, such
+// as XSALSA20 or XCHACHA20.
+func (skey *SecretKey) Generate(algorithm string) error {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+
+	return skey.Set(cryptostring.New(algorithm + ":" + b85.Encode(key)))
+}
+
+// Encrypt encrypts a byte slice using the key. It returns the resulting encrypted data as a
+// Base85-encoded string that amounts to a CryptoString without the prefix.
+func (skey SecretKey) Encrypt(data []byte) (string, error) {
+	if data == nil {
+		return "", nil
+	}
+
+	alg, err := GetAlgorithm(skey.Key.Prefix, CapSymmetric)
+	if err != nil {
+		return "", err
+	}
 
-	encryptedData, err := box.SealAnonymous(nil, data, &tempPtr, rand.Reader)
+	encryptedData, err := alg.SecretEncrypt(skey.Key.RawData(), data)
 	if err != nil {
 		return "", err
 	}
@@ -389,92 +453,150 @@ func (ekey EncryptionKey) Encrypt(data []byte) (string, error) {
 	return b85.Encode(encryptedData), nil
 }
 
-// HashPassword turns a string into an Argon2 password hash.
-func HashPassword(password string) string {
-	mode := viper.GetString("security.password_security")
+// Decrypt decrypts a string of encrypted data which is Base85 encoded using the key
+func (skey SecretKey) Decrypt(data string) ([]byte, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	alg, err := GetAlgorithm(skey.Key.Prefix, CapSymmetric)
+	if err != nil {
+		return nil, err
+	}
 
-	var argonRAM, argonIterations, argonSaltLength, argonKeyLength uint32
-	var argonThreads uint8
+	decodedData, err := b85.Decode(data)
+	if err != nil {
+		return nil, err
+	}
 
-	if strings.ToLower(mode) == "enhanced" {
+	return alg.SecretDecrypt(skey.Key.RawData(), decodedData)
+}
+
+// argonParams holds the settings used to create an Argon2id password hash
+type argonParams struct {
+	RAM        uint32
+	Iterations uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// currentArgonParams returns the settings for new password hashes, which depend on the
+// security.password_security setting
+func currentArgonParams() argonParams {
+	if strings.ToLower(viper.GetString("security.password_security")) == "enhanced" {
 		// LUDICROUS SPEED! GO!
-		argonRAM = 1073741824 // 1GB of RAM
-		argonIterations = 10
-		argonThreads = 8
-		argonSaltLength = 24
-		argonKeyLength = 48
-	} else {
-		argonRAM = 65536 // 64MB of RAM
-		argonIterations = 3
-		argonThreads = 4
-		argonSaltLength = 16
-		argonKeyLength = 32
-	}
-
-	salt := make([]byte, argonSaltLength)
+		return argonParams{
+			RAM:        1073741824, // 1GB of RAM
+			Iterations: 10,
+			Threads:    8,
+			SaltLength: 24,
+			KeyLength:  48,
+		}
+	}
+
+	return argonParams{
+		RAM:        65536, // 64MB of RAM
+		Iterations: 3,
+		Threads:    4,
+		SaltLength: 16,
+		KeyLength:  32,
+	}
+}
+
+// HashPassword turns a string into an Argon2 password hash.
+func HashPassword(password string) string {
+	params := currentArgonParams()
+
+	salt := make([]byte, params.SaltLength)
 	_, err := rand.Read(salt)
 	if err != nil {
 		logging.Writef("Failure reading random bytes: %s", err.Error())
 		return ""
 	}
 
-	passhash := argon2.IDKey([]byte(password), salt, argonIterations, argonRAM, argonThreads,
-		argonKeyLength)
+	passhash := argon2.IDKey([]byte(password), salt, params.Iterations, params.RAM,
+		params.Threads, params.KeyLength)
 
 	// Although base85 encoding is used wherever possible, base64 is used here because of a
 	// potential collision: base85 uses the $ character and argon2 hash strings use it as a
 	// field delimiter. Not a huge deal as it just uses a little extra disk storage and doesn't
 	// get transmitted over the network
 	passString := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
-		argon2.Version, argonRAM, argonIterations, argonThreads,
+		argon2.Version, params.RAM, params.Iterations, params.Threads,
 		base64.RawStdEncoding.EncodeToString(salt),
 		base64.RawStdEncoding.EncodeToString(passhash))
 	return passString
 }
 
-// VerifyPasswordHash takes a password and the Argon2 hash to verify against, gets the parameters
-// from the hash, applies them to the supplied password, and returns whether or not they match and
-// if something went wrong
-func VerifyPasswordHash(password string, hashPass string) (bool, error) {
+// parseArgonHash splits an Argon2 hash string into its parameters, salt, and hash
+func parseArgonHash(hashPass string) (argonParams, []byte, []byte, error) {
+	var params argonParams
+
 	splitValues := strings.Split(hashPass, "$")
 	if len(splitValues) != 6 {
-		return false, errors.New("Invalid Argon hash string")
+		return params, nil, nil, errors.New("Invalid Argon hash string")
 	}
 
 	var version int
 	_, err := fmt.Sscanf(splitValues[2], "v=%d", &version)
 	if err != nil {
-		return false, err
+		return params, nil, nil, err
 	}
 	if version != argon2.Version {
-		return false, errors.New("Unsupported Argon version")
+		return params, nil, nil, errors.New("Unsupported Argon version")
 	}
 
-	var ramUsage, iterations uint32
-	var parallelism uint8
-	_, err = fmt.Sscanf(splitValues[3], "m=%d,t=%d,p=%d", &ramUsage, &iterations, &parallelism)
+	_, err = fmt.Sscanf(splitValues[3], "m=%d,t=%d,p=%d", &params.RAM, &params.Iterations,
+		&params.Threads)
 	if err != nil {
-		return false, err
+		return params, nil, nil, err
 	}
 
 	var salt []byte
 	salt, err = base64.RawStdEncoding.DecodeString(splitValues[4])
 	if err != nil {
-		return false, err
+		return params, nil, nil, err
 	}
 
 	var savedHash []byte
 	savedHash, err = base64.RawStdEncoding.DecodeString(splitValues[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(savedHash))
+	return params, salt, savedHash, nil
+}
+
+// VerifyPasswordHash takes a password and the Argon2 hash to verify against, gets the parameters
+// from the hash, applies them to the supplied password, and returns whether or not they match and
+// if something went wrong
+func VerifyPasswordHash(password string, hashPass string) (bool, error) {
+	params, salt, savedHash, err := parseArgonHash(hashPass)
 	if err != nil {
 		return false, err
 	}
 
-	passhash := argon2.IDKey([]byte(password), salt, iterations, ramUsage, parallelism,
-		uint32(len(savedHash)))
+	passhash := argon2.IDKey([]byte(password), salt, params.Iterations, params.RAM,
+		params.Threads, params.KeyLength)
 
 	return (subtle.ConstantTimeCompare(passhash, savedHash) == 1), nil
 }
 
+// PasswordNeedsRehash returns true if an Argon2 hash was not created with the settings currently
+// used for new hashes. This happens when security.password_security is changed after the hash was
+// stored.
+func PasswordNeedsRehash(hashPass string) (bool, error) {
+	params, _, _, err := parseArgonHash(hashPass)
+	if err != nil {
+		return false, err
+	}
+
+	return params != currentArgonParams(), nil
+}
+
 // IsArgonHash checks to see if the string passed is an Argon2id password hash
 func IsArgonHash(hashstr string) (bool, error) {
 	// TODO: revisit and make more robust
@@ -488,3 +610,73 @@ func IsArgonHash(hashstr string) (bool, error) {
 
 	return true, nil
 }
+
+// KeyWrapAlgorithm is the CryptoString prefix used for key-encryption keys and the keys wrapped
+// with them. Wrapped keys are the XSalsa20-Poly1305 ciphertext of the key's CryptoString with the
+// nonce prepended.
+const KeyWrapAlgorithm = "XSALSA20"
+
+// kekDerivation holds the Argon2id parameters used to derive a key-encryption key from a
+// passphrase. Changing them makes existing wrapped keys unreadable.
+var kekDerivation = struct {
+	RAM        uint32
+	Iterations uint32
+	Threads    uint8
+}{65536, 3, 4}
+
+// GenerateKEK creates a new random key-encryption key
+func GenerateKEK() (cryptostring.CryptoString, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return cryptostring.CryptoString{}, err
+	}
+	return cryptostring.New(KeyWrapAlgorithm + ":" + b85.Encode(key)), nil
+}
+
+// DeriveKEK turns a passphrase into a key-encryption key using Argon2id. The salt should be 16
+// random bytes which are stored alongside the keys wrapped with the resulting key.
+func DeriveKEK(passphrase string, salt []byte) cryptostring.CryptoString {
+	key := argon2.IDKey([]byte(passphrase), salt, kekDerivation.Iterations, kekDerivation.RAM,
+		kekDerivation.Threads, 32)
+	return cryptostring.New(KeyWrapAlgorithm + ":" + b85.Encode(key))
+}
+
+// WrapKey encrypts a key with a key-encryption key
+func WrapKey(kek cryptostring.CryptoString,
+	key cryptostring.CryptoString) (cryptostring.CryptoString, error) {
+	if kek.Prefix != KeyWrapAlgorithm {
+		return cryptostring.CryptoString{}, cryptostring.ErrUnsupportedAlgorithm
+	}
+	skey := NewSecretKey(kek)
+	if skey == nil {
+		return cryptostring.CryptoString{}, errors.New("bad key-encryption key")
+	}
+
+	sealed, err := skey.Encrypt([]byte(key.AsString()))
+	if err != nil {
+		return cryptostring.CryptoString{}, err
+	}
+	return cryptostring.New(KeyWrapAlgorithm + ":" + sealed), nil
+}
+
+// UnwrapKey decrypts a key wrapped with WrapKey
+func UnwrapKey(kek cryptostring.CryptoString,
+	wrapped cryptostring.CryptoString) (cryptostring.CryptoString, error) {
+	if kek.Prefix != KeyWrapAlgorithm || wrapped.Prefix != KeyWrapAlgorithm {
+		return cryptostring.CryptoString{}, cryptostring.ErrUnsupportedAlgorithm
+	}
+	skey := NewSecretKey(kek)
+	if skey == nil {
+		return cryptostring.CryptoString{}, errors.New("bad key-encryption key")
+	}
+
+	opened, err := skey.Decrypt(wrapped.Data)
+	if err != nil {
+		return cryptostring.CryptoString{}, err
+	}
+
+	var key cryptostring.CryptoString
+	err = key.Set(string(opened))
+	return key, err
+}
@@ -0,0 +1,306 @@
+package ezcrypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/darkwyrm/b85"
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
+)
+
+// The algorithm registry maps CryptoString prefixes to their implementations so that code which
+// hashes, signs, verifies, or encrypts data doesn't need to know which algorithms exist. Adding
+// support for an algorithm only requires a call to RegisterAlgorithm.
+
+// Capability flags for registered algorithms
+const (
+	// CapHash algorithms provide NewHash
+	CapHash = 1 << iota
+	// CapSign algorithms provide Sign and Verify
+	CapSign
+	// CapEncrypt algorithms are asymmetric and provide Encrypt and Decrypt
+	CapEncrypt
+	// CapSymmetric algorithms provide SecretEncrypt and SecretDecrypt
+	CapSymmetric
+)
+
+// Algorithm describes a cryptographic algorithm identified by a CryptoString prefix. Only the
+// functions for the algorithm's capabilities need to be set.
+type Algorithm struct {
+	Name         string
+	Capabilities int
+
+	NewHash func() hash.Hash
+
+	Sign   func(privkey []byte, data []byte) ([]byte, error)
+	Verify func(pubkey []byte, data []byte, signature []byte) bool
+
+	Encrypt func(pubkey []byte, data []byte) ([]byte, error)
+	Decrypt func(pubkey []byte, privkey []byte, data []byte) ([]byte, error)
+
+	SecretEncrypt func(key []byte, data []byte) ([]byte, error)
+	SecretDecrypt func(key []byte, data []byte) ([]byte, error)
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Algorithm)
+
+	// Algorithm names must be usable as CryptoString prefixes
+	algorithmNamePattern = regexp.MustCompile("^[A-Z0-9-]{1,15}$")
+)
+
+// RegisterAlgorithm adds an algorithm to the registry, replacing any existing one with the same
+// name
+func RegisterAlgorithm(alg Algorithm) error {
+	if !algorithmNamePattern.MatchString(alg.Name) {
+		return errors.New("bad algorithm name")
+	}
+	if (alg.Capabilities&CapHash != 0 && alg.NewHash == nil) ||
+		(alg.Capabilities&CapSign != 0 && (alg.Sign == nil || alg.Verify == nil)) ||
+		(alg.Capabilities&CapEncrypt != 0 && (alg.Encrypt == nil || alg.Decrypt == nil)) ||
+		(alg.Capabilities&CapSymmetric != 0 &&
+			(alg.SecretEncrypt == nil || alg.SecretDecrypt == nil)) {
+		return errors.New("algorithm missing functions for its capabilities")
+	}
+
+	registryLock.Lock()
+	registry[alg.Name] = alg
+	registryLock.Unlock()
+	return nil
+}
+
+// GetAlgorithm returns the registered algorithm for a CryptoString prefix if it has the specified
+// capability. ErrUnsupportedAlgorithm is returned if it doesn't.
+func GetAlgorithm(name string, capability int) (Algorithm, error) {
+	registryLock.RLock()
+	alg, ok := registry[name]
+	registryLock.RUnlock()
+
+	if !ok || alg.Capabilities&capability != capability {
+		return Algorithm{}, cryptostring.ErrUnsupportedAlgorithm
+	}
+	return alg, nil
+}
+
+// IsSupported returns true if an algorithm is registered with the specified capability
+func IsSupported(name string, capability int) bool {
+	_, err := GetAlgorithm(name, capability)
+	return err == nil
+}
+
+// ListAlgorithms returns the sorted names of the registered algorithms with the specified
+// capability
+func ListAlgorithms(capability int) []string {
+	out := make([]string, 0)
+	registryLock.RLock()
+	for name, alg := range registry {
+		if alg.Capabilities&capability == capability {
+			out = append(out, name)
+		}
+	}
+	registryLock.RUnlock()
+
+	sort.Strings(out)
+	return out
+}
+
+// NewHasher returns a new hash.Hash for a CryptoString prefix
+func NewHasher(name string) (hash.Hash, error) {
+	alg, err := GetAlgorithm(name, CapHash)
+	if err != nil {
+		return nil, err
+	}
+	return alg.NewHash(), nil
+}
+
+// Sign signs data with a private key using the key's algorithm and returns the signature as a
+// CryptoString
+func Sign(privkey cryptostring.CryptoString, data []byte) (cryptostring.CryptoString, error) {
+	var out cryptostring.CryptoString
+
+	alg, err := GetAlgorithm(privkey.Prefix, CapSign)
+	if err != nil {
+		return out, err
+	}
+	privkeyDecoded := privkey.RawData()
+	if privkeyDecoded == nil {
+		return out, errors.New("bad signing key")
+	}
+
+	signature, err := alg.Sign(privkeyDecoded, data)
+	if err != nil {
+		return out, err
+	}
+	err = out.Set(privkey.Prefix + ":" + b85.Encode(signature))
+	return out, err
+}
+
+func init() {
+	RegisterAlgorithm(Algorithm{
+		Name:         "BLAKE2B-256",
+		Capabilities: CapHash,
+		NewHash: func() hash.Hash {
+			hasher, _ := blake2b.New256(nil)
+			return hasher
+		},
+	})
+	RegisterAlgorithm(Algorithm{
+		Name:         "BLAKE3-256",
+		Capabilities: CapHash,
+		NewHash:      func() hash.Hash { return blake3.New() },
+	})
+	RegisterAlgorithm(Algorithm{
+		Name:         "SHA-256",
+		Capabilities: CapHash,
+		NewHash:      sha256.New,
+	})
+	RegisterAlgorithm(Algorithm{
+		Name:         "SHA3-256",
+		Capabilities: CapHash,
+		NewHash:      sha3.New256,
+	})
+
+	RegisterAlgorithm(Algorithm{
+		Name:         "ED25519",
+		Capabilities: CapSign,
+		Sign:         ed25519Sign,
+		Verify: func(pubkey []byte, data []byte, signature []byte) bool {
+			if len(pubkey) != ed25519.PublicKeySize {
+				return false
+			}
+			return ed25519.Verify(pubkey, data, signature)
+		},
+	})
+
+	RegisterAlgorithm(Algorithm{
+		Name:         "CURVE25519",
+		Capabilities: CapEncrypt,
+		Encrypt:      curve25519Encrypt,
+		Decrypt:      curve25519Decrypt,
+	})
+
+	RegisterAlgorithm(Algorithm{
+		Name:          "XSALSA20",
+		Capabilities:  CapSymmetric,
+		SecretEncrypt: xsalsa20Encrypt,
+		SecretDecrypt: xsalsa20Decrypt,
+	})
+	RegisterAlgorithm(Algorithm{
+		Name:          "XCHACHA20",
+		Capabilities:  CapSymmetric,
+		SecretEncrypt: xchacha20Encrypt,
+		SecretDecrypt: xchacha20Decrypt,
+	})
+}
+
+func ed25519Sign(privkey []byte, data []byte) ([]byte, error) {
+	// Keys are stored as the 32-byte seeds used to generate them, not the 64-byte private keys
+	// the ed25519 module expects
+	if len(privkey) != ed25519.SeedSize {
+		return nil, errors.New("bad signing key length")
+	}
+	return ed25519.Sign(ed25519.NewKeyFromSeed(privkey), data), nil
+}
+
+func curve25519Encrypt(pubkey []byte, data []byte) ([]byte, error) {
+	if len(pubkey) != 32 {
+		return nil, errors.New("decoding error in public key")
+	}
+	var pubKeyPtr [32]byte
+	copy(pubKeyPtr[:], pubkey)
+
+	return box.SealAnonymous(nil, data, &pubKeyPtr, rand.Reader)
+}
+
+func curve25519Decrypt(pubkey []byte, privkey []byte, data []byte) ([]byte, error) {
+	if len(pubkey) != 32 {
+		return nil, errors.New("decoding error in public key")
+	}
+	if len(privkey) != 32 {
+		return nil, errors.New("decoding error in private key")
+	}
+	var pubKeyPtr, privKeyPtr [32]byte
+	copy(pubKeyPtr[:], pubkey)
+	copy(privKeyPtr[:], privkey)
+
+	decryptedData, ok := box.OpenAnonymous(nil, data, &pubKeyPtr, &privKeyPtr)
+	if !ok {
+		return nil, errors.New("decryption error")
+	}
+	return decryptedData, nil
+}
+
+func xsalsa20Encrypt(key []byte, data []byte) ([]byte, error) {
+	if len(key) != 32 {
+		return nil, errors.New("bad key length")
+	}
+	var keyPtr [32]byte
+	copy(keyPtr[:], key)
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], data, &nonce, &keyPtr), nil
+}
+
+func xsalsa20Decrypt(key []byte, data []byte) ([]byte, error) {
+	if len(key) != 32 {
+		return nil, errors.New("bad key length")
+	}
+	if len(data) < 24+secretbox.Overhead {
+		return nil, errors.New("encrypted data too short")
+	}
+	var keyPtr [32]byte
+	copy(keyPtr[:], key)
+	var nonce [24]byte
+	copy(nonce[:], data[:24])
+
+	decryptedData, ok := secretbox.Open(nil, data[24:], &nonce, &keyPtr)
+	if !ok {
+		return nil, errors.New("decryption error")
+	}
+	return decryptedData, nil
+}
+
+func xchacha20Encrypt(key []byte, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func xchacha20Decrypt(key []byte, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("encrypted data too short")
+	}
+
+	decryptedData, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("decryption error")
+	}
+	return decryptedData, nil
+}
@@ -0,0 +1,300 @@
+package ezcrypt
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Streaming encryption splits data into chunks which are encrypted separately with
+// XChaCha20-Poly1305 so that files of any size can be handled without loading them into memory.
+// A stream starts with a header, followed by the encrypted chunks:
+//
+// Version (1 byte)
+// Sealed secret key (80 bytes, only for streams encrypted with an EncryptionKey)
+// Nonce prefix (16 random bytes)
+//
+// The nonce for each chunk is the nonce prefix, a 7-byte big-endian chunk counter, and a byte which
+// is 1 for the last chunk and 0 otherwise. This keeps chunks from being reordered, dropped, or
+// truncated without detection. Every chunk except the last holds streamChunkSize bytes of data.
+
+const (
+	streamChunkSize = 65536
+	streamVersion   = 1
+	streamSealedKey = 2
+
+	streamPrefixSize = 16
+	sealedKeySize    = 32 + box.AnonymousOverhead
+)
+
+// ErrStreamCorrupt is returned when an encrypted stream fails authentication or is truncated
+var ErrStreamCorrupt = errors.New("encrypted stream corrupt or truncated")
+
+// NewEncryptWriter returns a writer which encrypts data written to it and writes the result to w.
+// The key must be an XCHACHA20 key. The caller must call Close on the returned writer to finish
+// the stream. Closing it does not close w.
+func (skey SecretKey) NewEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	aead, err := skey.streamAEAD()
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptWriter(aead, w, []byte{streamVersion})
+}
+
+// NewDecryptReader returns a reader which decrypts a stream created with NewEncryptWriter. Reading
+// returns ErrStreamCorrupt if any part of the stream has been modified or if it is incomplete.
+func (skey SecretKey) NewDecryptReader(r io.Reader) (io.Reader, error) {
+	aead, err := skey.streamAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	var version [1]byte
+	if _, err = io.ReadFull(r, version[:]); err != nil {
+		return nil, ErrStreamCorrupt
+	}
+	if version[0] != streamVersion {
+		return nil, errors.New("unsupported stream version")
+	}
+	return newDecryptReader(aead, r)
+}
+
+// NewEncryptWriter returns a writer which encrypts data written to it with a new random secret key
+// and writes the result to w. The secret key is sealed with the public key and stored in the
+// stream's header. The caller must call Close on the returned writer to finish the stream.
+func (ekey EncryptionKey) NewEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	return newSealedKeyWriter(ekey.PublicKey, w)
+}
+
+// NewEncryptWriter returns a writer which encrypts data with the pair's public key. See
+// EncryptionKey.NewEncryptWriter.
+func (kpair EncryptionPair) NewEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	return newSealedKeyWriter(kpair.PublicKey, w)
+}
+
+// NewDecryptReader returns a reader which decrypts a stream created with the NewEncryptWriter
+// method of an EncryptionKey or EncryptionPair using the pair's private key
+func (kpair EncryptionPair) NewDecryptReader(r io.Reader) (io.Reader, error) {
+	var pubKeyPtr, privKeyPtr [32]byte
+	copy(pubKeyPtr[:], kpair.PublicKey.RawData())
+	copy(privKeyPtr[:], kpair.PrivateKey.RawData())
+
+	header := make([]byte, 1+sealedKeySize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrStreamCorrupt
+	}
+	if header[0] != streamSealedKey {
+		return nil, errors.New("unsupported stream version")
+	}
+
+	secret, ok := box.OpenAnonymous(nil, header[1:], &pubKeyPtr, &privKeyPtr)
+	if !ok {
+		return nil, errors.New("decryption error")
+	}
+	aead, err := chacha20poly1305.NewX(secret)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(aead, r)
+}
+
+func newSealedKeyWriter(pubkey cryptostring.CryptoString, w io.Writer) (io.WriteCloser, error) {
+	pubKeyDecoded := pubkey.RawData()
+	if len(pubKeyDecoded) != 32 {
+		return nil, errors.New("decoding error in public key")
+	}
+	var pubKeyPtr [32]byte
+	copy(pubKeyPtr[:], pubKeyDecoded)
+
+	secret := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	sealed, err := box.SealAnonymous([]byte{streamSealedKey}, secret, &pubKeyPtr, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(secret)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptWriter(aead, w, sealed)
+}
+
+func (skey SecretKey) streamAEAD() (cipher.AEAD, error) {
+	if skey.Key.Prefix != "XCHACHA20" {
+		return nil, cryptostring.ErrUnsupportedAlgorithm
+	}
+	return chacha20poly1305.NewX(skey.Key.RawData())
+}
+
+// streamNonce builds the nonce for a chunk of a stream
+func streamNonce(prefix []byte, counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+
+	// The counter takes up 7 bytes, so the top byte of the big-endian value is dropped
+	var counterBytes [8]byte
+	binary.BigEndian.PutUint64(counterBytes[:], counter)
+	copy(nonce[streamPrefixSize:], counterBytes[1:])
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts a stream one chunk at a time. A full chunk is held back until more data
+// arrives because the last chunk must be marked as such.
+type encryptWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	prefix  []byte
+	counter uint64
+	buffer  []byte
+	closed  bool
+	err     error
+}
+
+func newEncryptWriter(aead cipher.AEAD, w io.Writer, header []byte) (*encryptWriter, error) {
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(header, prefix...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		aead:   aead,
+		w:      w,
+		prefix: prefix,
+		buffer: make([]byte, 0, streamChunkSize),
+	}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	if ew.closed {
+		return 0, errors.New("write to closed stream")
+	}
+
+	total := len(p)
+	for len(p) > 0 {
+		if len(ew.buffer) == streamChunkSize {
+			if ew.err = ew.flush(false); ew.err != nil {
+				return total - len(p), ew.err
+			}
+		}
+		n := copy(ew.buffer[len(ew.buffer):cap(ew.buffer)], p)
+		ew.buffer = ew.buffer[:len(ew.buffer)+n]
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Close writes the last chunk of the stream
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return ew.err
+	}
+	ew.closed = true
+	if ew.err == nil {
+		ew.err = ew.flush(true)
+	}
+	return ew.err
+}
+
+func (ew *encryptWriter) flush(last bool) error {
+	if ew.counter >= 1<<56 {
+		return errors.New("stream too long")
+	}
+	nonce := streamNonce(ew.prefix, ew.counter, last)
+	_, err := ew.w.Write(ew.aead.Seal(nil, nonce, ew.buffer, nil))
+	ew.counter++
+	ew.buffer = ew.buffer[:0]
+	return err
+}
+
+// decryptReader decrypts a stream one chunk at a time
+type decryptReader struct {
+	aead    cipher.AEAD
+	r       io.Reader
+	prefix  []byte
+	counter uint64
+	chunk   []byte
+	plain   []byte
+	done    bool
+	err     error
+}
+
+func newDecryptReader(aead cipher.AEAD, r io.Reader) (*decryptReader, error) {
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, ErrStreamCorrupt
+	}
+	return &decryptReader{
+		aead:   aead,
+		r:      r,
+		prefix: prefix,
+		chunk:  make([]byte, streamChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		dr.plain, dr.err = dr.readChunk()
+	}
+
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) readChunk() ([]byte, error) {
+	n, err := io.ReadFull(dr.r, dr.chunk)
+	switch err {
+	case nil:
+		// A full chunk is normally followed by more, but it can also be the last one
+		plain, err := dr.aead.Open(nil, streamNonce(dr.prefix, dr.counter, false), dr.chunk, nil)
+		if err == nil {
+			dr.counter++
+			return plain, nil
+		}
+		plain, err = dr.aead.Open(nil, streamNonce(dr.prefix, dr.counter, true), dr.chunk, nil)
+		if err != nil {
+			return nil, ErrStreamCorrupt
+		}
+		var extra [1]byte
+		if _, err = io.ReadFull(dr.r, extra[:]); err != io.EOF {
+			return nil, ErrStreamCorrupt
+		}
+		dr.done = true
+		return plain, nil
+	case io.ErrUnexpectedEOF:
+		plain, err := dr.aead.Open(nil, streamNonce(dr.prefix, dr.counter, true), dr.chunk[:n],
+			nil)
+		if err != nil {
+			return nil, ErrStreamCorrupt
+		}
+		dr.done = true
+		return plain, nil
+	case io.EOF:
+		// Every stream ends with a chunk marked as the last one, even if it is empty
+		return nil, ErrStreamCorrupt
+	}
+	return nil, err
+}
@@ -29,6 +29,61 @@ func handleFSError(session *sessionState, err error) {
 	session.SendStringResponse(400, "BAD REQUEST", err.Error())
 }
 
+// checkPathAccess makes sure that the session's workspace has the required access level for a
+// Mensago path. Users have full access to their own workspaces and the administrator has full
+// access to all of those in the same domain. Access to a shared workspace depends on the role of
+// the member. If access is denied, the appropriate response is sent to the client and false is
+// returned. Validation of the path itself is left to the filesystem provider.
+func checkPathAccess(session *sessionState, path string, level int) bool {
+	if !fshandler.ValidateMensagoPath(path) {
+		return true
+	}
+
+	// Workspace IDs are stored in lowercase, so a path with another case would not be found
+	wid := strings.ToLower(fshandler.GetPathWorkspace(path))
+	if wid != "" && wid == session.WID {
+		return true
+	}
+
+	admin, err := isAdmin(session)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("checkPathAccess: Error resolving admin address: %s", err)
+		return false
+	}
+	if admin {
+		// Administrators of one hosted domain don't get access to the workspaces of another, or to
+		// those whose domain can't be found
+		if wid == "" {
+			return true
+		}
+		domain, err := session.Store.Workspaces.GetWorkspaceDomain(wid)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("checkPathAccess: Error getting workspace domain: %s", err)
+			return false
+		}
+		if domain != "" && domain == getSessionDomain(session) {
+			return true
+		}
+	}
+
+	if wid != "" {
+		role, err := session.Store.Members.GetMemberRole(wid, session.WID)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("checkPathAccess: Error getting member role: %s", err)
+			return false
+		}
+		if fshandler.RoleAccess(role) >= level {
+			return true
+		}
+	}
+
+	session.SendStringResponse(403, "FORBIDDEN", "")
+	return false
+}
+
 func commandCopy(session *sessionState) {
 	// Command syntax:
 	// COPY(SourceFile, DestDir)
@@ -43,6 +98,11 @@ func commandCopy(session *sessionState) {
 		return
 	}
 
+	if !checkPathAccess(session, session.Message.Data["SourceFile"], fshandler.AccessRead) ||
+		!checkPathAccess(session, session.Message.Data["DestDir"], fshandler.AccessWrite) {
+		return
+	}
+
 	fsh := fshandler.GetFSProvider()
 	exists, err := fsh.Exists(session.Message.Data["SourceFile"])
 	if err != nil {
@@ -87,6 +147,10 @@ func commandDelete(session *sessionState) {
 		return
 	}
 
+	if !checkPathAccess(session, session.Message.Data["Path"], fshandler.AccessWrite) {
+		return
+	}
+
 	fsh := fshandler.GetFSProvider()
 	err := fsh.DeleteFile(session.Message.Data["Path"])
 	if err != nil {
@@ -111,6 +175,10 @@ func commandExists(session *sessionState) {
 		return
 	}
 
+	if !checkPathAccess(session, session.Message.Data["Path"], fshandler.AccessRead) {
+		return
+	}
+
 	fsh := fshandler.GetFSProvider()
 	exists, err := fsh.Exists(session.Message.Data["Path"])
 	if err != nil {
@@ -134,31 +202,15 @@ func commandGetQuotaInfo(session *sessionState) {
 		return
 	}
 
-	quotaSize, err := strconv.ParseInt(session.Message.Data["Size"], 10, 64)
-	if err != nil || quotaSize < 1 {
-		session.SendStringResponse(400, "BAD REQUEST", "Bad quota size")
-		return
-	}
-
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandGetQuotaInfo: Error resolving admin address: %s", err)
-		return
-	}
-
-	isAdmin := adminWid == session.WID
-
 	if session.Message.HasField("Workspaces") {
-		if !isAdmin {
-			session.SendStringResponse(403, "FORBIDDEN", "Only admin can use the Workspaces field")
+		if !checkRole(session, roleQuotaManager, roleSupport, roleAuditor) {
 			return
 		}
 
 		widList := strings.Split(session.Message.Data["Workspaces"], ",")
 		if len(widList) > 100 {
 			session.SendStringResponse(414, "LIMIT REACHED", "No more than 100 workspaces at once")
+			return
 		}
 
 		quotaList := make([]string, len(widList))
@@ -169,10 +221,13 @@ func commandGetQuotaInfo(session *sessionState) {
 				session.SendStringResponse(400, "BAD REQUEST", "Bad workspace ID "+wid)
 				return
 			}
+			if !checkSameDomain(session, wid) {
+				return
+			}
 
-			u, q, err := dbhandler.GetQuotaInfo(wid)
+			u, q, err := session.Store.Quotas.GetQuotaInfo(wid)
 			if err != nil {
-				session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+				session.SendDatabaseError(err)
 				logging.Writef("commandGetQuotaInfo: Error getting quota info for workspace %s: %s",
 					wid, err)
 				return
@@ -188,9 +243,9 @@ func commandGetQuotaInfo(session *sessionState) {
 		return
 	}
 
-	u, q, err := dbhandler.GetQuotaInfo(session.WID)
+	u, q, err := session.Store.Quotas.GetQuotaInfo(session.WID)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandGetQuotaInfo: Error getting quota info for workspace %s: %s",
 			session.WID, err)
 		return
@@ -221,7 +276,11 @@ func commandList(session *sessionState) {
 		unixTime, err = strconv.ParseInt(session.Message.Data["Time"], 10, 64)
 		if err != nil {
 			session.SendStringResponse(400, "BAD REQUEST", "Bad time field")
+			return
 		}
+	}
+
+	if !checkPathAccess(session, session.Message.Data["Path"], fshandler.AccessRead) {
 		return
 	}
 
@@ -246,6 +305,11 @@ func commandListDirs(session *sessionState) {
 		return
 	}
 
+	// Membership in a shared workspace may have changed since the directory was selected
+	if !checkPathAccess(session, session.CurrentPath.MensagoPath(), fshandler.AccessRead) {
+		return
+	}
+
 	fsh := fshandler.GetFSProvider()
 	names, err := fsh.ListDirectories(session.CurrentPath.MensagoPath())
 	if err != nil {
@@ -271,6 +335,10 @@ func commandMkDir(session *sessionState) {
 		return
 	}
 
+	if !checkPathAccess(session, session.Message.Data["Path"], fshandler.AccessWrite) {
+		return
+	}
+
 	fsh := fshandler.GetFSProvider()
 	err := fsh.MakeDirectory(session.Message.Data["Path"])
 	if err != nil {
@@ -295,6 +363,11 @@ func commandMove(session *sessionState) {
 		return
 	}
 
+	if !checkPathAccess(session, session.Message.Data["SourceFile"], fshandler.AccessRead) ||
+		!checkPathAccess(session, session.Message.Data["DestDir"], fshandler.AccessWrite) {
+		return
+	}
+
 	fsh := fshandler.GetFSProvider()
 	exists, err := fsh.Exists(session.Message.Data["SourceFile"])
 	if err != nil {
@@ -336,6 +409,10 @@ func commandRmDir(session *sessionState) {
 		return
 	}
 
+	if !checkPathAccess(session, session.Message.Data["Path"], fshandler.AccessWrite) {
+		return
+	}
+
 	fsh := fshandler.GetFSProvider()
 	exists, err := fsh.Exists(session.Message.Data["Path"])
 	if err != nil {
@@ -374,12 +451,18 @@ func commandSelect(session *sessionState) {
 		return
 	}
 
+	if !checkPathAccess(session, session.Message.Data["Path"], fshandler.AccessRead) {
+		return
+	}
+
 	fsh := fshandler.GetFSProvider()
 	path, err := fsh.Select(session.Message.Data["Path"])
 	if err != nil {
 		handleFSError(session, err)
+		return
 	}
 	session.CurrentPath = path
+	session.SendStringResponse(200, "OK", "")
 }
 
 func commandSetQuota(session *sessionState) {
@@ -402,16 +485,7 @@ func commandSetQuota(session *sessionState) {
 		return
 	}
 
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandSetQuota: Error resolving admin address: %s", err)
-		return
-	}
-
-	if session.LoginState != loginClientSession || session.WID != adminWid {
-		session.SendStringResponse(403, "FORBIDDEN", "Only admin can use this")
+	if !checkRole(session, roleQuotaManager) {
 		return
 	}
 
@@ -424,10 +498,13 @@ func commandSetQuota(session *sessionState) {
 			session.SendStringResponse(400, "BAD REQUEST", fmt.Sprintf("Bad workspace ID %s", w))
 			return
 		}
+		if !checkSameDomain(session, w) {
+			return
+		}
 
-		err = dbhandler.SetQuota(w, uint64(quotaSize))
+		err = session.Store.Quotas.SetQuota(w, uint64(quotaSize))
 		if err != nil {
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			session.SendDatabaseError(err)
 			return
 		}
 	}
@@ -470,6 +547,10 @@ func commandUpload(session *sessionState) {
 		return
 	}
 
+	if !checkPathAccess(session, session.Message.Data["Path"], fshandler.AccessWrite) {
+		return
+	}
+
 	fsp := fshandler.GetFSProvider()
 	exists, err := fsp.Exists(session.Message.Data["Path"])
 	if err != nil {
@@ -509,11 +590,16 @@ func commandUpload(session *sessionState) {
 		return
 	}
 
-	// Arguments have been validated, do a quota check
+	// Arguments have been validated, do a quota check. Files uploaded into a shared workspace
+	// count against that workspace's quota and not the uploader's.
 
-	diskUsage, diskQuota, err := dbhandler.GetQuotaInfo(session.WID)
+	quotaWid := fshandler.GetPathWorkspace(session.Message.Data["Path"])
+	if quotaWid == "" {
+		quotaWid = session.WID
+	}
+	diskUsage, diskQuota, err := session.Store.Quotas.GetQuotaInfo(quotaWid)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		return
 	}
 
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+)
+
+func TestCheckPathAccess(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	adminWid := "ae406c5e-2673-4d3e-af20-91325d9623ca"
+	userWid := "11111111-1111-1111-1111-111111111111"
+	otherWid := "22222222-2222-2222-2222-22222222222a"
+	for _, ws := range [][]string{
+		{adminWid, "admin", "example.com"},
+		{userWid, "csimons", "example.com"},
+		{otherWid, "rbrannan", "example.org"},
+	} {
+		err := store.Workspaces.AddWorkspace(ws[0], ws[1], ws[2], "-", "active", "individual")
+		if err != nil {
+			t.Fatalf("TestCheckPathAccess: Couldn't add workspace: %s", err.Error())
+		}
+	}
+
+	var admin sessionState
+	admin.WID = adminWid
+	admin.Domain = "example.com"
+	admin.LoginState = loginClientSession
+
+	// Subtest #1: The admin can reach the workspaces of its own domain, whatever the case of the
+	// path
+
+	for _, wid := range []string{userWid, strings.ToUpper(userWid)} {
+		response, _ := runCommand(t, store, admin, "EXISTS", map[string]string{
+			"Path": "/ " + wid,
+		})
+		if response.Code == 403 {
+			t.Fatalf("TestCheckPathAccess: #1: admin refused access to %s", wid)
+		}
+	}
+
+	// Subtest #2: The admin can't reach the workspaces of another domain, including through a
+	// path which doesn't match the stored workspace ID exactly
+
+	for _, wid := range []string{otherWid, strings.ToUpper(otherWid),
+		strings.ReplaceAll(otherWid, "-", "")} {
+		response, _ := runCommand(t, store, admin, "EXISTS", map[string]string{
+			"Path": "/ " + wid,
+		})
+		if response.Code != 403 {
+			t.Fatalf("TestCheckPathAccess: #2: admin given access to %s: %d", wid,
+				response.Code)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package fshandler
+
+// Access levels for paths in a workspace. Each level includes the permissions of the ones
+// below it.
+const (
+	AccessNone = iota
+	AccessRead
+	AccessWrite
+	AccessAdmin
+)
+
+// ValidateRole returns whether or not a string is a valid role for a shared workspace member
+func ValidateRole(role string) bool {
+	return RoleAccess(role) != AccessNone
+}
+
+// RoleAccess returns the access level granted to a shared workspace member by the specified role.
+// Unrecognized roles, including an empty string, are granted no access.
+func RoleAccess(role string) int {
+	switch role {
+	case "read":
+		return AccessRead
+	case "write":
+		return AccessWrite
+	case "admin":
+		return AccessAdmin
+	}
+	return AccessNone
+}
@@ -1,7 +1,6 @@
 package fshandler
 
 import (
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -16,11 +15,9 @@ import (
 
 	"github.com/darkwyrm/b85"
 	cs "github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/ezcrypt"
 	"github.com/darkwyrm/mensagod/logging"
 	"github.com/spf13/viper"
-	"github.com/zeebo/blake3"
-	"golang.org/x/crypto/blake2b"
-	"golang.org/x/crypto/sha3"
 )
 
 // LocalFSHandler represents local storage on the server
@@ -544,22 +541,13 @@ func (lfs *LocalFSHandler) Select(path string) (LocalAnPath, error) {
 // HashFile performs a hash check on a file and determines if it matches or not
 func HashFile(path string, hash cs.CryptoString) (bool, error) {
 
-	hasher := sha256.New()
-	switch hash.Prefix {
-	case "BLAKE3-256":
-		hasher = blake3.New()
-	case "BLAKE2B-256":
-		hasher, _ = blake2b.New256(nil)
-	case "SHA-256":
-		// Do nothing. We've already created a SHA-256 hasher
-	case "SHA3-256":
-		hasher = sha3.New256()
-	default:
-		return false, cs.ErrUnsupportedAlgorithm
+	hasher, err := ezcrypt.NewHasher(hash.Prefix)
+	if err != nil {
+		return false, err
 	}
 
 	var anpath LocalAnPath
-	err := anpath.Set(path)
+	err = anpath.Set(path)
 	if err != nil {
 		return false, err
 	}
@@ -591,19 +579,182 @@ func HashFile(path string, hash cs.CryptoString) (bool, error) {
 // RemoveWorkspace deletes all file and folder data for the specified workspace. This call does
 // not validate the workspace string. Validation is the caller's responsibility.
 func RemoveWorkspace(wid string) error {
+	allWorkspacesRoot, err := getWorkspacesRoot()
+	if err != nil {
+		return err
+	}
+
+	workspaceRoot := filepath.Join(allWorkspacesRoot, wid)
+	return os.RemoveAll(workspaceRoot)
+}
+
+// widPattern matches a workspace ID in the name of a directory in the workspace folder
+const widPattern = "([\\da-fA-F]{8}-[\\da-fA-F]{4}-[\\da-fA-F]{4}-[\\da-fA-F]{4}-[\\da-fA-F]{12})"
+
+// ListWorkspaces returns the IDs of the workspaces which have a top directory. Other items in the
+// workspace folder, such as the temporary file area, are skipped.
+func ListWorkspaces() ([]string, error) {
+	return listWorkspaceDirs("^" + widPattern + "$")
+}
+
+// ListRemovedWorkspaces returns the IDs of the workspaces whose directories were set aside by a
+// WorkspaceRemoval which was never finished
+func ListRemovedWorkspaces() ([]string, error) {
+	return listWorkspaceDirs("^\\." + widPattern + "\\.removed$")
+}
+
+// listWorkspaceDirs returns the workspace IDs captured by a pattern from the names of the
+// directories in the workspace folder
+func listWorkspaceDirs(dirPattern string) ([]string, error) {
+	allWorkspacesRoot, err := getWorkspacesRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := os.ReadDir(allWorkspacesRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := regexp.MustCompile(dirPattern)
+	out := make([]string, 0)
+	for _, item := range items {
+		if !item.IsDir() {
+			continue
+		}
+		if match := pattern.FindStringSubmatch(item.Name()); match != nil {
+			out = append(out, match[1])
+		}
+	}
+	return out, nil
+}
+
+// WorkspaceCreation creates the top directory for a new workspace as part of an account operation.
+// It is left alone when reverted if it already existed.
+type WorkspaceCreation struct {
+	WID     string
+	created bool
+}
+
+// Apply creates the workspace's directory if it doesn't exist
+func (c *WorkspaceCreation) Apply() error {
+	allWorkspacesRoot, err := getWorkspacesRoot()
+	if err != nil {
+		return err
+	}
+
+	workspaceRoot := filepath.Join(allWorkspacesRoot, c.WID)
+	_, err = os.Stat(workspaceRoot)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Mkdir(workspaceRoot, 0770)
+	if err != nil {
+		return err
+	}
+	c.created = true
+	return nil
+}
+
+// Revert removes the workspace's directory if Apply created it
+func (c *WorkspaceCreation) Revert() error {
+	if !c.created {
+		return nil
+	}
+	c.created = false
+	return RemoveWorkspace(c.WID)
+}
+
+// Finish does nothing because the directory is already in place
+func (c *WorkspaceCreation) Finish() error {
+	return nil
+}
+
+// WorkspaceRemoval deletes all file and folder data for a workspace as part of an account
+// operation. The workspace's directory is set aside when the change is applied so that it can be
+// put back, and it is only deleted when the change is finished.
+type WorkspaceRemoval struct {
+	WID       string
+	asidePath string
+}
+
+// Apply renames the workspace's directory so that it is no longer in use
+func (r *WorkspaceRemoval) Apply() error {
+	allWorkspacesRoot, err := getWorkspacesRoot()
+	if err != nil {
+		return err
+	}
+
+	workspaceRoot := filepath.Join(allWorkspacesRoot, r.WID)
+	_, err = os.Stat(workspaceRoot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Anything left behind by an earlier removal which didn't finish is removed first
+	asidePath := filepath.Join(allWorkspacesRoot, "."+r.WID+".removed")
+	err = os.RemoveAll(asidePath)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(workspaceRoot, asidePath)
+	if err != nil {
+		return err
+	}
+	r.asidePath = asidePath
+	return nil
+}
+
+// Revert puts the workspace's directory back in place
+func (r *WorkspaceRemoval) Revert() error {
+	if r.asidePath == "" {
+		return nil
+	}
+
+	workspaceRoot := filepath.Join(filepath.Dir(r.asidePath), r.WID)
+	err := os.Rename(r.asidePath, workspaceRoot)
+	if err != nil {
+		return err
+	}
+	r.asidePath = ""
+	return nil
+}
+
+// Finish deletes the workspace's data
+func (r *WorkspaceRemoval) Finish() error {
+	if r.asidePath == "" {
+		return nil
+	}
+
+	err := os.RemoveAll(r.asidePath)
+	if err != nil {
+		return err
+	}
+	r.asidePath = ""
+	return nil
+}
+
+// getWorkspacesRoot returns the folder which contains the top directories of all workspaces
+func getWorkspacesRoot() (string, error) {
 	allWorkspacesRoot := viper.GetString("global.workspace_dir")
 	if len(allWorkspacesRoot) < 1 {
-		return errors.New("empty workspace path")
+		return "", errors.New("empty workspace path")
 	}
 
 	stat, err := os.Stat(allWorkspacesRoot)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if !stat.IsDir() {
-		return errors.New("workspace path is a file")
+		return "", errors.New("workspace path is a file")
 	}
-
-	workspaceRoot := filepath.Join(allWorkspacesRoot, wid)
-	return os.RemoveAll(workspaceRoot)
+	return allWorkspacesRoot, nil
 }
@@ -1008,3 +1008,79 @@ func TestHashFile(t *testing.T) {
 		t.Fatal("Test_HashFile: BLAKE3-256 hash mismatch")
 	}
 }
+
+func TestWorkspaceRemoval(t *testing.T) {
+	err := setupTest()
+	if err != nil {
+		t.Fatalf("TestWorkspaceRemoval: Couldn't reset workspace dir: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	fsh := GetFSProvider()
+
+	creation := WorkspaceCreation{WID: wid}
+	err = creation.Apply()
+	if err != nil {
+		t.Fatalf("TestWorkspaceRemoval: Couldn't create workspace dir: %s", err.Error())
+	}
+	_, err = generateRandomFile("/ "+wid, 1000)
+	if err != nil {
+		t.Fatalf("TestWorkspaceRemoval: Couldn't create test file: %s", err.Error())
+	}
+	handle, _, err := fsh.MakeTempFile(wid)
+	if err != nil {
+		t.Fatalf("TestWorkspaceRemoval: Couldn't create temp file: %s", err.Error())
+	}
+	handle.Close()
+
+	// Subtest #1: Only workspace directories are listed
+
+	widList, err := ListWorkspaces()
+	if err != nil || len(widList) != 1 || widList[0] != wid {
+		t.Fatalf("TestWorkspaceRemoval: #1: wrong workspaces listed: %v %v", widList, err)
+	}
+
+	// Subtest #2: A reverted removal leaves the workspace as it was
+
+	removal := WorkspaceRemoval{WID: wid}
+	err = removal.Apply()
+	if err != nil {
+		t.Fatalf("TestWorkspaceRemoval: #2: Couldn't apply removal: %s", err.Error())
+	}
+	exists, _ := fsh.Exists("/ " + wid)
+	if exists {
+		t.Fatal("TestWorkspaceRemoval: #2: workspace still in place after removal applied")
+	}
+	err = removal.Revert()
+	if err != nil {
+		t.Fatalf("TestWorkspaceRemoval: #2: Couldn't revert removal: %s", err.Error())
+	}
+	files, err := fsh.ListFiles("/ "+wid, 0)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("TestWorkspaceRemoval: #2: workspace not restored: %v", err)
+	}
+
+	// Subtest #3: A finished removal deletes the workspace. Until it is finished, the directory
+	// set aside is listed as an unfinished removal.
+
+	err = removal.Apply()
+	if err != nil {
+		t.Fatalf("TestWorkspaceRemoval: #3: Couldn't apply removal: %s", err.Error())
+	}
+	widList, err = ListRemovedWorkspaces()
+	if err != nil || len(widList) != 1 || widList[0] != wid {
+		t.Fatalf("TestWorkspaceRemoval: #3: wrong removals listed: %v %v", widList, err)
+	}
+	err = removal.Finish()
+	if err != nil {
+		t.Fatalf("TestWorkspaceRemoval: #3: Couldn't remove workspace: %s", err.Error())
+	}
+	widList, err = ListWorkspaces()
+	if err != nil || len(widList) != 0 {
+		t.Fatalf("TestWorkspaceRemoval: #3: workspace not removed: %v %v", widList, err)
+	}
+	widList, err = ListRemovedWorkspaces()
+	if err != nil || len(widList) != 0 {
+		t.Fatalf("TestWorkspaceRemoval: #3: finished removal still listed: %v %v", widList, err)
+	}
+}
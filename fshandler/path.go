@@ -105,6 +105,21 @@ func ValidateMensagoPath(path string) bool {
 	return pattern.MatchString(path)
 }
 
+// GetPathWorkspace returns the ID of the workspace which contains the specified Mensago path. An
+// empty string is returned if the path is invalid or does not point inside a workspace, such as
+// the top level of the workspace hierarchy.
+func GetPathWorkspace(path string) string {
+	if !ValidateMensagoPath(path) {
+		return ""
+	}
+
+	pathParts := strings.Split(path, " ")
+	if len(pathParts) < 2 || ValidateFileName(pathParts[1]) {
+		return ""
+	}
+	return pathParts[1]
+}
+
 // ValidateFileName returns whether or not a filename conforms to the format expected by the
 // platform
 func ValidateFileName(filename string) bool {
@@ -43,6 +43,28 @@ func TestValidateFileName(t *testing.T) {
 	}
 }
 
+func TestGetPathWorkspace(t *testing.T) {
+
+	testPath1 := "/ 3e782960-a762-4def-8038-a1d0a3cd951d e5c2f479-b9db-4475-8152-e76605e731fc"
+	if GetPathWorkspace(testPath1) != "3e782960-a762-4def-8038-a1d0a3cd951d" {
+		t.Fatal("GetPathWorkspace didn't return the workspace for a valid path")
+	}
+
+	if GetPathWorkspace("/") != "" {
+		t.Fatal("GetPathWorkspace subtest #2 returned a workspace for the root path")
+	}
+
+	testPath3 := "/ 1257894000.1024.7cc9a1cf-dfa1-4cb4-bb2b-409a56608b11"
+	if GetPathWorkspace(testPath3) != "" {
+		t.Fatal("GetPathWorkspace subtest #3 returned a file name as a workspace")
+	}
+
+	testPath4 := "3e782960-a762-4def-8038-a1d0a3cd951d e5c2f479-b9db-4475-8152-e76605e731fc"
+	if GetPathWorkspace(testPath4) != "" {
+		t.Fatal("GetPathWorkspace subtest #4 returned a workspace for a bad path")
+	}
+}
+
 func TestAnPath_SetFromString(t *testing.T) {
 
 	workspacePath := viper.GetString("global.workspace_dir")
@@ -1,6 +1,6 @@
 module github.com/darkwyrm/mensagod
 
-go 1.15
+go 1.16
 
 require (
 	github.com/darkwyrm/b85 v0.0.0-20201016104639-0bcaa1e55b1b
@@ -8,7 +8,9 @@ require (
 	github.com/everlastingbeta/diceware v1.1.3
 	github.com/google/uuid v1.2.0
 	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/spf13/viper v1.7.1
 	github.com/zeebo/blake3 v0.1.0
 	golang.org/x/crypto v0.0.0-20210218145215-b8e89b74b9df
+	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf
 )
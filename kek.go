@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/ezcrypt"
+	"github.com/darkwyrm/mensagod/logging"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// The organization's private keys are wrapped with a key-encryption key (KEK) so that a copy of
+// the database isn't enough to forge the organization's signatures. The KEK is either stored in a
+// key file outside the database or derived from a passphrase given to the server when it starts.
+
+// loadOrgKEK returns the key-encryption key for the organization's private keys as configured in
+// security.org_key_protection. The returned key is empty if protection is turned off.
+func loadOrgKEK() (cryptostring.CryptoString, error) {
+	switch viper.GetString("security.org_key_protection") {
+	case "keyfile":
+		return readKEKFile(viper.GetString("security.org_key_file"))
+	case "passphrase":
+		salt, err := dbhandler.GetKEKSalt()
+		if err != nil {
+			return cryptostring.CryptoString{}, err
+		}
+		passphrase, err := readPassphrase("MENSAGOD_KEY_PASSPHRASE",
+			"Passphrase for organization keys: ")
+		if err != nil {
+			return cryptostring.CryptoString{}, err
+		}
+		return ezcrypt.DeriveKEK(passphrase, salt), nil
+	}
+	return cryptostring.CryptoString{}, nil
+}
+
+// unlockOrgKeys loads the key-encryption key and makes the organization's private keys available
+// to the server. The server exits if the keys can't be unlocked.
+func unlockOrgKeys() {
+	kek, err := loadOrgKEK()
+	if err != nil {
+		fmt.Printf("Unable to load the key for the organization's keys: %s\n", err.Error())
+		logging.Shutdown()
+		os.Exit(1)
+	}
+	if kek.Prefix == "" {
+		// Turning protection off doesn't unwrap keys which are already wrapped, so the server
+		// wouldn't be able to use them
+		wrapped, err := dbhandler.OrgKeysWrapped()
+		if err != nil {
+			fmt.Printf("Unable to check the organization's keys: %s\n", err.Error())
+			logging.Shutdown()
+			os.Exit(1)
+		}
+		if wrapped {
+			fmt.Println("The organization's keys are encrypted, but org_key_protection is " +
+				"'none'. Set it to the protection used when they were encrypted.")
+			logging.Write("unlockOrgKeys: organization keys are wrapped but no key is configured")
+			logging.Shutdown()
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = dbhandler.UnlockOrgKeys(kek)
+	if err != nil {
+		fmt.Printf("Unable to unlock the organization's keys: %s\n", err.Error())
+		logging.Writef("unlockOrgKeys: %s", err.Error())
+		logging.Shutdown()
+		os.Exit(1)
+	}
+}
+
+// commandRewrap implements 'mensagod rewrap', which encrypts the organization's private keys with
+// a new key-encryption key. The current key is loaded from the config file as usual. It is also
+// used to turn on protection for keys which are stored unencrypted.
+func commandRewrap(args []string) error {
+	flags := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	keyPath := flags.String("keyfile", "",
+		"path of the new key file. It is created if it doesn't exist.")
+	usePassphrase := flags.Bool("passphrase", false, "derive the new key from a passphrase")
+	flags.Parse(args)
+
+	if (*keyPath == "") == !*usePassphrase {
+		return errors.New("exactly one of -keyfile and -passphrase is required")
+	}
+
+	unlockOrgKeys()
+
+	var newKEK cryptostring.CryptoString
+	newSalt, err := dbhandler.GetKEKSalt()
+	if err != nil {
+		return err
+	}
+	if *usePassphrase {
+		passphrase, err := readPassphrase("MENSAGOD_NEW_KEY_PASSPHRASE",
+			"New passphrase for organization keys: ")
+		if err != nil {
+			return err
+		}
+		if len(passphrase) < 8 {
+			return errors.New("passphrase must be at least 8 characters")
+		}
+
+		// A new salt keeps the new key independent of the old one
+		newSalt = make([]byte, len(newSalt))
+		if _, err = rand.Read(newSalt); err != nil {
+			return err
+		}
+		newKEK = ezcrypt.DeriveKEK(passphrase, newSalt)
+	} else {
+		newKEK, err = readKEKFile(*keyPath)
+		if os.IsNotExist(err) {
+			newKEK, err = ezcrypt.GenerateKEK()
+			if err == nil {
+				err = ioutil.WriteFile(*keyPath, []byte(newKEK.AsString()+"\n"), 0600)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dbhandler.RewrapOrgKeys(newKEK, newSalt)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("The organization's keys have been rewrapped. Update the [security] section of " +
+		"the config file before restarting the server:")
+	if *usePassphrase {
+		fmt.Println(`  org_key_protection = "passphrase"`)
+	} else {
+		fmt.Println(`  org_key_protection = "keyfile"`)
+		fmt.Printf("  org_key_file = %q\n", *keyPath)
+	}
+	return nil
+}
+
+// readKEKFile reads a key-encryption key from a key file
+func readKEKFile(path string) (cryptostring.CryptoString, error) {
+	var kek cryptostring.CryptoString
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return kek, err
+	}
+	err = kek.Set(strings.TrimSpace(string(data)))
+	if err == nil && kek.Prefix != ezcrypt.KeyWrapAlgorithm {
+		err = cryptostring.ErrUnsupportedAlgorithm
+	}
+	return kek, err
+}
+
+// readPassphrase gets a passphrase from an environment variable or, if it isn't set, from the
+// terminal without echoing it
+func readPassphrase(envVar string, prompt string) (string, error) {
+	if passphrase, ok := os.LookupEnv(envVar); ok {
+		return passphrase, nil
+	}
+
+	fmt.Print(prompt)
+	line, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	passphrase := strings.TrimRight(string(line), "\r\n")
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
@@ -1,10 +1,10 @@
 package keycard
 
 import (
-	"bufio"
+	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -18,11 +18,9 @@ import (
 	"github.com/darkwyrm/b85"
 	"github.com/darkwyrm/gostringlist"
 	cs "github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/ezcrypt"
 	"github.com/darkwyrm/mensagod/logging"
-	"github.com/zeebo/blake3"
-	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/nacl/box"
-	"golang.org/x/crypto/sha3"
 )
 
 // KeyInfo describes the encryption and signing key fields for an Entry object
@@ -99,32 +97,43 @@ type Entry struct {
 
 // IsDataCompliant checks only the data fields of the entry to ensure that they are valid
 func (entry Entry) IsDataCompliant() bool {
+	return entry.ValidateData() == nil
+}
+
+// ValidateData performs the same checks as IsDataCompliant, but returns an error describing the
+// first problem found instead of a simple yes or no
+func (entry Entry) ValidateData() error {
 	if entry.Type != "User" && entry.Type != "Organization" {
-		return false
+		return errors.New("unsupported entry type")
 	}
 
 	for _, reqField := range entry.RequiredFields.Items {
 		strValue, ok := entry.Fields[reqField]
-		if !ok || strValue != strings.TrimSpace(strValue) {
-			return false
+		if !ok {
+			return fmt.Errorf("required field %s missing", reqField)
+		}
+		if strValue != strings.TrimSpace(strValue) {
+			return fmt.Errorf("field %s has leading or trailing whitespace", reqField)
 		}
 	}
 
 	// If a field exists, it may not be empty and may not be greater than 6144 bytes
-	for _, fieldValue := range entry.Fields {
-		if fieldValue == "" || len(fieldValue) > 6144 {
-			return false
+	for fieldName, fieldValue := range entry.Fields {
+		if fieldValue == "" {
+			return fmt.Errorf("field %s is empty", fieldName)
+		}
+		if len(fieldValue) > 6144 {
+			return fmt.Errorf("field %s is too long", fieldName)
 		}
 	}
 
-	var dataValid bool
+	var err error
 	if entry.Type == "User" {
-		dataValid, _ = entry.validateUserEntry()
+		_, err = entry.validateUserEntry()
 	} else {
-		dataValid, _ = entry.validateOrgEntry()
+		_, err = entry.validateOrgEntry()
 	}
-
-	return dataValid
+	return err
 }
 
 // IsCompliant returns true if the object meets spec compliance (required fields, etc.)
@@ -391,7 +400,7 @@ func (entry *Entry) Sign(signingKey cs.CryptoString, sigtype string) error {
 		return errors.New("bad signing key")
 	}
 
-	if signingKey.Prefix != "ED25519" {
+	if !ezcrypt.IsSupported(signingKey.Prefix, ezcrypt.CapSign) {
 		return cs.ErrUnsupportedAlgorithm
 	}
 
@@ -414,36 +423,21 @@ func (entry *Entry) Sign(signingKey cs.CryptoString, sigtype string) error {
 		return errors.New("bad signature type")
 	}
 
-	signkeyDecoded := signingKey.RawData()
-	if signkeyDecoded == nil {
-		return errors.New("base signing key")
+	signature, err := ezcrypt.Sign(signingKey, entry.MakeByteString(sigtypeIndex+1))
+	if err != nil {
+		return err
 	}
-
-	// We bypass the nacl/sign module because it requires a 64-bit private key. We, however, pass
-	// around the 32-bit ed25519 seeds used to generate the keys. Thus, we have to skip using
-	// nacl.Sign() and go directly to the equivalent code in the ed25519 module.
-	signKeyPriv := ed25519.NewKeyFromSeed(signkeyDecoded)
-	signature := ed25519.Sign(signKeyPriv, entry.MakeByteString(sigtypeIndex+1))
-	entry.Signatures[sigtype] = "ED25519:" + b85.Encode(signature)
+	entry.Signatures[sigtype] = signature.AsString()
 
 	return nil
 }
 
 // GenerateHash generates a hash containing the expected signatures and the previous hash, if it
-// exists. The supported hash algorithms are 'BLAKE3-256', 'BLAKE2B-256', 'SHA-256', and 'SHA3-256'.
+// exists. Any hash algorithm in ezcrypt's algorithm registry may be used.
 func (entry *Entry) GenerateHash(algorithm string) error {
-	validAlgorithm := false
-	switch algorithm {
-	case
-		"BLAKE3-256",
-		"BLAKE2B-256",
-		"SHA-256",
-		"SHA3-256":
-		validAlgorithm = true
-	}
-
-	if !validAlgorithm {
-		return cs.ErrUnsupportedAlgorithm
+	hasher, err := ezcrypt.NewHasher(algorithm)
+	if err != nil {
+		return err
 	}
 
 	hashLevel := -1
@@ -459,29 +453,31 @@ func (entry *Entry) GenerateHash(algorithm string) error {
 		return errors.New("bug: SignatureInfo missing hash entry")
 	}
 
-	switch algorithm {
-	case "BLAKE3-256":
-		// The API for Zeebo's BLAKE3 implementation isn't the same as the other hash APIs. It
-		// requires a bit more effort. :(
-		var sum []byte
-		hasher := blake3.New()
-		hasher.Write(entry.MakeByteString(hashLevel))
-		hasher.Sum(sum)
-		entry.Hash = algorithm + ":" + b85.Encode(sum)
-	case "BLAKE2B-256":
-		sum := blake2b.Sum256(entry.MakeByteString(hashLevel))
-		entry.Hash = algorithm + ":" + b85.Encode(sum[:])
-	case "SHA-256":
-		sum := sha256.Sum256(entry.MakeByteString(hashLevel))
-		entry.Hash = algorithm + ":" + b85.Encode(sum[:])
-	case "SHA3-256":
-		sum := sha3.Sum256(entry.MakeByteString(hashLevel))
-		entry.Hash = algorithm + ":" + b85.Encode(sum[:])
-	}
+	hasher.Write(entry.MakeByteString(hashLevel))
+	entry.Hash = algorithm + ":" + b85.Encode(hasher.Sum(nil))
 
 	return nil
 }
 
+// VerifyHash checks that the entry's hash matches its contents. The algorithm is taken from the
+// prefix of the hash.
+func (entry Entry) VerifyHash() (bool, error) {
+	var hash cs.CryptoString
+	err := hash.Set(entry.Hash)
+	if err != nil {
+		return false, errors.New("bad hash value")
+	}
+
+	// entry is a copy, so regenerating the hash here doesn't affect the caller's entry. The hash
+	// must be cleared first because it is not part of the data it covers.
+	entry.Hash = ""
+	err = entry.GenerateHash(hash.Prefix)
+	if err != nil {
+		return false, err
+	}
+	return entry.Hash == hash.AsString(), nil
+}
+
 // VerifySignature cryptographically verifies the entry against the key provided, given the
 // specific signature to verify.
 func (entry Entry) VerifySignature(verifyKey cs.CryptoString, sigtype string) (bool, error) {
@@ -490,8 +486,9 @@ func (entry Entry) VerifySignature(verifyKey cs.CryptoString, sigtype string) (b
 		return false, errors.New("bad verification key")
 	}
 
-	if verifyKey.Prefix != "ED25519" {
-		return false, cs.ErrUnsupportedAlgorithm
+	alg, err := ezcrypt.GetAlgorithm(verifyKey.Prefix, ezcrypt.CapSign)
+	if err != nil {
+		return false, err
 	}
 
 	if !entry.SignatureInfo.Contains(sigtype) {
@@ -508,12 +505,12 @@ func (entry Entry) VerifySignature(verifyKey cs.CryptoString, sigtype string) (b
 	}
 
 	var sig cs.CryptoString
-	err := sig.Set(entry.Signatures[sigtype])
+	err = sig.Set(entry.Signatures[sigtype])
 	if err != nil {
 		return false, err
 	}
-	if sig.Prefix != "ED25519" {
-		return false, cs.ErrUnsupportedAlgorithm
+	if sig.Prefix != verifyKey.Prefix {
+		return false, errors.New("signature algorithm doesn't match key")
 	}
 	digest := sig.RawData()
 	if digest == nil {
@@ -525,7 +522,7 @@ func (entry Entry) VerifySignature(verifyKey cs.CryptoString, sigtype string) (b
 		return false, errors.New("decoding error in verification key")
 	}
 
-	verifyStatus := ed25519.Verify(verifyKeyDecoded, entry.MakeByteString(sigInfo.Level-1), digest)
+	verifyStatus := alg.Verify(verifyKeyDecoded, entry.MakeByteString(sigInfo.Level-1), digest)
 
 	return verifyStatus, nil
 }
@@ -551,7 +548,7 @@ func (entry *Entry) Chain(key cs.CryptoString, rotateOptional bool) (*Entry, map
 		return newEntry, outKeys, errors.New("unsupported entry type")
 	}
 
-	if key.Prefix != "ED25519" {
+	if !ezcrypt.IsSupported(key.Prefix, ezcrypt.CapSign) {
 		return newEntry, outKeys, cs.ErrUnsupportedAlgorithm
 	}
 
@@ -569,6 +566,12 @@ func (entry *Entry) Chain(key cs.CryptoString, rotateOptional bool) (*Entry, map
 	}
 	newEntry.Fields["Index"] = fmt.Sprintf("%d", index+1)
 
+	// The timestamp and expiration copied from the previous entry don't apply to the new one
+	now := time.Now().UTC()
+	newEntry.Fields["Timestamp"] = fmt.Sprintf("%d%02d%02dT%02d%02d%02dZ", now.Year(),
+		now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second())
+	newEntry.SetExpiration(-1)
+
 	switch entry.Type {
 	case "User":
 		outKeys, err = GenerateUserKeys(rotateOptional)
@@ -580,8 +583,9 @@ func (entry *Entry) Chain(key cs.CryptoString, rotateOptional bool) (*Entry, map
 	}
 
 	for _, info := range entry.Keys {
+		// GenerateUserKeys returns empty keys for optional keys which aren't rotated
 		keyString, ok := outKeys[info.Name+".public"]
-		if ok {
+		if ok && keyString.IsValid() {
 			newEntry.Fields[info.Name] = keyString.AsString()
 		} else if !info.Optional {
 			logging.Write("missing required keys generated for Chain()")
@@ -628,6 +632,129 @@ func NewEntryFromData(textBlock string) (*Entry, error) {
 	return outEntry, nil
 }
 
+// entryJSON is the JSON representation of an Entry. Fields and Signatures only contain the items
+// which appear in the entry's text form, so converting between the two loses nothing.
+type entryJSON struct {
+	Type       string
+	Fields     map[string]string
+	Signatures map[string]string `json:",omitempty"`
+	PrevHash   string            `json:"Previous-Hash,omitempty"`
+	Hash       string            `json:",omitempty"`
+}
+
+// MarshalJSON returns the canonical JSON form of the entry. Map keys are sorted, there is no
+// insignificant whitespace, and characters such as < and > are not escaped.
+func (entry Entry) MarshalJSON() ([]byte, error) {
+	out := entryJSON{
+		Type:       entry.Type,
+		Fields:     make(map[string]string),
+		Signatures: make(map[string]string),
+		PrevHash:   entry.PrevHash,
+		Hash:       entry.Hash,
+	}
+	for _, fieldName := range entry.FieldNames.Items {
+		if len(entry.Fields[fieldName]) > 0 {
+			out.Fields[fieldName] = entry.Fields[fieldName]
+		}
+	}
+	for _, item := range entry.SignatureInfo.Items {
+		if item.Type == SigInfoSignature && len(entry.Signatures[item.Name]) > 0 {
+			out.Signatures[item.Name] = entry.Signatures[item.Name]
+		}
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(out); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// UnmarshalJSON initializes the entry from its JSON form. Fields and signatures which couldn't be
+// represented in the entry's text form are rejected.
+func (entry *Entry) UnmarshalJSON(data []byte) error {
+	// CAUTION: This function needs to be extra careful because it handles untrusted data
+
+	var in entryJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	var newEntry *Entry
+	switch in.Type {
+	case "Organization":
+		newEntry = NewOrgEntry()
+	case "User":
+		newEntry = NewUserEntry()
+	default:
+		return errors.New("bad entry type")
+	}
+
+	// The defaults set by the constructors are not part of the data
+	newEntry.Fields = make(map[string]string)
+	for k, v := range in.Fields {
+		if !newEntry.FieldNames.Contains(k) {
+			return fmt.Errorf("%s is not a valid field for %s entries", k, in.Type)
+		}
+		if err := checkJSONValue(k, v); err != nil {
+			return err
+		}
+		newEntry.Fields[k] = v
+	}
+
+	for k, v := range in.Signatures {
+		found, info := newEntry.SignatureInfo.GetItem(k)
+		if !found || info.Type != SigInfoSignature {
+			return fmt.Errorf("%s is not a valid signature type", k)
+		}
+		if err := checkJSONValue(k+"-Signature", v); err != nil {
+			return err
+		}
+		newEntry.Signatures[k] = v
+	}
+
+	if in.PrevHash != "" {
+		if err := checkJSONValue("Previous-Hash", in.PrevHash); err != nil {
+			return err
+		}
+	}
+	if in.Hash != "" {
+		if err := checkJSONValue("Hash", in.Hash); err != nil {
+			return err
+		}
+	}
+	newEntry.PrevHash = in.PrevHash
+	newEntry.Hash = in.Hash
+
+	*entry = *newEntry
+	return nil
+}
+
+// checkJSONValue makes sure that a value from the JSON form of an entry can be represented in its
+// text form
+func checkJSONValue(name string, value string) error {
+	if len(value) < 1 {
+		return fmt.Errorf("empty value for %s", name)
+	}
+	if strings.ContainsAny(value, "\r\n") || strings.TrimSpace(value) != value {
+		return fmt.Errorf("bad value for %s", name)
+	}
+	return nil
+}
+
+// NewEntryFromJSON creates a new entry from its JSON form. The type of entry created is based on
+// the Type member of the JSON object.
+func NewEntryFromJSON(data []byte) (*Entry, error) {
+	outEntry := new(Entry)
+	err := json.Unmarshal(data, outEntry)
+	if err != nil {
+		return nil, err
+	}
+	return outEntry, nil
+}
+
 // NewOrgEntry creates a new OrgEntry
 func NewOrgEntry() *Entry {
 	self := new(Entry)
@@ -664,8 +791,8 @@ func NewOrgEntry() *Entry {
 
 	self.Keys = []KeyInfo{
 		{"Primary-Verification-Key", "signing", false},
-		{"Secondary-Verification-Key", "signing", false},
-		{"Encryption-Key", "encryption", true}}
+		{"Secondary-Verification-Key", "signing", true},
+		{"Encryption-Key", "encryption", false}}
 
 	self.SignatureInfo.Items = []SigInfo{
 		{"Custody", 1, true, SigInfoSignature},
@@ -1275,83 +1402,112 @@ type Keycard struct {
 	Entries []Entry
 }
 
-// Load writes the entire entry chain to one file with optional overwrite
+// Load reads an entry chain from a file. Entries in the file are expected to be enclosed by
+// '----- BEGIN ENTRY -----' and '----- END ENTRY -----' lines as written by Save. A file
+// containing just the data for a single entry without these lines can also be loaded. If clobber
+// is true, any entries already in the keycard are replaced. Otherwise, loading into a keycard
+// which already has entries is an error.
 func (card *Keycard) Load(path string, clobber bool) error {
 	if len(path) < 1 {
 		return errors.New("empty path")
 	}
 
-	fHandle, err := os.Open(path)
-	if err != nil {
-		return err
+	if len(card.Entries) > 0 && !clobber {
+		return errors.New("keycard not empty")
 	}
-	defer fHandle.Close()
-
-	fReader := bufio.NewReader(fHandle)
 
-	var line string
-	line, err = fReader.ReadString('\n')
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
-	accumulator := make([][2]string, 0, 16)
+	// Line endings are normalized so that files edited on other platforms can still be loaded
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	entries := make([]Entry, 0, 4)
 	cardType := ""
-	lineIndex := 1
-	for line != "" {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			lineIndex++
-			continue
+	accumulator := make([]string, 0, 16)
+	inEntry := false
+	hasMarkers := false
+
+	addEntry := func(lineIndex int) error {
+		if len(accumulator) == 0 {
+			return fmt.Errorf("empty entry ending at line %d", lineIndex)
 		}
 
+		var currentEntry *Entry
+		switch accumulator[0] {
+		case "Type:User":
+			currentEntry = NewUserEntry()
+		case "Type:Organization":
+			currentEntry = NewOrgEntry()
+		default:
+			return fmt.Errorf("missing or unsupported entry type in entry ending at line %d",
+				lineIndex)
+		}
+		if cardType == "" {
+			cardType = currentEntry.Type
+		} else if cardType != currentEntry.Type {
+			return fmt.Errorf("keycard-entry type mismatch in entry ending at line %d", lineIndex)
+		}
+
+		// Set() starts from the defaults for a new entry, which must not leak into loaded data
+		currentEntry.Fields = make(map[string]string)
+		err := currentEntry.Set([]byte(strings.Join(accumulator, "\r\n") + "\r\n"))
+		if err != nil {
+			return fmt.Errorf("bad entry data ending at line %d: %s", lineIndex, err.Error())
+		}
+		entries = append(entries, *currentEntry)
+		accumulator = make([]string, 0, 16)
+		return nil
+	}
+
+	for i, rawLine := range lines {
+		lineIndex := i + 1
+		line := strings.TrimSpace(rawLine)
+
 		switch line {
+		case "":
+			continue
+
 		case "----- BEGIN ENTRY -----":
-			accumulator = make([][2]string, 0, 16)
+			if inEntry || (!hasMarkers && len(accumulator) > 0) {
+				return fmt.Errorf("unexpected entry start in line %d", lineIndex)
+			}
+			inEntry = true
+			hasMarkers = true
 
 		case "----- END ENTRY -----":
-			var currentEntry *Entry
-			switch cardType {
-			case "User":
-				currentEntry = NewUserEntry()
-			case "Organization":
-				currentEntry = NewOrgEntry()
-			default:
-				return errors.New("unsupported entry type ")
+			if !inEntry {
+				return fmt.Errorf("unexpected entry end in line %d", lineIndex)
 			}
-
-			for _, fieldData := range accumulator {
-				err = currentEntry.SetField(fieldData[0], fieldData[1])
-				if err != nil {
-					return fmt.Errorf("bad field data in card line %d", lineIndex)
-				}
+			inEntry = false
+			if err := addEntry(lineIndex); err != nil {
+				return err
 			}
 
 		default:
-			parts := strings.SplitN(line, ":", 1)
-			if len(parts) != 2 {
-				return fmt.Errorf("bad line data in card line %d", lineIndex)
+			if hasMarkers && !inEntry {
+				return fmt.Errorf("data outside of entry in line %d", lineIndex)
 			}
-
-			if parts[0] == "Type" {
-				if cardType != "" {
-					if cardType != parts[1] {
-						return fmt.Errorf("keycard-entry type mismatch in line %d", lineIndex)
-					}
-				} else {
-					cardType = parts[0]
-				}
-			}
-			accumulator = append(accumulator, [2]string{parts[0], parts[1]})
+			accumulator = append(accumulator, line)
 		}
+	}
 
-		line, err = fReader.ReadString('\n')
-		if err != nil {
+	if inEntry {
+		return errors.New("last entry not terminated")
+	}
+	if !hasMarkers {
+		if err := addEntry(len(lines)); err != nil {
 			return err
 		}
-		lineIndex++
+	}
+	if len(entries) == 0 {
+		return errors.New("no entries in file")
 	}
 
+	card.Type = cardType
+	card.Entries = entries
 	return nil
 }
 
@@ -1370,7 +1526,7 @@ func (card Keycard) Save(path string, clobber bool) error {
 	if err != nil {
 		return err
 	}
-	fHandle.Close()
+	defer fHandle.Close()
 
 	for _, entry := range card.Entries {
 		_, err = fHandle.Write([]byte("----- BEGIN ENTRY -----\r\n"))
@@ -1392,20 +1548,27 @@ func (card Keycard) Save(path string, clobber bool) error {
 	return nil
 }
 
-// VerifyChain verifies the entire chain of entries
-func (card Keycard) VerifyChain(path string, clobber bool) (bool, error) {
+// VerifyChain verifies the entire chain of entries. Each entry after the first must be linked to
+// the one before it by both its Previous-Hash field and its Custody signature. If verification
+// fails, the returned error indicates the entry at fault.
+func (card Keycard) VerifyChain() (bool, error) {
 	if len(card.Entries) < 1 {
 		return false, errors.New("no entries in keycard")
 	}
 
-	if len(card.Entries) == 1 {
-		return true, nil
-	}
+	for i := 1; i < len(card.Entries); i++ {
+		if card.Entries[i].PrevHash != card.Entries[i-1].Hash {
+			return false, fmt.Errorf("entry %s: previous hash mismatch",
+				card.Entries[i].Fields["Index"])
+		}
 
-	for i := 0; i < len(card.Entries)-1; i++ {
-		verifyStatus, err := card.Entries[i].VerifyChain(&card.Entries[i+1])
-		if err != nil || !verifyStatus {
-			return false, err
+		verifyStatus, err := card.Entries[i].VerifyChain(&card.Entries[i-1])
+		if err != nil {
+			return false, fmt.Errorf("entry %s: %s", card.Entries[i].Fields["Index"], err.Error())
+		}
+		if !verifyStatus {
+			return false, fmt.Errorf("entry %s: custody signature failed to verify",
+				card.Entries[i].Fields["Index"])
 		}
 	}
 	return true, nil
@@ -1,13 +1,17 @@
 package main
 
 import (
-	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/darkwyrm/b85"
+	"github.com/darkwyrm/mensagod/config"
 	"github.com/darkwyrm/mensagod/cryptostring"
 	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/ezcrypt"
 	"github.com/darkwyrm/mensagod/keycard"
 	"github.com/darkwyrm/mensagod/logging"
 	"github.com/spf13/viper"
@@ -62,22 +66,40 @@ func commandAddEntry(session *sessionState) {
 		return
 	}
 
-	if entry.Fields["Workspace-ID"] != session.WID {
+	// Users add entries to their own keycards. The exception is the new root entry for a revoked
+	// keycard, which is added by the domain's administrator on the owner's behalf.
+	wid := entry.Fields["Workspace-ID"]
+	admin, err := isAdmin(session)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandAddEntry: error checking admin status: %s", err.Error())
+		return
+	}
+	if wid != session.WID && !admin {
 		session.SendStringResponse(411, "BAD KEYCARD DATA", "Workspace doesn't match login")
 		return
 	}
 
+	domain := getSessionDomain(session)
+	if strings.ToLower(entry.Fields["Domain"]) != domain {
+		session.SendStringResponse(411, "BAD KEYCARD DATA", "Domain doesn't match login")
+		return
+	}
+	if !checkSameDomain(session, wid) {
+		return
+	}
+
 	// admin, support, and abuse can't change their user IDs
 	adminAddresses := []string{"admin", "support", "abuse"}
 	for _, address := range adminAddresses {
-		currentAddress := address + "/" + viper.GetString("global.domain")
-		currentWid, err := dbhandler.ResolveAddress(currentAddress)
+		currentAddress := address + "/" + domain
+		currentWid, err := session.Store.Workspaces.LookupAddress(currentAddress)
 		if err != nil {
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			session.SendDatabaseError(err)
 			logging.Writef("commandAddEntry: error resolving address: %s", err.Error())
 			return
 		}
-		if session.WID == currentWid {
+		if wid == currentWid {
 			if entry.Fields["User-ID"] != address {
 				session.SendStringResponse(411, "BAD KEYCARD DATA",
 					"Admin, Support, and Abuse can't change their user IDs")
@@ -86,14 +108,13 @@ func commandAddEntry(session *sessionState) {
 		}
 	}
 
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
+	adminWid, err := getAdminWID(session, domain)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandAddEntry: error resolving address: %s", err.Error())
 		return
 	}
-	if session.WID == adminWid {
+	if wid == adminWid {
 		if entry.Fields["User-ID"] != "admin" {
 			session.SendStringResponse(411, "BAD KEYCARD DATA", "Admin can't change its user ID")
 			return
@@ -113,17 +134,29 @@ func commandAddEntry(session *sessionState) {
 		return
 	}
 
-	if entry.Fields["Workspace-ID"] != session.WID {
-		session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA", "Workspace ID mismatch")
-		return
-	}
-
 	// IsDataCompliant ensures that we actually have a string in the Index field that will convert
 	// into a positive integer
 	currentIndex, _ := strconv.Atoi(entry.Fields["Index"])
 
+	// If the workspace's keycard has been revoked, the new entry starts a new chain of trust. It is
+	// not Custody-signed and is linked to the organization's keycard like any other root entry.
+	// Whoever compromised the workspace's keys may be the one logged into it, so only the
+	// administrator may start the new chain.
+	revokedIndex, _, err := session.Store.Keycards.GetRevocation(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("ERROR AddEntry: error checking revocation for workspace %s: %s",
+			entry.Fields["Workspace-ID"], err.Error())
+		return
+	}
+	isRoot := currentIndex == 1
+	isRevoked := false
+
 	// Passing a 0 as the start index means we'll get just the current entry
-	tempStrList, err := dbhandler.GetUserEntries(entry.Fields["Workspace-ID"], 0, 0)
+	tempStrList, err := session.Store.Keycards.GetUserEntries(entry.Fields["Workspace-ID"], 0, 0)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
 	if err == nil {
 		if len(tempStrList) == 0 {
 			if currentIndex != 1 {
@@ -146,22 +179,45 @@ func commandAddEntry(session *sessionState) {
 				return
 			}
 
-			// If there are previous entries for the workspace, the chain of trust must be validated.
-			isOK, err := entry.VerifyChain(prevEntry)
-			if !isOK || err != nil {
-				session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA",
-					"Entry failed to chain verify")
-				return
+			// If there are previous entries for the workspace, the chain of trust must be validated
+			// unless the keycard has been revoked.
+			if prevIndex <= revokedIndex {
+				if !admin {
+					session.SendStringResponse(403, "FORBIDDEN",
+						"Only the administrator can add an entry to a revoked keycard")
+					return
+				}
+				isRoot = true
+				isRevoked = true
+			} else if wid == session.WID {
+				// The administrator's entries for other workspaces are refused below
+				isOK, err := entry.VerifyChain(prevEntry)
+				if !isOK || err != nil {
+					session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA",
+						"Entry failed to chain verify")
+					return
+				}
 			}
 		}
+	} else {
+		session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
+		logging.Writef("ERROR AddEntry: error getting entries for workspace %s: %s",
+			entry.Fields["Workspace-ID"], err.Error())
+		return
+	}
+
+	if wid != session.WID && !isRevoked {
+		session.SendStringResponse(403, "FORBIDDEN",
+			"Only the owner can add entries to a keycard which isn't revoked")
+		return
 	}
 
 	// If we managed to get this far, we can (theoretically) trust the initial data set given to us
 	// by the client. Here we sign the data with the organization's signing key
 
-	pskstring, err := dbhandler.GetPrimarySigningKey()
+	pskstring, err := session.Store.Keycards.GetPrimarySigningKey(domain)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
+		session.SendDatabaseError(err)
 		logging.Write("ERROR AddEntry: missing primary signing key in database.")
 		return
 	}
@@ -174,23 +230,19 @@ func commandAddEntry(session *sessionState) {
 		return
 	}
 
-	// We bypass the nacl/sign module because it requires a 64-bit private key. We, however, pass
-	// around the 32-bit ed25519 seeds used to generate the keys. Thus, we have to skip using
-	// nacl.Sign() and go directly to the equivalent code in the ed25519 module.
-	pskBytes := ed25519.NewKeyFromSeed(psk.RawData())
-	rawSignature := ed25519.Sign(pskBytes, entry.MakeByteString(-1))
-	if rawSignature == nil {
+	orgSignature, err := ezcrypt.Sign(psk, entry.MakeByteString(-1))
+	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
 		logging.Write("ERROR AddEntry: failed to org sign entry.")
 		return
 	}
-	signature := "ED25519:" + b85.Encode(rawSignature)
+	signature := orgSignature.AsString()
 	entry.Signatures["Organization"] = signature
 
-	if currentIndex == 1 {
-		tempStrList, err = dbhandler.GetOrgEntries(0, 0)
+	if isRoot {
+		tempStrList, err = session.Store.Keycards.GetOrgEntries(domain, 0, 0)
 		if err != nil || len(tempStrList) == 0 {
-			session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
+			session.SendDatabaseError(err)
 			logging.Write("ERROR AddEntry: failed to obtain last org entry.")
 			return
 		}
@@ -207,7 +259,7 @@ func commandAddEntry(session *sessionState) {
 		entry.PrevHash = prevEntry.Hash
 	}
 
-	err = entry.GenerateHash("BLAKE2B-256")
+	err = entry.GenerateHash(viper.GetString("security.keycard_hash"))
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
 		logging.Write("ERROR AddEntry: failed to hash entry.")
@@ -255,7 +307,7 @@ func commandAddEntry(session *sessionState) {
 		return
 	}
 
-	err = dbhandler.AddEntry(entry)
+	err = session.Store.Keycards.AddEntry(entry)
 	if err == nil {
 		session.SendStringResponse(200, "OK", "")
 	} else {
@@ -266,7 +318,10 @@ func commandAddEntry(session *sessionState) {
 
 func commandOrgCard(session *sessionState) {
 	// command syntax:
-	// ORGCARD(Start-Index, End-Index=0)
+	// ORGCARD(Start-Index, End-Index=0, Domain="", Format="text")
+	//
+	// If Domain is not hosted by the server, the organization's keycard is fetched from its server,
+	// verified, and cached. If Format is "json", the entries are sent as a JSON array.
 
 	if !session.Message.HasField("Start-Index") {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing Start-Index")
@@ -289,27 +344,54 @@ func commandOrgCard(session *sessionState) {
 		}
 	}
 
-	entries, err := dbhandler.GetOrgEntries(startIndex, endIndex)
+	format, ok := getEntryFormat(session)
+	if !ok {
+		return
+	}
+
+	var entries []string
+	domain := strings.ToLower(session.Message.Data["Domain"])
+	if domain != "" && !config.IsHostedDomain(domain) {
+		// Organization keycards for other domains are served from the remote keycard cache
+		if !checkRemoteLookup(session, domain) {
+			return
+		}
+		_, err = getRemoteOrgEntries(session.Store, domain)
+		if err != nil {
+			sendRemoteError(session, domain, err)
+			return
+		}
+		entries, err = session.Store.RemoteCards.GetRemoteEntries(domain, "organization",
+			startIndex, endIndex)
+	} else {
+		domain, ok = getRequestDomain(session)
+		if !ok {
+			return
+		}
+		entries, err = session.Store.Keycards.GetOrgEntries(domain, startIndex, endIndex)
+	}
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandOrgCard: error retrieving org entries: %s", err.Error())
 		return
 	}
 	entryCount := len(entries)
 	var response ServerResponse
 	if entryCount > 0 {
-		transmissionSize := uint64(0)
-		for _, entry := range entries {
-			// 56 is the size of the header and footer and accompanying line terminators
-			transmissionSize += uint64(len(entry) + len("----- BEGIN ORG ENTRY -----\r\n") +
-				len("----- END ORG ENTRY -----\r\n"))
+		data, err := packEntries(entries, "ORG", format)
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandOrgCard: error packing org entries: %s", err.Error())
+			return
 		}
 
 		response.Code = 104
 		response.Status = "TRANSFER"
 		response.Data = make(map[string]string)
 		response.Data["Item-Count"] = fmt.Sprintf("%d", entryCount)
-		response.Data["Total-Size"] = fmt.Sprintf("%d", transmissionSize)
+		response.Data["Total-Size"] = fmt.Sprintf("%d", len(data))
+		response.Data["Domain"] = domain
+		response.Data["Format"] = format
 		if session.SendResponse(response) != nil {
 			return
 		}
@@ -327,42 +409,240 @@ func commandOrgCard(session *sessionState) {
 			return
 		}
 
-		totalBytes := 0
-		for _, entry := range entries {
-			bytesWritten, err := session.WriteClient("----- BEGIN ORG ENTRY -----\r\n" + entry +
-				"----- END ORG ENTRY -----\r\n")
-			if err != nil {
-				return
-			}
-			totalBytes += bytesWritten
-		}
+		session.WriteClient(data)
 	} else {
 		session.SendStringResponse(404, "NOT FOUND", "")
 	}
 }
 
+func commandOrgRotate(session *sessionState) {
+	// command syntax:
+	// ORGROTATE(Rotate-Optional="No")
+
+	// The server creates the new organization entry itself because it holds the organization's
+	// keys. The new entry is chained to the current one using a Custody signature from the current
+	// primary signing key and signed with the new one. Old keys are kept in the database so that
+	// earlier entries can still be verified.
+
+	if !checkRole(session) {
+		return
+	}
+
+	rotateOptional := false
+	if session.Message.HasField("Rotate-Optional") {
+		switch strings.ToLower(session.Message.Data["Rotate-Optional"]) {
+		case "yes":
+			rotateOptional = true
+		case "no":
+			// Do nothing. Default value.
+		default:
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Rotate-Optional")
+			return
+		}
+	}
+
+	domain := getSessionDomain(session)
+	entries, err := session.Store.Keycards.GetOrgEntries(domain, 0, 0)
+	if err != nil || len(entries) == 0 {
+		session.SendDatabaseError(err)
+		logging.Writef("commandOrgRotate: failed to obtain current org entry for %s", domain)
+		return
+	}
+	currentEntry, err := keycard.NewEntryFromData(entries[0])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandOrgRotate: error creating org entry from data for %s: %s", domain,
+			err.Error())
+		return
+	}
+
+	psk, ok := getOrgSigningKey(session, domain)
+	if !ok {
+		return
+	}
+
+	newEntry, keys, err := currentEntry.Chain(psk, rotateOptional)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandOrgRotate: failed to chain org entry for %s: %s", domain,
+			err.Error())
+		return
+	}
+
+	newEntry.PrevHash = currentEntry.Hash
+	err = newEntry.GenerateHash(viper.GetString("security.keycard_hash"))
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandOrgRotate: failed to hash org entry: %s", err.Error())
+		return
+	}
+
+	err = newEntry.Sign(keys["Primary-Verification-Key.private"], "Organization")
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandOrgRotate: failed to org sign entry: %s", err.Error())
+		return
+	}
+
+	if !newEntry.IsCompliant() {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandOrgRotate: new org entry for %s not compliant", domain)
+		return
+	}
+
+	err = session.Store.Keycards.AddOrgEntry(domain, newEntry, keys)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandOrgRotate: failed to add org entry for %s: %s", domain,
+			err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Index"] = newEntry.Fields["Index"]
+	response.Data["Hash"] = newEntry.Hash
+	session.SendResponse(*response)
+}
+
+func commandRevoke(session *sessionState) {
+	// command syntax:
+	// REVOKE(Workspace-ID, Reason="")
+
+	// Revoking a keycard breaks its chain of trust in case the workspace's contact request signing
+	// key has been compromised. All current entries are revoked and the next entry added for the
+	// workspace becomes a new root entry, which only the administrator may add. The organization
+	// signs a revocation record which is given to clients requesting the keycard.
+
+	if session.Message.Validate([]string{"Workspace-ID"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if !checkRole(session) {
+		return
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Workspace-ID")
+		return
+	}
+
+	reason := ""
+	if session.Message.HasField("Reason") {
+		reason = session.Message.Data["Reason"]
+		if len(reason) > 64 || strings.ContainsAny(reason, "\r\n") {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Reason")
+			return
+		}
+	}
+
+	if !checkSameDomain(session, wid) {
+		return
+	}
+
+	entries, err := session.Store.Keycards.GetUserEntries(wid, 0, 0)
+	if err != nil || len(entries) == 0 {
+		if err == nil || err == sql.ErrNoRows {
+			session.SendStringResponse(404, "NOT FOUND", "")
+		} else {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandRevoke: error retrieving user %s entries: %s", wid,
+				err.Error())
+		}
+		return
+	}
+
+	currentEntry, err := keycard.NewEntryFromData(entries[0])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRevoke: error creating user entry from data for %s: %s",
+			wid, err.Error())
+		return
+	}
+	currentIndex, err := strconv.Atoi(currentEntry.Fields["Index"])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRevoke: bad index in user entry data for %s: %s",
+			wid, err.Error())
+		return
+	}
+
+	revokedIndex, _, err := session.Store.Keycards.GetRevocation(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRevoke: error checking revocation for %s: %s", wid, err.Error())
+		return
+	}
+	if revokedIndex >= currentIndex {
+		session.SendStringResponse(408, "RESOURCE EXISTS", "Keycard already revoked")
+		return
+	}
+
+	domain := getSessionDomain(session)
+	psk, ok := getOrgSigningKey(session, domain)
+	if !ok {
+		return
+	}
+
+	// The revocation record uses the same line format as keycard entries. The organization's
+	// signature covers all of the lines which precede it.
+	now := time.Now().UTC()
+	timestamp := fmt.Sprintf("%d%02d%02dT%02d%02d%02dZ", now.Year(), now.Month(), now.Day(),
+		now.Hour(), now.Minute(), now.Second())
+	lines := []string{
+		"Type:Revocation",
+		"Workspace-ID:" + wid,
+		"Domain:" + domain,
+		fmt.Sprintf("Index:%d", currentIndex),
+	}
+	if reason != "" {
+		lines = append(lines, "Reason:"+reason)
+	}
+	lines = append(lines, "Timestamp:"+timestamp, "")
+	record := strings.Join(lines, "\r\n")
+
+	signature, err := ezcrypt.Sign(psk, []byte(record))
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRevoke: failed to sign revocation for %s: %s", wid, err.Error())
+		return
+	}
+	record += "Organization-Signature:" + signature.AsString() + "\r\n"
+
+	err = session.Store.Keycards.AddRevocation(wid, currentIndex, timestamp, record)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRevoke: failed to add revocation for %s: %s", wid, err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Revocation"] = record
+	session.SendResponse(*response)
+}
+
 func commandUserCard(session *sessionState) {
 	// command syntax:
-	// USERCARD(Owner, Start-Index, End-Index=0)
+	// USERCARD(Owner, Start-Index, End-Index=0, Format="text")
+	//
+	// If Owner belongs to a domain not hosted by the server, the keycard is fetched from the
+	// domain's server, verified, and cached. The response's Domain field holds the owner's domain.
+	// If Format is "json", the entries are sent as a JSON array.
 
 	if session.Message.Validate([]string{"Owner", "Start-Index"}) != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing Start-Index")
 		return
 	}
 
-	if dbhandler.GetMensagoAddressType(session.Message.Data["Owner"]) == 0 {
+	owner := session.Message.Data["Owner"]
+	if dbhandler.GetMensagoAddressType(owner) == 0 {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing Owner")
 		return
 	}
 
-	wid, err := dbhandler.ResolveAddress(session.Message.Data["Owner"])
-	if wid == "" {
-		session.SendStringResponse(404, "NOT FOUND", "")
-		return
-	}
-
 	var startIndex, endIndex int
-	startIndex, err = strconv.Atoi(session.Message.Data["Start-Index"])
+	startIndex, err := strconv.Atoi(session.Message.Data["Start-Index"])
 	if err != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "Bad Start-Index")
 		return
@@ -376,27 +656,75 @@ func commandUserCard(session *sessionState) {
 		}
 	}
 
-	entries, err := dbhandler.GetUserEntries(wid, startIndex, endIndex)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandUserCard: error retrieving user entries: %s", err.Error())
+	format, ok := getEntryFormat(session)
+	if !ok {
 		return
 	}
+
+	var entries []string
+	var wid, revocation string
+	var revokedIndex int
+	domain := strings.ToLower(strings.SplitN(owner, "/", 2)[1])
+	if config.IsHostedDomain(domain) {
+		wid, _ = session.Store.Workspaces.ResolveAddress(owner)
+		if wid == "" {
+			session.SendStringResponse(404, "NOT FOUND", "")
+			return
+		}
+
+		entries, err = session.Store.Keycards.GetUserEntries(wid, startIndex, endIndex)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandUserCard: error retrieving user entries: %s", err.Error())
+			return
+		}
+
+		revokedIndex, revocation, err = session.Store.Keycards.GetRevocation(wid)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandUserCard: error checking revocation: %s", err.Error())
+			return
+		}
+	} else {
+		// Keycards for other domains are served from the remote keycard cache
+		if !checkRemoteLookup(session, domain) {
+			return
+		}
+		wid, revokedIndex, revocation, err = getRemoteUserCard(session.Store, owner)
+		if err != nil {
+			sendRemoteError(session, domain, err)
+			return
+		}
+
+		entries, err = session.Store.RemoteCards.GetRemoteEntries(domain, wid, startIndex, endIndex)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandUserCard: error retrieving remote entries: %s", err.Error())
+			return
+		}
+	}
 	entryCount := len(entries)
 	var response ServerResponse
 	if entryCount > 0 {
-		transmissionSize := uint64(0)
-		for _, entry := range entries {
-			// 56 is the size of the header and footer and accompanying line terminators
-			transmissionSize += uint64(len(entry) + len("----- BEGIN USER ENTRY -----\r\n") +
-				len("----- END USER ENTRY -----\r\n"))
+		data, err := packEntries(entries, "USER", format)
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandUserCard: error packing user entries: %s", err.Error())
+			return
 		}
 
 		response.Code = 104
 		response.Status = "TRANSFER"
 		response.Data = make(map[string]string)
 		response.Data["Item-Count"] = fmt.Sprintf("%d", entryCount)
-		response.Data["Total-Size"] = fmt.Sprintf("%d", transmissionSize)
+		response.Data["Total-Size"] = fmt.Sprintf("%d", len(data))
+		response.Data["Domain"] = domain
+		response.Data["Format"] = format
+		if revokedIndex > 0 {
+			// Clients must stop trusting all entries up to and including the revoked index
+			response.Data["Revoked-Index"] = fmt.Sprintf("%d", revokedIndex)
+			response.Data["Revocation"] = revocation
+		}
 		if session.SendResponse(response) != nil {
 			return
 		}
@@ -414,23 +742,228 @@ func commandUserCard(session *sessionState) {
 			return
 		}
 
-		totalBytes := 0
-		for _, entry := range entries {
-			bytesWritten, err := session.WriteClient("----- BEGIN USER ENTRY -----\r\n" + entry +
-				"----- END USER ENTRY -----\r\n")
-			if err != nil {
+		session.WriteClient(data)
+	} else {
+		session.SendStringResponse(404, "NOT FOUND", "")
+	}
+}
+
+// maxBatchOwners is the largest number of keycards which can be requested with one USERCARDS
+// command
+const maxBatchOwners = 1000
+
+// maxOwnerListSize is the largest owner list which can be uploaded for USERCARDS. It leaves room
+// for maxBatchOwners addresses of the longest possible length and their known indices.
+const maxOwnerListSize = maxBatchOwners * 512
+
+func commandUserCards(session *sessionState) {
+	// command syntax:
+	// USERCARDS(Owners, Known-Indices="", Size=0, Format="text")
+	//
+	// Owners is a comma-separated list of addresses on this server. Known-Indices is a
+	// comma-separated list of the index of the newest entry the client already has for each owner,
+	// 0 if none. Only entries newer than the known ones are sent. Lists too long to fit in the
+	// command are uploaded instead: the client sends the size of the upload in Size, waits for
+	// 100 CONTINUE, and then sends a JSON object containing the Owners and Known-Indices fields.
+	// Keycards on other servers must be requested with USERCARD, and requesting one here is
+	// answered with 400 BAD REQUEST and the address in the Owner field.
+	//
+	// The response contains the following comma-separated lists, which are in the same order as
+	// Owners:
+	// Current-Indices: the index of each owner's current entry, 0 if the owner was not found
+	// Revoked-Indices: the highest revoked index of each owner's keycard, 0 if not revoked
+	// Time-To-Live: the Time-To-Live value of each owner's current entry, which tells the client
+	// how many days it may cache the entry before checking for a new one
+	//
+	// If there are new entries for any owner, the response is 104 TRANSFER and the entries follow
+	// grouped by owner in the same order. Otherwise, the response is 200 OK. If Format is "json",
+	// the entries are sent as a JSON array.
+
+	format, ok := getEntryFormat(session)
+	if !ok {
+		return
+	}
+
+	ownerFields, ok := getOwnerList(session)
+	if !ok {
+		return
+	}
+
+	owners := strings.Split(ownerFields["Owners"], ",")
+	if len(owners) > maxBatchOwners {
+		session.SendStringResponse(414, "LIMIT REACHED",
+			fmt.Sprintf("No more than %d owners per request", maxBatchOwners))
+		return
+	}
+
+	knownIndices := make([]int, len(owners))
+	if ownerFields["Known-Indices"] != "" {
+		indexList := strings.Split(ownerFields["Known-Indices"], ",")
+		if len(indexList) != len(owners) {
+			session.SendStringResponse(400, "BAD REQUEST", "Known-Indices doesn't match Owners")
+			return
+		}
+		for i, indexStr := range indexList {
+			index, err := strconv.Atoi(strings.TrimSpace(indexStr))
+			if err != nil || index < 0 {
+				session.SendStringResponse(400, "BAD REQUEST", "Bad Known-Indices")
 				return
 			}
-			totalBytes += bytesWritten
+			knownIndices[i] = index
 		}
-	} else {
-		session.SendStringResponse(404, "NOT FOUND", "")
 	}
+
+	currentIndices := make([]string, len(owners))
+	revokedIndices := make([]string, len(owners))
+	ttlValues := make([]string, len(owners))
+	entries := make([]string, 0, len(owners))
+	for i, owner := range owners {
+		owner = strings.TrimSpace(owner)
+		if dbhandler.GetMensagoAddressType(owner) == 0 {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad owner "+owner)
+			return
+		}
+		if !config.IsHostedDomain(strings.SplitN(owner, "/", 2)[1]) {
+			response := NewServerResponse(400, "BAD REQUEST")
+			response.Info = "Remote owners must be requested with USERCARD"
+			response.Data["Owner"] = owner
+			session.SendResponse(*response)
+			return
+		}
+		currentIndices[i] = "0"
+		revokedIndices[i] = "0"
+		ttlValues[i] = "0"
+
+		wid, _ := session.Store.Workspaces.ResolveAddress(owner)
+		if wid == "" {
+			continue
+		}
+
+		current, err := session.Store.Keycards.GetUserEntries(wid, 0, 0)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandUserCards: error retrieving entries for %s: %s", wid,
+				err.Error())
+			return
+		}
+
+		currentEntry, err := keycard.NewEntryFromData(current[0])
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandUserCards: bad entry data for %s: %s", wid, err.Error())
+			return
+		}
+		currentIndices[i] = currentEntry.Fields["Index"]
+		ttlValues[i] = currentEntry.Fields["Time-To-Live"]
+
+		revokedIndex, _, err := session.Store.Keycards.GetRevocation(wid)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandUserCards: error checking revocation for %s: %s", wid,
+				err.Error())
+			return
+		}
+		revokedIndices[i] = fmt.Sprintf("%d", revokedIndex)
+
+		currentIndex, _ := strconv.Atoi(currentEntry.Fields["Index"])
+		if knownIndices[i] >= currentIndex {
+			continue
+		}
+		newEntries, err := session.Store.Keycards.GetUserEntries(wid, knownIndices[i]+1, 0)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandUserCards: error retrieving entries for %s: %s", wid,
+				err.Error())
+			return
+		}
+		entries = append(entries, newEntries...)
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Current-Indices"] = strings.Join(currentIndices, ",")
+	response.Data["Revoked-Indices"] = strings.Join(revokedIndices, ",")
+	response.Data["Time-To-Live"] = strings.Join(ttlValues, ",")
+	if len(entries) == 0 {
+		session.SendResponse(*response)
+		return
+	}
+
+	data, err := packEntries(entries, "USER", format)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandUserCards: error packing user entries: %s", err.Error())
+		return
+	}
+
+	response.Code = 104
+	response.Status = "TRANSFER"
+	response.Data["Item-Count"] = fmt.Sprintf("%d", len(entries))
+	response.Data["Total-Size"] = fmt.Sprintf("%d", len(data))
+	response.Data["Format"] = format
+	if session.SendResponse(*response) != nil {
+		return
+	}
+
+	request, err := session.GetRequest()
+	if err != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "")
+		return
+	}
+	if request.Action == "CANCEL" {
+		return
+	}
+	if request.Action != "TRANSFER" {
+		session.SendStringResponse(400, "BAD REQUEST", "")
+		return
+	}
+
+	session.WriteClient(data)
+}
+
+// getOwnerList returns the Owners and Known-Indices fields of a USERCARDS request, receiving
+// them from the client if they were too long to be sent with the command. If they can't be read,
+// the appropriate response is sent to the client and false is returned.
+func getOwnerList(session *sessionState) (map[string]string, bool) {
+	if !session.Message.HasField("Size") {
+		if !session.Message.HasField("Owners") {
+			session.SendStringResponse(400, "BAD REQUEST", "Missing Owners")
+			return nil, false
+		}
+		return session.Message.Data, true
+	}
+
+	size, err := strconv.ParseUint(session.Message.Data["Size"], 10, 64)
+	if err != nil || size < 1 {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Size")
+		return nil, false
+	}
+	if size > maxOwnerListSize {
+		session.SendStringResponse(414, "LIMIT REACHED",
+			fmt.Sprintf("Owner list may not be larger than %d bytes", maxOwnerListSize))
+		return nil, false
+	}
+
+	session.SendStringResponse(100, "CONTINUE", "")
+	data, err := session.ReadData(size)
+	if err != nil {
+		return nil, false
+	}
+
+	var fields map[string]string
+	err = json.Unmarshal(data, &fields)
+	if err != nil || fields["Owners"] == "" {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad owner list")
+		return nil, false
+	}
+	return fields, true
 }
 
 func commandIsCurrent(session *sessionState) {
 	// command syntax:
-	// ISCURRENT(Index, Workspace-ID="")
+	// ISCURRENT(Index, Workspace-ID="", Domain="")
 
 	if !session.Message.HasField("Index") {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing Index")
@@ -444,6 +977,7 @@ func commandIsCurrent(session *sessionState) {
 	}
 
 	var currentIndex int
+	revoked := ""
 	if session.Message.HasField("Workspace-ID") {
 		wid := session.Message.Data["Workspace-ID"]
 		if !dbhandler.ValidateUUID(wid) {
@@ -451,9 +985,9 @@ func commandIsCurrent(session *sessionState) {
 			return
 		}
 
-		entries, err := dbhandler.GetUserEntries(wid, 0, 0)
+		entries, err := session.Store.Keycards.GetUserEntries(wid, 0, 0)
 		if err != nil {
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			session.SendDatabaseError(err)
 			logging.Writef("commandIsCurrent: error retrieving user %s entries: %s", wid,
 				err.Error())
 			return
@@ -461,7 +995,7 @@ func commandIsCurrent(session *sessionState) {
 
 		entryCount := len(entries)
 		if entryCount < 1 {
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			session.SendDatabaseError(err)
 			logging.Writef("commandIsCurrent: no user entries found for %s", wid)
 			return
 		}
@@ -481,17 +1015,35 @@ func commandIsCurrent(session *sessionState) {
 				wid, err.Error())
 			return
 		}
+
+		revokedIndex, _, err := session.Store.Keycards.GetRevocation(wid)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandIsCurrent: error checking revocation for %s: %s", wid,
+				err.Error())
+			return
+		}
+		if index <= revokedIndex {
+			revoked = "YES"
+		} else {
+			revoked = "NO"
+		}
 	} else {
-		entries, err := dbhandler.GetOrgEntries(0, 0)
+		domain, ok := getRequestDomain(session)
+		if !ok {
+			return
+		}
+
+		entries, err := session.Store.Keycards.GetOrgEntries(domain, 0, 0)
 		if err != nil {
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			session.SendDatabaseError(err)
 			logging.Writef("commandIsCurrent: error retrieving org entries: %s", err.Error())
 			return
 		}
 
 		entryCount := len(entries)
 		if entryCount < 1 {
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			session.SendDatabaseError(err)
 			logging.Writef("commandIsCurrent: no org entries found")
 			return
 		}
@@ -512,10 +1064,77 @@ func commandIsCurrent(session *sessionState) {
 	}
 
 	response := NewServerResponse(200, "OK")
-	if index == currentIndex {
+	if index == currentIndex && revoked != "YES" {
 		response.Data["Is-Current"] = "YES"
 	} else {
 		response.Data["Is-Current"] = "NO"
 	}
+	if revoked != "" {
+		response.Data["Revoked"] = revoked
+	}
 	session.SendResponse(*response)
 }
+
+// getOrgSigningKey returns the current primary signing key for a hosted domain's organization. If
+// the key can't be obtained, the error is logged, a response is sent to the client, and false is
+// returned.
+func getOrgSigningKey(session *sessionState, domain string) (cryptostring.CryptoString, bool) {
+	var psk cryptostring.CryptoString
+	pskstring, err := session.Store.Keycards.GetPrimarySigningKey(domain)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("missing primary signing key for %s in database", domain)
+		return psk, false
+	}
+
+	err = psk.Set(pskstring)
+	if err != nil || psk.RawData() == nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("corrupted primary signing key for %s in database", domain)
+		return psk, false
+	}
+	return psk, true
+}
+
+// getEntryFormat returns the format the client requested for keycard entries, which is either
+// "text", the default, or "json". If the format isn't supported, the appropriate response is sent
+// to the client and false is returned.
+func getEntryFormat(session *sessionState) (string, bool) {
+	format := strings.ToLower(session.Message.Data["Format"])
+	switch format {
+	case "":
+		return "text", true
+	case "text", "json":
+		return format, true
+	}
+	session.SendStringResponse(400, "BAD REQUEST", "Bad Format")
+	return "", false
+}
+
+// packEntries converts stored keycard entries into the data sent to the client. entryType is the
+// type of entry header used for the text format, i.e. ORG or USER. In JSON format, the entries
+// are sent as a single JSON array of entry objects.
+func packEntries(entries []string, entryType string, format string) (string, error) {
+	if format != "json" {
+		var out strings.Builder
+		for _, entry := range entries {
+			out.WriteString("----- BEGIN " + entryType + " ENTRY -----\r\n" + entry +
+				"----- END " + entryType + " ENTRY -----\r\n")
+		}
+		return out.String(), nil
+	}
+
+	items := make([]string, len(entries))
+	for i, data := range entries {
+		entry, err := keycard.NewEntryFromData(data)
+		if err != nil {
+			return "", err
+		}
+		item, err := entry.MarshalJSON()
+		if err != nil {
+			return "", err
+		}
+		items[i] = string(item)
+	}
+	return "[" + strings.Join(items, ",") + "]", nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+)
+
+func TestCommandIsCurrent(t *testing.T) {
+	store := dbhandler.NewMemoryStore()
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	for _, index := range []string{"1", "2"} {
+		err := addExpiringEntry(store, wid, "example.com", index, 90)
+		if err != nil {
+			t.Fatalf("TestCommandIsCurrent: Couldn't add entry: %s", err.Error())
+		}
+	}
+
+	var state sessionState
+
+	// Subtest #1: Before revocation, the current entry is current and nothing is revoked
+
+	response, _ := runCommand(t, store, state, "ISCURRENT", map[string]string{
+		"Index":        "2",
+		"Workspace-ID": wid,
+	})
+	if response.Code != 200 || response.Data["Is-Current"] != "YES" ||
+		response.Data["Revoked"] != "NO" {
+		t.Fatalf("TestCommandIsCurrent: #1: wrong response: %d %v", response.Code,
+			response.Data)
+	}
+
+	// Subtest #2: Revoking the keycard revokes all entries up to the revoked index
+
+	err := store.Keycards.AddRevocation(wid, 2, "20210301T000000Z", "-")
+	if err != nil {
+		t.Fatalf("TestCommandIsCurrent: Couldn't add revocation: %s", err.Error())
+	}
+
+	response, _ = runCommand(t, store, state, "ISCURRENT", map[string]string{
+		"Index":        "1",
+		"Workspace-ID": wid,
+	})
+	if response.Code != 200 || response.Data["Is-Current"] != "NO" ||
+		response.Data["Revoked"] != "YES" {
+		t.Fatalf("TestCommandIsCurrent: #2: wrong response: %d %v", response.Code,
+			response.Data)
+	}
+
+	response, _ = runCommand(t, store, state, "ISCURRENT", map[string]string{
+		"Index":        "2",
+		"Workspace-ID": wid,
+	})
+	if response.Code != 200 || response.Data["Is-Current"] != "NO" ||
+		response.Data["Revoked"] != "YES" {
+		t.Fatalf("TestCommandIsCurrent: #2: revoked entry is current: %d %v", response.Code,
+			response.Data)
+	}
+}
+
+func TestCommandAddEntryRevoked(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	domain := config.HostedDomains()[0]
+	adminWid := "ae406c5e-2673-4d3e-af20-91325d9623ca"
+	revokedWid := "11111111-1111-1111-1111-111111111111"
+	otherWid := "22222222-2222-2222-2222-222222222222"
+	for _, ws := range [][]string{
+		{adminWid, "admin"},
+		{revokedWid, "csimons"},
+		{otherWid, "rbrannan"},
+	} {
+		err := store.Workspaces.AddWorkspace(ws[0], ws[1], domain, "-", "active", "individual")
+		if err != nil {
+			t.Fatalf("TestCommandAddEntryRevoked: Couldn't add workspace: %s", err.Error())
+		}
+	}
+	for i, uid := range []string{"support", "abuse"} {
+		aliasWid := fmt.Sprintf("3333333%d-3333-3333-3333-333333333333", i)
+		err := store.Aliases.AddAlias(aliasWid, uid, domain, adminWid)
+		if err != nil {
+			t.Fatalf("TestCommandAddEntryRevoked: Couldn't add alias: %s", err.Error())
+		}
+	}
+	for _, wid := range []string{revokedWid, otherWid} {
+		err := addExpiringEntry(store, wid, domain, "1", 90)
+		if err != nil {
+			t.Fatalf("TestCommandAddEntryRevoked: Couldn't add entry: %s", err.Error())
+		}
+	}
+	err := store.Keycards.AddRevocation(revokedWid, 1, "20210301T000000Z", "-")
+	if err != nil {
+		t.Fatalf("TestCommandAddEntryRevoked: Couldn't add revocation: %s", err.Error())
+	}
+
+	newRoot, err := newExpiringEntry(revokedWid, domain, "2", 90)
+	if err != nil {
+		t.Fatalf("TestCommandAddEntryRevoked: Couldn't create entry: %s", err.Error())
+	}
+
+	// Subtest #1: The owner of a revoked keycard can't start a new chain of trust, as whoever
+	// compromised it may be the one logged in
+
+	var user sessionState
+	user.WID = revokedWid
+	user.Domain = domain
+	user.LoginState = loginClientSession
+	response, _ := runCommand(t, store, user, "ADDENTRY", map[string]string{
+		"Base-Entry": string(newRoot.MakeByteString(-1)),
+	})
+	if response.Code != 403 {
+		t.Fatalf("TestCommandAddEntryRevoked: #1: owner added a new root entry: %d %s",
+			response.Code, response.Info)
+	}
+
+	// Subtest #2: Other users can't add entries for the workspace
+
+	var other sessionState
+	other.WID = otherWid
+	other.Domain = domain
+	other.LoginState = loginClientSession
+	response, _ = runCommand(t, store, other, "ADDENTRY", map[string]string{
+		"Base-Entry": string(newRoot.MakeByteString(-1)),
+	})
+	if response.Code != 411 {
+		t.Fatalf("TestCommandAddEntryRevoked: #2: other user added an entry: %d", response.Code)
+	}
+
+	// Subtest #3: The administrator can only add entries for others to revoked keycards
+
+	var admin sessionState
+	admin.WID = adminWid
+	admin.Domain = domain
+	admin.LoginState = loginClientSession
+	nextEntry, err := newExpiringEntry(otherWid, domain, "2", 90)
+	if err != nil {
+		t.Fatalf("TestCommandAddEntryRevoked: #3: Couldn't create entry: %s", err.Error())
+	}
+	response, _ = runCommand(t, store, admin, "ADDENTRY", map[string]string{
+		"Base-Entry": string(nextEntry.MakeByteString(-1)),
+	})
+	if response.Code != 403 {
+		t.Fatalf("TestCommandAddEntryRevoked: #3: admin added entry to unrevoked keycard: %d",
+			response.Code)
+	}
+}
+
+func TestCommandUserCards(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	// The owner list for this many keycards is far too large to fit in a command. Each owner is
+	// an alias of the same workspace so that the test doesn't have to hash hundreds of passwords.
+	domain := config.HostedDomains()[0]
+	wid := "11111111-1111-1111-1111-111111111111"
+	err := store.Workspaces.AddWorkspace(wid, "csimons", domain, "-", "active", "individual")
+	if err != nil {
+		t.Fatalf("TestCommandUserCards: Couldn't add workspace: %s", err.Error())
+	}
+	for _, index := range []string{"1", "2"} {
+		err = addExpiringEntry(store, wid, domain, index, 90)
+		if err != nil {
+			t.Fatalf("TestCommandUserCards: Couldn't add entry: %s", err.Error())
+		}
+	}
+
+	owners := make([]string, 400)
+	known := make([]string, len(owners))
+	for i := range owners {
+		aliasWid := fmt.Sprintf("%08d-2222-2222-2222-222222222222", i)
+		err = store.Aliases.AddAlias(aliasWid, fmt.Sprintf("user%d", i), domain, wid)
+		if err != nil {
+			t.Fatalf("TestCommandUserCards: Couldn't add alias: %s", err.Error())
+		}
+		owners[i] = fmt.Sprintf("user%d/%s", i, domain)
+		known[i] = "2"
+	}
+
+	// Subtest #1: Owner lists can be uploaded
+
+	upload, _ := json.Marshal(map[string]string{
+		"Owners":        strings.Join(owners, ","),
+		"Known-Indices": strings.Join(known, ","),
+	})
+	responses := runUpload(t, store, "USERCARDS", map[string]string{
+		"Size": fmt.Sprintf("%d", len(upload)),
+	}, upload)
+	if responses[0].Code != 100 {
+		t.Fatalf("TestCommandUserCards: #1: upload not accepted: %d %s", responses[0].Code,
+			responses[0].Info)
+	}
+	if responses[1].Code != 200 ||
+		responses[1].Data["Current-Indices"] != strings.Join(known, ",") {
+		t.Fatalf("TestCommandUserCards: #1: wrong response: %d %s", responses[1].Code,
+			responses[1].Info)
+	}
+
+	// Subtest #2: Keycards on other servers aren't looked up
+
+	var state sessionState
+	response, _ := runCommand(t, store, state, "USERCARDS", map[string]string{
+		"Owners": owners[0] + ",csimons/example.net",
+	})
+	if response.Code != 400 || response.Data["Owner"] != "csimons/example.net" {
+		t.Fatalf("TestCommandUserCards: #2: remote owner not refused: %d", response.Code)
+	}
+
+	// Subtest #3: Uploads are limited in size
+
+	response, _ = runCommand(t, store, state, "USERCARDS", map[string]string{
+		"Size": fmt.Sprintf("%d", maxOwnerListSize+1),
+	})
+	if response.Code != 414 {
+		t.Fatalf("TestCommandUserCards: #3: oversized upload accepted: %d", response.Code)
+	}
+}
+
+// runUpload runs a command which uploads data once the server responds with 100 CONTINUE. The
+// responses sent before and after the upload are returned.
+func runUpload(t *testing.T, store *dbhandler.Store, action string, data map[string]string,
+	upload []byte) []ServerResponse {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var state sessionState
+	state.Connection = server
+	state.Store = store
+	state.Message = ClientRequest{action, data}
+
+	done := make(chan bool)
+	go func() {
+		defer server.Close()
+		processCommand(&state)
+		done <- true
+	}()
+
+	decoder := json.NewDecoder(client)
+	responses := make([]ServerResponse, 2)
+	err := decoder.Decode(&responses[0])
+	if err != nil {
+		t.Fatalf("%s: bad response: %s", action, err.Error())
+	}
+	if responses[0].Code == 100 {
+		_, err = client.Write(upload)
+		if err != nil {
+			t.Fatalf("%s: couldn't upload data: %s", action, err.Error())
+		}
+		err = decoder.Decode(&responses[1])
+		if err != nil {
+			t.Fatalf("%s: bad response: %s", action, err.Error())
+		}
+	}
+	<-done
+	return responses
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/darkwyrm/b85"
@@ -36,9 +40,12 @@ func commandDevice(session *sessionState) {
 		session.SendStringResponse(400, "BAD REQUEST", "Bad Device-Key")
 		return
 	}
+	if !checkDeviceKeyType(session, devkey) {
+		return
+	}
 
-	success, err := dbhandler.CheckDevice(session.WID, session.Message.Data["Device-ID"],
-		devkey.AsString())
+	success, err := session.Store.Devices.CheckDevice(session.WID,
+		session.Message.Data["Device-ID"], devkey.AsString())
 	if err != nil {
 		if err.Error() == "cancel" {
 			session.LoginState = loginNoSession
@@ -61,18 +68,19 @@ func commandDevice(session *sessionState) {
 
 		// This code exists to at least enable the server to work until device checking can
 		// be implemented.
-		dbhandler.AddDevice(session.WID, session.Message.Data["Device-ID"], devkey, "active")
+		session.Store.Devices.AddDevice(session.WID, session.Message.Data["Device-ID"], devkey,
+			"active")
 	}
 
 	// The device is part of the workspace, so now we issue undergo a challenge-response
 	// to ensure that the device really is authorized and the key wasn't stolen by an impostor
 
-	success, err = challengeDevice(session, "CURVE25519", session.Message.Data["Device-Key"])
+	success, err = challengeDevice(session, devkey)
 	if !success {
 		lockout, err := logFailure(session, "device", session.WID)
 		if err != nil {
 			// No need to log here -- logFailure does that.
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			session.SendDatabaseError(err)
 			return
 		}
 
@@ -118,8 +126,8 @@ func commandDevKey(session *sessionState) {
 		return
 	}
 
-	success, err := dbhandler.CheckDevice(session.WID, session.Message.Data["Device-ID"],
-		oldkey.AsString())
+	success, err := session.Store.Devices.CheckDevice(session.WID,
+		session.Message.Data["Device-ID"], oldkey.AsString())
 
 	if err != nil {
 		if err.Error() == "cancel" {
@@ -137,6 +145,9 @@ func commandDevKey(session *sessionState) {
 		session.SendStringResponse(400, "BAD REQUEST", "Bad New-Key")
 		return
 	}
+	if !checkDeviceKeyType(session, newkey) {
+		return
+	}
 
 	success, err = dualChallengeDevice(session, oldkey, newkey)
 	if !success {
@@ -144,10 +155,10 @@ func commandDevKey(session *sessionState) {
 		return
 	}
 
-	err = dbhandler.UpdateDevice(session.WID, session.Message.Data["Device-ID"], oldkey.AsString(),
-		newkey.AsString())
+	err = session.Store.Devices.UpdateDevice(session.WID, session.Message.Data["Device-ID"],
+		oldkey.AsString(), newkey.AsString())
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandDevKey: error updating device: %s", err.Error())
 		return
 	}
@@ -157,7 +168,7 @@ func commandDevKey(session *sessionState) {
 
 func commandLogin(session *sessionState) {
 	// Command syntax:
-	// LOGIN(Login-Type,Workspace-ID)
+	// LOGIN(Login-Type,Workspace-ID,Challenge,Domain="")
 
 	// PLAIN authentication is currently the only supported type
 	if session.Message.Validate([]string{"Login-Type", "Workspace-ID", "Challenge"}) != nil {
@@ -182,7 +193,7 @@ func commandLogin(session *sessionState) {
 
 	wid := session.Message.Data["Workspace-ID"]
 	var exists bool
-	exists, session.WorkspaceStatus = dbhandler.CheckWorkspace(wid)
+	exists, session.WorkspaceStatus = session.Store.Workspaces.CheckWorkspace(wid)
 	if exists {
 		lockout, err := isLocked(session, "workspace", wid)
 		if err != nil || lockout {
@@ -204,6 +215,18 @@ func commandLogin(session *sessionState) {
 		return
 	}
 
+	// Shared workspaces are accessed through the sessions of their members
+	wtype, err := session.Store.Workspaces.GetWorkspaceType(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandLogin: error getting workspace type: %s", err.Error())
+		return
+	}
+	if wtype == "shared" {
+		session.SendStringResponse(403, "FORBIDDEN", "Shared workspaces can't be logged into")
+		return
+	}
+
 	switch session.WorkspaceStatus {
 	case "disabled":
 		session.SendStringResponse(407, "UNAVAILABLE", "account disabled")
@@ -214,14 +237,30 @@ func commandLogin(session *sessionState) {
 	case "active", "approved":
 		break
 	default:
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
+		return
+	}
+
+	// Preregistered workspaces aren't in the workspace table yet, so they use the domain from the
+	// request instead
+	domain, err := session.Store.Workspaces.GetWorkspaceDomain(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandLogin: error getting workspace domain: %s", err.Error())
 		return
 	}
+	if domain == "" {
+		var ok bool
+		domain, ok = getRequestDomain(session)
+		if !ok {
+			return
+		}
+	}
 
 	// We got this far, so decrypt the challenge and send it to the client
-	keypair, err := dbhandler.GetEncryptionPair()
+	keypair, err := session.Store.Keycards.GetEncryptionPair(domain)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		return
 	}
 	decryptedChallenge, err := keypair.Decrypt(session.Message.Data["Challenge"])
@@ -232,6 +271,7 @@ func commandLogin(session *sessionState) {
 
 	session.LoginState = loginAwaitingPassword
 	session.WID = wid
+	session.Domain = domain
 	response := NewServerResponse(100, "CONTINUE")
 	response.Data["Response"] = string(decryptedChallenge)
 	session.SendResponse(*response)
@@ -243,6 +283,7 @@ func commandLogout(session *sessionState) {
 	session.SendStringResponse(200, "OK", "")
 	session.LoginState = loginNoSession
 	session.WID = ""
+	session.Domain = ""
 	session.WorkspaceStatus = ""
 }
 
@@ -271,17 +312,17 @@ func commandPasscode(session *sessionState) {
 		return
 	}
 
-	verified, err := dbhandler.CheckPasscode(session.Message.Data["Workspace-ID"],
+	verified, err := session.Store.Passcodes.CheckPasscode(session.Message.Data["Workspace-ID"],
 		session.Message.Data["Reset-Code"])
 	if err != nil {
 		if err.Error() == "expired" {
 			session.SendStringResponse(415, "EXPIRED", "")
-			dbhandler.DeletePasscode(session.Message.Data["Workspace-ID"],
+			session.Store.Passcodes.DeletePasscode(session.Message.Data["Workspace-ID"],
 				session.Message.Data["Reset-Code"])
 			return
 		}
 
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandPasscode: Error checking passcode: %s", err.Error())
 		return
 	}
@@ -295,13 +336,21 @@ func commandPasscode(session *sessionState) {
 		return
 	}
 
-	err = dbhandler.SetPassword(session.WID, session.Message.Data["Password-Hash"])
+	err = session.Store.Workspaces.SetPassword(session.Message.Data["Workspace-ID"],
+		session.Message.Data["Password-Hash"])
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandPasscode: failed to update password: %s", err.Error())
 		return
 	}
 
+	// Reset codes can only be used once
+	err = session.Store.Passcodes.DeletePasscode(session.Message.Data["Workspace-ID"],
+		session.Message.Data["Reset-Code"])
+	if err != nil {
+		logging.Writef("commandPasscode: failed to delete reset code: %s", err.Error())
+	}
+
 	session.SendStringResponse(200, "OK", "")
 }
 
@@ -327,7 +376,8 @@ func commandPassword(session *sessionState) {
 		return
 	}
 
-	match, err := dbhandler.CheckPassword(session.WID, session.Message.Data["Password-Hash"])
+	match, err := session.Store.Workspaces.CheckPassword(session.WID,
+		session.Message.Data["Password-Hash"])
 	if err != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "Password check error")
 		return
@@ -352,24 +402,54 @@ func commandPassword(session *sessionState) {
 		return
 	}
 
+	// Now that the password is known to be good, the stored hash can be brought up to the current
+	// password security settings if they have changed since it was made. A failure here doesn't
+	// keep the user from logging in.
+	_, err = session.Store.Workspaces.RehashPassword(session.WID,
+		session.Message.Data["Password-Hash"])
+	if err != nil {
+		logging.Writef("commandPassword: error rehashing password for %s: %s", session.WID,
+			err.Error())
+	}
+
 	session.LoginState = loginAwaitingSessionID
 	session.SendStringResponse(100, "CONTINUE", "")
 }
 
-func commandResetPassword(session *sessionState) {
-	// Command syntax:
-	// RESETPASSWORD(Workspace-ID, Reset-Code="", Expires="")
+func commandPasswordReport(session *sessionState) {
+	// command syntax:
+	// PASSWORDREPORT()
 
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
+	if !checkRole(session, roleAuditor) {
+		return
+	}
+
+	domain := getSessionDomain(session)
+	total, legacy, unreadable, err := session.Store.Workspaces.CountLegacyPasswords(domain)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandResetPassword: Error resolving address: %s", err)
+		session.SendDatabaseError(err)
+		logging.Writef("commandPasswordReport: error counting passwords: %s", err.Error())
 		return
 	}
+	if unreadable > 0 {
+		logging.Writef("commandPasswordReport: %d unreadable password hashes in %s", unreadable,
+			domain)
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Password-Security"] = viper.GetString("security.password_security")
+	response.Data["Workspace-Count"] = fmt.Sprintf("%d", total)
+	response.Data["Legacy-Count"] = fmt.Sprintf("%d", legacy)
+	response.Data["Unreadable-Count"] = fmt.Sprintf("%d", unreadable)
+	session.SendResponse(*response)
+}
+
+func commandResetPassword(session *sessionState) {
+	// Command syntax:
+	// RESETPASSWORD(Workspace-ID, Reset-Code="", Expires="")
 
-	if session.LoginState != loginClientSession || session.WID != adminWid {
-		session.SendStringResponse(403, "FORBIDDEN", "Only admin can use this")
+	if !checkRole(session, roleSupport) {
+		return
 	}
 
 	if !session.Message.HasField("Workspace-ID") {
@@ -382,6 +462,37 @@ func commandResetPassword(session *sessionState) {
 		return
 	}
 
+	if !checkSameDomain(session, session.Message.Data["Workspace-ID"]) {
+		return
+	}
+
+	// Support staff can't be allowed to take over the admin account
+	adminWid, err := getAdminWID(session, getSessionDomain(session))
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandResetPassword: Error resolving address: %s", err)
+		return
+	}
+	if session.Message.Data["Workspace-ID"] == adminWid && session.WID != adminWid {
+		session.SendStringResponse(403, "FORBIDDEN", "Only admin can reset the admin password")
+		return
+	}
+
+	// ...nor any other workspace which holds a role, which would let them gain its rights
+	if session.WID != adminWid {
+		roles, err := session.Store.Roles.GetRoles(session.Message.Data["Workspace-ID"])
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandResetPassword: Error getting roles: %s", err)
+			return
+		}
+		if len(roles.Items) > 0 {
+			session.SendStringResponse(403, "FORBIDDEN",
+				"Only admin can reset the password of a workspace with a role")
+			return
+		}
+	}
+
 	var passcode string
 	if session.Message.HasField("Reset-Code") && session.Message.Data["Reset-Code"] != "" {
 		if len(session.Message.Data["Reset-Code"]) < 8 {
@@ -416,9 +527,10 @@ func commandResetPassword(session *sessionState) {
 			Format("20060102T150405Z")
 	}
 
-	err = dbhandler.ResetPassword(session.Message.Data["Workspace-ID"], passcode, expires)
+	err = session.Store.Passcodes.ResetPassword(session.Message.Data["Workspace-ID"], passcode,
+		expires)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandResetPassword: failed to add password reset code: %s", err.Error())
 		return
 	}
@@ -455,7 +567,8 @@ func commandSetPassword(session *sessionState) {
 		return
 	}
 
-	match, err := dbhandler.CheckPassword(session.WID, session.Message.Data["Password-Hash"])
+	match, err := session.Store.Workspaces.CheckPassword(session.WID,
+		session.Message.Data["Password-Hash"])
 	if err != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "Password check error")
 		return
@@ -466,9 +579,10 @@ func commandSetPassword(session *sessionState) {
 		return
 	}
 
-	err = dbhandler.SetPassword(session.WID, session.Message.Data["NewPassword-Hash"])
+	err = session.Store.Workspaces.SetPassword(session.WID,
+		session.Message.Data["NewPassword-Hash"])
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandSetPassword: failed to update password: %s", err.Error())
 		return
 	}
@@ -476,38 +590,125 @@ func commandSetPassword(session *sessionState) {
 	session.SendStringResponse(200, "OK", "")
 }
 
-func challengeDevice(session *sessionState, keytype string, devkeystr string) (bool, error) {
-	// 1) Generate a 32-byte random string of bytes
-	// 2) Encode string in base85
-	// 3) Encrypt said string, encode in base85, and return it as part of 100 CONTINUE response
-	// 4) Wait for response from client and compare response to original base85 string
-	// 5) If strings don't match, respond to client with 402 Authentication Failure and return false
-	// 6) If strings match respond to client with 200 OK and return true/nil
+// Devices prove that they hold the private half of their device key by answering a challenge.
+// The kind of challenge depends on the type of the key: a device with an encryption key, such as
+// CURVE25519, must decrypt the challenge and send it back, and a device with a signing key, such
+// as ED25519, must return a signature of the challenge. Signing keys make it possible for devices
+// to keep their keys in a keystore provided by the OS which only permits signing. The client learns
+// the kind of challenge from the Challenge-Type field of the server's response. If a device's key
+// type isn't supported, the server responds with 309 and a list of the supported key types.
+
+// deviceChallenge is a challenge issued to a device to verify its key
+type deviceChallenge struct {
+	Key       cryptostring.CryptoString
+	Type      string
+	challenge string
+}
 
-	randBytes := make([]byte, 32)
-	if _, err := rand.Read(randBytes); err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("challengeDevice: error checking lockout: %s", err.Error())
-		return false, err
+// newDeviceChallenge generates a random challenge for a device key
+func newDeviceChallenge(key cryptostring.CryptoString) (deviceChallenge, error) {
+	var out deviceChallenge
+	switch {
+	case ezcrypt.IsSupported(key.Prefix, ezcrypt.CapEncrypt):
+		out.Type = "encrypt"
+	case ezcrypt.IsSupported(key.Prefix, ezcrypt.CapSign):
+		out.Type = "sign"
+	default:
+		return out, errors.New("unsupported key type")
 	}
+	out.Key = key
 
 	// We Base85-encode the random run of bytes this so that when we receive the response, it
 	// should just be a matter of doing a string comparison to determine success
-	challenge := b85.Encode(randBytes)
-	if keytype != "CURVE25519" {
-		return false, errors.New("unsupported key type")
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		return out, err
+	}
+	out.challenge = b85.Encode(randBytes)
+
+	return out, nil
+}
+
+// Data returns the challenge as it is sent to the device. Challenges for encryption keys are
+// encrypted with the key and challenges for signing keys are sent as-is.
+func (dc deviceChallenge) Data() (string, error) {
+	if dc.Type == "sign" {
+		return dc.challenge, nil
 	}
 
-	devkey := ezcrypt.NewEncryptionKey(cryptostring.New(devkeystr))
-	encryptedChallenge, err := devkey.Encrypt([]byte(challenge))
+	encryptor := ezcrypt.NewEncryptionKey(dc.Key)
+	if encryptor == nil {
+		return "", errors.New("bad device key")
+	}
+	return encryptor.Encrypt([]byte(dc.challenge))
+}
+
+// Check returns true if the device's response answers the challenge. For signing keys, the
+// response is a CryptoString of the signature of the challenge string.
+func (dc deviceChallenge) Check(response string) bool {
+	if dc.Type != "sign" {
+		return subtle.ConstantTimeCompare([]byte(dc.challenge), []byte(response)) == 1
+	}
+
+	verifier := ezcrypt.NewVerificationKey(dc.Key)
+	if verifier == nil {
+		return false
+	}
+	var signature cryptostring.CryptoString
+	if signature.Set(response) != nil {
+		return false
+	}
+	verified, err := verifier.Verify([]byte(dc.challenge), signature)
+	return err == nil && verified
+}
 
+// deviceKeyTypes returns the key types which may be used for devices
+func deviceKeyTypes() []string {
+	out := append(ezcrypt.ListAlgorithms(ezcrypt.CapEncrypt),
+		ezcrypt.ListAlgorithms(ezcrypt.CapSign)...)
+	sort.Strings(out)
+	return out
+}
+
+// checkDeviceKeyType returns true if the type of a device key is supported. If it isn't, the
+// client is sent the list of supported types and false is returned.
+func checkDeviceKeyType(session *sessionState, devkey cryptostring.CryptoString) bool {
+	if ezcrypt.IsSupported(devkey.Prefix, ezcrypt.CapEncrypt) ||
+		ezcrypt.IsSupported(devkey.Prefix, ezcrypt.CapSign) {
+		return true
+	}
+	session.SendStringResponse(309, "ENCRYPTION TYPE NOT SUPPORTED", "Supported: "+
+		strings.Join(deviceKeyTypes(), ","))
+	return false
+}
+
+func challengeDevice(session *sessionState, devkey cryptostring.CryptoString) (bool, error) {
+	// 1) Generate a 32-byte random string of bytes
+	// 2) Encode string in base85
+	// 3) Encrypt said string with encryption keys, encode in base85, and return it as part of
+	//    100 CONTINUE response. Signing keys get the string as-is.
+	// 4) Wait for response from client and compare response to original base85 string or verify
+	//    the signature of it
+	// 5) If the response doesn't match, respond to client with 402 Authentication Failure and
+	//    return false
+	// 6) If the response matches, respond to client with 200 OK and return true/nil
+
+	challenge, err := newDeviceChallenge(devkey)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("challengeDevice: error generating challenge: %s", err.Error())
+		return false, err
+	}
+
+	challengeData, err := challenge.Data()
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		return false, err
 	}
 
 	response := NewServerResponse(100, "CONTINUE")
-	response.Data["Challenge"] = encryptedChallenge
+	response.Data["Challenge"] = challengeData
+	response.Data["Challenge-Type"] = challenge.Type
 	err = session.SendResponse(*response)
 	if err != nil {
 		return false, err
@@ -530,63 +731,49 @@ func challengeDevice(session *sessionState, keytype string, devkeystr string) (b
 		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
 		return false, nil
 	}
-	if request.Data["Device-Key"] != devkeystr {
+	if request.Data["Device-Key"] != devkey.AsString() {
 		session.SendStringResponse(400, "BAD REQUEST", "Device key mismatch")
 		return false, nil
 	}
 
 	// Validate client response
-	if challenge != request.Data["Response"] {
-		return false, nil
-	}
-
-	return true, nil
+	return challenge.Check(request.Data["Response"]), nil
 }
 
 func dualChallengeDevice(session *sessionState, oldkey cryptostring.CryptoString,
 	newkey cryptostring.CryptoString) (bool, error) {
-	// This is just like challengeDevice, but using two keys, an old one and a new one
+	// This is just like challengeDevice, but using two keys, an old one and a new one. The two
+	// keys don't need to be of the same type.
 
-	if oldkey.Prefix != "CURVE25519" || newkey.Prefix != "CURVE25519" {
-		return false, errors.New("unsupported key type")
-	}
-
-	randBytes := make([]byte, 32)
-	_, err := rand.Read(randBytes)
+	challenge, err := newDeviceChallenge(oldkey)
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("challengeDevice: error checking lockout: %s", err.Error())
+		logging.Writef("dualChallengeDevice: error generating challenge: %s", err.Error())
 		return false, err
 	}
-	challenge := b85.Encode(randBytes)
-
-	encryptor := ezcrypt.NewEncryptionKey(oldkey)
-	encryptedChallenge, err := encryptor.Encrypt([]byte(challenge))
-
+	newChallenge, err := newDeviceChallenge(newkey)
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("dualChallengeDevice: error generating challenge: %s", err.Error())
 		return false, err
 	}
 
-	response := NewServerResponse(100, "CONTINUE")
-	response.Data["Challenge"] = encryptedChallenge
-
-	_, err = rand.Read(randBytes)
+	challengeData, err := challenge.Data()
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("challengeDevice: error checking lockout: %s", err.Error())
 		return false, err
 	}
-	newChallenge := b85.Encode(randBytes)
-
-	encryptor = ezcrypt.NewEncryptionKey(newkey)
-	encryptedNewChallenge, err := encryptor.Encrypt([]byte(newChallenge))
-
+	newChallengeData, err := newChallenge.Data()
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		return false, err
 	}
-	response.Data["New-Challenge"] = encryptedNewChallenge
+
+	response := NewServerResponse(100, "CONTINUE")
+	response.Data["Challenge"] = challengeData
+	response.Data["Challenge-Type"] = challenge.Type
+	response.Data["New-Challenge"] = newChallengeData
+	response.Data["New-Challenge-Type"] = newChallenge.Type
 
 	err = session.SendResponse(*response)
 	if err != nil {
@@ -612,9 +799,6 @@ func dualChallengeDevice(session *sessionState, oldkey cryptostring.CryptoString
 	}
 
 	// Validate client response
-	if challenge != request.Data["Response"] || newChallenge != request.Data["New-Response"] {
-		return false, nil
-	}
-
-	return true, nil
+	return challenge.Check(request.Data["Response"]) &&
+		newChallenge.Check(request.Data["New-Response"]), nil
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/darkwyrm/mensagod/dbhandler"
+)
+
+// runCommand runs a command handler on a session which uses the given store and returns the
+// handler's response along with the session's state afterward
+func runCommand(t *testing.T, store *dbhandler.Store, state sessionState, action string,
+	data map[string]string) (ServerResponse, sessionState) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	state.Connection = server
+	state.Store = store
+	state.Message = ClientRequest{action, data}
+
+	done := make(chan sessionState)
+	go func() {
+		defer server.Close()
+		processCommand(&state)
+		done <- state
+	}()
+
+	var response ServerResponse
+	buffer := make([]byte, MaxCommandLength)
+	bytesRead, err := client.Read(buffer)
+	if err != nil {
+		t.Fatalf("%s: couldn't read response: %s", action, err.Error())
+	}
+	err = json.Unmarshal(buffer[:bytesRead], &response)
+	if err != nil {
+		t.Fatalf("%s: bad response: %s", action, err.Error())
+	}
+	return response, <-done
+}
+
+func TestCommandPassword(t *testing.T) {
+	store := dbhandler.NewMemoryStore()
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	pwhash := "$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCqdcCYkJLok65" +
+		"qussSyhN5TTZP+OTgzEI"
+	err := store.Workspaces.AddWorkspace(wid, "csimons", "example.com", pwhash, "active",
+		"individual")
+	if err != nil {
+		t.Fatalf("TestCommandPassword: Couldn't add workspace: %s", err.Error())
+	}
+
+	// Subtest #1: The password is only accepted after LOGIN
+
+	var state sessionState
+	state.WID = wid
+	state.LoginState = loginNoSession
+	response, _ := runCommand(t, store, state, "PASSWORD", map[string]string{
+		"Password-Hash": pwhash,
+	})
+	if response.Code != 400 {
+		t.Fatalf("TestCommandPassword: #1: password accepted without LOGIN: %d", response.Code)
+	}
+
+	// Subtest #2: The right password moves the session on to the device check
+
+	state.LoginState = loginAwaitingPassword
+	response, state = runCommand(t, store, state, "PASSWORD", map[string]string{
+		"Password-Hash": pwhash,
+	})
+	if response.Code != 100 {
+		t.Fatalf("TestCommandPassword: #2: password not accepted: %d %s", response.Code,
+			response.Info)
+	}
+	if state.LoginState != loginAwaitingSessionID {
+		t.Fatal("TestCommandPassword: #2: session didn't advance to device check")
+	}
+}
+
+func TestCommandPasscode(t *testing.T) {
+	store := dbhandler.NewMemoryStore()
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	oldhash := "$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCqdcCYkJLok65" +
+		"qussSyhN5TTZP+OTgzEI"
+	newhash := "$argon2id$v=19$m=65536,t=2,p=1$4FpLqZPQAGRlhmmqpAfaFg$aDGf9d6m6r+o+lWpyR9Kbe" +
+		"UNt5j6xCMqBkfdBVE7r5g"
+	err := store.Workspaces.AddWorkspace(wid, "csimons", "example.com", oldhash, "active",
+		"individual")
+	if err != nil {
+		t.Fatalf("TestCommandPasscode: Couldn't add workspace: %s", err.Error())
+	}
+	err = store.Passcodes.ResetPassword(wid, "barely-enough-words", "29991231T235959Z")
+	if err != nil {
+		t.Fatalf("TestCommandPasscode: Couldn't add reset code: %s", err.Error())
+	}
+
+	// Subtest #1: The reset code sets the workspace's password
+
+	var state sessionState
+	state.LoginState = loginNoSession
+	response, _ := runCommand(t, store, state, "PASSCODE", map[string]string{
+		"Workspace-ID":  wid,
+		"Reset-Code":    "barely-enough-words",
+		"Password-Hash": newhash,
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandPasscode: #1: reset code not accepted: %d %s", response.Code,
+			response.Info)
+	}
+	match, err := store.Workspaces.CheckPassword(wid, newhash)
+	if err != nil || !match {
+		t.Fatal("TestCommandPasscode: #1: password not changed")
+	}
+
+	// Subtest #2: Reset codes can't be used twice
+
+	verified, err := store.Passcodes.CheckPasscode(wid, "barely-enough-words")
+	if err != nil || verified {
+		t.Fatal("TestCommandPasscode: #2: reset code not deleted after use")
+	}
+}
+
+func TestCommandPasswordReport(t *testing.T) {
+	store := dbhandler.NewMemoryStore()
+
+	adminWid := "ae406c5e-2673-4d3e-af20-91325d9623ca"
+	auditorWid := "11111111-1111-1111-1111-111111111111"
+	for _, ws := range [][]string{
+		{adminWid, "admin", "individual"},
+		{auditorWid, "csimons", "individual"},
+		{"22222222-2222-2222-2222-222222222222", "", "shared"},
+	} {
+		err := store.Workspaces.AddWorkspace(ws[0], ws[1], "example.com", "password", "active",
+			ws[2])
+		if err != nil {
+			t.Fatalf("TestCommandPasswordReport: Couldn't add workspace: %s", err.Error())
+		}
+	}
+	if err := store.Roles.AddRole(auditorWid, roleAuditor); err != nil {
+		t.Fatalf("TestCommandPasswordReport: Couldn't add role: %s", err.Error())
+	}
+
+	var auditor sessionState
+	auditor.WID = auditorWid
+	auditor.Domain = "example.com"
+	auditor.LoginState = loginClientSession
+
+	// Subtest #1: Workspaces with passwords are counted, and none of them are legacy or unreadable
+
+	response, _ := runCommand(t, store, auditor, "PASSWORDREPORT", map[string]string{})
+	if response.Code != 200 || response.Data["Workspace-Count"] != "2" ||
+		response.Data["Legacy-Count"] != "0" || response.Data["Unreadable-Count"] != "0" {
+		t.Fatalf("TestCommandPasswordReport: #1: wrong report: %d %v", response.Code,
+			response.Data)
+	}
+}
+
+func TestCommandResetPassword(t *testing.T) {
+	store := dbhandler.NewMemoryStore()
+
+	adminWid := "ae406c5e-2673-4d3e-af20-91325d9623ca"
+	supportWid := "11111111-1111-1111-1111-111111111111"
+	registrarWid := "22222222-2222-2222-2222-222222222222"
+	userWid := "33333333-3333-3333-3333-333333333333"
+	for _, ws := range [][]string{
+		{adminWid, "admin"},
+		{supportWid, "csimons"},
+		{registrarWid, "rbrannan"},
+		{userWid, "pmakani"},
+	} {
+		err := store.Workspaces.AddWorkspace(ws[0], ws[1], "example.com", "-", "active",
+			"individual")
+		if err != nil {
+			t.Fatalf("TestCommandResetPassword: Couldn't add workspace: %s", err.Error())
+		}
+	}
+	if err := store.Roles.AddRole(supportWid, roleSupport); err != nil {
+		t.Fatalf("TestCommandResetPassword: Couldn't add role: %s", err.Error())
+	}
+	if err := store.Roles.AddRole(registrarWid, roleRegistrar); err != nil {
+		t.Fatalf("TestCommandResetPassword: Couldn't add role: %s", err.Error())
+	}
+
+	var admin sessionState
+	admin.WID = adminWid
+	admin.Domain = "example.com"
+	admin.LoginState = loginClientSession
+
+	var support sessionState
+	support.WID = supportWid
+	support.Domain = "example.com"
+	support.LoginState = loginClientSession
+
+	// Subtest #1: Support can reset the password of a workspace without a role
+
+	response, _ := runCommand(t, store, support, "RESETPASSWORD", map[string]string{
+		"Workspace-ID": userWid,
+		"Reset-Code":   "barely-enough-words",
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandResetPassword: #1: support couldn't reset password: %d %s",
+			response.Code, response.Info)
+	}
+
+	// Subtest #2: Support can't reset the password of a workspace with a role, including its own
+	// and those of the admin
+
+	for _, wid := range []string{registrarWid, supportWid, adminWid} {
+		response, _ = runCommand(t, store, support, "RESETPASSWORD", map[string]string{
+			"Workspace-ID": wid,
+			"Reset-Code":   "barely-enough-words",
+		})
+		if response.Code != 403 {
+			t.Fatalf("TestCommandResetPassword: #2: support reset password of %s: %d", wid,
+				response.Code)
+		}
+	}
+	verified, err := store.Passcodes.CheckPasscode(registrarWid, "barely-enough-words")
+	if err != nil || verified {
+		t.Fatal("TestCommandResetPassword: #2: reset code added for registrar")
+	}
+
+	// Subtest #3: The admin can reset the password of a workspace with a role
+
+	response, _ = runCommand(t, store, admin, "RESETPASSWORD", map[string]string{
+		"Workspace-ID": registrarWid,
+		"Reset-Code":   "barely-enough-words",
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandResetPassword: #3: admin couldn't reset password: %d %s",
+			response.Code, response.Info)
+	}
+}
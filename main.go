@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/darkwyrm/mensagod/config"
 	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/ezcrypt"
 	"github.com/darkwyrm/mensagod/fshandler"
 	"github.com/darkwyrm/mensagod/logging"
 	"github.com/everlastingbeta/diceware"
@@ -25,6 +27,10 @@ var ServerLog *log.Logger
 // gDiceWordList is a copy of the word list for preregistration code generation
 var gDiceWordList diceware.Wordlist
 
+// gStore is the data access used by the server's background tasks and startup checks. Each
+// session has its own.
+var gStore *dbhandler.Store
+
 // -------------------------------------------------------------------------------------------
 // Types
 // -------------------------------------------------------------------------------------------
@@ -55,7 +61,11 @@ type sessionState struct {
 	IsTerminating    bool
 	WID              string
 	WorkspaceStatus  string
-	CurrentPath      fshandler.LocalAnPath
+	// Domain of the logged-in workspace. Empty if not logged in.
+	Domain      string
+	CurrentPath fshandler.LocalAnPath
+	// Data access for the session's commands
+	Store *dbhandler.Store
 }
 
 // ClientRequest is for encapsulating requests from the client.
@@ -143,6 +153,16 @@ func (s sessionState) SendStringResponse(code int, status string, info string) (
 	return s.SendResponse(ServerResponse{code, status, info, map[string]string{}})
 }
 
+// SendDatabaseError sends the error response for a command whose database call failed. If the
+// database couldn't be reached, the server is reported as unavailable, which tells the client that
+// trying again later may work. Any other error is an internal server error.
+func (s sessionState) SendDatabaseError(err error) error {
+	if dbhandler.IsUnavailableError(err) {
+		return s.SendStringResponse(303, "SERVER UNAVAILABLE", "Database unavailable")
+	}
+	return s.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+}
+
 func (s *sessionState) ReadClient() (string, error) {
 	buffer := make([]byte, MaxCommandLength)
 	bytesRead, err := s.Connection.Read(buffer)
@@ -166,6 +186,37 @@ func (s sessionState) WriteClient(msg string) (n int, err error) {
 	return s.Connection.Write([]byte(msg))
 }
 
+// ReadData reads a block of data of the specified size which the client sends after a command,
+// such as the owner list for USERCARDS. Nothing past the end of the block is read.
+func (s *sessionState) ReadData(size uint64) ([]byte, error) {
+	out := make([]byte, 0, size)
+	buffer := make([]byte, MaxCommandLength)
+
+	for uint64(len(out)) < size {
+		remaining := size - uint64(len(out))
+		if remaining < uint64(len(buffer)) {
+			buffer = buffer[:remaining]
+		}
+
+		bytesRead, err := s.Connection.Read(buffer)
+		if err != nil {
+			ne, ok := err.(*net.OpError)
+			if ok && ne.Timeout() {
+				s.IsTerminating = true
+				return out, errors.New("connection timed out")
+			}
+
+			if err.Error() != "EOF" {
+				fmt.Println("Error reading from client: ", err.Error())
+			}
+			return out, err
+		}
+		out = append(out, buffer[:bytesRead]...)
+	}
+
+	return out, nil
+}
+
 func (s *sessionState) ReadFileData(fileSize uint64, fileHandle *os.File) (uint64, error) {
 
 	var totalRead uint64
@@ -207,6 +258,45 @@ func main() {
 		os.Exit(1)
 	}
 	defer dbhandler.Disconnect()
+	gStore = dbhandler.NewSQLStore(context.Background())
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := commandMigrate(os.Args[2:])
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			dbhandler.Disconnect()
+			os.Exit(1)
+		}
+		return
+	}
+	checkSchemaVersion()
+
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		err := commandCheck()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			dbhandler.Disconnect()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rewrap" {
+		err := commandRewrap(os.Args[2:])
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			dbhandler.Disconnect()
+			os.Exit(1)
+		}
+		return
+	}
+	unlockOrgKeys()
+
+	if viper.GetBool("security.verify_keycards") {
+		checkKeycardChains(gStore)
+	}
+
+	go runScheduledTasks()
 
 	listenString := viper.GetString("network.listen_ip") + ":" + viper.GetString("network.port")
 	listener, err := net.Listen("tcp", listenString)
@@ -234,8 +324,16 @@ func connectionWorker(conn net.Conn) {
 	conn.SetReadDeadline(time.Now().Add(time.Minute * 30))
 	conn.SetWriteDeadline(time.Now().Add(time.Minute * 10))
 
+	// Commands are handled one at a time on this goroutine, so a slow query holds up the session
+	// until database.query_timeout runs out, even if the client has gone. Canceling the session's
+	// context when it ends makes sure nothing it started, such as a transaction a command left
+	// open, outlives it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	var session sessionState
 	session.Connection = conn
+	session.Store = dbhandler.NewSQLStore(ctx)
 	session.LoginState = loginNoSession
 
 	session.WriteClient("{\"Name\":\"Mensago\",\"Version\":\"0.1\",\"Code\":200," +
@@ -262,10 +360,20 @@ func connectionWorker(conn net.Conn) {
 
 func processCommand(session *sessionState) {
 	switch session.Message.Action {
+	case "ADDALIAS":
+		commandAddAlias(session)
 	case "ADDENTRY":
 		commandAddEntry(session)
+	case "ADDMEMBER":
+		commandAddMember(session)
+	case "ADDROLE":
+		commandAddRole(session)
 	case "CANCEL":
 		commandCancel(session)
+	case "CANCELUNREGISTER":
+		commandCancelUnregister(session)
+	case "CONSISTENCYPROOF":
+		commandConsistencyProof(session)
 	case "COPY":
 		commandCopy(session)
 	case "DELETE":
@@ -276,16 +384,26 @@ func processCommand(session *sessionState) {
 		commandDevKey(session)
 	case "EXISTS":
 		commandExists(session)
+	case "EXPIRINGCARDS":
+		commandExpiringCards(session)
 	case "GETQUOTAINFO":
 		commandGetQuotaInfo(session)
 	case "GETWID":
 		commandGetWID(session)
+	case "INCLUSIONPROOF":
+		commandInclusionProof(session)
 	case "ISCURRENT":
 		commandIsCurrent(session)
 	case "LIST":
 		commandList(session)
+	case "LISTALIASES":
+		commandListAliases(session)
 	case "LISTDIRS":
 		commandListDirs(session)
+	case "LISTMEMBERS":
+		commandListMembers(session)
+	case "LISTROLES":
+		commandListRoles(session)
 	case "LOGIN":
 		commandLogin(session)
 	case "LOGOUT":
@@ -298,34 +416,58 @@ func processCommand(session *sessionState) {
 		// Do nothing. Just resets the idle counter.
 	case "ORGCARD":
 		commandOrgCard(session)
+	case "ORGROTATE":
+		commandOrgRotate(session)
 	case "PASSCODE":
 		commandPasscode(session)
 	case "PASSWORD":
 		commandPassword(session)
+	case "PASSWORDREPORT":
+		commandPasswordReport(session)
 	case "PREREG":
 		commandPreregister(session)
 	case "REGCODE":
 		commandRegCode(session)
 	case "REGISTER":
 		commandRegister(session)
+	case "REJECTUNREGISTER":
+		commandRejectUnregister(session)
+	case "REMOVEALIAS":
+		commandRemoveAlias(session)
+	case "REMOVEMEMBER":
+		commandRemoveMember(session)
+	case "REMOVEROLE":
+		commandRemoveRole(session)
 	case "RESETPASSWORD":
 		commandResetPassword(session)
+	case "REVOKE":
+		commandRevoke(session)
 	case "RMDIR":
 		commandRmDir(session)
 	case "SELECT":
 		commandSelect(session)
+	case "SERVERINFO":
+		commandServerInfo(session)
 	case "SETPASSWORD":
 		commandSetPassword(session)
 	case "SETQUOTA":
 		commandSetQuota(session)
 	case "SETSTATUS":
 		commandSetStatus(session)
+	case "TREEHEAD":
+		commandTreeHead(session)
 	case "UNREGISTER":
 		commandUnregister(session)
+	case "UNREGREQUESTS":
+		commandUnregRequests(session)
 	case "UPLOAD":
 		commandUpload(session)
 	case "USERCARD":
 		commandUserCard(session)
+	case "USERCARDS":
+		commandUserCards(session)
+	case "VERIFYCHAINS":
+		commandVerifyChains(session)
 	default:
 		commandUnrecognized(session)
 	}
@@ -338,6 +480,21 @@ func commandCancel(session *sessionState) {
 	session.SendStringResponse(200, "OK", "")
 }
 
+func commandServerInfo(session *sessionState) {
+	// command syntax:
+	// SERVERINFO()
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Hash-Algorithms"] = strings.Join(ezcrypt.ListAlgorithms(ezcrypt.CapHash), ",")
+	response.Data["Signing-Algorithms"] = strings.Join(ezcrypt.ListAlgorithms(ezcrypt.CapSign),
+		",")
+	response.Data["Encryption-Algorithms"] = strings.Join(
+		ezcrypt.ListAlgorithms(ezcrypt.CapEncrypt), ",")
+	response.Data["Symmetric-Algorithms"] = strings.Join(
+		ezcrypt.ListAlgorithms(ezcrypt.CapSymmetric), ",")
+	session.SendResponse(*response)
+}
+
 func commandSetStatus(session *sessionState) {
 	// Command syntax:
 	// SETSTATUS(wid, status)
@@ -360,32 +517,29 @@ func commandSetStatus(session *sessionState) {
 		return
 	}
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkRole(session, roleRegistrar, roleSupport) {
 		return
 	}
 
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandPreregister: Error resolving address: %s", err)
+	if !checkSameDomain(session, session.Message.Data["Workspace-ID"]) {
 		return
 	}
-	if session.WID != adminWid {
-		session.SendStringResponse(403, "FORBIDDEN", "Only admin can use this")
+
+	adminWid, err := getAdminWID(session, getSessionDomain(session))
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandSetStatus: Error resolving address: %s", err)
 		return
 	}
-
-	if session.Message.Data["Workspace-ID"] == session.WID {
+	if session.Message.Data["Workspace-ID"] == adminWid {
 		session.SendStringResponse(403, "FORBIDDEN", "admin status can't be changed")
 		return
 	}
 
-	err = dbhandler.SetWorkspaceStatus(session.Message.Data["Workspace-ID"],
+	err = session.Store.Workspaces.SetWorkspaceStatus(session.Message.Data["Workspace-ID"],
 		session.Message.Data["Status"])
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("commandSetStatus: error setting workspace status: %s", err.Error())
 		return
 	}
@@ -400,9 +554,9 @@ func commandSetStatus(session *sessionState) {
 // specific workspace ID.
 func logFailure(session *sessionState, failType string, wid string) (bool, error) {
 	remoteip := strings.Split(session.Connection.RemoteAddr().String(), ":")[0]
-	err := dbhandler.LogFailure(failType, wid, remoteip)
+	err := session.Store.Failures.LogFailure(failType, wid, remoteip)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("logFailure: error logging failure: %s", err.Error())
 		return true, err
 	}
@@ -412,6 +566,9 @@ func logFailure(session *sessionState, failType string, wid string) (bool, error
 	// means that although there has been a failure, the count for this IP address is
 	// still under the limit.
 	lockTime, err := getLockout(session, failType, wid)
+	if err != nil {
+		return true, err
+	}
 	if len(lockTime) > 0 {
 		response := NewServerResponse(405, "TERMINATED")
 		response.Data["Lock-Time"] = lockTime
@@ -441,21 +598,16 @@ func isLocked(session *sessionState, failType string, wid string) (bool, error)
 	return false, nil
 }
 
+// getLockout returns the time the client is locked out until for a type of failure, or an empty
+// string if it isn't locked out. Failures are logged by IP address, so the connection's port is
+// not part of the lookup. The caller is responsible for telling the client about the lockout.
 func getLockout(session *sessionState, failType string, wid string) (string, error) {
-
-	lockTime, err := dbhandler.CheckLockout(failType, wid, session.Connection.RemoteAddr().String())
+	remoteip := strings.Split(session.Connection.RemoteAddr().String(), ":")[0]
+	lockTime, err := session.Store.Failures.CheckLockout(failType, wid, remoteip)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("getLockout: error checking lockout: %s", err.Error())
 		return "", err
 	}
-
-	if len(lockTime) > 0 {
-		response := NewServerResponse(407, "UNAVAILABLE")
-		response.Data["Lock-Time"] = lockTime
-		session.SendResponse(*response)
-		return lockTime, nil
-	}
-
-	return "", nil
+	return lockTime, nil
 }
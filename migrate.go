@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/logging"
+)
+
+// checkSchemaVersion makes sure the database schema is the one this version of the server was
+// written for. The server exits if it isn't, because running against an older schema would fail
+// in confusing ways and running against a newer one could damage data the server doesn't
+// understand.
+func checkSchemaVersion() {
+	pending, err := dbhandler.PendingMigrations()
+	if err == dbhandler.ErrSchemaTooNew {
+		fmt.Println("The database schema is newer than this version of mensagod supports. " +
+			"Please upgrade the server.")
+		logging.Write("Database schema is newer than the server. Exiting.")
+		logging.Shutdown()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Unable to check the database schema version: %s\n", err.Error())
+		logging.Writef("checkSchemaVersion: %s", err.Error())
+		logging.Shutdown()
+		os.Exit(1)
+	}
+
+	if len(pending) > 0 {
+		fmt.Println("The database schema is out of date. Back up the database and run " +
+			"'mensagod migrate' to update it.")
+		logging.Write("Database schema is out of date. Exiting.")
+		logging.Shutdown()
+		os.Exit(1)
+	}
+}
+
+// commandMigrate implements 'mensagod migrate', which applies any pending migrations to the
+// database schema
+func commandMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+	flags.Parse(args)
+
+	if *dryRun {
+		pending, err := dbhandler.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			fmt.Println("The database schema is up to date.")
+		}
+		for _, migration := range pending {
+			fmt.Printf("Pending: %04d_%s\n", migration.Version, migration.Name)
+		}
+		return nil
+	}
+
+	applied, err := dbhandler.Migrate()
+	for _, migration := range applied {
+		fmt.Printf("Applied: %04d_%s\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("The database schema is up to date.")
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/darkwyrm/mensagod/cryptostring"
 	"github.com/darkwyrm/mensagod/dbhandler"
@@ -37,7 +38,7 @@ func commandGetWID(session *sessionState) {
 			return
 		}
 	} else {
-		domain = viper.GetString("global.domain")
+		domain = getSessionDomain(session)
 	}
 
 	lockout, err := isLocked(session, "widlookup", "")
@@ -46,9 +47,9 @@ func commandGetWID(session *sessionState) {
 	}
 
 	address := strings.Join([]string{session.Message.Data["User-ID"], "/", domain}, "")
-	wid, err := dbhandler.ResolveAddress(address)
+	wid, err := session.Store.Workspaces.ResolveAddress(address)
 	if err != nil {
-		if err.Error() == "workspace not found" {
+		if err == dbhandler.ErrWorkspaceNotFound {
 			terminate, err := logFailure(session, "widlookup", "")
 			if terminate || err != nil {
 				return
@@ -64,16 +65,7 @@ func commandPreregister(session *sessionState) {
 	// command syntax:
 	// PREREG(User-ID="",Workspace-ID="",Domain="")
 
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandPreregister: Error resolving address: %s", err)
-		return
-	}
-
-	if session.LoginState != loginClientSession || session.WID != adminWid {
-		session.SendStringResponse(403, "FORBIDDEN", "Only admin can use this")
+	if !checkRole(session, roleRegistrar) {
 		return
 	}
 
@@ -85,12 +77,6 @@ func commandPreregister(session *sessionState) {
 			session.SendStringResponse(400, "BAD REQUEST", "Bad User-ID")
 			return
 		}
-
-		success, _ := dbhandler.CheckUserID(session.Message.Data["User-ID"])
-		if success {
-			session.SendStringResponse(408, "RESOURCE EXISTS", "User-ID exists")
-			return
-		}
 	}
 
 	// If the client submits a workspace ID as the user ID, it is considered a request for that
@@ -107,22 +93,27 @@ func commandPreregister(session *sessionState) {
 		}
 	}
 
-	domain := ""
-	if session.Message.HasField("Domain") {
-		domain = session.Message.Data["Domain"]
-		pattern := regexp.MustCompile("([a-zA-Z0-9]+\x2E)+[a-zA-Z0-9]+")
-		if !pattern.MatchString(domain) {
-			session.SendStringResponse(400, "BAD REQUEST", "Bad Domain")
+	// Registrars may only preregister workspaces in their own domain
+	domain, ok := getRequestDomain(session)
+	if !ok {
+		return
+	}
+	if domain != getSessionDomain(session) {
+		session.SendStringResponse(403, "FORBIDDEN", "Workspace belongs to another domain")
+		return
+	}
+
+	if uid != "" {
+		success, _ := session.Store.Workspaces.CheckUserID(uid, domain)
+		if success {
+			session.SendStringResponse(408, "RESOURCE EXISTS", "User-ID exists")
 			return
 		}
 	}
-	if domain == "" {
-		domain = viper.GetString("global.domain")
-	}
 
 	var haswid bool
 	if wid != "" {
-		haswid, _ = dbhandler.CheckWorkspace(wid)
+		haswid, _ = session.Store.Workspaces.CheckWorkspace(wid)
 		if haswid {
 			session.SendStringResponse(408, "RESOURCE EXISTS", "")
 			return
@@ -131,11 +122,11 @@ func commandPreregister(session *sessionState) {
 		haswid = true
 		for haswid {
 			wid = uuid.New().String()
-			haswid, _ = dbhandler.CheckWorkspace(wid)
+			haswid, _ = session.Store.Workspaces.CheckWorkspace(wid)
 		}
 	}
 
-	regcode, err := dbhandler.PreregWorkspace(wid, uid, domain, &gDiceWordList,
+	regcode, err := session.Store.Prereg.PreregWorkspace(wid, uid, domain, &gDiceWordList,
 		viper.GetInt("security.diceware_wordcount"))
 	if err != nil {
 		if err.Error() == "uid exists" {
@@ -144,7 +135,7 @@ func commandPreregister(session *sessionState) {
 		}
 		logging.Write(fmt.Sprintf("Internal server error. commandPreregister.PreregWorkspace. "+
 			"Error: %s\n", err))
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		return
 	}
 
@@ -230,17 +221,9 @@ func commandRegCode(session *sessionState) {
 		return
 	}
 
-	domain := ""
-	if session.Message.HasField("Domain") {
-		domain = session.Message.Data["Domain"]
-		pattern := regexp.MustCompile("([a-zA-Z0-9]+\x2E)+[a-zA-Z0-9]+")
-		if !pattern.MatchString(domain) {
-			session.SendStringResponse(400, "BAD REQUEST", "Bad Domain")
-			return
-		}
-	}
-	if domain == "" {
-		domain = viper.GetString("global.domain")
+	domain, ok := getRequestDomain(session)
+	if !ok {
+		return
 	}
 
 	// If lockTime is non-empty, it means that the client has exceeded the configured threshold.
@@ -258,18 +241,17 @@ func commandRegCode(session *sessionState) {
 		return
 	}
 
-	if devkey.Prefix != "CURVE25519" {
-		session.SendStringResponse(309, "ENCRYPTION TYPE NOT SUPPORTED", "Supported: CURVE25519")
+	if !checkDeviceKeyType(session, devkey) {
 		return
 	}
 
 	var wid, uid string
 	if session.Message.HasField("Workspace-ID") {
-		wid, uid, err = dbhandler.CheckRegCode(session.Message.Data["Workspace-ID"], domain, true,
-			session.Message.Data["Reg-Code"])
+		wid, uid, err = session.Store.Prereg.CheckRegCode(session.Message.Data["Workspace-ID"],
+			domain, true, session.Message.Data["Reg-Code"])
 	} else {
-		wid, uid, err = dbhandler.CheckRegCode(session.Message.Data["User-ID"], domain, false,
-			session.Message.Data["Reg-Code"])
+		wid, uid, err = session.Store.Prereg.CheckRegCode(session.Message.Data["User-ID"],
+			domain, false, session.Message.Data["Reg-Code"])
 	}
 
 	if wid == "" {
@@ -279,37 +261,30 @@ func commandRegCode(session *sessionState) {
 		return
 	}
 
-	err = dbhandler.AddWorkspace(wid, uid, domain, session.Message.Data["Password-Hash"], "active",
-		"individual")
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("Internal server error. commandRegister.AddWorkspace. Error: %s\n", err)
-		return
-	}
-
-	err = dbhandler.SetWorkspaceStatus(wid, "active")
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("Internal server error. commandRegister.SetWorkspaceStatus. Error: %s\n", err)
-		return
-	}
-
-	err = dbhandler.AddDevice(wid, session.Message.Data["Device-ID"], devkey, "active")
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("Internal server error. commandRegister.AddDevice. Error: %s\n", err)
-		return
+	reg := dbhandler.Registration{
+		WID:       wid,
+		UID:       uid,
+		Domain:    domain,
+		Password:  session.Message.Data["Password-Hash"],
+		Status:    "active",
+		Type:      "individual",
+		DeviceID:  session.Message.Data["Device-ID"],
+		DeviceKey: devkey,
+		RegCode:   session.Message.Data["Reg-Code"],
 	}
-
 	if session.Message.HasField("Workspace-ID") {
-		err = dbhandler.DeleteRegCode(session.Message.Data["Workspace-ID"], domain, true,
-			session.Message.Data["Reg-Code"])
+		reg.PreregID = session.Message.Data["Workspace-ID"]
+		reg.PreregIsWID = true
 	} else {
-		err = dbhandler.DeleteRegCode(session.Message.Data["User-ID"], domain, false,
-			session.Message.Data["Reg-Code"])
+		reg.PreregID = session.Message.Data["User-ID"]
 	}
+
+	// The workspace's directory was made when it was preregistered, but it is created here if it
+	// has gone missing since then
+	err = session.Store.Accounts.RegisterWorkspace(reg, &fshandler.WorkspaceCreation{WID: wid})
 	if err != nil {
-		logging.Writef("Internal server error. commandRegister.DeleteRegCode. Error: %s\n", err)
+		session.SendDatabaseError(err)
+		logging.Writef("Internal server error. commandRegCode.RegisterWorkspace. Error: %s\n", err)
 		return
 	}
 
@@ -318,7 +293,13 @@ func commandRegCode(session *sessionState) {
 
 func commandRegister(session *sessionState) {
 	// command syntax:
-	// REGISTER(Workspace-ID, Password-Hash, Device-ID, Device-Key, User-ID="", Type="")
+	// REGISTER(Workspace-ID, Password-Hash, Device-ID, Device-Key, User-ID="", Type="", Domain="")
+
+	// Shared workspaces have no password or devices of their own, so they are handled separately
+	if session.Message.HasField("Type") && session.Message.Data["Type"] == "shared" {
+		registerSharedWorkspace(session)
+		return
+	}
 
 	if session.Message.Validate([]string{"Workspace-ID", "Password-Hash", "Device-ID",
 		"Device-Key"}) != nil {
@@ -343,25 +324,27 @@ func commandRegister(session *sessionState) {
 	wtype := "individual"
 	if session.Message.HasField("Type") {
 		wtype = session.Message.Data["Type"]
-		if wtype != "shared" && wtype != "individual" {
+		if wtype != "individual" {
 			session.SendStringResponse(400, "BAD REQUEST", "Bad Type")
 			return
 		}
-
-		// TODO: Eliminate this when shared workspaces are implemented
-		if wtype == "shared" {
-			session.SendStringResponse(301, "NOT IMPLEMENTED", "")
-			return
-		}
 	}
-	regType := strings.ToLower(viper.GetString("global.registration"))
+	domain, ok := getRequestDomain(session)
+	if !ok {
+		return
+	}
+	dc, ok := getDomainConfig(session, domain)
+	if !ok {
+		return
+	}
+	regType := dc.Registration
 
 	if regType == "private" {
 		session.SendStringResponse(304, "REGISTRATION CLOSED", "")
 		return
 	}
 
-	success, _ := dbhandler.CheckWorkspace(session.Message.Data["Workspace-ID"])
+	success, _ := session.Store.Workspaces.CheckWorkspace(session.Message.Data["Workspace-ID"])
 	if success {
 		response := NewServerResponse(408, "RESOURCE EXISTS")
 		response.Data["Field"] = "Workspace-ID"
@@ -370,7 +353,7 @@ func commandRegister(session *sessionState) {
 	}
 
 	if session.Message.HasField("User-ID") {
-		success, _ = dbhandler.CheckUserID(session.Message.Data["User-ID"])
+		success, _ = session.Store.Workspaces.CheckUserID(session.Message.Data["User-ID"], domain)
 		if success {
 			response := NewServerResponse(408, "RESOURCE EXISTS")
 			response.Data["Field"] = "User-ID"
@@ -417,51 +400,34 @@ func commandRegister(session *sessionState) {
 		return
 	}
 
-	if devkey.Prefix != "CURVE25519" {
-		session.SendStringResponse(309, "ENCRYPTION TYPE NOT SUPPORTED", "Supported: CURVE25519")
+	if !checkDeviceKeyType(session, devkey) {
 		return
 	}
 
-	err := dbhandler.AddWorkspace(session.Message.Data["Workspace-ID"], uid,
-		viper.GetString("global.domain"), session.Message.Data["Password-Hash"], workspaceStatus,
-		wtype)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("Internal server error. commandRegister.AddWorkspace. Error: %s\n", err)
-		return
+	reg := dbhandler.Registration{
+		WID:       session.Message.Data["Workspace-ID"],
+		UID:       uid,
+		Domain:    domain,
+		Password:  session.Message.Data["Password-Hash"],
+		Status:    workspaceStatus,
+		Type:      wtype,
+		DeviceID:  uuid.New().String(),
+		DeviceKey: devkey,
 	}
-
-	devid := uuid.New().String()
-	err = dbhandler.AddDevice(session.Message.Data["Workspace-ID"], devid, devkey, "active")
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("Internal server error. commandRegister.AddDevice. Error: %s\n", err)
-		return
-	}
-
-	fsp := fshandler.GetFSProvider()
-	exists, err := fsp.Exists("/ " + session.Message.Data["Workspace-ID"])
+	err := session.Store.Accounts.RegisterWorkspace(reg,
+		&fshandler.WorkspaceCreation{WID: reg.WID})
 	if err != nil {
-		logging.Writef("commandPreregister: Failed to check workspace %s existence: %s",
-			session.Message.Data["Workspace-ID"], err)
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
+		logging.Writef("Internal server error. commandRegister.RegisterWorkspace. Error: %s\n",
+			err)
 		return
 	}
-	if !exists {
-		fsp.MakeDirectory("/ " + session.Message.Data["Workspace-ID"])
-		if err != nil {
-			logging.Writef("commandPreregister: Failed to create workspace %s top directory: %s",
-				session.Message.Data["Workspace-ID"], err)
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-			return
-		}
-	}
 
 	if regType == "moderated" {
 		session.SendStringResponse(101, "PENDING", "")
 	} else {
 		response := NewServerResponse(201, "REGISTERED")
-		response.Data["Domain"] = viper.GetString("global.domain")
+		response.Data["Domain"] = domain
 		session.SendResponse(*response)
 	}
 }
@@ -473,7 +439,7 @@ func commandUnrecognized(session *sessionState) {
 
 func commandUnregister(session *sessionState) {
 	// command syntax:
-	// UNREGISTER(Password-Hash)
+	// UNREGISTER(Password-Hash, Workspace-ID="")
 	if !session.Message.HasField("Password-Hash") {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
 		return
@@ -481,11 +447,13 @@ func commandUnregister(session *sessionState) {
 
 	if session.LoginState != loginClientSession {
 		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
 	}
 
-	match, err := dbhandler.CheckPassword(session.WID, session.Message.Data["Password-Hash"])
+	match, err := session.Store.Workspaces.CheckPassword(session.WID,
+		session.Message.Data["Password-Hash"])
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Writef("Unregister: error checking password: %s", err.Error())
 		return
 	}
@@ -494,23 +462,16 @@ func commandUnregister(session *sessionState) {
 		return
 	}
 
-	regType := strings.ToLower(viper.GetString("global.registration"))
-	if regType == "private" || regType == "moderated" {
-		// TODO: submit admin request to delete workspace
-		// session.SendStringResponse(101, "PENDING", "Pending administrator approval")
-		session.SendStringResponse(301, "NOT IMPLEMENTED", "Not implemented yet. Sorry!")
-		return
-	}
-
-	adminWid, err := dbhandler.ResolveAddress("admin/" + viper.GetString("global.domain"))
+	domain := getSessionDomain(session)
+	adminWid, err := getAdminWID(session, domain)
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		session.SendDatabaseError(err)
 		logging.Write("Unregister: failed to resolve admin account")
 		return
 	}
 
-	// This command can be used to unregister other workspaces, but only the admin account is
-	// allowed to do this
+	// This command can be used to unregister other workspaces, but only the admin account and
+	// registrars are allowed to do this
 	wid := session.WID
 	if session.Message.HasField("Workspace-ID") {
 		if !dbhandler.ValidateUUID(session.Message.Data["Workspace-ID"]) {
@@ -520,13 +481,21 @@ func commandUnregister(session *sessionState) {
 
 		if session.WID != session.Message.Data["Workspace-ID"] {
 
-			if session.WID != adminWid {
+			authorized, err := hasRole(session, roleRegistrar)
+			if err != nil {
+				session.SendDatabaseError(err)
+				logging.Writef("Unregister: error checking roles: %s", err.Error())
+				return
+			}
+			if !authorized {
 				session.SendStringResponse(401, "UNAUTHORIZED",
 					"Only admin can unregister other workspaces")
 				return
 			}
+			if !checkSameDomain(session, session.Message.Data["Workspace-ID"]) {
+				return
+			}
 			wid = session.Message.Data["Workspace-ID"]
-
 		}
 	}
 
@@ -538,9 +507,9 @@ func commandUnregister(session *sessionState) {
 
 	// Can't delete support or abuse accounts
 	for _, builtin := range []string{"support", "abuse"} {
-		address, err := dbhandler.ResolveAddress(builtin + "/" + viper.GetString("global.domain"))
+		address, err := session.Store.Workspaces.LookupAddress(builtin + "/" + domain)
 		if err != nil {
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			session.SendDatabaseError(err)
 			logging.Write("Unregister: failed to resolve account " + builtin)
 			return
 		}
@@ -552,25 +521,211 @@ func commandUnregister(session *sessionState) {
 	}
 
 	// You also don't delete aliases with this command
-	isAlias, err := dbhandler.IsAlias(wid)
+	isAlias, err := session.Store.Aliases.IsAlias(wid)
 	if isAlias {
 		session.SendStringResponse(403, "FORBIDDEN", "Aliases aren't removed with this command")
 		return
 	}
 
-	err = dbhandler.RemoveWorkspace(wid)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("Unregister: error removing workspace from db: %s", err.Error())
+	dc, ok := getDomainConfig(session, domain)
+	if !ok {
 		return
 	}
+	if dc.Registration == "private" || dc.Registration == "moderated" {
+		status, graceUntil, exportUntil, err := session.Store.Unregs.GetUnregRequest(wid)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("Unregister: error checking unregistration request: %s", err.Error())
+			return
+		}
+
+		if wid == session.WID {
+			// Users on these servers can't remove their own workspaces. Instead, the request is
+			// queued for the administrator and the user has a grace period in which to cancel.
+			if status == "" {
+				graceUntil = time.Now().UTC().
+					AddDate(0, 0, viper.GetInt("global.unregister_grace_days")).
+					Format(time.RFC3339)
+				err = session.Store.Unregs.AddUnregRequest(wid, graceUntil)
+				if err != nil {
+					session.SendDatabaseError(err)
+					logging.Writef("Unregister: error queueing unregistration request: %s",
+						err.Error())
+					return
+				}
+			}
+
+			response := NewServerResponse(101, "PENDING")
+			response.Info = "Pending administrator approval"
+			response.Data["Grace-Until"] = graceUntil
+			if exportUntil != "" {
+				response.Data["Export-Until"] = exportUntil
+			}
+			session.SendResponse(*response)
+			return
+		}
+
+		// An admin unregistering a workspace which has a pending request approves the request
+		// instead of removing the workspace outright. The workspace is removed by the server once
+		// the user has had the chance to export their data.
+		if status != "" {
+			if status == "approved" {
+				response := NewServerResponse(200, "OK")
+				response.Data["Export-Until"] = exportUntil
+				session.SendResponse(*response)
+				return
+			}
+
+			graceEnd, err := time.Parse(time.RFC3339, graceUntil)
+			if err != nil {
+				session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+				logging.Writef("Unregister: bad grace period timestamp for %s: %s", wid,
+					err.Error())
+				return
+			}
+			if graceEnd.After(time.Now().UTC()) {
+				response := NewServerResponse(403, "FORBIDDEN")
+				response.Info = "Grace period has not ended"
+				response.Data["Grace-Until"] = graceUntil
+				session.SendResponse(*response)
+				return
+			}
+
+			exportUntil = time.Now().UTC().
+				AddDate(0, 0, viper.GetInt("global.unregister_export_days")).
+				Format(time.RFC3339)
+			err = session.Store.Unregs.ApproveUnregRequest(wid, exportUntil)
+			if err != nil {
+				session.SendDatabaseError(err)
+				logging.Writef("Unregister: error approving unregistration request: %s",
+					err.Error())
+				return
+			}
+
+			response := NewServerResponse(200, "OK")
+			response.Data["Export-Until"] = exportUntil
+			session.SendResponse(*response)
+			return
+		}
+	}
 
-	err = fshandler.RemoveWorkspace(wid)
+	err = session.Store.Accounts.UnregisterWorkspace(wid, &fshandler.WorkspaceRemoval{WID: wid})
 	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("Unregister: error removing workspace from filesystem: %s", err.Error())
+		session.SendDatabaseError(err)
+		logging.Writef("Unregister: error removing workspace: %s", err.Error())
 		return
 	}
 
 	session.SendStringResponse(202, "UNREGISTERED", "")
 }
+
+func commandCancelUnregister(session *sessionState) {
+	// command syntax:
+	// CANCELUNREGISTER()
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	status, _, _, err := session.Store.Unregs.GetUnregRequest(session.WID)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("CancelUnregister: error checking unregistration request: %s", err.Error())
+		return
+	}
+
+	if status == "" {
+		session.SendStringResponse(404, "NOT FOUND", "No unregistration request")
+		return
+	}
+
+	// The end of the grace period only permits the admin to approve the request. The user can
+	// still cancel it until they do.
+	if status != "pending" {
+		session.SendStringResponse(403, "FORBIDDEN", "Request has been approved")
+		return
+	}
+
+	err = session.Store.Unregs.DeleteUnregRequest(session.WID)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("CancelUnregister: error removing unregistration request: %s", err.Error())
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandRejectUnregister(session *sessionState) {
+	// command syntax:
+	// REJECTUNREGISTER(Workspace-ID)
+
+	if !checkRole(session, roleRegistrar) {
+		return
+	}
+
+	if session.Message.Validate([]string{"Workspace-ID"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Workspace-ID")
+		return
+	}
+
+	if !checkSameDomain(session, wid) {
+		return
+	}
+
+	status, _, _, err := session.Store.Unregs.GetUnregRequest(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("RejectUnregister: error checking unregistration request: %s", err.Error())
+		return
+	}
+	if status == "" {
+		session.SendStringResponse(404, "NOT FOUND", "No unregistration request")
+		return
+	}
+
+	err = session.Store.Unregs.DeleteUnregRequest(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("RejectUnregister: error removing unregistration request: %s", err.Error())
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandUnregRequests(session *sessionState) {
+	// command syntax:
+	// UNREGREQUESTS()
+
+	if !checkRole(session, roleRegistrar) {
+		return
+	}
+
+	requests, err := session.Store.Unregs.GetUnregRequests(getSessionDomain(session))
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("UnregRequests: error getting unregistration requests: %s", err.Error())
+		return
+	}
+
+	// Each request is listed as its workspace ID, status, end of the grace period, and end of the
+	// data export window, which is empty for pending requests
+	lines := make([]string, len(requests))
+	for i, request := range requests {
+		lines[i] = strings.Join([]string{request.WID, request.Status, request.GraceUntil,
+			request.ExportUntil}, ",")
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Request-Count"] = fmt.Sprintf("%d", len(requests))
+	response.Data["Requests"] = strings.Join(lines, "\r\n")
+	session.SendResponse(*response)
+}
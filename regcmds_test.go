@@ -0,0 +1,214 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/spf13/viper"
+)
+
+func TestCommandRegCode(t *testing.T) {
+	wordList := config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+	domain := config.PrimaryDomain()
+	wid := "11111111-1111-1111-1111-111111111111"
+	pwhash := "$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCqdcCYkJLok65" +
+		"qussSyhN5TTZP+OTgzEI"
+
+	regcode, err := store.Prereg.PreregWorkspace(wid, "support", domain, &wordList,
+		viper.GetInt("security.diceware_wordcount"))
+	if err != nil {
+		t.Fatalf("TestCommandRegCode: Couldn't preregister workspace: %s", err.Error())
+	}
+
+	// Subtest #1: A preregistered user ID can be redeemed with its registration code
+
+	var state sessionState
+	response, _ := runCommand(t, store, state, "REGCODE", map[string]string{
+		"User-ID":       "support",
+		"Reg-Code":      regcode,
+		"Password-Hash": pwhash,
+		"Device-ID":     "14e5a5ad-1e9c-4a9f-9efc-3c0e4e5a7a39",
+		"Device-Key":    "CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z",
+	})
+	if response.Code != 201 {
+		t.Fatalf("TestCommandRegCode: #1: registration failed: %d %s", response.Code,
+			response.Info)
+	}
+	found, err := store.Workspaces.LookupAddress("support/" + domain)
+	if err != nil || found != wid {
+		t.Fatalf("TestCommandRegCode: #1: registered workspace not found: %s %v", found, err)
+	}
+	match, err := store.Workspaces.CheckPassword(wid, pwhash)
+	if err != nil || !match {
+		t.Fatalf("TestCommandRegCode: #1: password not set: %v", err)
+	}
+}
+
+func TestCommandRegisterUnhostedDomain(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	// Subtest #1: Sessions in a domain without settings can't register workspaces, because its
+	// registration mode and default quota aren't known
+
+	var state sessionState
+	state.Domain = "unhosted.example"
+	response, _ := runCommand(t, store, state, "REGISTER", map[string]string{
+		"Workspace-ID": "11111111-1111-1111-1111-111111111111",
+		"Password-Hash": "$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XC" +
+			"qdcCYkJLok65qussSyhN5TTZP+OTgzEI",
+		"Device-ID":  "14e5a5ad-1e9c-4a9f-9efc-3c0e4e5a7a39",
+		"Device-Key": "CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z",
+	})
+	if response.Code != 404 {
+		t.Fatalf("TestCommandRegisterUnhostedDomain: #1: registered in unhosted domain: %d",
+			response.Code)
+	}
+}
+
+func TestCommandUnregister(t *testing.T) {
+	// Unregistration requests are only queued on servers which use private or moderated
+	// registration
+	config.SetupConfig()
+	oldMode := viper.GetString("global.registration")
+	viper.Set("global.registration", "moderated")
+	config.SetupConfig()
+	defer func() {
+		viper.Set("global.registration", oldMode)
+		config.SetupConfig()
+	}()
+
+	store := dbhandler.NewMemoryStore()
+	domain := config.PrimaryDomain()
+	adminWid := "ae406c5e-2673-4d3e-af20-91325d9623ca"
+	userWid := "11111111-1111-1111-1111-111111111111"
+	pwhash := "$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCqdcCYkJLok65" +
+		"qussSyhN5TTZP+OTgzEI"
+	for _, ws := range [][]string{
+		{adminWid, "admin"},
+		{"f8cfdbdf-62fe-4275-b490-736f5fdc82e3", "support"},
+		{"3d2c4a7b-ac8c-4b1b-8a8b-1f2e5c1d9a60", "abuse"},
+		{userWid, "csimons"},
+	} {
+		err := store.Workspaces.AddWorkspace(ws[0], ws[1], domain, pwhash, "active",
+			"individual")
+		if err != nil {
+			t.Fatalf("TestCommandUnregister: Couldn't add workspace: %s", err.Error())
+		}
+	}
+
+	var admin sessionState
+	admin.WID = adminWid
+	admin.Domain = domain
+	admin.LoginState = loginClientSession
+
+	var user sessionState
+	user.WID = userWid
+	user.Domain = domain
+	user.LoginState = loginClientSession
+
+	pastGrace := time.Now().UTC().AddDate(0, 0, -1).Format(time.RFC3339)
+
+	// Subtest #1: The user's request is queued and listed for the admin
+
+	response, _ := runCommand(t, store, user, "UNREGISTER", map[string]string{
+		"Password-Hash": pwhash,
+	})
+	if response.Code != 101 || response.Data["Grace-Until"] == "" {
+		t.Fatalf("TestCommandUnregister: #1: request not queued: %d %s", response.Code,
+			response.Info)
+	}
+
+	response, _ = runCommand(t, store, user, "UNREGREQUESTS", map[string]string{})
+	if response.Code != 403 {
+		t.Fatalf("TestCommandUnregister: #1: user listed requests: %d", response.Code)
+	}
+
+	response, _ = runCommand(t, store, admin, "UNREGREQUESTS", map[string]string{})
+	if response.Code != 200 || response.Data["Request-Count"] != "1" ||
+		!strings.HasPrefix(response.Data["Requests"], userWid+",pending,") {
+		t.Fatalf("TestCommandUnregister: #1: wrong request list: %d %s", response.Code,
+			response.Data["Requests"])
+	}
+
+	// Subtest #2: The admin can't approve a request during the grace period
+
+	response, _ = runCommand(t, store, admin, "UNREGISTER", map[string]string{
+		"Password-Hash": pwhash,
+		"Workspace-ID":  userWid,
+	})
+	if response.Code != 403 {
+		t.Fatalf("TestCommandUnregister: #2: request approved during grace period: %d",
+			response.Code)
+	}
+
+	// Subtest #3: The user can cancel a request after the grace period until it is approved
+
+	err := store.Unregs.AddUnregRequest(userWid, pastGrace)
+	if err != nil {
+		t.Fatalf("TestCommandUnregister: #3: Couldn't add request: %s", err.Error())
+	}
+	response, _ = runCommand(t, store, user, "CANCELUNREGISTER", map[string]string{})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandUnregister: #3: couldn't cancel request: %d %s", response.Code,
+			response.Info)
+	}
+	status, _, _, _ := store.Unregs.GetUnregRequest(userWid)
+	if status != "" {
+		t.Fatal("TestCommandUnregister: #3: canceled request not removed")
+	}
+
+	// Subtest #4: The admin can reject a request
+
+	response, _ = runCommand(t, store, admin, "REJECTUNREGISTER", map[string]string{
+		"Workspace-ID": userWid,
+	})
+	if response.Code != 404 {
+		t.Fatalf("TestCommandUnregister: #4: rejected nonexistent request: %d", response.Code)
+	}
+
+	err = store.Unregs.AddUnregRequest(userWid, pastGrace)
+	if err != nil {
+		t.Fatalf("TestCommandUnregister: #4: Couldn't add request: %s", err.Error())
+	}
+	response, _ = runCommand(t, store, admin, "REJECTUNREGISTER", map[string]string{
+		"Workspace-ID": userWid,
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandUnregister: #4: couldn't reject request: %d %s", response.Code,
+			response.Info)
+	}
+	status, _, _, _ = store.Unregs.GetUnregRequest(userWid)
+	if status != "" {
+		t.Fatal("TestCommandUnregister: #4: rejected request not removed")
+	}
+
+	// Subtest #5: Once the grace period is over, the admin can approve the request, and the user
+	// can no longer cancel it
+
+	err = store.Unregs.AddUnregRequest(userWid, pastGrace)
+	if err != nil {
+		t.Fatalf("TestCommandUnregister: #5: Couldn't add request: %s", err.Error())
+	}
+	response, _ = runCommand(t, store, admin, "UNREGISTER", map[string]string{
+		"Password-Hash": pwhash,
+		"Workspace-ID":  userWid,
+	})
+	if response.Code != 200 || response.Data["Export-Until"] == "" {
+		t.Fatalf("TestCommandUnregister: #5: request not approved: %d %s", response.Code,
+			response.Info)
+	}
+
+	response, _ = runCommand(t, store, user, "CANCELUNREGISTER", map[string]string{})
+	if response.Code != 403 {
+		t.Fatalf("TestCommandUnregister: #5: approved request canceled: %d", response.Code)
+	}
+	exists, _ := store.Workspaces.CheckWorkspace(userWid)
+	if !exists {
+		t.Fatal("TestCommandUnregister: #5: workspace removed before export window ended")
+	}
+}
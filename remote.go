@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkwyrm/mensagod/cryptostring"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/ezcrypt"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/darkwyrm/mensagod/logging"
+	"github.com/spf13/viper"
+)
+
+// The server acts as a caching resolver for keycards belonging to other domains so that clients
+// only need to talk to their own server. Remote keycards are fetched in their entirety, verified in
+// the same way as local ones, and cached until the Time-To-Live of their current entry runs out.
+
+// ErrRemoteKeycard is returned when a keycard from another server fails verification
+var ErrRemoteKeycard = errors.New("remote keycard failed verification")
+
+// remoteTimeout is how long the server waits on another server before giving up
+const remoteTimeout = time.Second * 30
+
+// maxRemoteKeycardSize is the largest keycard the server will download from another server. Entries
+// are only a few kilobytes and a keycard gains one each time its keys are rotated, so 1MiB is room
+// for hundreds of rotations while keeping a remote server from making this one allocate arbitrary
+// amounts of memory.
+const maxRemoteKeycardSize = 1 << 20
+
+// remoteConnection is a client connection to another Mensago server
+type remoteConnection struct {
+	conn net.Conn
+}
+
+// getRemoteServer returns the host and port of the Mensago server for a domain. The
+// resolver.servers setting takes precedence, followed by the domain's _mensago._tcp SRV record.
+// If neither exists, the server is expected to be at mensago.<domain> on the standard port.
+func getRemoteServer(domain string) string {
+	servers := viper.GetStringMapString("resolver.servers")
+	if server, ok := servers[domain]; ok {
+		return server
+	}
+
+	_, records, err := net.LookupSRV("mensago", "tcp", domain)
+	if err == nil && len(records) > 0 {
+		return net.JoinHostPort(strings.TrimSuffix(records[0].Target, "."),
+			fmt.Sprintf("%d", records[0].Port))
+	}
+	return net.JoinHostPort("mensago."+domain, "2001")
+}
+
+// dialRemote connects to the Mensago server for a domain
+func dialRemote(domain string) (*remoteConnection, error) {
+	conn, err := net.DialTimeout("tcp", getRemoteServer(domain), remoteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := remoteConnection{conn}
+
+	// The server greets new connections before accepting commands
+	greeting, err := rc.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if greeting.Code != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("remote server error %d: %s", greeting.Code, greeting.Status)
+	}
+	return &rc, nil
+}
+
+// Close ends the session with the remote server and closes the connection
+func (rc *remoteConnection) Close() {
+	rc.sendRequest(ClientRequest{"QUIT", map[string]string{}})
+	rc.conn.Close()
+}
+
+func (rc *remoteConnection) sendRequest(request ClientRequest) error {
+	out, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	rc.conn.SetWriteDeadline(time.Now().Add(remoteTimeout))
+	_, err = rc.conn.Write(out)
+	return err
+}
+
+func (rc *remoteConnection) readResponse() (ServerResponse, error) {
+	var out ServerResponse
+	buffer := make([]byte, 8192)
+	rc.conn.SetReadDeadline(time.Now().Add(remoteTimeout))
+	bytesRead, err := rc.conn.Read(buffer)
+	if err != nil {
+		return out, err
+	}
+	err = json.Unmarshal(buffer[:bytesRead], &out)
+	return out, err
+}
+
+// getEntries sends a keycard request to the remote server and downloads the entries it returns.
+// entryType is the type of entry header used in the transfer, i.e. ORG or USER.
+func (rc *remoteConnection) getEntries(request ClientRequest, entryType string) ([]string,
+	ServerResponse, error) {
+	err := rc.sendRequest(request)
+	if err != nil {
+		return nil, ServerResponse{}, err
+	}
+	response, err := rc.readResponse()
+	if err != nil {
+		return nil, response, err
+	}
+	if response.Code != 104 {
+		return nil, response, fmt.Errorf("remote server error %d: %s", response.Code,
+			response.Status)
+	}
+
+	dataSize, err := strconv.Atoi(response.Data["Total-Size"])
+	if err != nil || dataSize < 1 {
+		return nil, response, errors.New("bad Total-Size from remote server")
+	}
+	if dataSize > maxRemoteKeycardSize {
+		return nil, response, fmt.Errorf("keycard from remote server too large: %d bytes",
+			dataSize)
+	}
+	err = rc.sendRequest(ClientRequest{"TRANSFER", map[string]string{}})
+	if err != nil {
+		return nil, response, err
+	}
+
+	data := make([]byte, 0, dataSize)
+	buffer := make([]byte, 8192)
+	for len(data) < dataSize {
+		rc.conn.SetReadDeadline(time.Now().Add(remoteTimeout))
+		bytesRead, err := rc.conn.Read(buffer)
+		if err != nil {
+			return nil, response, err
+		}
+		data = append(data, buffer[:bytesRead]...)
+	}
+	if len(data) != dataSize {
+		return nil, response, errors.New("size mismatch in data from remote server")
+	}
+
+	header := "----- BEGIN " + entryType + " ENTRY -----\r\n"
+	footer := "----- END " + entryType + " ENTRY -----\r\n"
+	entries := make([]string, 0)
+	for _, item := range strings.Split(string(data), footer) {
+		if item == "" {
+			continue
+		}
+		if !strings.HasPrefix(item, header) {
+			return nil, response, errors.New("bad entry data from remote server")
+		}
+		entries = append(entries, strings.TrimPrefix(item, header))
+	}
+	return entries, response, nil
+}
+
+// getRemoteOrgEntries returns the entries of another domain's organization keycard, fetching it
+// from the domain's server if it is not in the cache
+func getRemoteOrgEntries(store *dbhandler.Store, domain string) ([]*keycard.Entry, error) {
+	owner, _, _, err := store.RemoteCards.GetRemoteKeycard(domain, "organization")
+	if err != nil {
+		return nil, err
+	}
+	// Cached entries are kept after the keycard expires so that a fresh copy can be checked
+	// against them
+	cachedList, err := store.RemoteCards.GetRemoteEntries(domain, "organization", 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if owner != "" {
+		return parseRemoteChain(domain, "organization", cachedList)
+	}
+
+	rc, err := dialRemote(domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	entryList, _, err := rc.getEntries(ClientRequest{"ORGCARD",
+		map[string]string{"Start-Index": "1", "Domain": domain}}, "ORG")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseRemoteChain(domain, "organization", entryList)
+	if err != nil {
+		return nil, err
+	}
+
+	report := chainReport{Domain: domain, Problems: make([]chainProblem, 0)}
+	checkOrgEntries(&report, entries)
+	if !checkRemoteReport(report) {
+		return nil, ErrRemoteKeycard
+	}
+
+	// Organization keycards only ever grow, so a new copy must contain all of the entries which
+	// were cached before. Otherwise the remote server could swap out the organization's keys
+	// without anyone noticing.
+	if len(cachedList) > 0 {
+		cached, err := parseRemoteChain(domain, "organization", cachedList)
+		if err != nil {
+			return nil, err
+		}
+		if !checkChainExtension(domain, cached, entries) {
+			return nil, ErrRemoteKeycard
+		}
+	}
+
+	err = store.RemoteCards.SetRemoteKeycard(domain, "organization", "", entryList, 0, "",
+		getCacheExpiration(entries[len(entries)-1]))
+	return entries, err
+}
+
+// getRemoteUserCard returns the workspace ID of the owner of a user keycard on another server,
+// fetching and caching the keycard if needed. The latest revocation of the keycard is also
+// returned.
+func getRemoteUserCard(store *dbhandler.Store, address string) (string, int, string, error) {
+	parts := strings.SplitN(address, "/", 2)
+	id, domain := parts[0], strings.ToLower(parts[1])
+
+	wid, revokedIndex, revocation, err := store.RemoteCards.GetRemoteKeycard(domain, id)
+	if err != nil || wid != "" {
+		return wid, revokedIndex, revocation, err
+	}
+
+	orgEntries, err := getRemoteOrgEntries(store, domain)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	rc, err := dialRemote(domain)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer rc.Close()
+
+	entryList, response, err := rc.getEntries(ClientRequest{"USERCARD",
+		map[string]string{"Owner": id + "/" + domain, "Start-Index": "1"}}, "USER")
+	if err != nil {
+		return "", 0, "", err
+	}
+	if response.Data["Revoked-Index"] != "" {
+		revokedIndex, err = strconv.Atoi(response.Data["Revoked-Index"])
+		if err != nil {
+			return "", 0, "", errors.New("bad Revoked-Index from remote server")
+		}
+		revocation = response.Data["Revocation"]
+	}
+
+	entries, err := parseRemoteChain(domain, id, entryList)
+	if err != nil {
+		return "", 0, "", err
+	}
+	current := entries[len(entries)-1]
+	wid = current.Fields["Workspace-ID"]
+
+	// The revoked index decides which entries start a new chain of trust, so it is only believed
+	// if the organization vouches for it
+	if revokedIndex > 0 && !checkRevocation(domain, wid, revokedIndex, revocation, orgEntries) {
+		return "", 0, "", ErrRemoteKeycard
+	}
+
+	// Only the latest revocation is sent by the remote server. Any entries at or before it which
+	// don't have a Custody signature start a new chain of trust after an earlier revocation.
+	revoked := map[int]bool{revokedIndex: true}
+	for _, entry := range entries {
+		index, _ := strconv.Atoi(entry.Fields["Index"])
+		if index > 1 && index <= revokedIndex && entry.Signatures["Custody"] == "" {
+			revoked[index-1] = true
+		}
+	}
+
+	report := chainReport{Domain: domain, Problems: make([]chainProblem, 0)}
+	checkUserEntries(&report, wid, entries, revoked, orgEntries)
+	if !checkRemoteReport(report) {
+		return "", 0, "", ErrRemoteKeycard
+	}
+
+	err = store.RemoteCards.SetRemoteKeycard(domain, wid, current.Fields["User-ID"], entryList,
+		revokedIndex, revocation, getCacheExpiration(current))
+	return wid, revokedIndex, revocation, err
+}
+
+// parseRemoteChain converts the entries of a keycard from another server into Entry objects
+func parseRemoteChain(domain string, owner string, entryList []string) ([]*keycard.Entry, error) {
+	if len(entryList) == 0 {
+		return nil, fmt.Errorf("no entries for %s/%s from remote server", owner, domain)
+	}
+	report := chainReport{Domain: domain, Problems: make([]chainProblem, 0)}
+	entries := parseChain(&report, owner, entryList)
+	if !checkRemoteReport(report) {
+		return nil, ErrRemoteKeycard
+	}
+	return entries, nil
+}
+
+// checkChainExtension returns true if a newly fetched keycard starts with the same entries as the
+// previously cached copy
+func checkChainExtension(domain string, cached []*keycard.Entry, entries []*keycard.Entry) bool {
+	if len(entries) < len(cached) {
+		logging.Writef("Remote keycard for %s is shorter than the cached copy", domain)
+		return false
+	}
+	for i, entry := range cached {
+		if entries[i].Hash != entry.Hash {
+			logging.Writef("Remote keycard for %s doesn't match the cached copy at index %d",
+				domain, i+1)
+			return false
+		}
+	}
+	return true
+}
+
+// checkRevocation verifies the revocation record sent with a keycard from another server. The
+// record must revoke the specified entry of the workspace's keycard and carry a valid signature
+// from the organization key current when it was made.
+func checkRevocation(domain string, wid string, revokedIndex int, record string,
+	orgEntries []*keycard.Entry) bool {
+	sigStart := strings.Index(record, "Organization-Signature:")
+	if sigStart < 0 {
+		logging.Writef("Revocation for %s/%s from remote server isn't signed", wid, domain)
+		return false
+	}
+	body := record[:sigStart]
+	var signature cryptostring.CryptoString
+	if signature.Set(strings.TrimSpace(strings.TrimPrefix(record[sigStart:],
+		"Organization-Signature:"))) != nil {
+		logging.Writef("Bad signature in revocation for %s/%s from remote server", wid, domain)
+		return false
+	}
+
+	fields := make(map[string]string)
+	for _, line := range strings.Split(body, "\r\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	if fields["Type"] != "Revocation" || fields["Workspace-ID"] != wid ||
+		!strings.EqualFold(fields["Domain"], domain) ||
+		fields["Index"] != strconv.Itoa(revokedIndex) {
+		logging.Writef("Revocation for %s/%s from remote server doesn't match the keycard", wid,
+			domain)
+		return false
+	}
+
+	for _, orgEntry := range orgEntriesAt(orgEntries, fields["Timestamp"]) {
+		var pvk cryptostring.CryptoString
+		if pvk.Set(orgEntry.Fields["Primary-Verification-Key"]) != nil {
+			continue
+		}
+		if ok, _ := ezcrypt.NewVerificationKey(pvk).Verify([]byte(body), signature); ok {
+			return true
+		}
+	}
+	logging.Writef("Revocation for %s/%s from remote server failed to verify", wid, domain)
+	return false
+}
+
+// checkRemoteReport logs any problems found in a remote keycard and returns true if there were
+// none
+func checkRemoteReport(report chainReport) bool {
+	for _, problem := range report.Problems {
+		logging.Writef("Remote keycard for %s failed verification: %s", report.Domain,
+			problem.String())
+	}
+	return len(report.Problems) == 0
+}
+
+// getCacheExpiration returns the time a keycard can be cached until based on the Time-To-Live
+// field of its current entry
+func getCacheExpiration(current *keycard.Entry) string {
+	ttl, err := strconv.Atoi(current.Fields["Time-To-Live"])
+	if err != nil || ttl < 1 {
+		ttl = 1
+	}
+	return time.Now().UTC().AddDate(0, 0, ttl).Format(time.RFC3339)
+}
+
+// checkRemoteLookup makes sure that a session is allowed to look up keycards on another server.
+// Remote lookups make the server contact other servers on the client's behalf, so they are only
+// available to logged-in clients, and clients whose lookups keep failing are locked out for a
+// while. If the lookup isn't allowed, the appropriate response is sent to the client and false is
+// returned.
+func checkRemoteLookup(session *sessionState, domain string) bool {
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for remote lookups")
+		return false
+	}
+	if dbhandler.GetMensagoAddressType("x/"+domain) == 0 {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad domain")
+		return false
+	}
+
+	lockout, err := isLocked(session, "remotelookup", session.WID)
+	return !lockout && err == nil
+}
+
+// sendRemoteError sends the client the response for a failed remote keycard lookup. Successful
+// lookups are cached, so failures are what make the server contact other servers over and over,
+// and they count toward a lockout in the same way as failed logins.
+func sendRemoteError(session *sessionState, domain string, err error) {
+	logging.Writef("Remote keycard lookup for %s failed: %s", domain, err.Error())
+	terminate, logErr := logFailure(session, "remotelookup", session.WID)
+	if terminate || logErr != nil {
+		return
+	}
+	if err == ErrRemoteKeycard {
+		session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA",
+			"Remote keycard failed verification")
+		return
+	}
+	session.SendStringResponse(404, "NOT FOUND", "Unable to get keycard from remote server")
+}
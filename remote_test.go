@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/darkwyrm/b85"
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/spf13/viper"
+)
+
+// newRevocation returns a revocation record signed with the given primary signing key
+func newRevocation(wid string, domain string, index string, timestamp string,
+	psk ed25519.PrivateKey) string {
+	record := strings.Join([]string{
+		"Type:Revocation",
+		"Workspace-ID:" + wid,
+		"Domain:" + domain,
+		"Index:" + index,
+		"Timestamp:" + timestamp,
+		"",
+	}, "\r\n")
+	rawSignature := ed25519.Sign(psk, []byte(record))
+	return record + "Organization-Signature:ED25519:" + b85.Encode(rawSignature) + "\r\n"
+}
+
+func TestCheckRevocation(t *testing.T) {
+	config.SetupConfig()
+	wid := "11111111-1111-1111-1111-111111111111"
+	orgKeys, err := keycard.GenerateOrgKeys(false)
+	if err != nil {
+		t.Fatalf("TestCheckRevocation: Couldn't generate org keys: %s", err.Error())
+	}
+	pvk := orgKeys["Primary-Verification-Key.public"]
+	psk := orgKeys["Primary-Verification-Key.private"]
+	orgEntry := keycard.NewOrgEntry()
+	orgEntry.Fields["Primary-Verification-Key"] = pvk.AsString()
+	orgEntries := []*keycard.Entry{orgEntry}
+	pskBytes := ed25519.NewKeyFromSeed(psk.RawData())
+	timestamp := orgEntry.Fields["Timestamp"]
+
+	// Subtest #1: A record signed by the organization for the revoked entry is accepted
+
+	record := newRevocation(wid, "example.net", "2", timestamp, pskBytes)
+	if !checkRevocation("example.net", wid, 2, record, orgEntries) {
+		t.Fatal("TestCheckRevocation: #1: valid revocation rejected")
+	}
+
+	// Subtest #2: The record must be for the revoked index and workspace
+
+	if checkRevocation("example.net", wid, 3, record, orgEntries) {
+		t.Fatal("TestCheckRevocation: #2: revocation accepted for the wrong index")
+	}
+	if checkRevocation("example.net", "22222222-2222-2222-2222-222222222222", 2, record,
+		orgEntries) {
+		t.Fatal("TestCheckRevocation: #2: revocation accepted for the wrong workspace")
+	}
+
+	// Subtest #3: Records which are unsigned, altered, or signed with another key are rejected
+
+	unsigned := record[:strings.Index(record, "Organization-Signature:")]
+	if checkRevocation("example.net", wid, 2, unsigned, orgEntries) {
+		t.Fatal("TestCheckRevocation: #3: unsigned revocation accepted")
+	}
+
+	altered := strings.Replace(record, "Index:2", "Index:3", 1)
+	if checkRevocation("example.net", wid, 3, altered, orgEntries) {
+		t.Fatal("TestCheckRevocation: #3: altered revocation accepted")
+	}
+
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("TestCheckRevocation: Couldn't generate signing key: %s", err.Error())
+	}
+	forged := newRevocation(wid, "example.net", "2", timestamp, otherKey)
+	if checkRevocation("example.net", wid, 2, forged, orgEntries) {
+		t.Fatal("TestCheckRevocation: #3: revocation signed by another key accepted")
+	}
+}
+
+func TestCheckChainExtension(t *testing.T) {
+	config.SetupConfig()
+	cached := make([]*keycard.Entry, 2)
+	for i, hash := range []string{"BLAKE2B-256:aaaa", "BLAKE2B-256:bbbb"} {
+		cached[i] = keycard.NewOrgEntry()
+		cached[i].Hash = hash
+	}
+	added := keycard.NewOrgEntry()
+	added.Hash = "BLAKE2B-256:cccc"
+
+	// Subtest #1: The same chain or a longer one starting with the cached entries is accepted
+
+	if !checkChainExtension("example.net", cached, cached) {
+		t.Fatal("TestCheckChainExtension: #1: unchanged chain rejected")
+	}
+	if !checkChainExtension("example.net", cached, append(cached[:2:2], added)) {
+		t.Fatal("TestCheckChainExtension: #1: extended chain rejected")
+	}
+
+	// Subtest #2: Chains which are shorter or replace cached entries are rejected
+
+	if checkChainExtension("example.net", cached, cached[:1]) {
+		t.Fatal("TestCheckChainExtension: #2: shorter chain accepted")
+	}
+	if checkChainExtension("example.net", cached, []*keycard.Entry{cached[0], added}) {
+		t.Fatal("TestCheckChainExtension: #2: replaced chain accepted")
+	}
+}
+
+func TestRemoteLookupLockout(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	// Lookups for example.net go to a port nobody is listening on, so every one of them fails
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestRemoteLookupLockout: Couldn't listen: %s", err.Error())
+	}
+	viper.Set("resolver.servers", map[string]string{"example.net": closed.Addr().String()})
+	defer viper.Set("resolver.servers", map[string]string{})
+	closed.Close()
+
+	// Failures are logged by IP address, so the session needs a real network connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestRemoteLookupLockout: Couldn't listen: %s", err.Error())
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("TestRemoteLookupLockout: Couldn't connect: %s", err.Error())
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("TestRemoteLookupLockout: Couldn't accept connection: %s", err.Error())
+	}
+	defer server.Close()
+
+	state := sessionState{
+		Connection: server,
+		LoginState: loginClientSession,
+		WID:        "11111111-1111-1111-1111-111111111111",
+		Store:      store,
+	}
+	decoder := json.NewDecoder(client)
+	lookup := func() ServerResponse {
+		state.Message = ClientRequest{"USERCARD", map[string]string{
+			"Owner":       "csimons/example.net",
+			"Start-Index": "1",
+		}}
+		done := make(chan bool)
+		go func() {
+			processCommand(&state)
+			done <- true
+		}()
+
+		var response ServerResponse
+		err := decoder.Decode(&response)
+		if err != nil {
+			t.Fatalf("TestRemoteLookupLockout: bad response: %s", err.Error())
+		}
+		<-done
+		return response
+	}
+
+	// Subtest #1: Failed lookups are reported until the failure limit is reached
+
+	maxFailures := viper.GetInt("security.max_failures")
+	for i := 1; i < maxFailures; i++ {
+		if response := lookup(); response.Code != 404 {
+			t.Fatalf("TestRemoteLookupLockout: #1: wrong response for lookup %d: %d", i,
+				response.Code)
+		}
+	}
+
+	// Subtest #2: Reaching the limit ends the session and later lookups are refused
+
+	if response := lookup(); response.Code != 405 || response.Data["Lock-Time"] == "" {
+		t.Fatalf("TestRemoteLookupLockout: #2: client not locked out: %d", response.Code)
+	}
+	if response := lookup(); response.Code != 407 {
+		t.Fatalf("TestRemoteLookupLockout: #2: locked out client allowed lookup: %d",
+			response.Code)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/logging"
+)
+
+// Administrative roles which can be granted to workspaces so that server management tasks can be
+// delegated without sharing the admin workspace. The admin workspace implicitly holds all of them.
+const (
+	roleQuotaManager = "quota-manager"
+	roleRegistrar    = "registrar"
+	roleSupport      = "support"
+	roleAuditor      = "auditor"
+)
+
+// validateRoleName returns whether or not a string is the name of an administrative role
+func validateRoleName(role string) bool {
+	switch role {
+	case roleQuotaManager, roleRegistrar, roleSupport, roleAuditor:
+		return true
+	}
+	return false
+}
+
+// getAdminWID returns the workspace ID of the admin account for a hosted domain
+func getAdminWID(session *sessionState, domain string) (string, error) {
+	return session.Store.Workspaces.ResolveAddress("admin/" + domain)
+}
+
+// isAdmin returns true if the session is logged into the admin workspace for its domain
+func isAdmin(session *sessionState) (bool, error) {
+	if session.LoginState != loginClientSession {
+		return false, nil
+	}
+
+	adminWid, err := getAdminWID(session, getSessionDomain(session))
+	if err != nil {
+		return false, err
+	}
+	return session.WID == adminWid, nil
+}
+
+// hasRole returns true if the session's workspace holds at least one of the specified
+// administrative roles. If no roles are given, only the admin workspace is authorized.
+func hasRole(session *sessionState, roles ...string) (bool, error) {
+	admin, err := isAdmin(session)
+	if err != nil || admin {
+		return admin, err
+	}
+	if session.LoginState != loginClientSession {
+		return false, nil
+	}
+
+	for _, role := range roles {
+		granted, err := session.Store.Roles.HasRole(session.WID, role)
+		if err != nil || granted {
+			return granted, err
+		}
+	}
+	return false, nil
+}
+
+// checkRole is the authorization check for privileged commands. It returns true if the session's
+// workspace holds at least one of the specified roles. If not, the appropriate response is sent
+// to the client and false is returned. If no roles are given, only the admin workspace is
+// authorized.
+func checkRole(session *sessionState, roles ...string) bool {
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return false
+	}
+
+	authorized, err := hasRole(session, roles...)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("checkRole: error checking roles for %s: %s", session.WID, err)
+		return false
+	}
+	if !authorized {
+		session.SendStringResponse(403, "FORBIDDEN", "Insufficient privileges")
+		return false
+	}
+	return true
+}
+
+func commandAddRole(session *sessionState) {
+	// command syntax:
+	// ADDROLE(Workspace-ID, Role)
+
+	if session.Message.Validate([]string{"Workspace-ID", "Role"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if !checkRole(session) {
+		return
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Workspace-ID")
+		return
+	}
+
+	if !validateRoleName(session.Message.Data["Role"]) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Role")
+		return
+	}
+
+	if !checkSameDomain(session, wid) {
+		return
+	}
+
+	wtype, err := session.Store.Workspaces.GetWorkspaceType(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandAddRole: error getting workspace type: %s", err.Error())
+		return
+	}
+	switch wtype {
+	case "":
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	case "individual":
+		break
+	default:
+		session.SendStringResponse(400, "BAD REQUEST", "Roles can only be given to individuals")
+		return
+	}
+
+	err = session.Store.Roles.AddRole(wid, session.Message.Data["Role"])
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandAddRole: error adding role: %s", err.Error())
+		return
+	}
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandListRoles(session *sessionState) {
+	// command syntax:
+	// LISTROLES(Workspace-ID="")
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	wid := session.WID
+	if session.Message.HasField("Workspace-ID") && session.Message.Data["Workspace-ID"] != wid {
+		if !checkRole(session, roleAuditor) {
+			return
+		}
+
+		wid = session.Message.Data["Workspace-ID"]
+		if !dbhandler.ValidateUUID(wid) {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Workspace-ID")
+			return
+		}
+
+		if !checkSameDomain(session, wid) {
+			return
+		}
+	}
+
+	roles, err := session.Store.Roles.GetRoles(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandListRoles: error getting roles: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Roles"] = roles.Join(",")
+	session.SendResponse(*response)
+}
+
+func commandRemoveRole(session *sessionState) {
+	// command syntax:
+	// REMOVEROLE(Workspace-ID, Role)
+
+	if session.Message.Validate([]string{"Workspace-ID", "Role"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if !checkRole(session) {
+		return
+	}
+
+	if !dbhandler.ValidateUUID(session.Message.Data["Workspace-ID"]) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Workspace-ID")
+		return
+	}
+
+	if !validateRoleName(session.Message.Data["Role"]) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Role")
+		return
+	}
+
+	if !checkSameDomain(session, session.Message.Data["Workspace-ID"]) {
+		return
+	}
+
+	err := session.Store.Roles.RemoveRole(session.Message.Data["Workspace-ID"],
+		session.Message.Data["Role"])
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRemoveRole: error removing role: %s", err.Error())
+		return
+	}
+	session.SendStringResponse(200, "OK", "")
+}
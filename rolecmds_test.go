@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/darkwyrm/mensagod/dbhandler"
+)
+
+func TestCommandRoles(t *testing.T) {
+	store := dbhandler.NewMemoryStore()
+
+	adminWid := "ae406c5e-2673-4d3e-af20-91325d9623ca"
+	userWid := "11111111-1111-1111-1111-111111111111"
+	otherWid := "22222222-2222-2222-2222-222222222222"
+	for _, ws := range [][]string{
+		{adminWid, "admin"},
+		{userWid, "csimons"},
+		{otherWid, "rbrannan"},
+	} {
+		err := store.Workspaces.AddWorkspace(ws[0], ws[1], "example.com", "-", "active",
+			"individual")
+		if err != nil {
+			t.Fatalf("TestCommandRoles: Couldn't add workspace: %s", err.Error())
+		}
+	}
+
+	var admin sessionState
+	admin.WID = adminWid
+	admin.Domain = "example.com"
+	admin.LoginState = loginClientSession
+
+	var user sessionState
+	user.WID = userWid
+	user.Domain = "example.com"
+	user.LoginState = loginClientSession
+
+	// Subtest #1: Only the admin can grant roles
+
+	response, _ := runCommand(t, store, user, "ADDROLE", map[string]string{
+		"Workspace-ID": userWid,
+		"Role":         roleAuditor,
+	})
+	if response.Code != 403 {
+		t.Fatalf("TestCommandRoles: #1: user granted a role: %d", response.Code)
+	}
+
+	response, _ = runCommand(t, store, admin, "ADDROLE", map[string]string{
+		"Workspace-ID": userWid,
+		"Role":         roleAuditor,
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandRoles: #1: admin couldn't grant role: %d %s", response.Code,
+			response.Info)
+	}
+
+	// Subtest #2: The role lets its holder list the roles of other workspaces
+
+	response, _ = runCommand(t, store, user, "LISTROLES", map[string]string{
+		"Workspace-ID": otherWid,
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandRoles: #2: auditor couldn't list roles: %d %s", response.Code,
+			response.Info)
+	}
+
+	response, _ = runCommand(t, store, user, "LISTROLES", map[string]string{})
+	if response.Code != 200 || response.Data["Roles"] != roleAuditor {
+		t.Fatalf("TestCommandRoles: #2: wrong roles: %d %s", response.Code,
+			response.Data["Roles"])
+	}
+
+	// Subtest #3: Once the role is removed, the user can no longer use it
+
+	response, _ = runCommand(t, store, admin, "REMOVEROLE", map[string]string{
+		"Workspace-ID": userWid,
+		"Role":         roleAuditor,
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandRoles: #3: admin couldn't remove role: %d %s", response.Code,
+			response.Info)
+	}
+
+	response, _ = runCommand(t, store, user, "LISTROLES", map[string]string{
+		"Workspace-ID": otherWid,
+	})
+	if response.Code != 403 {
+		t.Fatalf("TestCommandRoles: #3: removed role still honored: %d", response.Code)
+	}
+}
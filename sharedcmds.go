@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/fshandler"
+	"github.com/darkwyrm/mensagod/logging"
+)
+
+func commandAddMember(session *sessionState) {
+	// command syntax:
+	// ADDMEMBER(Workspace-ID, Member, Role)
+
+	if session.Message.Validate([]string{"Workspace-ID", "Member", "Role"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !checkSharedWorkspace(session, wid) {
+		return
+	}
+
+	role := strings.ToLower(session.Message.Data["Role"])
+	if !fshandler.ValidateRole(role) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Role")
+		return
+	}
+
+	member, ok := resolveMember(session, session.Message.Data["Member"])
+	if !ok {
+		return
+	}
+
+	isAdmin, err := isSharedAdmin(session, wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandAddMember: error checking admin status: %s", err.Error())
+		return
+	}
+	if !isAdmin {
+		session.SendStringResponse(403, "FORBIDDEN", "Only workspace administrators can do this")
+		return
+	}
+
+	// Demoting the last administrator would leave nobody to manage the workspace
+	if role != "admin" {
+		lastAdmin, err := isLastAdmin(session, wid, member)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandAddMember: error getting members: %s", err.Error())
+			return
+		}
+		if lastAdmin {
+			session.SendStringResponse(403, "FORBIDDEN", "Workspace must have an administrator")
+			return
+		}
+	}
+
+	err = session.Store.Members.AddMember(wid, member, role)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandAddMember: error adding member: %s", err.Error())
+		return
+	}
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandListMembers(session *sessionState) {
+	// command syntax:
+	// LISTMEMBERS(Workspace-ID)
+
+	if !session.Message.HasField("Workspace-ID") {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !checkSharedWorkspace(session, wid) {
+		return
+	}
+
+	members, err := session.Store.Members.GetMembers(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandListMembers: error getting members: %s", err.Error())
+		return
+	}
+
+	// Any member may see who else belongs to the workspace
+	if _, ok := members[session.WID]; !ok {
+		isAdmin, err := isSharedAdmin(session, wid)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandListMembers: error checking admin status: %s", err.Error())
+			return
+		}
+		if !isAdmin {
+			session.SendStringResponse(403, "FORBIDDEN", "")
+			return
+		}
+	}
+
+	memberList := make([]string, 0, len(members))
+	for member, role := range members {
+		memberList = append(memberList, fmt.Sprintf("%s:%s", member, role))
+	}
+	sort.Strings(memberList)
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Members"] = strings.Join(memberList, ",")
+	session.SendResponse(*response)
+}
+
+func commandRemoveMember(session *sessionState) {
+	// command syntax:
+	// REMOVEMEMBER(Workspace-ID, Member)
+
+	if session.Message.Validate([]string{"Workspace-ID", "Member"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !checkSharedWorkspace(session, wid) {
+		return
+	}
+
+	member, ok := resolveMember(session, session.Message.Data["Member"])
+	if !ok {
+		return
+	}
+
+	// Members are always allowed to leave a workspace
+	if member != session.WID {
+		isAdmin, err := isSharedAdmin(session, wid)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("commandRemoveMember: error checking admin status: %s", err.Error())
+			return
+		}
+		if !isAdmin {
+			session.SendStringResponse(403, "FORBIDDEN",
+				"Only workspace administrators can do this")
+			return
+		}
+	}
+
+	role, err := session.Store.Members.GetMemberRole(wid, member)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRemoveMember: error getting member role: %s", err.Error())
+		return
+	}
+	if role == "" {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	lastAdmin, err := isLastAdmin(session, wid, member)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRemoveMember: error getting members: %s", err.Error())
+		return
+	}
+	if lastAdmin {
+		session.SendStringResponse(403, "FORBIDDEN", "Workspace must have an administrator")
+		return
+	}
+
+	err = session.Store.Members.RemoveMember(wid, member)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandRemoveMember: error removing member: %s", err.Error())
+		return
+	}
+	session.SendStringResponse(200, "OK", "")
+}
+
+// registerSharedWorkspace handles REGISTER requests for shared workspaces. Unlike individual
+// workspaces, a shared workspace is created by a user who is already logged in, and that user
+// becomes the workspace's first administrator.
+func registerSharedWorkspace(session *sessionState) {
+	// command syntax:
+	// REGISTER(Workspace-ID, Type="shared", User-ID="")
+
+	if !session.Message.HasField("Workspace-ID") {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return
+	}
+
+	uid := ""
+	if session.Message.HasField("User-ID") {
+		uid = session.Message.Data["User-ID"]
+		if strings.ContainsAny(uid, "/\"") {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad User-ID")
+			return
+		}
+	}
+
+	domain := getSessionDomain(session)
+	dc, ok := getDomainConfig(session, domain)
+	if !ok {
+		return
+	}
+	regType := dc.Registration
+	if regType == "private" {
+		authorized, err := hasRole(session, roleRegistrar)
+		if err != nil {
+			session.SendDatabaseError(err)
+			logging.Writef("registerSharedWorkspace: Error checking roles: %s", err)
+			return
+		}
+		if !authorized {
+			session.SendStringResponse(304, "REGISTRATION CLOSED", "")
+			return
+		}
+	}
+
+	success, _ := session.Store.Workspaces.CheckWorkspace(wid)
+	if success {
+		response := NewServerResponse(408, "RESOURCE EXISTS")
+		response.Data["Field"] = "Workspace-ID"
+		session.SendResponse(*response)
+		return
+	}
+
+	if uid != "" {
+		success, _ = session.Store.Workspaces.CheckUserID(uid, domain)
+		if success {
+			response := NewServerResponse(408, "RESOURCE EXISTS")
+			response.Data["Field"] = "User-ID"
+			session.SendResponse(*response)
+			return
+		}
+	}
+
+	workspaceStatus := "active"
+	if regType == "moderated" {
+		workspaceStatus = "pending"
+	}
+
+	// The workspace, its first administrator, and its directory are created together so that a
+	// failure partway through doesn't leave a workspace which nobody can manage
+	reg := dbhandler.Registration{
+		WID:    wid,
+		UID:    uid,
+		Domain: domain,
+		Status: workspaceStatus,
+		Type:   "shared",
+		Admin:  session.WID,
+	}
+	err := session.Store.Accounts.RegisterWorkspace(reg, &fshandler.WorkspaceCreation{WID: wid})
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("registerSharedWorkspace: error registering workspace: %s", err.Error())
+		return
+	}
+
+	if regType == "moderated" {
+		session.SendStringResponse(101, "PENDING", "")
+	} else {
+		response := NewServerResponse(201, "REGISTERED")
+		response.Data["Domain"] = domain
+		session.SendResponse(*response)
+	}
+}
+
+// checkSharedWorkspace makes sure that the workspace ID passed to it refers to an existing shared
+// workspace. If it does not, the appropriate response is sent to the client and false is returned.
+func checkSharedWorkspace(session *sessionState, wid string) bool {
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return false
+	}
+
+	wtype, err := session.Store.Workspaces.GetWorkspaceType(wid)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("checkSharedWorkspace: error getting workspace type: %s", err.Error())
+		return false
+	}
+
+	switch wtype {
+	case "":
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return false
+	case "shared":
+		return true
+	}
+	session.SendStringResponse(400, "BAD REQUEST", "Not a shared workspace")
+	return false
+}
+
+// resolveMember converts the workspace ID or Mensago address of a prospective member of a shared
+// workspace into a workspace ID. Only individual workspaces may be members. If the member can't be
+// resolved, the appropriate response is sent to the client and false is returned.
+func resolveMember(session *sessionState, member string) (string, bool) {
+	if !dbhandler.ValidateUUID(member) {
+		if dbhandler.GetMensagoAddressType(member) == 0 {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Member")
+			return "", false
+		}
+
+		wid, err := session.Store.Workspaces.ResolveAddress(member)
+		if err != nil {
+			session.SendStringResponse(404, "NOT FOUND", "")
+			return "", false
+		}
+		member = wid
+	}
+
+	wtype, err := session.Store.Workspaces.GetWorkspaceType(member)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("resolveMember: error getting workspace type: %s", err.Error())
+		return "", false
+	}
+
+	switch wtype {
+	case "":
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return "", false
+	case "individual":
+		return member, true
+	}
+	session.SendStringResponse(400, "BAD REQUEST", "Member must be an individual workspace")
+	return "", false
+}
+
+// isSharedAdmin returns true if the session's workspace may manage the members of a shared
+// workspace, which is the case for members with the admin role and the administrator of the
+// workspace's domain.
+func isSharedAdmin(session *sessionState, wid string) (bool, error) {
+	role, err := session.Store.Members.GetMemberRole(wid, session.WID)
+	if err != nil {
+		return false, err
+	}
+	if role == "admin" {
+		return true, nil
+	}
+
+	// The administrator of one hosted domain has no say over another domain's workspaces
+	domain, err := session.Store.Workspaces.GetWorkspaceDomain(wid)
+	if err != nil {
+		return false, err
+	}
+	if domain != getSessionDomain(session) {
+		return false, nil
+	}
+
+	return isAdmin(session)
+}
+
+// isLastAdmin returns true if the specified member is the only administrator of a shared workspace
+func isLastAdmin(session *sessionState, wid string, member string) (bool, error) {
+	members, err := session.Store.Members.GetMembers(wid)
+	if err != nil {
+		return false, err
+	}
+
+	if members[member] != "admin" {
+		return false, nil
+	}
+	for wkspc, role := range members {
+		if wkspc != member && role == "admin" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/spf13/viper"
+)
+
+func TestCommandSharedWorkspace(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	domain := config.HostedDomains()[0]
+	userWid := "11111111-1111-1111-1111-111111111111"
+	memberWid := "22222222-2222-2222-2222-222222222222"
+	otherAdminWid := "33333333-3333-3333-3333-333333333333"
+	sharedWid := "44444444-4444-4444-4444-444444444444"
+	for _, ws := range [][]string{
+		{"ae406c5e-2673-4d3e-af20-91325d9623ca", "admin", domain},
+		{userWid, "csimons", domain},
+		{memberWid, "rbrannan", domain},
+		{otherAdminWid, "admin", "example.org"},
+	} {
+		err := store.Workspaces.AddWorkspace(ws[0], ws[1], ws[2], "-", "active", "individual")
+		if err != nil {
+			t.Fatalf("TestCommandSharedWorkspace: Couldn't add workspace: %s", err.Error())
+		}
+	}
+
+	// Servers using private registration only let registrars create shared workspaces
+	err := store.Roles.AddRole(userWid, roleRegistrar)
+	if err != nil {
+		t.Fatalf("TestCommandSharedWorkspace: Couldn't add role: %s", err.Error())
+	}
+	defer os.RemoveAll(filepath.Join(viper.GetString("global.workspace_dir"), sharedWid))
+
+	var user sessionState
+	user.WID = userWid
+	user.Domain = domain
+	user.LoginState = loginClientSession
+
+	// Subtest #1: The workspace is created along with its first administrator and its directory
+
+	response, _ := runCommand(t, store, user, "REGISTER", map[string]string{
+		"Workspace-ID": sharedWid,
+		"Type":         "shared",
+	})
+	if response.Code != 201 && response.Code != 101 {
+		t.Fatalf("TestCommandSharedWorkspace: #1: registration failed: %d %s", response.Code,
+			response.Info)
+	}
+
+	role, _ := store.Members.GetMemberRole(sharedWid, userWid)
+	if role != "admin" {
+		t.Fatalf("TestCommandSharedWorkspace: #1: creator isn't an administrator: %s", role)
+	}
+	_, err = os.Stat(filepath.Join(viper.GetString("global.workspace_dir"), sharedWid))
+	if err != nil {
+		t.Fatalf("TestCommandSharedWorkspace: #1: workspace directory missing: %s", err.Error())
+	}
+
+	// Subtest #2: The administrator of another hosted domain can't manage the workspace
+
+	var otherAdmin sessionState
+	otherAdmin.WID = otherAdminWid
+	otherAdmin.Domain = "example.org"
+	otherAdmin.LoginState = loginClientSession
+	response, _ = runCommand(t, store, otherAdmin, "ADDMEMBER", map[string]string{
+		"Workspace-ID": sharedWid,
+		"Member":       otherAdminWid,
+		"Role":         "admin",
+	})
+	if response.Code != 403 {
+		t.Fatalf("TestCommandSharedWorkspace: #2: other domain's admin added a member: %d",
+			response.Code)
+	}
+
+	// Subtest #3: The workspace's administrator can add members
+
+	response, _ = runCommand(t, store, user, "ADDMEMBER", map[string]string{
+		"Workspace-ID": sharedWid,
+		"Member":       memberWid,
+		"Role":         "read",
+	})
+	if response.Code != 200 {
+		t.Fatalf("TestCommandSharedWorkspace: #3: admin couldn't add member: %d %s",
+			response.Code, response.Info)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/fshandler"
+	"github.com/darkwyrm/mensagod/logging"
+)
+
+// taskInterval is how often the server performs its periodic maintenance tasks
+const taskInterval = time.Hour
+
+// runScheduledTasks performs server maintenance which isn't tied to any particular client
+// session. It is intended to be run in its own goroutine and does not return.
+func runScheduledTasks() {
+	for {
+		processUnregistrations(gStore)
+		processKeycardExpirations(gStore)
+		time.Sleep(taskInterval)
+	}
+}
+
+// processUnregistrations removes the workspaces belonging to approved unregistration requests
+// whose data export window has closed. Each request is deleted along with its workspace.
+func processUnregistrations(store *dbhandler.Store) {
+	widList, err := store.Unregs.GetExpiredUnregRequests()
+	if err != nil {
+		logging.Writef("processUnregistrations: error getting unregistration requests: %s",
+			err.Error())
+		return
+	}
+
+	for _, wid := range widList {
+		err = store.Accounts.UnregisterWorkspace(wid, &fshandler.WorkspaceRemoval{WID: wid})
+		if err != nil {
+			logging.Writef("processUnregistrations: error removing workspace %s: %s", wid,
+				err.Error())
+		}
+	}
+}
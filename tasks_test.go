@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+)
+
+func TestProcessUnregistrations(t *testing.T) {
+	config.SetupConfig()
+	store := dbhandler.NewMemoryStore()
+
+	expiredWid := "11111111-1111-1111-1111-111111111111"
+	pendingWid := "22222222-2222-2222-2222-222222222222"
+	for _, wid := range []string{expiredWid, pendingWid} {
+		err := store.Workspaces.AddWorkspace(wid, "", "example.com", "-", "active", "individual")
+		if err != nil {
+			t.Fatalf("TestProcessUnregistrations: Couldn't add workspace: %s", err.Error())
+		}
+		err = store.Unregs.AddUnregRequest(wid, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			t.Fatalf("TestProcessUnregistrations: Couldn't add request: %s", err.Error())
+		}
+	}
+	err := store.Unregs.ApproveUnregRequest(expiredWid,
+		time.Now().UTC().AddDate(0, 0, -1).Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("TestProcessUnregistrations: Couldn't approve request: %s", err.Error())
+	}
+
+	// Subtest #1: Approved requests whose export window has closed are carried out
+
+	processUnregistrations(store)
+
+	_, status := store.Workspaces.CheckWorkspace(expiredWid)
+	if status != "deleted" {
+		t.Fatalf("TestProcessUnregistrations: #1: workspace not removed: %s", status)
+	}
+	status, _, _, err = store.Unregs.GetUnregRequest(expiredWid)
+	if err != nil || status != "" {
+		t.Fatalf("TestProcessUnregistrations: #1: request not removed: %s", status)
+	}
+
+	// Subtest #2: Pending requests are left alone
+
+	_, status = store.Workspaces.CheckWorkspace(pendingWid)
+	if status != "active" {
+		t.Fatalf("TestProcessUnregistrations: #2: pending workspace removed: %s", status)
+	}
+	status, _, _, err = store.Unregs.GetUnregRequest(pendingWid)
+	if err != nil || status != "pending" {
+		t.Fatalf("TestProcessUnregistrations: #2: pending request changed: %s", status)
+	}
+}
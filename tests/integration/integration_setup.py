@@ -1,4 +1,5 @@
 from base64 import b85encode
+import hashlib
 import os.path
 import platform
 import re
@@ -64,12 +65,18 @@ import pymensago.serverconn as serverconn
 # Initial User Primary Encryption Key: nSRso=K(WF{P+4x5S*5?Da-rseY-^>S8VN#v+)IN
 # Initial User Primary Decryption Key: 4A!nTPZSVD#tm78d=-?1OIQ43{ipSpE;@il{lYkg
 
-def load_server_config_file() -> dict:
+def get_config_path(filename: str) -> str:
+	'''Returns the path of a file in the Mensago server configuration directory'''
+	if platform.system() == 'Windows':
+		return 'C:\\ProgramData\\mensagod\\' + filename
+	return '/etc/mensagod/' + filename
+
+
+def load_server_config_file(config_file_path='') -> dict:
 	'''Loads the Mensago server configuration from the config file'''
 	
-	config_file_path = '/etc/mensagod/serverconfig.toml'
-	if platform.system() == 'Windows':
-		config_file_path = 'C:\\ProgramData\\mensagod\\serverconfig.toml'
+	if not config_file_path:
+		config_file_path = get_config_path('serverconfig.toml')
 
 	if os.path.exists(config_file_path):
 		try:
@@ -117,7 +124,24 @@ def load_server_config_file() -> dict:
 def setup_test():
 	'''Resets the Postgres test database to be ready for an integration test'''
 	
-	serverconfig = load_server_config_file()
+	return reset_database(load_server_config_file())
+
+
+def setup_remote_test():
+	'''Resets the database of the second server instance used as a remote server by tests. The
+	instance is expected to host example.org on port 2002 and use the config file remoteconfig.toml
+	in the server configuration directory. The local server must list it in the servers setting of
+	its [resolver] section. None is returned if the remote instance has not been configured.'''
+
+	config_file_path = get_config_path('remoteconfig.toml')
+	if not os.path.exists(config_file_path):
+		return None
+	
+	return reset_database(load_server_config_file(config_file_path))
+
+
+def reset_database(serverconfig: dict):
+	'''Resets the database for a server configuration to an empty schema'''
 
 	# Reset the test database to defaults
 	try:
@@ -130,24 +154,51 @@ def setup_test():
 		print("Couldn't connect to database: %s" % e)
 		sys.exit(1)
 
-	schema_path = os.path.abspath(__file__ + '/../')
-	schema_path = os.path.join(schema_path, 'psql_schema.sql')
-
-	sqlcmds = ''
-	with open(schema_path, 'r') as f:
-		sqlcmds = f.read()
-	
+	# The tables are created by the server's own migrations so that the tests use the same schema
+	# as a server. Migrations which need more than SQL only change existing rows, so they have
+	# nothing to do on an empty database.
 	cur = conn.cursor()
-	cur.execute(sqlcmds)
+	cur.execute('''DO $$ DECLARE
+			r RECORD;
+		BEGIN
+			FOR r IN (SELECT tablename FROM pg_tables WHERE schemaname = current_schema()) LOOP
+				EXECUTE 'DROP TABLE IF EXISTS ' || quote_ident(r.tablename) || ' CASCADE';
+			END LOOP;
+		END $$;''')
+	cur.execute('''CREATE TABLE schema_version(version INTEGER PRIMARY KEY,
+		name VARCHAR(128) NOT NULL, applied VARCHAR(32) NOT NULL);''')
+
+	migration_dir = os.path.abspath(__file__ + '/../../../dbhandler/migrations/postgresql')
+	for filename in sorted(os.listdir(migration_dir)):
+		match = re.match(r'^([0-9]{4})_([a-z0-9_]+)\.sql$', filename)
+		if not match:
+			continue
+		
+		with open(os.path.join(migration_dir, filename), 'r') as f:
+			cur.execute(f.read())
+		cur.execute("INSERT INTO schema_version(version, name, applied) VALUES(%s, %s, %s);",
+			(int(match.group(1)), match.group(2),
+			time.strftime('%Y-%m-%dT%H:%M:%SZ', time.gmtime())))
+	
 	cur.close()
 	conn.commit()
 
 	return conn
 
 
-def init_server(dbconn) -> dict:
+def add_translog_entry(cur, seq: int, entry, domain='example.com'):
+	'''Adds an org entry inserted directly into the database to the keycard transparency log'''
+	hasher = hashlib.blake2b(digest_size=32)
+	hasher.update(b'\x00' + entry.make_bytestring(-1))
+	cur.execute("INSERT INTO translog(domain, seq, fingerprint, leafhash) "
+		"VALUES(%s,%s,%s,%s);",
+		(domain, seq, entry.hash, 'BLAKE2B-256:' + b85encode(hasher.digest()).decode()))
+
+
+def init_server(dbconn, domain='example.com') -> dict:
 	'''Adds basic data to the database as if setupconfig had been run. Returns data needed for 
-	tests, such as the keys'''
+	tests, such as the keys. A domain other than example.com is used for the database of a second
+	server instance in tests which need a remote server.'''
 	
 	# Start off by generating the org's root keycard entry and add to the database
 
@@ -159,7 +210,7 @@ def init_server(dbconn) -> dict:
 		'Name':'Example, Inc.',
 		'Contact-Admin':'c590b44c-798d-4055-8d72-725a7942f3f6/acme.com',
 		'Language':'en',
-		'Domain':'example.com',
+		'Domain':domain,
 		'Primary-Verification-Key':'ED25519:r#r*RiXIN-0n)BzP3bv`LA&t4LFEQNF0Q@$N~RF*',
 		'Encryption-Key':'CURVE25519:SNhj2K`hgBd8>G>lW$!pXiM7S-B!Fbd9jT2&{{Az'
 	})
@@ -188,20 +239,21 @@ def init_server(dbconn) -> dict:
 	assert not status.error(), f"OrgEntry wasn't compliant: {str(status)}"
 
 	card.entries.append(root_entry)
-	cur.execute("INSERT INTO keycards(owner,creationtime,index,entry,fingerprint) " \
-		"VALUES('organization',%s,%s,%s,%s);",
+	cur.execute("INSERT INTO keycards(owner,creationtime,index,entry,fingerprint,domain) " \
+		"VALUES('organization',%s,%s,%s,%s,%s);",
 		(root_entry.fields['Timestamp'],root_entry.fields['Index'],
-			root_entry.make_bytestring(-1).decode(), root_entry.hash))
+			root_entry.make_bytestring(-1).decode(), root_entry.hash, domain))
+	add_translog_entry(cur, 0, root_entry, domain)
 
-	cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint) "
-				"VALUES(%s,%s,%s,'encrypt',%s);",
+	cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint, domain) "
+				"VALUES(%s,%s,%s,'encrypt',%s,%s);",
 				(root_entry.fields['Timestamp'], initial_epubkey.as_string(),
-				initial_eprivkey.as_string(), initial_epubhash.as_string()))
+				initial_eprivkey.as_string(), initial_epubhash.as_string(), domain))
 
-	cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint) "
-				"VALUES(%s,%s,%s,'sign',%s);",
+	cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint, domain) "
+				"VALUES(%s,%s,%s,'sign',%s,%s);",
 				(root_entry.fields['Timestamp'], initial_ovkey.as_string(),
-				initial_oskey.as_string(), initial_ovhash.as_string()))
+				initial_oskey.as_string(), initial_ovhash.as_string(), domain))
 
 	cur.close()
 	dbconn.commit()	
@@ -226,46 +278,47 @@ def init_server(dbconn) -> dict:
 	status = card.verify()
 	assert not status.error(), f'keycard failed to verify: {status}'
 
-	cur.execute("INSERT INTO keycards(owner,creationtime,index,entry,fingerprint) " \
-		"VALUES('organization',%s,%s,%s,%s);",
+	cur.execute("INSERT INTO keycards(owner,creationtime,index,entry,fingerprint,domain) " \
+		"VALUES('organization',%s,%s,%s,%s,%s);",
 		(new_entry.fields['Timestamp'],new_entry.fields['Index'],
-			new_entry.make_bytestring(-1).decode(), new_entry.hash))
+			new_entry.make_bytestring(-1).decode(), new_entry.hash, domain))
+	add_translog_entry(cur, 1, new_entry, domain)
 
-	cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint) "
-				"VALUES(%s,%s,%s,'sign',%s);",
+	cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint, domain) "
+				"VALUES(%s,%s,%s,'sign',%s,%s);",
 				(new_entry.fields['Timestamp'], keys['sign.public'],
-				keys['sign.private'], keys['sign.pubhash']))
+				keys['sign.private'], keys['sign.pubhash'], domain))
 
-	cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint) "
-				"VALUES(%s,%s,%s,'encrypt',%s);",
+	cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint, domain) "
+				"VALUES(%s,%s,%s,'encrypt',%s,%s);",
 				(new_entry.fields['Timestamp'], keys['encrypt.public'],
-				keys['encrypt.private'], keys['encrypt.pubhash']))
+				keys['encrypt.private'], keys['encrypt.pubhash'], domain))
 	
 	if keys.has_value('altsign.public'):
-		cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint) "
-					"VALUES(%s,%s,%s,'altsign',%s);",
+		cur.execute("INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint, domain) "
+					"VALUES(%s,%s,%s,'altsign',%s,%s);",
 					(new_entry.fields['Timestamp'], keys['altsign.public'],
-					keys['altsign.private'], keys['altsign.pubhash']))
+					keys['altsign.private'], keys['altsign.pubhash'], domain))
 
 
 	# Prereg the admin account
 	admin_wid = 'ae406c5e-2673-4d3e-af20-91325d9623ca'
 	regcode = 'Undamaged Shining Amaretto Improve Scuttle Uptake'
 	cur.execute(f"INSERT INTO prereg(wid, uid, domain, regcode) VALUES('{admin_wid}', 'admin', "
-		f"'example.com', '{regcode}');")
+		f"'{domain}', '{regcode}');")
 	
 	# Set up abuse/support forwarding to admin
 	abuse_wid = 'f8cfdbdf-62fe-4275-b490-736f5fdc82e3'
 	cur.execute("INSERT INTO workspaces(wid, uid, domain, password, status, wtype) "
-		f"VALUES('{abuse_wid}', 'abuse', 'example.com', '-', 'active', 'alias');")
+		f"VALUES('{abuse_wid}', 'abuse', '{domain}', '-', 'active', 'alias');")
 	cur.execute(f"INSERT INTO aliases(wid, alias) VALUES('{abuse_wid}', "
-		f"'{'/'.join([admin_wid, 'example.com'])}');")
+		f"'{'/'.join([admin_wid, domain])}');")
 
 	support_wid = 'f0309ef1-a155-4655-836f-55173cc1bc3b'
 	cur.execute(f"INSERT INTO workspaces(wid, uid, domain, password, status, wtype) "
-		f"VALUES('{support_wid}', 'support', 'example.com', '-', 'active', 'alias');")
+		f"VALUES('{support_wid}', 'support', '{domain}', '-', 'active', 'alias');")
 	cur.execute(f"INSERT INTO aliases(wid, alias) VALUES('{support_wid}', "
-		f"'{'/'.join([admin_wid, 'example.com'])}');")
+		f"'{'/'.join([admin_wid, domain])}');")
 	
 	cur.close()
 	dbconn.commit()	
@@ -282,7 +335,7 @@ def init_server(dbconn) -> dict:
 		'second_org_entry' : new_entry,
 		'support_wid' : support_wid,
 		'abuse_wid' : abuse_wid,
-		'org_domain' : 'example.com'
+		'org_domain' : domain
 	}
 
 
@@ -400,11 +453,7 @@ def login_admin(config, conn):
 
 
 def keycard_admin(config, conn) -> dict:
-	'''Uploads a keycard entry for the admin account'''
-
-	conn = serverconn.ServerConnection()
-	status = conn.connect('localhost', 2001)
-	assert not status.error(), f"test_addentry(): failed to connect to server: {status.info()}"
+	'''Uploads a keycard entry for the admin account using a logged-in connection'''
 
 	crepair = EncryptionPair(
 		CryptoString(r'CURVE25519:mO?WWA-k2B2O|Z%fA`~s3^$iiN{5R->#jxO@cy6{'),
@@ -426,7 +475,7 @@ def keycard_admin(config, conn) -> dict:
 		'Name':'Administrator',
 		'Workspace-ID':config['admin_wid'],
 		'User-ID':'admin',
-		'Domain':'example.com',
+		'Domain':config['org_domain'],
 		'Contact-Request-Verification-Key':crspair.get_public_key(),
 		'Contact-Request-Encryption-Key':crepair.get_public_key(),
 		'Public-Encryption-Key':epair.get_public_key()
@@ -1,8 +1,13 @@
+from base64 import b85encode
+import hashlib
+import json
+
 from pymensago.cryptostring import CryptoString
 from pymensago.encryption import EncryptionPair
 import pymensago.keycard as keycard
 from pymensago.serverconn import ServerConnection
-from integration_setup import setup_test, init_server, regcode_admin, login_admin
+from integration_setup import setup_test, init_server, regcode_admin, login_admin, \
+	setup_remote_test, keycard_admin
 
 # Keys used in the various tests. 
 # THESE KEYS ARE STORED ON GITHUB! DO NOT USE THESE FOR ANYTHING EXCEPT UNIT TESTS!!
@@ -89,6 +94,42 @@ def test_orgcard():
 		dbdata['second_org_entry'].make_bytestring(-1).decode(), \
 		"test_orgcard: second entry didn't match"
 
+	# Subtest: entries in JSON format
+
+	conn.send_message({
+		'Action' : "ORGCARD",
+		'Data' : { 'Start-Index' : '1', 'Format' : 'json' }
+	})
+
+	response = conn.read_response(server_response)
+	assert response['Code'] == 104 and response['Data']['Format'] == 'json', \
+		'test_orgcard: server didn\'t accept JSON format'
+	data_size = int(response['Data']['Total-Size'])
+	conn.send_message({'Action':'TRANSFER'})
+
+	chunks = list()
+	data_read = 0
+	while data_read < data_size:
+		tempstr = conn.read()
+		data_read = data_read + len(tempstr)
+		chunks.append(tempstr)
+	assert data_read == data_size, 'test_orgcard: JSON size mismatch'
+
+	entries = json.loads(''.join(chunks))
+	assert len(entries) == 2, "test_orgcard: server did not send 2 JSON entries"
+	for i, name in enumerate(['root_org_entry', 'second_org_entry']):
+		assert entries[i]['Type'] == 'Organization' and \
+			entries[i]['Fields']['Index'] == dbdata[name].fields['Index'] and \
+			entries[i]['Hash'] == dbdata[name].hash, \
+			f"test_orgcard: JSON entry {i+1} didn't match"
+
+	conn.send_message({
+		'Action' : "ORGCARD",
+		'Data' : { 'Start-Index' : '1', 'Format' : 'xml' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 400, 'test_orgcard: server accepted bad format'
+
 	conn.send_message({'Action' : "QUIT"})
 
 
@@ -297,6 +338,47 @@ def test_addentry_usercard():
 		second_user_entry.make_bytestring(-1).decode(), \
 		"test_orgcard.usercard: entry didn't match"
 
+	# Batched retrieval only sends the entries newer than the ones the client already has
+
+	conn.send_message({
+		'Action' : "USERCARDS",
+		'Data' : { 
+			'Owners' : 'admin/example.com,nobody/example.com',
+			'Known-Indices' : '1,0'
+		}
+	})
+
+	response = conn.read_response(server_response)
+	assert response['Code'] == 104 and response['Data']['Item-Count'] == '1', \
+		'test_addentry.usercards: server returned wrong number of items'
+	assert response['Data']['Current-Indices'] == '2,0', \
+		'test_addentry.usercards: wrong current indices'
+	assert response['Data']['Time-To-Live'] == second_user_entry.fields['Time-To-Live'] + ',0', \
+		'test_addentry.usercards: wrong Time-To-Live values'
+	data_size = int(response['Data']['Total-Size'])
+	conn.send_message({'Action':'TRANSFER'})
+
+	tempstr = conn.read()
+	while len(tempstr) < data_size:
+		tempstr = tempstr + conn.read()
+	assert tempstr == '----- BEGIN USER ENTRY -----\r\n' + \
+		second_user_entry.make_bytestring(-1).decode() + '----- END USER ENTRY -----\r\n', \
+		"test_addentry.usercards: entry didn't match"
+
+	# Nothing is transferred if the client is up to date
+
+	conn.send_message({
+		'Action' : "USERCARDS",
+		'Data' : { 
+			'Owners' : 'admin/example.com',
+			'Known-Indices' : '2'
+		}
+	})
+
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Current-Indices'] == '2', \
+		'test_addentry.usercards: server sent entries to an up-to-date client'
+
 	conn.send_message({'Action' : "QUIT"})
 
 def test_iscurrent():
@@ -326,8 +408,451 @@ def test_iscurrent():
 	assert response['Code'] == 200 and response['Status'] == 'OK' and \
 		response['Data']['Is-Current'] == 'YES', 'test_iscurrent: org success check failed'
 
+def test_revoke():
+	'''Tests the REVOKE command and how revocations are reported by USERCARD and ISCURRENT'''
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# Subtest #1: Login required
+
+	conn.send_message({'Action' : "REVOKE", 'Data' : { 'Workspace-ID' : dbdata['admin_wid'] } })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 401, 'test_revoke: revocation allowed without login'
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+	
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	# Subtest #2: Workspaces without a keycard can't be revoked
+
+	conn.send_message({'Action' : "REVOKE", 'Data' : { 'Workspace-ID' : dbdata['admin_wid'] } })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 404, 'test_revoke: revoked a workspace without a keycard'
+
+	keycard_admin(dbdata, conn)
+
+	# Subtest #3: Before revocation, ISCURRENT reports the entry as current and not revoked
+
+	conn.send_message({
+		'Action' : "ISCURRENT",
+		'Data' : { 'Index' : '1', 'Workspace-ID' : dbdata['admin_wid'] }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Is-Current'] == 'YES' and \
+		response['Data']['Revoked'] == 'NO', 'test_revoke: unrevoked entry reported wrongly'
+
+	# Subtest #4: Successful revocation
+
+	conn.send_message({
+		'Action' : "REVOKE",
+		'Data' : { 'Workspace-ID' : dbdata['admin_wid'], 'Reason' : 'Key compromise' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200, f"test_revoke: revocation failed: {response}"
+	revocation = response['Data']['Revocation']
+	lines = revocation.split('\r\n')
+	assert 'Workspace-ID:' + dbdata['admin_wid'] in lines and 'Index:1' in lines and \
+		'Reason:Key compromise' in lines, 'test_revoke: bad revocation record'
+	assert [x for x in lines if x.startswith('Organization-Signature:ED25519:')], \
+		'test_revoke: revocation record missing organization signature'
+
+	# Subtest #5: A keycard can't be revoked twice at the same index
+
+	conn.send_message({'Action' : "REVOKE", 'Data' : { 'Workspace-ID' : dbdata['admin_wid'] } })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 408, 'test_revoke: keycard revoked twice'
+
+	# Subtest #6: ISCURRENT reports the revoked entry as revoked and no longer current
+
+	conn.send_message({
+		'Action' : "ISCURRENT",
+		'Data' : { 'Index' : '1', 'Workspace-ID' : dbdata['admin_wid'] }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Is-Current'] == 'NO' and \
+		response['Data']['Revoked'] == 'YES', 'test_revoke: revoked entry reported as current'
+
+	# Subtest #7: USERCARD sends the revoked index and the revocation record with the keycard
+
+	conn.send_message({
+		'Action' : "USERCARD",
+		'Data' : { 
+			'Owner' : 'admin/example.com',
+			'Start-Index' : '1'
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 104 and response['Status'] == 'TRANSFER', \
+		'test_revoke: failed to get user keycard'
+	assert response['Data']['Revoked-Index'] == '1', 'test_revoke: wrong Revoked-Index'
+	assert response['Data']['Revocation'] == revocation, 'test_revoke: wrong revocation record'
+	conn.send_message({'Action':'CANCEL'})
+
+	conn.send_message({'Action' : "QUIT"})
+
+def test_orgrotate():
+	'''Tests the ORGROTATE command'''
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# Subtest #1: Login required
+
+	conn.send_message({'Action' : "ORGROTATE", 'Data' : {} })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 401, 'test_orgrotate: rotation allowed without login'
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+	
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	# Subtest #2: Successful rotation
+
+	conn.send_message({'Action' : "ORGROTATE", 'Data' : { 'Rotate-Optional' : 'No' } })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Index'] == '3', \
+		'test_orgrotate: rotation failed'
+	new_hash = response['Data']['Hash']
+
+	# Subtest #3: The new entry is the head of the organization's chain
+
+	conn.send_message({
+		'Action' : "ISCURRENT",
+		'Data' : { 'Index' : '3' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Is-Current'] == 'YES', \
+		'test_orgrotate: new entry is not current'
+
+	conn.send_message({
+		'Action' : "ORGCARD",
+		'Data' : { 'Start-Index' : '0' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 104 and response['Data']['Item-Count'] == '1', \
+		'test_orgrotate: failed to get current org entry'
+	data_size = int(response['Data']['Total-Size'])
+	conn.send_message({'Action':'TRANSFER'})
+
+	tempstr = conn.read()
+	while len(tempstr) < data_size:
+		tempstr = tempstr + conn.read()
+	
+	lines = tempstr.split('\r\n')
+	assert 'Hash:' + new_hash in lines, 'test_orgrotate: hash mismatch in new entry'
+	assert 'Previous-Hash:' + dbdata['second_org_entry'].hash in lines, \
+		'test_orgrotate: new entry not chained to previous one'
+	assert [x for x in lines if x.startswith('Custody-Signature:')], \
+		'test_orgrotate: new entry missing custody signature'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_translog():
+	'''Tests the TREEHEAD, INCLUSIONPROOF, and CONSISTENCYPROOF commands'''
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# The two org entries added by init_server() are the only ones in the log
+	leaves = list()
+	for entry in [dbdata['root_org_entry'], dbdata['second_org_entry']]:
+		hasher = hashlib.blake2b(digest_size=32)
+		hasher.update(b'\x00' + entry.make_bytestring(-1))
+		leaves.append(hasher.digest())
+	hasher = hashlib.blake2b(digest_size=32)
+	hasher.update(b'\x01' + leaves[0] + leaves[1])
+	root = 'BLAKE2B-256:' + b85encode(hasher.digest()).decode()
+
+	# Subtest #1: Signed tree head
+
+	conn.send_message({'Action' : "TREEHEAD", 'Data' : {} })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Tree-Size'] == '2', \
+		'test_translog: failed to get tree head'
+	assert response['Data']['Root-Hash'] == root, 'test_translog: root hash mismatch'
+	assert response['Data']['Organization-Signature'], 'test_translog: tree head not signed'
+
+	# Subtest #2: Inclusion proof
+
+	conn.send_message({
+		'Action' : "INCLUSIONPROOF",
+		'Data' : { 'Hash' : dbdata['second_org_entry'].hash }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Leaf-Index'] == '1', \
+		'test_translog: failed to get inclusion proof'
+	assert response['Data']['Audit-Path'] == \
+		'BLAKE2B-256:' + b85encode(leaves[0]).decode(), 'test_translog: bad audit path'
+
+	# Subtest #3: Consistency proof
+
+	conn.send_message({
+		'Action' : "CONSISTENCYPROOF",
+		'Data' : { 'Old-Size' : '1' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['New-Size'] == '2', \
+		'test_translog: failed to get consistency proof'
+	assert response['Data']['Proof'] == 'BLAKE2B-256:' + b85encode(leaves[1]).decode(), \
+		'test_translog: bad consistency proof'
+
+	# Subtest #4: Tree larger than the log
+
+	conn.send_message({
+		'Action' : "CONSISTENCYPROOF",
+		'Data' : { 'Old-Size' : '1', 'New-Size' : '5' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 404, 'test_translog: proof returned for nonexistent tree'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_verifychains():
+	'''Tests the VERIFYCHAINS command'''
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# Subtest #1: Login required
+
+	conn.send_message({'Action' : "VERIFYCHAINS", 'Data' : {} })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 401, 'test_verifychains: verification allowed without login'
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+	
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	# Subtest #2: Untouched organization keycard passes
+
+	conn.send_message({'Action' : "VERIFYCHAINS", 'Data' : {} })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Problem-Count'] == '0', \
+		'test_verifychains: problems found in valid keycards'
+
+	# Subtest #3: Tampering is detected
+
+	cur = dbconn.cursor()
+	cur.execute("UPDATE keycards SET entry = replace(entry, 'Index:2', 'Index:4') " \
+		"WHERE owner = 'organization' AND index = 2")
+	dbconn.commit()
+
+	conn.send_message({'Action' : "VERIFYCHAINS", 'Data' : {} })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Data']['Problem-Count'] != '0', \
+		'test_verifychains: tampered keycard passed verification'
+	assert 'non-sequential index' in response['Data']['Problems'], \
+		'test_verifychains: index problem not reported'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_expiringcards():
+	'''Tests the EXPIRINGCARDS command'''
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# Subtest #1: Login required
+
+	conn.send_message({'Action' : "EXPIRINGCARDS", 'Data' : {} })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 401, 'test_expiringcards: report allowed without login'
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+	
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	# Subtest #2: New keycards aren't expiring
+
+	conn.send_message({'Action' : "EXPIRINGCARDS", 'Data' : { 'Days' : '0' } })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200, 'test_expiringcards: failed to get report'
+	assert response['Data']['Expiring-Count'] == '0' and response['Data']['Expired-Count'] == '0', \
+		'test_expiringcards: new keycards reported as expiring'
+
+	# Subtest #3: A long enough window includes the organization's keycard
+
+	conn.send_message({'Action' : "EXPIRINGCARDS", 'Data' : { 'Days' : '1095' } })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200, 'test_expiringcards: failed to get report'
+	assert 'organization,' in response['Data']['Expiring'], \
+		'test_expiringcards: organization keycard not reported'
+
+	# Subtest #4: Bad window
+
+	conn.send_message({'Action' : "EXPIRINGCARDS", 'Data' : { 'Days' : '-1' } })
+	response = conn.read_response(server_response)
+	assert response['Code'] == 400, 'test_expiringcards: bad Days accepted'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_remote_keycards():
+	'''Tests looking up keycards for another domain through USERCARD and ORGCARD'''
+	
+	# A second server instance hosting example.org acts as the remote server
+	remote_dbconn = setup_remote_test()
+	if remote_dbconn is None:
+		print('test_remote_keycards: remote server instance not configured. Skipping.')
+		return
+	remote_dbdata = init_server(remote_dbconn, 'example.org')
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	for data in [dbdata, remote_dbdata]:
+		data['pwhash'] = pwhash
+		data['devid'] = devid
+		data['devpair'] = devpair
+
+	# Give the remote admin a keycard to look up
+
+	remote_conn = ServerConnection()
+	assert remote_conn.connect('localhost', 2002), \
+		"Connection to server at localhost:2002 failed"
+	regcode_admin(remote_dbdata, remote_conn)
+	login_admin(remote_dbdata, remote_conn)
+	keycard_admin(remote_dbdata, remote_conn)
+	remote_conn.send_message({'Action' : "QUIT"})
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# Subtest #1: Remote lookups require login
+
+	conn.send_message({
+		'Action' : "ORGCARD",
+		'Data' : { 'Start-Index' : '1', 'Domain' : 'example.org' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 401, 'test_remote_keycards: remote lookup allowed without login'
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	# Subtest #2: Remote organization keycard
+
+	conn.send_message({
+		'Action' : "ORGCARD",
+		'Data' : { 'Start-Index' : '1', 'Domain' : 'example.org' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 104 and response['Data']['Item-Count'] == '2' and \
+		response['Data']['Domain'] == 'example.org', \
+		'test_remote_keycards: failed to get remote org card'
+	data_size = int(response['Data']['Total-Size'])
+	conn.send_message({'Action':'TRANSFER'})
+
+	tempstr = conn.read()
+	while len(tempstr) < data_size:
+		tempstr = tempstr + conn.read()
+	assert remote_dbdata['second_org_entry'].make_bytestring(-1).decode() in tempstr, \
+		'test_remote_keycards: remote org card mismatch'
+
+	# Subtest #3: Remote user keycard
+
+	conn.send_message({
+		'Action' : "USERCARD",
+		'Data' : { 'Owner' : 'admin/example.org', 'Start-Index' : '1' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 104 and response['Data']['Item-Count'] == '1' and \
+		response['Data']['Domain'] == 'example.org', \
+		'test_remote_keycards: failed to get remote user card'
+	data_size = int(response['Data']['Total-Size'])
+	conn.send_message({'Action':'TRANSFER'})
+
+	tempstr = conn.read()
+	while len(tempstr) < data_size:
+		tempstr = tempstr + conn.read()
+	assert 'Workspace-ID:' + remote_dbdata['admin_wid'] in tempstr, \
+		'test_remote_keycards: remote user card mismatch'
+
+	# Subtest #4: Verified keycards are cached
+
+	cur = dbconn.cursor()
+	cur.execute("SELECT COUNT(*) FROM remotecards WHERE domain='example.org'")
+	rows = cur.fetchall()
+	assert rows[0][0] == 2, 'test_remote_keycards: remote keycards not cached'
+
+	# Subtest #5: Nonexistent remote user
+
+	conn.send_message({
+		'Action' : "USERCARD",
+		'Data' : { 'Owner' : 'nobody/example.org', 'Start-Index' : '1' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 404, 'test_remote_keycards: got card for nonexistent remote user'
+
+	conn.send_message({'Action' : "QUIT"})
+
 
 if __name__ == '__main__':
 	test_orgcard()
 	test_addentry_usercard()
 	test_iscurrent()
+	test_orgrotate()
+	test_translog()
+	test_verifychains()
+	test_expiringcards()
+	test_remote_keycards()
@@ -1,7 +1,8 @@
 import datetime
 from pymensago.cryptostring import CryptoString
-from pymensago.encryption import EncryptionPair, Password
+from pymensago.encryption import EncryptionPair, Password, SigningPair
 from pymensago.serverconn import ServerConnection
+import pymensago.serverconn as serverconn
 from integration_setup import setup_test, init_user, init_server, regcode_admin, login_admin
 
 def test_devkey():
@@ -68,6 +69,125 @@ def test_devkey():
 	conn.send_message({'Action' : "QUIT"})
 
 
+def test_device_signing_key():
+	'''Tests switching a device to an ED25519 key and logging in with it'''
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	# Subtest #1: Unsupported device key type
+	conn.send_message({
+		'Action': 'DEVKEY',
+		'Data': {
+			'Device-ID': devid,
+			'Old-Key': devpair.get_public_key(),
+			'New-Key': 'XSALSA20:009C61O)~M2nh-c3=Iws5D^j+6crX17#SKH9337X'
+		}
+	})
+
+	response = conn.read_response(None)
+	assert response['Code'] == 309, 'test_device_signing_key(): server accepted a symmetric key'
+	assert 'ED25519' in response['Data']['Info'], \
+		'test_device_signing_key(): ED25519 missing from supported key types'
+
+	# Subtest #2: Replace the device's encryption key with a signing key
+	newdevpair = SigningPair(CryptoString(r'ED25519:E?_z~5@+tkQz!iXK?oV<Zx(ec;=27C8Pjm((kRc|'),
+		CryptoString(r'ED25519:u4#h6LEwM6Aa+f<++?lma4Iy63^}V$JOP~ejYkB;'))
+
+	conn.send_message({
+		'Action': 'DEVKEY',
+		'Data': {
+			'Device-ID': devid,
+			'Old-Key': devpair.get_public_key(),
+			'New-Key': newdevpair.get_public_key()
+		}
+	})
+
+	response = conn.read_response(None)
+	assert response['Code'] == 100 and response['Status'] == 'CONTINUE', \
+		"test_device_signing_key(): server failed to return new and old key challenge"
+	assert response['Data']['Challenge-Type'] == 'encrypt' and \
+		response['Data']['New-Challenge-Type'] == 'sign', \
+		"test_device_signing_key(): server returned the wrong challenge types"
+
+	status = devpair.decrypt(response['Data']['Challenge'])
+	assert not status.error(), 'test_device_signing_key(): failed to decrypt old key challenge'
+	oldresponse = status['data']
+
+	status = newdevpair.sign(response['Data']['New-Challenge'].encode())
+	assert not status.error(), 'test_device_signing_key(): failed to sign new key challenge'
+
+	conn.send_message({
+		'Action' : "DEVKEY",
+		'Data' : {
+			'Response': oldresponse,
+			'New-Response': status['signature']
+		}
+	})
+
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_device_signing_key(): failed to change to the signing key'
+
+	conn.send_message({'Action' : "QUIT"})
+
+	# Subtest #3: Log in using the signing key
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	status = serverconn.login(conn, dbdata['admin_wid'], CryptoString(dbdata['oekey']))
+	assert not status.error(), 'test_device_signing_key(): login phase failed'
+	status = serverconn.password(conn, dbdata['admin_wid'], pwhash)
+	assert not status.error(), 'test_device_signing_key(): password phase failed'
+
+	conn.send_message({
+		'Action' : "DEVICE",
+		'Data' : { 
+			'Device-ID' : devid,
+			'Device-Key' : newdevpair.get_public_key()
+		}
+	})
+
+	response = conn.read_response(None)
+	assert response['Code'] == 100 and response['Status'] == 'CONTINUE', \
+		'test_device_signing_key(): failed to auth device'
+	assert response['Data']['Challenge-Type'] == 'sign', \
+		'test_device_signing_key(): server returned the wrong challenge type'
+
+	status = newdevpair.sign(response['Data']['Challenge'].encode())
+	assert not status.error(), 'test_device_signing_key(): failed to sign device challenge'
+
+	conn.send_message({
+		'Action' : "DEVICE",
+		'Data' : { 
+			'Device-ID' : devid,
+			'Device-Key' : newdevpair.get_public_key(),
+			'Response' : status['signature']
+		}
+	})
+
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_device_signing_key(): signed challenge-response phase failed'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
 def test_login():
 	'''Performs a basic login intended to be successful'''
 	
@@ -96,6 +216,47 @@ def test_login():
 	conn.send_message({'Action' : "QUIT"})
 
 
+def test_passwordreport():
+	'''Tests the PASSWORDREPORT command'''
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	conn.send_message({
+		'Action': 'PASSWORDREPORT',
+		'Data': {}
+	})
+
+	# The admin's password was hashed with the current settings when it was set, so nothing is
+	# left on legacy settings
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_passwordreport(): failed to get password report'
+	assert response['Data']['Workspace-Count'] == '1', \
+		'test_passwordreport(): wrong workspace count'
+	assert response['Data']['Legacy-Count'] == '0', \
+		'test_passwordreport(): wrong legacy password count'
+	assert response['Data']['Unreadable-Count'] == '0', \
+		'test_passwordreport(): wrong unreadable password count'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
 def test_resetpassword():
 	'''Tests the RESETPASSWORD command'''
 	dbconn = setup_test()
@@ -243,5 +404,7 @@ if __name__ == '__main__':
 	# test_login()
 	# test_setpassword()
 	# test_devkey()
+	# test_device_signing_key()
+	# test_passwordreport()
 	test_resetpassword()
 
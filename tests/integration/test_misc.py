@@ -97,5 +97,34 @@ def test_set_status():
 		'test_set_status: failed to disable test user'
 
 
+def test_serverinfo():
+	'''Tests the SERVERINFO command'''
+
+	dbconn = setup_test()
+	init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	conn.send_message({
+		'Action': 'SERVERINFO',
+		'Data': {}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_serverinfo: failed to get server info'
+
+	for field in ['Hash-Algorithms', 'Signing-Algorithms', 'Encryption-Algorithms',
+		'Symmetric-Algorithms']:
+		assert field in response['Data'], f"test_serverinfo: server didn't return {field}"
+	assert 'BLAKE2B-256' in response['Data']['Hash-Algorithms'].split(','), \
+		'test_serverinfo: BLAKE2B-256 missing from hash algorithms'
+	assert response['Data']['Signing-Algorithms'] == 'ED25519', \
+		'test_serverinfo: wrong signing algorithms'
+	assert response['Data']['Encryption-Algorithms'] == 'CURVE25519', \
+		'test_serverinfo: wrong encryption algorithms'
+
+
 if __name__ == '__main__':
 	test_set_status()
+	test_serverinfo()
@@ -1,9 +1,11 @@
+import pytest
+
 from pymensago.encryption import EncryptionPair, SigningPair
 from pymensago.cryptostring import CryptoString
 import pymensago.keycard as keycard
 import pymensago.serverconn as serverconn
 from integration_setup import load_server_config_file, setup_test, init_server, regcode_admin, \
-	login_admin
+	login_admin, init_user
 
 server_response = {
 	'title' : 'Mensago Server Response',
@@ -275,6 +277,179 @@ def test_unregister():
 
 
 
+def test_unregister_pending():
+	'''Tests UNREGISTER and CANCELUNREGISTER on servers which require admin approval'''
+
+	# Self-service unregistration is queued only in private and moderated modes
+	serverconfig = load_server_config_file()
+	if serverconfig['global']['registration'] not in ['private', 'moderated']:
+		pytest.skip('server registration mode is not private or moderated')
+	
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = serverconn.ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+	
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Status'] == 'OK'
+
+	status = serverconn.login(conn, dbdata['user_wid'], CryptoString(dbdata['oekey']))
+	assert not status.error(), f"test_unregister_pending(): user login phase failed: {status.info()}"
+
+	status = serverconn.password(conn, dbdata['user_wid'], dbdata['user_password'].hashstring)
+	assert not status.error(), f"test_unregister_pending(): password phase failed: {status.info()}"
+
+	status = serverconn.device(conn, dbdata['user_devid'], dbdata['user_devpair'])
+	assert not status.error(), f"test_unregister_pending(): device phase failed: {status.info()}"
+
+	# Subtest #1: Cancel without a pending request
+	conn.send_message({'Action' : "CANCELUNREGISTER", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 404, \
+		"test_unregister_pending(): failed to handle canceling a nonexistent request"
+
+	# Subtest #2: Request is queued instead of the workspace being deleted
+	conn.send_message({
+		'Action' : "UNREGISTER",
+		'Data' : {
+			'Password-Hash' : dbdata['user_password'].hashstring
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 101 and response['Status'] == 'PENDING', \
+		f"test_unregister_pending(): request not queued: {response['Status']}"
+	assert 'Grace-Until' in response['Data'], \
+		"test_unregister_pending(): server didn't return the grace period"
+
+	cur = dbconn.cursor()
+	cur.execute('SELECT status FROM workspaces WHERE wid = %s ', (dbdata['user_wid'],))
+	row = cur.fetchone()
+	assert row and row[0] == 'active', \
+		"test_unregister_pending(): workspace was changed before approval"
+
+	# Subtest #3: Cancel the request during the grace period
+	conn.send_message({'Action' : "CANCELUNREGISTER", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		f"test_unregister_pending(): failed to cancel request: {response['Status']}"
+
+	cur.execute('SELECT wid FROM unregrequests WHERE wid = %s ', (dbdata['user_wid'],))
+	assert cur.fetchone() is None, "test_unregister_pending(): request not removed on cancel"
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_register_shared():
+	'''Tests registration of shared workspaces and the membership commands'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = serverconn.ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+	
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+	
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	sharedwid = '55555555-5555-5555-5555-555555555555'
+
+	# Subtest #1: Create the shared workspace
+	conn.send_message({
+		'Action' : "REGISTER",
+		'Data' : {
+			'Workspace-ID' : sharedwid,
+			'Type' : 'shared'
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] in [101, 201], "test_register_shared(): failed to create workspace"
+
+	# Subtest #2: Bad role
+	conn.send_message({
+		'Action' : "ADDMEMBER",
+		'Data' : {
+			'Workspace-ID' : sharedwid,
+			'Member' : dbdata['user_wid'],
+			'Role' : 'owner'
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 400, "test_register_shared(): failed to handle bad role"
+
+	# Subtest #3: Add a member by address
+	conn.send_message({
+		'Action' : "ADDMEMBER",
+		'Data' : {
+			'Workspace-ID' : sharedwid,
+			'Member' : 'csimons/example.net',
+			'Role' : 'read'
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200, "test_register_shared(): failed to add member"
+
+	conn.send_message({
+		'Action' : "LISTMEMBERS",
+		'Data' : {
+			'Workspace-ID' : sharedwid
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200, "test_register_shared(): failed to list members"
+	members = response['Data']['Members'].split(',')
+	assert f"{dbdata['admin_wid']}:admin" in members and \
+		f"{dbdata['user_wid']}:read" in members, "test_register_shared(): member list mismatch"
+
+	# Subtest #4: The last administrator can't leave
+	conn.send_message({
+		'Action' : "REMOVEMEMBER",
+		'Data' : {
+			'Workspace-ID' : sharedwid,
+			'Member' : dbdata['admin_wid']
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 403, "test_register_shared(): removed the last administrator"
+
+	# Subtest #5: Remove a member
+	conn.send_message({
+		'Action' : "REMOVEMEMBER",
+		'Data' : {
+			'Workspace-ID' : sharedwid,
+			'Member' : dbdata['user_wid']
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200, "test_register_shared(): failed to remove member"
+
+
 def test_overflow():
 	'''Tests the server's command handling for commands greater than 8K'''
 
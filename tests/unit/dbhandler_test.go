@@ -1,9 +1,13 @@
 package mensagod
 
 import (
+	"database/sql"
 	"testing"
 
+	"github.com/darkwyrm/mensagod/cryptostring"
 	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/everlastingbeta/diceware"
+	"github.com/everlastingbeta/diceware/wordlist"
 )
 
 func TestValidateUUID(t *testing.T) {
@@ -49,3 +53,81 @@ func TestGetMensagoAddressType(t *testing.T) {
 			"invalid characters")
 	}
 }
+
+func TestMemoryStore(t *testing.T) {
+	store := dbhandler.NewMemoryStore()
+	wid := "11111111-1111-1111-1111-111111111111"
+
+	// Workspaces and passwords
+
+	err := store.Workspaces.AddWorkspace(wid, "csimons", "example.com", "password", "active",
+		"individual")
+	if err != nil {
+		t.Fatalf("MemoryStore.AddWorkspace() failed: %s", err.Error())
+	}
+	exists, status := store.Workspaces.CheckUserID("csimons", "example.com")
+	if !exists || status != "active" {
+		t.Fatal("MemoryStore.CheckUserID() didn't find the workspace")
+	}
+	match, err := store.Workspaces.CheckPassword(wid, "password")
+	if err != nil || !match {
+		t.Fatal("MemoryStore.CheckPassword() failed a good password")
+	}
+	match, _ = store.Workspaces.CheckPassword(wid, "wrong")
+	if match {
+		t.Fatal("MemoryStore.CheckPassword() passed a bad password")
+	}
+	if store.Workspaces.SetWorkspaceStatus(wid, "awaiting") == nil {
+		t.Fatal("MemoryStore.SetWorkspaceStatus() allowed an internal status")
+	}
+
+	// Preregistration
+
+	prewid := "22222222-2222-2222-2222-222222222222"
+	var wordList diceware.Wordlist = wordlist.EFFShortPrefix
+	regcode, err := store.Prereg.PreregWorkspace(prewid, "rbrannan", "example.com", &wordList, 6)
+	if err != nil {
+		t.Fatalf("MemoryStore.PreregWorkspace() failed: %s", err.Error())
+	}
+	_, status = store.Workspaces.CheckWorkspace(prewid)
+	if status != "approved" {
+		t.Fatal("MemoryStore.CheckWorkspace() didn't find the preregistered workspace")
+	}
+	foundWid, _, err := store.Prereg.CheckRegCode("rbrannan", "example.com", false, regcode)
+	if err != nil || foundWid != prewid {
+		t.Fatal("MemoryStore.CheckRegCode() failed a good registration code")
+	}
+	store.Prereg.DeleteRegCode(prewid, "example.com", true, regcode)
+	if exists, _ = store.Workspaces.CheckWorkspace(prewid); exists {
+		t.Fatal("MemoryStore.DeleteRegCode() didn't remove the preregistration")
+	}
+
+	// Devices
+
+	devid := "33333333-3333-3333-3333-333333333333"
+	devkey := cryptostring.New("CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z")
+	store.Devices.AddDevice(wid, devid, devkey, "active")
+	match, _ = store.Devices.CheckDevice(wid, devid, devkey.AsString())
+	if !match {
+		t.Fatal("MemoryStore.CheckDevice() didn't find the device")
+	}
+
+	// Keycards
+
+	_, err = store.Keycards.GetUserEntries(wid, 0, 0)
+	if err != sql.ErrNoRows {
+		t.Fatal("MemoryStore.GetUserEntries() didn't return sql.ErrNoRows for a missing keycard")
+	}
+
+	// Quotas
+
+	store.Quotas.SetQuota(wid, 1000)
+	usage, err := store.Quotas.ModifyQuotaUsage(wid, 600)
+	if err != nil || usage != 600 {
+		t.Fatal("MemoryStore.ModifyQuotaUsage() didn't add usage")
+	}
+	usage, quota, _ := store.Quotas.GetQuotaInfo(wid)
+	if usage != 600 || quota != 1000 {
+		t.Fatalf("MemoryStore.GetQuotaInfo() returned %d/%d", usage, quota)
+	}
+}
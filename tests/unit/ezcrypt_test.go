@@ -1,10 +1,17 @@
 package mensagod
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/darkwyrm/mensagod/cryptostring"
 	"github.com/darkwyrm/mensagod/ezcrypt"
+	"github.com/spf13/viper"
 )
 
 func TestEZCryptEncryptDecrypt(t *testing.T) {
@@ -46,3 +53,302 @@ func TestEZCryptSignVerify(t *testing.T) {
 		t.Fatal("SigningPair.Verify() failed")
 	}
 }
+
+func TestEZCryptWrapKey(t *testing.T) {
+	kek, err := ezcrypt.GenerateKEK()
+	if err != nil {
+		t.Fatalf("GenerateKEK() error: %s", err.Error())
+	}
+	signkey := cryptostring.New("ED25519:{^A@`5N*T%5ybCU%be892x6%*Rb2rnYd=SGeO4jF")
+
+	wrapped, err := ezcrypt.WrapKey(kek, signkey)
+	if err != nil {
+		t.Fatalf("WrapKey() error: %s", err.Error())
+	}
+	if wrapped.Prefix != ezcrypt.KeyWrapAlgorithm {
+		t.Fatalf("WrapKey() used wrong prefix %s", wrapped.Prefix)
+	}
+
+	unwrapped, err := ezcrypt.UnwrapKey(kek, wrapped)
+	if err != nil {
+		t.Fatalf("UnwrapKey() error: %s", err.Error())
+	}
+	if unwrapped.AsString() != signkey.AsString() {
+		t.Fatal("UnwrapKey() key mismatch")
+	}
+
+	otherKEK, _ := ezcrypt.GenerateKEK()
+	_, err = ezcrypt.UnwrapKey(otherKEK, wrapped)
+	if err == nil {
+		t.Fatal("UnwrapKey() accepted the wrong key-encryption key")
+	}
+
+	// Passphrase-derived keys must be repeatable with the same salt and differ with another one
+	salt := []byte("0123456789abcdef")
+	kek1 := ezcrypt.DeriveKEK("correct horse battery staple", salt)
+	kek2 := ezcrypt.DeriveKEK("correct horse battery staple", salt)
+	if kek1.AsString() != kek2.AsString() {
+		t.Fatal("DeriveKEK() not deterministic")
+	}
+	kek3 := ezcrypt.DeriveKEK("correct horse battery staple", []byte("fedcba9876543210"))
+	if kek1.AsString() == kek3.AsString() {
+		t.Fatal("DeriveKEK() ignored salt")
+	}
+}
+
+func TestEZCryptSecretKey(t *testing.T) {
+	testData := "This is some symmetric encryption test data"
+
+	for _, algorithm := range []string{"XSALSA20", "XCHACHA20"} {
+		var key ezcrypt.SecretKey
+		if err := key.Generate(algorithm); err != nil {
+			t.Fatalf("SecretKey.Generate(%s) failed: %s", algorithm, err.Error())
+		}
+		if key.GetEncryptionType() != algorithm || key.GetType() != "symmetric" {
+			t.Fatalf("SecretKey.Generate(%s) set wrong key info", algorithm)
+		}
+
+		encryptedData, err := key.Encrypt([]byte(testData))
+		if err != nil || encryptedData == "" {
+			t.Fatalf("SecretKey.Encrypt() failed for %s", algorithm)
+		}
+
+		decryptedRaw, err := key.Decrypt(encryptedData)
+		if err != nil || string(decryptedRaw) != testData {
+			t.Fatalf("SecretKey decrypted data mismatch for %s", algorithm)
+		}
+
+		var otherKey ezcrypt.SecretKey
+		otherKey.Generate(algorithm)
+		if _, err = otherKey.Decrypt(encryptedData); err == nil {
+			t.Fatalf("SecretKey.Decrypt() accepted the wrong key for %s", algorithm)
+		}
+	}
+
+	privkey := cryptostring.New("CURVE25519:(Rj5)mmd1|YqlLCUP0vE;YZ#o;tJxtlAIzmPD7b&")
+	if ezcrypt.NewSecretKey(privkey) != nil {
+		t.Fatal("NewSecretKey() accepted an asymmetric key")
+	}
+}
+
+// TestEZCryptSecretKeyVectors checks data encrypted with a fixed nonce. The same values are
+// produced by PyNaCl's SecretBox and Aead classes, so the client and server can read each other's
+// data. The key is bytes 0-31 and the nonce is bytes 0x40-0x57.
+func TestEZCryptSecretKeyVectors(t *testing.T) {
+	testData := "This is some symmetric encryption test data"
+	vectors := []struct {
+		Key       string
+		Encrypted string
+	}{
+		{"XSALSA20:009C61O)~M2nh-c3=Iws5D^j+6crX17#SKH9337X",
+			"KtV!7L`6nNNJ&adOifNtP*GA-R8>}2I4{yOxQfSw|0nB91j3vF9)COv8aT)bwKg0CNctn3qf#;^1R#H{in" +
+				"dU*iLL58x)dFBox|o}I5>R"},
+		{"XCHACHA20:009C61O)~M2nh-c3=Iws5D^j+6crX17#SKH9337X",
+			"KtV!7L`6nNNJ&adOifNtP*GA-R8>}2fKhA%@QDgG{G00AkMA7+|KHiRdOCCe1X7PYd2mYqc-eLfCg!Acp2n" +
+				"4qux~wNsThEdvyYuF9M`M"},
+	}
+
+	for _, vector := range vectors {
+		key := ezcrypt.NewSecretKey(cryptostring.New(vector.Key))
+		if key == nil {
+			t.Fatalf("NewSecretKey() failed for %s", vector.Key)
+		}
+		decryptedRaw, err := key.Decrypt(vector.Encrypted)
+		if err != nil || string(decryptedRaw) != testData {
+			t.Fatalf("SecretKey test vector failed for %s", key.GetEncryptionType())
+		}
+	}
+}
+
+func TestEZCryptStream(t *testing.T) {
+	var key ezcrypt.SecretKey
+	if err := key.Generate("XCHACHA20"); err != nil {
+		t.Fatalf("SecretKey.Generate() failed: %s", err.Error())
+	}
+
+	// Sizes around the 64KiB chunk boundary are the interesting ones
+	for _, size := range []int{0, 1, 65535, 65536, 65537, 3 * 65536, 200000} {
+		testData := make([]byte, size)
+		rand.Read(testData)
+
+		var encrypted bytes.Buffer
+		writer, err := key.NewEncryptWriter(&encrypted)
+		if err != nil {
+			t.Fatalf("NewEncryptWriter() failed: %s", err.Error())
+		}
+		// Odd-sized writes make sure chunking doesn't depend on how the data is written
+		for offset := 0; offset < size; offset += 10000 {
+			end := offset + 10000
+			if end > size {
+				end = size
+			}
+			writer.Write(testData[offset:end])
+		}
+		if err = writer.Close(); err != nil {
+			t.Fatalf("encryptWriter.Close() failed: %s", err.Error())
+		}
+		encryptedData := encrypted.Bytes()
+
+		reader, err := key.NewDecryptReader(bytes.NewReader(encryptedData))
+		if err != nil {
+			t.Fatalf("NewDecryptReader() failed for size %d: %s", size, err.Error())
+		}
+		decrypted, err := ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(decrypted, testData) {
+			t.Fatalf("stream decrypted data mismatch for size %d: %v", size, err)
+		}
+
+		// Modified data
+		if size > 0 {
+			tampered := append([]byte{}, encryptedData...)
+			tampered[len(tampered)/2] ^= 1
+			reader, err = key.NewDecryptReader(bytes.NewReader(tampered))
+			if err == nil {
+				_, err = ioutil.ReadAll(reader)
+			}
+			if err == nil {
+				t.Fatalf("modified stream accepted for size %d", size)
+			}
+		}
+
+		// Truncated data, including streams cut off at a chunk boundary
+		for _, cut := range []int{1, 16 + 65536} {
+			if cut >= len(encryptedData)-17 {
+				continue
+			}
+			truncated := encryptedData[:len(encryptedData)-cut]
+			reader, err = key.NewDecryptReader(bytes.NewReader(truncated))
+			if err == nil {
+				_, err = ioutil.ReadAll(reader)
+			}
+			if err != ezcrypt.ErrStreamCorrupt {
+				t.Fatalf("truncated stream accepted for size %d, cut %d", size, cut)
+			}
+		}
+	}
+
+	// Streams encrypted with a public key
+	pubkey := cryptostring.New("CURVE25519:(B2XX5|<+lOSR>_0mQ=KX4o<aOvXe6M`Z5ldINd`")
+	privkey := cryptostring.New("CURVE25519:(Rj5)mmd1|YqlLCUP0vE;YZ#o;tJxtlAIzmPD7b&")
+	keypair := ezcrypt.NewEncryptionPair(pubkey, privkey)
+
+	testData := make([]byte, 100000)
+	rand.Read(testData)
+	var encrypted bytes.Buffer
+	writer, err := ezcrypt.NewEncryptionKey(pubkey).NewEncryptWriter(&encrypted)
+	if err != nil {
+		t.Fatalf("EncryptionKey.NewEncryptWriter() failed: %s", err.Error())
+	}
+	writer.Write(testData)
+	writer.Close()
+
+	reader, err := keypair.NewDecryptReader(&encrypted)
+	if err != nil {
+		t.Fatalf("EncryptionPair.NewDecryptReader() failed: %s", err.Error())
+	}
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(decrypted, testData) {
+		t.Fatalf("public key stream decrypted data mismatch: %v", err)
+	}
+}
+
+func TestEZCryptRegistry(t *testing.T) {
+	hashList := strings.Join(ezcrypt.ListAlgorithms(ezcrypt.CapHash), ",")
+	if hashList != "BLAKE2B-256,BLAKE3-256,SHA-256,SHA3-256" {
+		t.Fatalf("ListAlgorithms() returned wrong hash algorithms: %s", hashList)
+	}
+	if !ezcrypt.IsSupported("CURVE25519", ezcrypt.CapEncrypt) ||
+		ezcrypt.IsSupported("CURVE25519", ezcrypt.CapSign) ||
+		ezcrypt.IsSupported("NOSUCHALG", ezcrypt.CapHash) {
+		t.Fatal("IsSupported() returned the wrong capability info")
+	}
+
+	if ezcrypt.RegisterAlgorithm(ezcrypt.Algorithm{Name: "bad name", Capabilities: 0}) == nil {
+		t.Fatal("RegisterAlgorithm() accepted a bad name")
+	}
+	if ezcrypt.RegisterAlgorithm(ezcrypt.Algorithm{Name: "TEST-SHA512",
+		Capabilities: ezcrypt.CapHash}) == nil {
+		t.Fatal("RegisterAlgorithm() accepted an algorithm without functions")
+	}
+
+	err := ezcrypt.RegisterAlgorithm(ezcrypt.Algorithm{
+		Name:         "TEST-SHA512",
+		Capabilities: ezcrypt.CapHash,
+		NewHash:      sha512.New,
+	})
+	if err != nil {
+		t.Fatalf("RegisterAlgorithm() failed: %s", err.Error())
+	}
+	hasher, err := ezcrypt.NewHasher("TEST-SHA512")
+	if err != nil || hasher.Size() != sha512.Size {
+		t.Fatal("NewHasher() didn't return the registered algorithm")
+	}
+
+	// A registered signing algorithm can be used by signing pairs without any other changes. An
+	// HMAC stands in for a real signing algorithm, so both keys of the pair are the same.
+	hmacSign := func(key []byte, data []byte) ([]byte, error) {
+		mac := hmac.New(sha512.New, key)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	}
+	if ezcrypt.RegisterAlgorithm(ezcrypt.Algorithm{Name: "TEST-HMAC",
+		Capabilities: ezcrypt.CapSign,
+		Verify:       func(key []byte, data []byte, signature []byte) bool { return false },
+	}) == nil {
+		t.Fatal("RegisterAlgorithm() accepted a signing algorithm without Sign")
+	}
+	err = ezcrypt.RegisterAlgorithm(ezcrypt.Algorithm{
+		Name:         "TEST-HMAC",
+		Capabilities: ezcrypt.CapSign,
+		Sign:         hmacSign,
+		Verify: func(key []byte, data []byte, signature []byte) bool {
+			expected, _ := hmacSign(key, data)
+			return hmac.Equal(expected, signature)
+		},
+	})
+	if err != nil {
+		t.Fatalf("RegisterAlgorithm() failed: %s", err.Error())
+	}
+
+	key := cryptostring.New("TEST-HMAC:(Rj5)mmd1|YqlLCUP0vE;YZ#o;tJxtlAIzmPD7b&")
+	signpair := ezcrypt.NewSigningPair(key, key)
+	if signpair == nil {
+		t.Fatal("NewSigningPair() rejected a registered signing algorithm")
+	}
+	signature, err := signpair.Sign([]byte("test data"))
+	if err != nil || signature.Prefix != "TEST-HMAC" {
+		t.Fatalf("SigningPair.Sign() didn't use the registered algorithm: %v", err)
+	}
+	verified, err := signpair.Verify([]byte("test data"), signature)
+	if err != nil || !verified {
+		t.Fatalf("SigningPair.Verify() failed for the registered algorithm: %v", err)
+	}
+}
+
+func TestEZCryptPasswordRehash(t *testing.T) {
+	viper.Set("security.password_security", "normal")
+	defer viper.Set("security.password_security", "normal")
+
+	passHash := ezcrypt.HashPassword("SandstoneAgendaTricycle")
+	rehash, err := ezcrypt.PasswordNeedsRehash(passHash)
+	if err != nil || rehash {
+		t.Fatalf("PasswordNeedsRehash() flagged a current hash: %v", err)
+	}
+
+	oldHash := "$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCqdcCYkJLok65" +
+		"qussSyhN5TTZP+OTgzEI"
+	rehash, err = ezcrypt.PasswordNeedsRehash(oldHash)
+	if err != nil || !rehash {
+		t.Fatalf("PasswordNeedsRehash() missed a hash with old parameters: %v", err)
+	}
+
+	viper.Set("security.password_security", "enhanced")
+	rehash, err = ezcrypt.PasswordNeedsRehash(passHash)
+	if err != nil || !rehash {
+		t.Fatalf("PasswordNeedsRehash() missed a change in password security: %v", err)
+	}
+
+	if _, err = ezcrypt.PasswordNeedsRehash("$argon2id$bad"); err == nil {
+		t.Fatal("PasswordNeedsRehash() accepted a bad hash")
+	}
+}
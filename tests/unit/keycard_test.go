@@ -2,6 +2,8 @@ package mensagod
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -493,6 +495,61 @@ func TestOrgChain(t *testing.T) {
 	}
 }
 
+func TestOrgChainRequiredKeys(t *testing.T) {
+	entry := keycard.NewOrgEntry()
+	var orgSigningKey cryptostring.CryptoString
+
+	err := orgSigningKey.Set("ED25519:msvXw(nII<Qm6oBHc+92xwRI3>VFF-RcZ=7DEu3|")
+	if err != nil {
+		t.Fatalf("TestOrgChainRequiredKeys: org signing key decoding failure: %s\n", err)
+	}
+
+	entry.SetFields(map[string]string{
+		"Name":                       "Acme, Inc.",
+		"Contact-Admin":              "ae406c5e-2673-4d3e-af20-91325d9623ca/acme.com",
+		"Primary-Verification-Key":   "ED25519:)8id(gE02^S<{3H>9B;X4{DuYcb`%wo^mC&1lN88",
+		"Secondary-Verification-Key": "ED25519:)8id(gE02^S<{3H>9B;X4{DuYcb`%wo^mC&1lN88",
+		"Encryption-Key":             "CURVE25519:@b?cjpeY;<&y+LSOA&yUQ&ZIrp(JGt{W$*V>ATLG",
+		"Time-To-Live":               "14",
+		"Expires":                    "20201002",
+		"Timestamp":                  "20200901T131313Z"})
+
+	err = entry.GenerateHash("BLAKE2B-256")
+	if err != nil {
+		t.Fatalf("TestOrgChainRequiredKeys: hashing failure: %s\n", err)
+	}
+	err = entry.Sign(orgSigningKey, "Organization")
+	if err != nil {
+		t.Fatalf("TestOrgChainRequiredKeys: org signing failure: %s\n", err)
+	}
+
+	// Rotating only the required keys keeps the secondary verification key and gives the new
+	// entry its own timestamp and expiration date
+	newEntry, newKeys, err := entry.Chain(orgSigningKey, false)
+	if err != nil {
+		t.Fatalf("TestOrgChainRequiredKeys: chain failure error: %s\n", err)
+	}
+
+	if _, ok := newKeys["Secondary-Verification-Key.private"]; ok {
+		t.Fatal("TestOrgChainRequiredKeys: optional key rotated\n")
+	}
+	if newEntry.Fields["Secondary-Verification-Key"] != entry.Fields["Secondary-Verification-Key"] {
+		t.Fatal("TestOrgChainRequiredKeys: secondary verification key not kept\n")
+	}
+	if newEntry.Fields["Encryption-Key"] == entry.Fields["Encryption-Key"] {
+		t.Fatal("TestOrgChainRequiredKeys: encryption key not rotated\n")
+	}
+	if newEntry.Fields["Timestamp"] == entry.Fields["Timestamp"] ||
+		newEntry.Fields["Expires"] == entry.Fields["Expires"] {
+		t.Fatal("TestOrgChainRequiredKeys: timestamp or expiration copied from previous entry\n")
+	}
+
+	verified, err := newEntry.VerifyChain(entry)
+	if !verified {
+		t.Fatalf("TestOrgChainRequiredKeys: chain verify failure: %s\n", err)
+	}
+}
+
 func TestUserChain(t *testing.T) {
 	var signingKey, crSigningKey, orgSigningKey, verifyKey cryptostring.CryptoString
 
@@ -918,6 +975,35 @@ func TestIsDataCompliantUser(t *testing.T) {
 
 }
 
+func TestGenerateHashBLAKE3(t *testing.T) {
+	entry := keycard.NewUserEntry()
+	entry.SetFields(map[string]string{
+		"Name":         "Corbin Simons",
+		"Workspace-ID": "4418bf6c-000b-4bb3-8111-316e72030468",
+		"Domain":       "example.com",
+		"Expires":      "20201002",
+		"Timestamp":    "20200901T131313Z"})
+	if err := entry.GenerateHash("BLAKE3-256"); err != nil {
+		t.Fatalf("TestGenerateHashBLAKE3: hashing failure: %s\n", err)
+	}
+
+	var hash cryptostring.CryptoString
+	if err := hash.Set(entry.Hash); err != nil || len(hash.RawData()) != 32 {
+		t.Fatalf("TestGenerateHashBLAKE3: bad hash %s\n", entry.Hash)
+	}
+
+	// The hash must depend on the entry's data
+	firstHash := entry.Hash
+	entry.Hash = ""
+	entry.SetField("Name", "Corbin Smith")
+	if err := entry.GenerateHash("BLAKE3-256"); err != nil {
+		t.Fatalf("TestGenerateHashBLAKE3: hashing failure: %s\n", err)
+	}
+	if entry.Hash == firstHash {
+		t.Fatal("TestGenerateHashBLAKE3: different entries have the same hash\n")
+	}
+}
+
 func TestIsExpired(t *testing.T) {
 	entry := keycard.NewOrgEntry()
 
@@ -973,3 +1059,132 @@ func TestIsTimestampValid(t *testing.T) {
 		t.Fatal("TestIsTimestampValid: IsTimestampValid passed a failing timestamp\n")
 	}
 }
+
+func TestKeycardSaveLoad(t *testing.T) {
+	var orgSigningKey cryptostring.CryptoString
+	err := orgSigningKey.Set("ED25519:msvXw(nII<Qm6oBHc+92xwRI3>VFF-RcZ=7DEu3|")
+	if err != nil {
+		t.Fatalf("TestKeycardSaveLoad: org signing key decoding failure: %s\n", err)
+	}
+
+	entry := keycard.NewOrgEntry()
+	entry.SetFields(map[string]string{
+		"Name":                       "Acme, Inc.",
+		"Contact-Admin":              "ae406c5e-2673-4d3e-af20-91325d9623ca/acme.com",
+		"Primary-Verification-Key":   "ED25519:)8id(gE02^S<{3H>9B;X4{DuYcb`%wo^mC&1lN88",
+		"Secondary-Verification-Key": "ED25519:)8id(gE02^S<{3H>9B;X4{DuYcb`%wo^mC&1lN88",
+		"Encryption-Key":             "CURVE25519:@b?cjpeY;<&y+LSOA&yUQ&ZIrp(JGt{W$*V>ATLG",
+		"Time-To-Live":               "14",
+		"Expires":                    "20201002",
+		"Timestamp":                  "20200901T131313Z"})
+	if err = entry.GenerateHash("BLAKE2B-256"); err != nil {
+		t.Fatalf("TestKeycardSaveLoad: hashing failure: %s\n", err)
+	}
+	if err = entry.Sign(orgSigningKey, "Organization"); err != nil {
+		t.Fatalf("TestKeycardSaveLoad: org signing failure: %s\n", err)
+	}
+
+	newEntry, _, err := entry.Chain(orgSigningKey, false)
+	if err != nil {
+		t.Fatalf("TestKeycardSaveLoad: chain failure: %s\n", err)
+	}
+	newEntry.PrevHash = entry.Hash
+	if err = newEntry.GenerateHash("BLAKE2B-256"); err != nil {
+		t.Fatalf("TestKeycardSaveLoad: hashing failure: %s\n", err)
+	}
+
+	card := keycard.Keycard{Type: "Organization", Entries: []keycard.Entry{*entry, *newEntry}}
+	path := filepath.Join(t.TempDir(), "org.kc")
+	if err = card.Save(path, false); err != nil {
+		t.Fatalf("TestKeycardSaveLoad: save failure: %s\n", err)
+	}
+
+	var loaded keycard.Keycard
+	if err = loaded.Load(path, false); err != nil {
+		t.Fatalf("TestKeycardSaveLoad: load failure: %s\n", err)
+	}
+	if loaded.Type != "Organization" || len(loaded.Entries) != 2 {
+		t.Fatal("TestKeycardSaveLoad: loaded keycard doesn't match saved one\n")
+	}
+
+	for i := range loaded.Entries {
+		if ok, err := loaded.Entries[i].VerifyHash(); !ok {
+			t.Fatalf("TestKeycardSaveLoad: hash failure for entry %d: %s\n", i+1, err)
+		}
+	}
+	if ok, err := loaded.VerifyChain(); !ok {
+		t.Fatalf("TestKeycardSaveLoad: chain verify failure: %s\n", err)
+	}
+
+	// Breaking the link between the entries must be caught
+	loaded.Entries[1].PrevHash = loaded.Entries[1].Hash
+	if ok, _ := loaded.VerifyChain(); ok {
+		t.Fatal("TestKeycardSaveLoad: broken chain passed verification\n")
+	}
+}
+
+func TestEntryJSON(t *testing.T) {
+	var orgSigningKey cryptostring.CryptoString
+	err := orgSigningKey.Set("ED25519:msvXw(nII<Qm6oBHc+92xwRI3>VFF-RcZ=7DEu3|")
+	if err != nil {
+		t.Fatalf("TestEntryJSON: org signing key decoding failure: %s\n", err)
+	}
+
+	entry := keycard.NewOrgEntry()
+	entry.SetFields(map[string]string{
+		"Name":                     "Acme, Inc.",
+		"Contact-Admin":            "ae406c5e-2673-4d3e-af20-91325d9623ca/acme.com",
+		"Primary-Verification-Key": "ED25519:)8id(gE02^S<{3H>9B;X4{DuYcb`%wo^mC&1lN88",
+		"Encryption-Key":           "CURVE25519:@b?cjpeY;<&y+LSOA&yUQ&ZIrp(JGt{W$*V>ATLG",
+		"Time-To-Live":             "14",
+		"Expires":                  "20201002",
+		"Timestamp":                "20200901T131313Z"})
+	entry.PrevHash = "BLAKE2B-256:tSl@QzD1w-vNq@CC-5`($KuxO0#aOl^-cy(l7XXT"
+	if err = entry.GenerateHash("BLAKE2B-256"); err != nil {
+		t.Fatalf("TestEntryJSON: hashing failure: %s\n", err)
+	}
+	if err = entry.Sign(orgSigningKey, "Organization"); err != nil {
+		t.Fatalf("TestEntryJSON: org signing failure: %s\n", err)
+	}
+
+	// Subtest #1: Round trip
+
+	data, err := entry.MarshalJSON()
+	if err != nil {
+		t.Fatalf("TestEntryJSON: marshal failure: %s\n", err)
+	}
+	if strings.Contains(string(data), `\u003c`) || strings.Contains(string(data), "\n") {
+		t.Fatalf("TestEntryJSON: JSON form not canonical: %s\n", data)
+	}
+
+	newEntry, err := keycard.NewEntryFromJSON(data)
+	if err != nil {
+		t.Fatalf("TestEntryJSON: unmarshal failure: %s\n", err)
+	}
+	if string(newEntry.MakeByteString(-1)) != string(entry.MakeByteString(-1)) {
+		t.Fatal("TestEntryJSON: text form changed by round trip\n")
+	}
+	if ok, err := newEntry.VerifyHash(); !ok {
+		t.Fatalf("TestEntryJSON: hash failure after round trip: %s\n", err)
+	}
+
+	newData, _ := newEntry.MarshalJSON()
+	if string(newData) != string(data) {
+		t.Fatal("TestEntryJSON: JSON form changed by round trip\n")
+	}
+
+	// Subtest #2: Data which can't be represented in the text form is rejected
+
+	badData := []string{
+		`{"Type":"Group","Fields":{"Index":"1"}}`,
+		`{"Type":"Organization","Fields":{"Favorite-Color":"blue"}}`,
+		`{"Type":"Organization","Fields":{"Name":"Acme\r\nIndex:2"}}`,
+		`{"Type":"Organization","Fields":{"Name":""}}`,
+		`{"Type":"Organization","Fields":{"Index":"1"},"Signatures":{"Hashes":"foo"}}`,
+	}
+	for i, item := range badData {
+		if _, err = keycard.NewEntryFromJSON([]byte(item)); err == nil {
+			t.Fatalf("TestEntryJSON: bad data #%d accepted\n", i+1)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package mensagod
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/darkwyrm/mensagod/translog"
+)
+
+func makeTestLeaves(count int) [][]byte {
+	leaves := make([][]byte, count)
+	for i := range leaves {
+		leaves[i] = translog.LeafHash([]byte(fmt.Sprintf("entry %d", i)))
+	}
+	return leaves
+}
+
+func TestTranslogInclusion(t *testing.T) {
+	for size := 1; size <= 17; size++ {
+		leaves := makeTestLeaves(size)
+		root := translog.RootHash(leaves)
+
+		for index := 0; index < size; index++ {
+			proof, err := translog.InclusionProof(index, leaves)
+			if err != nil {
+				t.Fatalf("TestTranslogInclusion: proof error for leaf %d of %d: %s", index, size,
+					err)
+			}
+			if !translog.VerifyInclusion(index, size, leaves[index], proof, root) {
+				t.Fatalf("TestTranslogInclusion: proof failed for leaf %d of %d", index, size)
+			}
+
+			// The proof must not verify for a different leaf
+			other := translog.LeafHash([]byte("bogus"))
+			if translog.VerifyInclusion(index, size, other, proof, root) {
+				t.Fatalf("TestTranslogInclusion: bogus leaf passed for leaf %d of %d", index,
+					size)
+			}
+		}
+	}
+
+	_, err := translog.InclusionProof(3, makeTestLeaves(3))
+	if err == nil {
+		t.Fatal("TestTranslogInclusion: proof generated for out-of-range leaf")
+	}
+}
+
+func TestTranslogConsistency(t *testing.T) {
+	for newSize := 1; newSize <= 17; newSize++ {
+		leaves := makeTestLeaves(newSize)
+		newRoot := translog.RootHash(leaves)
+
+		for oldSize := 1; oldSize <= newSize; oldSize++ {
+			oldRoot := translog.RootHash(leaves[:oldSize])
+			proof, err := translog.ConsistencyProof(oldSize, leaves)
+			if err != nil {
+				t.Fatalf("TestTranslogConsistency: proof error for %d -> %d: %s", oldSize,
+					newSize, err)
+			}
+			if !translog.VerifyConsistency(oldSize, newSize, oldRoot, newRoot, proof) {
+				t.Fatalf("TestTranslogConsistency: proof failed for %d -> %d", oldSize, newSize)
+			}
+
+			// A server presenting a different history must fail the check
+			if oldSize < newSize {
+				forked := makeTestLeaves(newSize)
+				forked[0] = translog.LeafHash([]byte("forked"))
+				if translog.VerifyConsistency(oldSize, newSize, translog.RootHash(forked[:oldSize]),
+					newRoot, proof) {
+					t.Fatalf("TestTranslogConsistency: forked tree passed for %d -> %d", oldSize,
+						newSize)
+				}
+			}
+		}
+	}
+}
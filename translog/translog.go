@@ -0,0 +1,188 @@
+package translog
+
+// This package implements the Merkle tree used by the keycard transparency log. The tree follows
+// the design of the one used by Certificate Transparency (RFC 6962), except that BLAKE2B-256 is
+// used as the hash algorithm. Leaves and interior nodes are hashed with different prefixes so that
+// a leaf can never be passed off as an interior node and vice versa.
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgorithm is the name of the hash algorithm used for the tree, formatted for use as a
+// CryptoString prefix
+const HashAlgorithm = "BLAKE2B-256"
+
+// ErrBadTreeSize is returned when a requested tree size or leaf index is out of range
+var ErrBadTreeSize = errors.New("bad tree size")
+
+// LeafHash returns the Merkle tree hash of a single log entry
+func LeafHash(data []byte) []byte {
+	sum := blake2b.Sum256(append([]byte{0}, data...))
+	return sum[:]
+}
+
+// nodeHash returns the hash of an interior node of the tree
+func nodeHash(left []byte, right []byte) []byte {
+	buffer := make([]byte, 0, 1+len(left)+len(right))
+	buffer = append(buffer, 1)
+	buffer = append(buffer, left...)
+	buffer = append(buffer, right...)
+	sum := blake2b.Sum256(buffer)
+	return sum[:]
+}
+
+// splitPoint returns the largest power of two which is smaller than n. n must be greater than 1.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// RootHash returns the root hash of the tree made from the list of leaf hashes passed to it. The
+// root of an empty tree is the hash of an empty string.
+func RootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := blake2b.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+
+	k := splitPoint(len(leaves))
+	return nodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// InclusionProof returns the audit path needed to prove that the leaf at the specified index is
+// part of the tree made from the list of leaf hashes passed to it
+func InclusionProof(index int, leaves [][]byte) ([][]byte, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, ErrBadTreeSize
+	}
+	return inclusionPath(index, leaves), nil
+}
+
+func inclusionPath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) < 2 {
+		return [][]byte{}
+	}
+
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(inclusionPath(index, leaves[:k]), RootHash(leaves[k:]))
+	}
+	return append(inclusionPath(index-k, leaves[k:]), RootHash(leaves[:k]))
+}
+
+// ConsistencyProof returns the list of nodes needed to prove that the tree made from the first
+// oldSize leaves is a prefix of the tree made from all of the leaf hashes passed to it
+func ConsistencyProof(oldSize int, leaves [][]byte) ([][]byte, error) {
+	if oldSize < 1 || oldSize > len(leaves) {
+		return nil, ErrBadTreeSize
+	}
+	return subproof(oldSize, leaves, true), nil
+}
+
+func subproof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{RootHash(leaves)}
+	}
+
+	k := splitPoint(n)
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), RootHash(leaves[k:]))
+	}
+	return append(subproof(m-k, leaves[k:], false), RootHash(leaves[:k]))
+}
+
+// VerifyInclusion checks an audit path returned by InclusionProof against the root hash of a tree
+// of the specified size
+func VerifyInclusion(index int, treeSize int, leafHash []byte, proof [][]byte,
+	root []byte) bool {
+	if index < 0 || index >= treeSize {
+		return false
+	}
+
+	fn := index
+	sn := treeSize - 1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistency checks a proof returned by ConsistencyProof against the root hashes of the
+// older and newer trees
+func VerifyConsistency(oldSize int, newSize int, oldRoot []byte, newRoot []byte,
+	proof [][]byte) bool {
+	if oldSize < 1 || oldSize > newSize {
+		return false
+	}
+	if oldSize == newSize {
+		return len(proof) == 0 && bytes.Equal(oldRoot, newRoot)
+	}
+
+	// If the old tree is a complete subtree of the new one, its root is the starting point
+	if oldSize&(oldSize-1) == 0 {
+		proof = append([][]byte{oldRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return false
+	}
+
+	fn := oldSize - 1
+	sn := newSize - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr := proof[0]
+	sr := proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(fr, oldRoot) && bytes.Equal(sr, newRoot)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkwyrm/b85"
+	"github.com/darkwyrm/mensagod/ezcrypt"
+	"github.com/darkwyrm/mensagod/logging"
+	"github.com/darkwyrm/mensagod/translog"
+	"github.com/spf13/viper"
+)
+
+// Every keycard entry accepted by the server is appended to a per-domain Merkle tree, the keycard
+// transparency log. Clients and auditors keep the signed tree heads they have seen and use
+// inclusion and consistency proofs to detect a server which shows different keycards to
+// different people.
+
+// The log commands don't require a login, so the leaves of each domain's log are kept in memory
+// and only read again once the log grows. The log is append-only, so the leaves of a tree of a
+// given size never change. The signed tree head for the current size is kept with them, so a head
+// is signed once per new entry instead of once per request.
+type logCacheItem struct {
+	leaves [][]byte
+	head   map[string]string
+	psk    string
+}
+
+var gLogCache = make(map[string]*logCacheItem)
+var gLogCacheLock sync.Mutex
+
+// Clients are limited in how often they can request log data, counted per IP address over a
+// one-minute window.
+type logRateItem struct {
+	start time.Time
+	count int
+}
+
+var gLogRates = make(map[string]*logRateItem)
+var gLogRatesSwept time.Time
+var gLogRatesLock sync.Mutex
+
+func commandTreeHead(session *sessionState) {
+	// command syntax:
+	// TREEHEAD(Domain="")
+
+	if isLogRateLimited(session) {
+		return
+	}
+
+	domain, ok := getRequestDomain(session)
+	if !ok {
+		return
+	}
+
+	leaves, ok := getLogLeaves(session, domain, 0)
+	if !ok {
+		return
+	}
+
+	psk, ok := getOrgSigningKey(session, domain)
+	if !ok {
+		return
+	}
+
+	// The cached head is only reused if it was signed with the current key for a tree of the
+	// current size
+	gLogCacheLock.Lock()
+	item := gLogCache[domain]
+	if item != nil && item.head != nil && item.psk == psk.AsString() &&
+		item.head["Tree-Size"] == fmt.Sprintf("%d", len(leaves)) {
+		head := item.head
+		gLogCacheLock.Unlock()
+		sendTreeHead(session, head)
+		return
+	}
+	gLogCacheLock.Unlock()
+
+	// The signature covers the tree head lines in the same format used by keycard entries
+	now := time.Now().UTC()
+	timestamp := fmt.Sprintf("%d%02d%02dT%02d%02d%02dZ", now.Year(), now.Month(), now.Day(),
+		now.Hour(), now.Minute(), now.Second())
+	rootHash := encodeLogHash(translog.RootHash(leaves))
+	treeHead := strings.Join([]string{
+		"Domain:" + domain,
+		fmt.Sprintf("Tree-Size:%d", len(leaves)),
+		"Root-Hash:" + rootHash,
+		"Timestamp:" + timestamp,
+		"",
+	}, "\r\n")
+
+	signature, err := ezcrypt.Sign(psk, []byte(treeHead))
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandTreeHead: failed to sign tree head for %s: %s", domain,
+			err.Error())
+		return
+	}
+
+	head := map[string]string{
+		"Domain":                 domain,
+		"Tree-Size":              fmt.Sprintf("%d", len(leaves)),
+		"Root-Hash":              rootHash,
+		"Timestamp":              timestamp,
+		"Organization-Signature": signature.AsString(),
+	}
+
+	// The log may have grown while the head was being signed, in which case the newer leaves are
+	// kept and the head isn't cached
+	gLogCacheLock.Lock()
+	item = gLogCache[domain]
+	if item != nil && len(item.leaves) == len(leaves) {
+		item.head = head
+		item.psk = psk.AsString()
+	}
+	gLogCacheLock.Unlock()
+
+	sendTreeHead(session, head)
+}
+
+func sendTreeHead(session *sessionState, head map[string]string) {
+	response := NewServerResponse(200, "OK")
+	for k, v := range head {
+		response.Data[k] = v
+	}
+	session.SendResponse(*response)
+}
+
+func commandInclusionProof(session *sessionState) {
+	// command syntax:
+	// INCLUSIONPROOF(Hash, Tree-Size=0, Domain="")
+
+	if isLogRateLimited(session) {
+		return
+	}
+
+	if session.Message.Validate([]string{"Hash"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	treeSize, ok := getTreeSizeField(session, "Tree-Size")
+	if !ok {
+		return
+	}
+
+	domain, ok := getRequestDomain(session)
+	if !ok {
+		return
+	}
+
+	index, err := session.Store.TransLog.GetLogIndex(domain, session.Message.Data["Hash"])
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("commandInclusionProof: error looking up log entry: %s", err.Error())
+		return
+	}
+	if index < 0 {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	leaves, ok := getLogLeaves(session, domain, treeSize)
+	if !ok {
+		return
+	}
+
+	proof, err := translog.InclusionProof(index, leaves)
+	if err != nil {
+		session.SendStringResponse(404, "NOT FOUND", "Entry not in tree of requested size")
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Leaf-Index"] = fmt.Sprintf("%d", index)
+	response.Data["Tree-Size"] = fmt.Sprintf("%d", len(leaves))
+	response.Data["Audit-Path"] = encodeLogProof(proof)
+	session.SendResponse(*response)
+}
+
+func commandConsistencyProof(session *sessionState) {
+	// command syntax:
+	// CONSISTENCYPROOF(Old-Size, New-Size=0, Domain="")
+
+	if isLogRateLimited(session) {
+		return
+	}
+
+	if session.Message.Validate([]string{"Old-Size"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	oldSize, ok := getTreeSizeField(session, "Old-Size")
+	if !ok {
+		return
+	}
+	if oldSize < 1 {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Old-Size")
+		return
+	}
+
+	newSize, ok := getTreeSizeField(session, "New-Size")
+	if !ok {
+		return
+	}
+
+	domain, ok := getRequestDomain(session)
+	if !ok {
+		return
+	}
+
+	leaves, ok := getLogLeaves(session, domain, newSize)
+	if !ok {
+		return
+	}
+
+	proof, err := translog.ConsistencyProof(oldSize, leaves)
+	if err != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Old-Size larger than New-Size")
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Old-Size"] = fmt.Sprintf("%d", oldSize)
+	response.Data["New-Size"] = fmt.Sprintf("%d", len(leaves))
+	response.Data["Proof"] = encodeLogProof(proof)
+	session.SendResponse(*response)
+}
+
+// getTreeSizeField reads an optional tree size from the current request. 0 is returned if the
+// field is not present. If the field is invalid, a response is sent to the client and false is
+// returned.
+func getTreeSizeField(session *sessionState, fieldName string) (int, bool) {
+	if !session.Message.HasField(fieldName) {
+		return 0, true
+	}
+
+	size, err := strconv.Atoi(session.Message.Data[fieldName])
+	if err != nil || size < 0 {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad "+fieldName)
+		return 0, false
+	}
+	return size, true
+}
+
+// getLogLeaves returns the leaf hashes for a tree of the specified size from a domain's
+// transparency log. A size of 0 returns the current tree. If the log is smaller than the requested
+// size or an error occurs, a response is sent to the client and false is returned.
+func getLogLeaves(session *sessionState, domain string, size int) ([][]byte, bool) {
+	logSize, err := session.Store.TransLog.GetLogSize(domain)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("getLogLeaves: error getting log size for %s: %s", domain, err.Error())
+		return nil, false
+	}
+	if size == 0 {
+		size = logSize
+	}
+	if size > logSize {
+		session.SendStringResponse(404, "NOT FOUND", "Tree size larger than log")
+		return nil, false
+	}
+
+	gLogCacheLock.Lock()
+	item := gLogCache[domain]
+	if item != nil && len(item.leaves) >= logSize {
+		leaves := item.leaves[:size]
+		gLogCacheLock.Unlock()
+		return leaves, true
+	}
+	gLogCacheLock.Unlock()
+
+	leaves, err := session.Store.TransLog.GetLogLeaves(domain, logSize)
+	if err != nil {
+		session.SendDatabaseError(err)
+		logging.Writef("getLogLeaves: error getting log entries for %s: %s", domain, err.Error())
+		return nil, false
+	}
+
+	gLogCacheLock.Lock()
+	item = gLogCache[domain]
+	if item == nil || len(item.leaves) < len(leaves) {
+		gLogCache[domain] = &logCacheItem{leaves: leaves}
+	}
+	gLogCacheLock.Unlock()
+
+	return leaves[:size], true
+}
+
+// isLogRateLimited counts a request for log data against the client's IP address. If the client
+// has made too many requests in the current minute, it is told so and true is returned.
+func isLogRateLimited(session *sessionState) bool {
+	remoteip := strings.Split(session.Connection.RemoteAddr().String(), ":")[0]
+	now := time.Now()
+
+	gLogRatesLock.Lock()
+	item := gLogRates[remoteip]
+	if now.Sub(gLogRatesSwept) >= time.Minute {
+		// Clients which haven't made a request in the last minute no longer need tracking
+		for ip, rate := range gLogRates {
+			if now.Sub(rate.start) >= time.Minute {
+				delete(gLogRates, ip)
+			}
+		}
+		gLogRatesSwept = now
+		item = gLogRates[remoteip]
+	}
+	if item == nil || now.Sub(item.start) >= time.Minute {
+		item = &logRateItem{start: now}
+		gLogRates[remoteip] = item
+	}
+	item.count++
+	count := item.count
+	gLogRatesLock.Unlock()
+
+	if count > viper.GetInt("security.log_requests_per_min") {
+		session.SendStringResponse(414, "LIMIT REACHED", "Too many log requests. Try again later.")
+		return true
+	}
+	return false
+}
+
+func encodeLogHash(hash []byte) string {
+	return translog.HashAlgorithm + ":" + b85.Encode(hash)
+}
+
+// encodeLogProof formats a list of tree hashes as a comma-separated list of CryptoStrings
+func encodeLogProof(proof [][]byte) string {
+	out := make([]string, len(proof))
+	for i, hash := range proof {
+		out[i] = encodeLogHash(hash)
+	}
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/darkwyrm/mensagod/config"
+	"github.com/darkwyrm/mensagod/dbhandler"
+	"github.com/darkwyrm/mensagod/keycard"
+	"github.com/spf13/viper"
+)
+
+func TestCommandTreeHead(t *testing.T) {
+	config.SetupConfig()
+	oldLimit := viper.GetInt("security.log_requests_per_min")
+	viper.Set("security.log_requests_per_min", 3)
+	defer viper.Set("security.log_requests_per_min", oldLimit)
+	gLogCache = make(map[string]*logCacheItem)
+	gLogRates = make(map[string]*logRateItem)
+
+	store := dbhandler.NewMemoryStore()
+	domain := config.PrimaryDomain()
+	keys, err := keycard.GenerateOrgKeys(false)
+	if err != nil {
+		t.Fatalf("TestCommandTreeHead: Couldn't generate keys: %s", err.Error())
+	}
+	entry := keycard.NewOrgEntry()
+	entry.SetFields(map[string]string{
+		"Index":  "1",
+		"Domain": domain,
+	})
+	err = store.Keycards.AddOrgEntry(domain, entry, keys)
+	if err != nil {
+		t.Fatalf("TestCommandTreeHead: Couldn't add org entry: %s", err.Error())
+	}
+
+	var state sessionState
+
+	// Subtest #1: The signed head is reused while the log doesn't change
+
+	first, _ := runCommand(t, store, state, "TREEHEAD", map[string]string{})
+	if first.Code != 200 || first.Data["Tree-Size"] != "1" {
+		t.Fatalf("TestCommandTreeHead: #1: wrong response: %d %v", first.Code, first.Data)
+	}
+
+	response, _ := runCommand(t, store, state, "TREEHEAD", map[string]string{})
+	if response.Code != 200 ||
+		response.Data["Organization-Signature"] != first.Data["Organization-Signature"] ||
+		response.Data["Timestamp"] != first.Data["Timestamp"] {
+		t.Fatalf("TestCommandTreeHead: #1: head signed again: %d %v", response.Code,
+			response.Data)
+	}
+
+	// Subtest #2: A new head is signed once the log grows
+
+	err = addExpiringEntry(store, "11111111-1111-1111-1111-111111111111", domain, "1", 90)
+	if err != nil {
+		t.Fatalf("TestCommandTreeHead: Couldn't add entry: %s", err.Error())
+	}
+	response, _ = runCommand(t, store, state, "TREEHEAD", map[string]string{})
+	if response.Code != 200 || response.Data["Tree-Size"] != "2" ||
+		response.Data["Root-Hash"] == first.Data["Root-Hash"] {
+		t.Fatalf("TestCommandTreeHead: #2: stale head: %d %v", response.Code, response.Data)
+	}
+
+	// Subtest #3: Clients which make too many log requests are refused
+
+	response, _ = runCommand(t, store, state, "CONSISTENCYPROOF", map[string]string{
+		"Old-Size": "1",
+	})
+	if response.Code != 414 {
+		t.Fatalf("TestCommandTreeHead: #3: request over limit accepted: %d", response.Code)
+	}
+}
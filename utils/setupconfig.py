@@ -20,6 +20,7 @@ import diceware
 import nacl.public
 import nacl.signing
 import psycopg2
+import sqlite3
 from termcolor import colored
 
 import pymensago.keycard as keycard
@@ -48,6 +49,8 @@ def make_diceware():
 #	- is separate abuse account desired?
 #	- is separate support account desired?
 #	- quota size
+#	- database engine
+#	- location of the SQLite database file
 #	- IP address of postgres server
 #	- port of postgres server
 #	- database name
@@ -219,36 +222,59 @@ else:
 		tempstr = 'mensago'
 	config['server_group'] = tempstr
 
-# IP address of postgres server
-tempstr = input('\nEnter the IP address of the database server. [localhost]: ')
-if tempstr == '':
-	tempstr = 'localhost'
-config['server_ip'] = tempstr
+# database engine
+config['db_engine'] = ''
+while config['db_engine'] == '':
+	choice = input('\nWhich database engine should be used, postgresql or sqlite? [postgresql]: ')
+	choice = choice.strip().casefold()
+	if choice == '':
+		choice = 'postgresql'
+	
+	if choice in ['postgresql', 'sqlite']:
+		config['db_engine'] = choice
 
-# port of postgres server
-tempstr = input('Enter the database server port. [5432]: ')
-if tempstr == '':
-	tempstr = '5432'
-config['server_port'] = tempstr
+if config['db_engine'] == 'sqlite':
+	default_db_file = '/var/lib/mensagod/mensagod.db'
+	if server_platform == 'windows':
+		default_db_file = os.environ['PROGRAMDATA'] + '\\mensagod\\mensagod.db'
+	
+	# location of the database file
+	tempstr = input(f'Where should the database file be stored? [{default_db_file}]: ').strip()
+	if tempstr == '':
+		tempstr = default_db_file
+	config['db_file'] = tempstr
+else:
+	# IP address of postgres server
+	tempstr = input('\nEnter the IP address of the database server. [localhost]: ')
+	if tempstr == '':
+		tempstr = 'localhost'
+	config['server_ip'] = tempstr
 
-# database username
-tempstr = input('Enter the name of the database to store data. [mensago]: ')
-if tempstr == '':
-	tempstr = 'mensago'
-config['db_name'] = tempstr
+	# port of postgres server
+	tempstr = input('Enter the database server port. [5432]: ')
+	if tempstr == '':
+		tempstr = '5432'
+	config['server_port'] = tempstr
 
-tempstr = input('Enter a username which has admin privileges on this database. [mensago]: ').strip()
-if tempstr == '':
-	tempstr = 'mensago'
-config['db_user'] = tempstr
+	# database username
+	tempstr = input('Enter the name of the database to store data. [mensago]: ')
+	if tempstr == '':
+		tempstr = 'mensago'
+	config['db_name'] = tempstr
+
+	tempstr = input('Enter a username which has admin privileges on this database. [mensago]: ')
+	tempstr = tempstr.strip()
+	if tempstr == '':
+		tempstr = 'mensago'
+	config['db_user'] = tempstr
 
-# database user password
-config['db_password'] = ''
-while config['db_password'] == '':
-	choice = input('Enter the password of this user (min 8 characters): ').strip()
+	# database user password
+	config['db_password'] = ''
+	while config['db_password'] == '':
+		choice = input('Enter the password of this user (min 8 characters): ').strip()
 
-	if len(choice) <= 64 and len(choice) >= 8:
-		config['db_password'] = choice
+		if len(choice) <= 64 and len(choice) >= 8:
+			config['db_password'] = choice
 
 # required keycard fields
 
@@ -305,11 +331,15 @@ while config['org_language'] == '':
 
 # connectivity check
 try:
-	conn = psycopg2.connect(host=config['server_ip'],
-							port=config['server_port'],
-							database=config['db_name'],
-							user=config['db_user'],
-							password=config['db_password'])
+	if config['db_engine'] == 'sqlite':
+		os.makedirs(os.path.dirname(config['db_file']), 0o700, exist_ok=True)
+		conn = sqlite3.connect(config['db_file'])
+	else:
+		conn = psycopg2.connect(host=config['server_ip'],
+								port=config['server_port'],
+								database=config['db_name'],
+								user=config['db_user'],
+								password=config['db_password'])
 except Exception as e:
 	print("Couldn't connect to database: %s" % e)
 	print("Unable to continue until connectivity problems are resolved. Sorry!")
@@ -318,8 +348,11 @@ except Exception as e:
 # Step 3: set up the database tables
 
 cur = conn.cursor()
-cur.execute("SELECT table_name FROM information_schema.tables WHERE table_schema = 'public' ORDER "
-			"BY table_name;")
+if config['db_engine'] == 'sqlite':
+	cur.execute("SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name;")
+else:
+	cur.execute("SELECT table_name FROM information_schema.tables WHERE table_schema = 'public' "
+				"ORDER BY table_name;")
 rows = cur.fetchall()
 if len(rows) > 0:
 	print(f"""
@@ -334,110 +367,46 @@ keycards and workspace information will be erased.
 	if choice not in ['y', 'yes']:
 		sys.exit(0)
 	
-	dropcmd = '''DO $$ DECLARE
-		r RECORD;
-	BEGIN
-		FOR r IN (SELECT tablename FROM pg_tables WHERE schemaname = current_schema()) LOOP
-			EXECUTE 'DROP TABLE IF EXISTS ' || quote_ident(r.tablename) || ' CASCADE';
-		END LOOP;
-	END $$;'''
-	cur.execute(dropcmd)
+	if config['db_engine'] == 'sqlite':
+		for row in rows:
+			cur.execute(f"DROP TABLE IF EXISTS {row[0]};")
+	else:
+		dropcmd = '''DO $$ DECLARE
+			r RECORD;
+		BEGIN
+			FOR r IN (SELECT tablename FROM pg_tables WHERE schemaname = current_schema()) LOOP
+				EXECUTE 'DROP TABLE IF EXISTS ' || quote_ident(r.tablename) || ' CASCADE';
+			END LOOP;
+		END $$;'''
+		cur.execute(dropcmd)
 
 print('Performing database first-time setup.\n')
 
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'workspaces' AND "
-			"c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE workspaces(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, "
-		"uid VARCHAR(64), domain VARCHAR(255) NOT NULL, wtype VARCHAR(32) NOT NULL, "
-		"status VARCHAR(16) NOT NULL, password VARCHAR(128));")
-
+# psycopg2 and sqlite3 use different placeholders for query parameters
+ph = '?' if config['db_engine'] == 'sqlite' else '%s'
 
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'aliases' AND "
-			"c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE aliases(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, "
-		"alias CHAR(292) NOT NULL);")
-
-
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'iwkspc_folders' "
-			"AND c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE iwkspc_folders(rowid SERIAL PRIMARY KEY, wid char(36) NOT NULL, "
-				"enc_key VARCHAR(64) NOT NULL);")
-
-
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'iwkspc_devices' "
-			"AND c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE iwkspc_devices(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, "
-				"devid CHAR(36) NOT NULL, devkey VARCHAR(1000) NOT NULL, "
-				"status VARCHAR(16) NOT NULL);")
+# The tables are created by applying the server's schema migrations, which are kept with its
+# source in dbhandler/migrations. Recording them in schema_version tells the server that the
+# database is current.
+cur.execute("CREATE TABLE schema_version(version INTEGER PRIMARY KEY, name VARCHAR(128) NOT NULL, "
+			"applied VARCHAR(32) NOT NULL);")
 
-
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'quotas' "
-			"AND c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE quotas(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, "
-			"usage BIGINT, quota BIGINT);")
-
-
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'failure_log' "
-			"AND c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE failure_log(rowid SERIAL PRIMARY KEY, type VARCHAR(16) NOT NULL, "
-				"id VARCHAR(36), source VARCHAR(36) NOT NULL, count INTEGER, "
-				"last_failure TIMESTAMP NOT NULL, lockout_until TIMESTAMP);")
-
-
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'passcodes' "
-			"AND c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE passcodes(rowid SERIAL PRIMARY KEY, wid VARCHAR(36) NOT NULL UNIQUE, "
-				"passcode VARCHAR(128) NOT NULL, expires TIMESTAMP NOT NULL);")
-
-
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'prereg' "
-			"AND c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE prereg(rowid SERIAL PRIMARY KEY, wid VARCHAR(36) NOT NULL UNIQUE, "
-				"uid VARCHAR(128) NOT NULL, domain VARCHAR(255) NOT NULL, regcode VARCHAR(128));")
-
-
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'keycards' "
-			"AND c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE keycards(rowid SERIAL PRIMARY KEY, owner VARCHAR(292) NOT NULL, "
-				"creationtime TIMESTAMP NOT NULL, index INTEGER NOT NULL, "
-				"entry VARCHAR(8192) NOT NULL, fingerprint VARCHAR(96) NOT NULL);")
-
-
-cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
-			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'orgkeys' "
-			"AND c.relkind = 'r');")
-rows = cur.fetchall()
-if rows[0][0] is False:
-	cur.execute("CREATE TABLE orgkeys(rowid SERIAL PRIMARY KEY, creationtime TIMESTAMP NOT NULL, "
-				"pubkey VARCHAR(7000), privkey VARCHAR(7000) NOT NULL, "
-				"purpose VARCHAR(8) NOT NULL, fingerprint VARCHAR(96) NOT NULL);")
+migrations_path = os.path.join(os.path.dirname(os.path.abspath(__file__)), '..', 'dbhandler',
+	'migrations', config['db_engine'])
+for migration_name in sorted(os.listdir(migrations_path)):
+	m = re.match(r'^([0-9]{4})_([a-z0-9_]+)\.sql$', migration_name)
+	if not m:
+		continue
+	
+	with open(os.path.join(migrations_path, migration_name), 'r') as migration_file:
+		script = migration_file.read()
+	if config['db_engine'] == 'sqlite':
+		cur.executescript(script)
+	else:
+		cur.execute(script)
+	
+	cur.execute(f"INSERT INTO schema_version(version, name, applied) VALUES({ph}, {ph}, {ph});",
+				(int(m.group(1)), m.group(2), time.strftime('%Y-%m-%dT%H:%M:%SZ', time.gmtime())))
 
 
 # create the org's keys and put them in the table
@@ -469,13 +438,13 @@ config['org_sign'] = pskey['sign']
 # dangerous because it enables SQL injection attacks. We're using only our own data generated in 
 # this script, so it's not so terrible
 
-cur.execute(f"INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint) "
+cur.execute(f"INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint, domain) "
 			f"VALUES('{ekey['timestamp']}', '{ekey['public']}', '{ekey['private']}', 'encrypt', "
-			f"'{ekey['fingerprint']}');")
+			f"'{ekey['fingerprint']}', '{config['org_domain']}');")
 
-cur.execute(f"INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint) "
+cur.execute(f"INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, fingerprint, domain) "
 			f"VALUES('{pskey['timestamp']}', '{pskey['verify']}', '{pskey['sign']}', 'sign', "
-			f"'{pskey['fingerprint']}');")
+			f"'{pskey['fingerprint']}', '{config['org_domain']}');")
 
 
 rootentry = keycard.OrgEntry()
@@ -567,12 +536,20 @@ if status.error():
 	print(f"There was a problem with the keycard's compliance: {status.info()}")
 	sys.exit()
 
-cur.execute("INSERT INTO keycards(owner, creationtime, index, entry, fingerprint) "
-			"VALUES(%s, %s, %s, %s, %s);",
-			(config['org_domain'], rootentry.fields['Timestamp'], rootentry.fields['Index'],
-				str(rootentry), rootentry.hash)
+cur.execute('INSERT INTO keycards(owner, creationtime, "index", entry, fingerprint, domain) '
+			f"VALUES('organization', {ph}, {ph}, {ph}, {ph}, {ph});",
+			(rootentry.fields['Timestamp'], rootentry.fields['Index'],
+				str(rootentry), rootentry.hash, config['org_domain'])
 			)
 
+# The root entry is also the first entry in the domain's keycard transparency log
+hasher = hashlib.blake2b(digest_size=32)
+hasher.update(b'\x00' + str(rootentry).encode())
+leafhash = "BLAKE2B-256:" + base64.b85encode(hasher.digest()).decode()
+cur.execute("INSERT INTO translog(domain, seq, fingerprint, leafhash) "
+			f"VALUES({ph}, 0, {ph}, {ph});",
+			(config['org_domain'], rootentry.hash, leafhash))
+
 cur.close()
 conn.commit()
 
@@ -616,6 +593,21 @@ if server_platform != 'windows':
 			print("Please create the user manually as a system user without a login shell and "
 				"restart this script.")
 			sys.exit(1)
+	
+	# The server needs to be able to write to the SQLite database file and the directory
+	# containing it, which holds the database's journal
+	if config['db_engine'] == 'sqlite':
+		try:
+			uid = pwd.getpwnam(config['server_user']).pw_uid
+			gid = grp.getgrnam(config['server_group']).gr_gid
+			os.chown(os.path.dirname(config['db_file']), uid, gid) # pylint: disable=no-member
+			os.chown(config['db_file'], uid, gid) # pylint: disable=no-member
+		except Exception as e:
+			print(f"Error changing owner for database file {config['db_file']}: {e}")
+			print(f"You will need to do this manually. Please set the owner of "
+				f"{config['db_file']} and its folder to {config['server_user']} and restart "
+				"this script.")
+			sys.exit(-1)
 
 
 # create the server config folder and, for POSIX platforms, the log folder 
@@ -679,25 +671,33 @@ fhandle.write('''# This is an Mensago server config file. Each value listed belo
 # The database section should generally be the only real editing for this 
 # file.
 #
+# The engine may be 'postgresql' or 'sqlite'. The file setting applies only
+# to SQLite and the others only to PostgreSQL.
+# engine = "postgresql"
 # ip = "localhost"
 # port = "5432"
 # name = "mensago"
 # user = "mensago"
+# file = "/var/lib/mensagod/mensagod.db"
 ''')
-if config['server_ip'] != 'localhost':
-	fhandle.write('ip = "' + config['server_ip'] + '"' + os.linesep)
+if config['db_engine'] == 'sqlite':
+	fhandle.write('engine = "sqlite"' + os.linesep)
+	fhandle.write('file = "' + config['db_file'] + '"' + os.linesep)
+else:
+	if config['server_ip'] != 'localhost':
+		fhandle.write('ip = "' + config['server_ip'] + '"' + os.linesep)
 
-if config['server_port'] != '5432':
-	fhandle.write('port = "' + config['server_port'] + '"' + os.linesep)
+	if config['server_port'] != '5432':
+		fhandle.write('port = "' + config['server_port'] + '"' + os.linesep)
 
-if config['db_name'] != 'mensago':
-	fhandle.write('name = "' + config['db_name'] + '"' + os.linesep)
+	if config['db_name'] != 'mensago':
+		fhandle.write('name = "' + config['db_name'] + '"' + os.linesep)
 
-if config['db_user'] != 'mensago':
-	fhandle.write('user = "' + config['db_user'] + '"' + os.linesep)
+	if config['db_user'] != 'mensago':
+		fhandle.write('user = "' + config['db_user'] + '"' + os.linesep)
 
-if config['db_password'] != 'mensago':
-	fhandle.write('password = "' + config['db_password'] + '"' + os.linesep)
+	if config['db_password'] != 'mensago':
+		fhandle.write('password = "' + config['db_password'] + '"' + os.linesep)
 
 fhandle.write('''
 [global]
@@ -806,7 +806,8 @@ fhandle.write('''
 # generation algorithm. This setting may be `normal` or `enhanced`. Normal is
 # best for most situations, but for environments which require extra security,
 # `enhanced` provides additional protection at the cost of higher server
-# demands.
+# demands. Passwords stored under a different setting are rehashed the next
+# time their owners log in.
 # password_security = normal
 ''')
 